@@ -0,0 +1,158 @@
+// Package codemap indexes a workspace into a code graph and queries it from
+// Go, without going through the MCP server. It uses the same scanner, store
+// and language server enrichment as the codemap binary.
+//
+//	g, err := codemap.Open(codemap.Options{DBPath: "/tmp/project.sqlite"})
+//	if err != nil {
+//		return err
+//	}
+//	defer g.Close()
+//	if _, err := g.Index(ctx, "/path/to/project"); err != nil {
+//		return err
+//	}
+//	callers, err := g.FindImpact(ctx, "ParseConfig")
+package codemap
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"codemap/internal/db"
+	"codemap/internal/graph"
+	"codemap/internal/indexer"
+	"codemap/internal/lsp"
+	"codemap/internal/scanner"
+)
+
+// Node is a symbol in the graph.
+type Node = graph.Node
+
+// Edge is a relationship between two symbols.
+type Edge = graph.Edge
+
+// Options configures Open.
+type Options struct {
+	// DBPath is the SQLite file holding the graph. It is created if missing
+	// and reused across runs.
+	DBPath string
+
+	// NoEnrich skips language servers during Index, so the graph holds the
+	// symbols found by tree-sitter but no edges between them. Nothing is
+	// downloaded or started.
+	NoEnrich bool
+
+	// IncludeGlobs, if any, limit Index to the files matching one of them,
+	// relative to the indexed root; ** matches any number of directories.
+	// ExcludeGlobs skip the files and directories matching any of them and
+	// take precedence.
+	IncludeGlobs []string
+	ExcludeGlobs []string
+}
+
+// Graph is an indexed code graph. Its methods are safe for concurrent use.
+type Graph struct {
+	db       *db.DB
+	store    *graph.Store
+	scanner  *scanner.Scanner
+	lsp      *lsp.Service
+	noEnrich bool
+
+	indexMu sync.Mutex // serializes Index
+}
+
+// Open opens or creates the graph database at opts.DBPath.
+func Open(opts Options) (*Graph, error) {
+	database, err := db.New(opts.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	scope := scanner.Scope{IncludeGlobs: opts.IncludeGlobs, ExcludeGlobs: opts.ExcludeGlobs}
+	if err := scope.Validate(); err != nil {
+		database.Close()
+		return nil, err
+	}
+	scn, err := scanner.New()
+	if err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to init scanner: %w", err)
+	}
+	scn.SetScope(scope)
+	return &Graph{
+		db:       database,
+		store:    graph.NewStore(database),
+		scanner:  scn,
+		lsp:      lsp.NewService(),
+		noEnrich: opts.NoEnrich,
+	}, nil
+}
+
+// Close stops any language servers started by Index and closes the database.
+func (g *Graph) Close() error {
+	g.lsp.Shutdown()
+	return g.db.Close()
+}
+
+// IndexResult summarizes an Index run.
+type IndexResult struct {
+	Files    int
+	Nodes    int
+	Edges    int
+	Warnings []string // non-fatal problems that left the index incomplete
+}
+
+// Index scans root, stores the symbols it finds and removes those of files
+// that are gone, then links the symbols through the language servers. It is
+// the same pipeline the MCP index tool runs. An empty scan leaves the graph
+// untouched. Concurrent calls run one after another.
+func (g *Graph) Index(ctx context.Context, root string) (*IndexResult, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	g.indexMu.Lock()
+	defer g.indexMu.Unlock()
+
+	ix := &indexer.Indexer{Scanner: g.scanner, Store: g.store, LSP: g.lsp}
+	var phases indexer.Phases
+	sym, err := ix.StoreSymbols(ctx, root, &phases)
+	if err != nil {
+		return nil, err
+	}
+	res := &IndexResult{Files: sym.FilesScanned, Nodes: sym.Nodes, Warnings: sym.Warnings}
+	if sym.FilesScanned == 0 || g.noEnrich {
+		return res, nil
+	}
+
+	links, err := ix.Enrich(ctx, sym, &phases)
+	if err != nil {
+		return nil, err
+	}
+	res.Nodes += links.Nodes
+	res.Edges = links.Edges
+	res.Warnings = append(res.Warnings, links.Warnings...)
+	return res, nil
+}
+
+// GetSymbol returns the definitions named name, ordered by file.
+func (g *Graph) GetSymbol(ctx context.Context, name string) ([]*Node, error) {
+	return g.store.GetSymbolLocation(ctx, name)
+}
+
+// FindImpact returns the symbols that transitively depend on name.
+func (g *Graph) FindImpact(ctx context.Context, name string) ([]*Node, error) {
+	return g.store.FindImpact(ctx, name)
+}
+
+// SymbolsInFile returns the symbols defined in the file at path, in order.
+func (g *Graph) SymbolsInFile(ctx context.Context, path string) ([]*Node, error) {
+	return g.store.GetSymbolsInFile(ctx, path)
+}
+
+// SearchSymbols returns up to limit symbols whose names match query,
+// ignoring case, as the search_symbols tool ranks them.
+func (g *Graph) SearchSymbols(ctx context.Context, query string, limit int) ([]*Node, error) {
+	return g.store.SearchSymbols(ctx, query, limit)
+}
@@ -0,0 +1,67 @@
+// Package budget bounds how much work codemap does at once across its
+// subsystems. Language server downloads, version lookups and enrichment
+// requests all draw from one pool of CODEMAP_MAX_CONCURRENCY slots, so the
+// total stays predictable however many languages are involved.
+package budget
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	once  sync.Once
+	limit int
+	slots chan struct{}
+)
+
+func initialize() {
+	once.Do(func() {
+		limit = parseLimit(os.Getenv("CODEMAP_MAX_CONCURRENCY"))
+		slots = make(chan struct{}, limit)
+	})
+}
+
+// parseLimit reads a CODEMAP_MAX_CONCURRENCY value, defaulting to GOMAXPROCS
+// when it is unset or not a positive integer.
+func parseLimit(raw string) int {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return runtime.GOMAXPROCS(0)
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		log.Printf("Warning: ignoring invalid CODEMAP_MAX_CONCURRENCY %q", raw)
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+// Limit returns the number of slots in the budget.
+func Limit() int {
+	initialize()
+	return limit
+}
+
+// Acquire takes a slot, waiting for one to be released if all are in use. It
+// returns ctx.Err() if ctx is done first. Holders must not acquire a second
+// slot, which could deadlock once the budget is exhausted.
+func Acquire(ctx context.Context) error {
+	initialize()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release returns a slot taken by Acquire.
+func Release() {
+	<-slots
+}
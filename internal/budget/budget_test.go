@@ -0,0 +1,26 @@
+package budget
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{"", procs},
+		{"4", 4},
+		{" 1 ", 1},
+		{"0", procs},
+		{"-2", procs},
+		{"lots", procs},
+	}
+	for _, tt := range tests {
+		if got := parseLimit(tt.raw); got != tt.want {
+			t.Errorf("parseLimit(%q) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -2,14 +2,44 @@ package db
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// SchemaVersion is stored in the database's user_version. A database written
+// with an older version is incompatible and is rebuilt from scratch, which
+// makes the next index a full one. Version 0 marks a new database or one from
+// before versioning, which is rebuilt the same way. A newer version is refused
+// with ErrNewerSchema.
+//
+// Version 2 switched node kinds to the canonical set in graph.
+const SchemaVersion = 2
+
+// errCorrupt marks a database file that SQLite cannot read or whose integrity
+// check fails.
+var errCorrupt = errors.New("database is corrupt")
+
+// ErrNewerSchema is returned for a database written by a newer codemap. It is
+// left as it is rather than rebuilt, so the newer version keeps its index.
+var ErrNewerSchema = errors.New("index database was written by a newer version of codemap")
+
+// metaChecksum is the meta key of the checksum Close records over the schema
+// version and every node and edge. Opening verifies and removes it, so a
+// process that dies with the database open leaves none behind, and only the
+// integrity check applies on the next start. Read-only opens, which may run
+// beside a process writing to the database, neither remove nor record it.
+const metaChecksum = "checksum"
+
 // Execer is an interface for types that can execute SQL queries.
 type Execer interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
@@ -17,6 +47,7 @@ type Execer interface {
 
 type DB struct {
 	*sql.DB
+	readOnly bool // opened with NewReadOnly
 }
 
 func New(dbPath string) (*DB, error) {
@@ -29,6 +60,61 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
+	sdb, err := open(dbPath)
+	if errors.Is(err, errCorrupt) {
+		// The index is only a cache of the sources; rebuild rather than fail
+		log.Printf("Warning: %v; moving %s aside and rebuilding the index", err, dbPath)
+		if err := quarantine(dbPath); err != nil {
+			return nil, err
+		}
+		sdb, err = open(dbPath)
+	}
+	return sdb, err
+}
+
+// NewReadOnly opens the existing database at dbPath for reading, for commands
+// such as export that may run while a server writes to it. Unlike New it
+// neither migrates nor rebuilds the database: one with another schema
+// version or failing its checks is an error.
+func NewReadOnly(dbPath string) (*DB, error) {
+	dsn := fmt.Sprintf("file:%s?mode=ro", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, classify(fmt.Errorf("failed to ping database: %w", err))
+	}
+
+	sdb := &DB{DB: db, readOnly: true}
+	if err := sdb.checkIntegrity(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, classify(fmt.Errorf("failed to read schema version: %w", err))
+	}
+	if version > SchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("%w (schema version %d, this build supports %d)", ErrNewerSchema, version, SchemaVersion)
+	}
+	if version != SchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("index database schema version %d is out of date; run codemap in the project to rebuild it", version)
+	}
+	if err := sdb.verifyChecksum(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+// open opens and migrates the database at dbPath, returning an error wrapping
+// errCorrupt if the file is damaged.
+func open(dbPath string) (*DB, error) {
 	// Enable WAL mode for performance
 	dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc&_journal_mode=WAL", dbPath)
 	db, err := sql.Open("sqlite3", dsn)
@@ -37,19 +123,173 @@ func New(dbPath string) (*DB, error) {
 	}
 
 	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+		db.Close()
+		return nil, classify(fmt.Errorf("failed to ping database: %w", err))
 	}
 
 	sdb := &DB{DB: db}
+	if err := sdb.checkIntegrity(); err != nil {
+		db.Close()
+		return nil, err
+	}
 	if err := sdb.migrate(); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
+		return nil, classify(fmt.Errorf("failed to migrate database: %w", err))
+	}
+	if err := sdb.verifyChecksum(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return sdb, nil
 }
 
+// verifyChecksum compares the checksum recorded when the database was last
+// closed with its contents, then, unless the database is read-only, removes it
+// while the database is in use.
+func (db *DB) verifyChecksum() error {
+	var want string
+	err := db.QueryRow("SELECT value FROM meta WHERE key = ?", metaChecksum).Scan(&want)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return classify(fmt.Errorf("failed to read checksum: %w", err))
+	}
+
+	got, err := db.checksum()
+	if err != nil {
+		return classify(err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+	if db.readOnly {
+		return nil
+	}
+	if _, err := db.Exec("DELETE FROM meta WHERE key = ?", metaChecksum); err != nil {
+		return classify(fmt.Errorf("failed to clear checksum: %w", err))
+	}
+	return nil
+}
+
+// checksum hashes the schema version and every node and edge, in a fixed
+// order. Each value is length-prefixed so adjacent columns cannot run
+// together.
+func (db *DB) checksum() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "schema %d\n", SchemaVersion)
+	for _, query := range []string{
+		"SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers FROM nodes ORDER BY id",
+		"SELECT source_id, target_id, relation FROM edges ORDER BY source_id, target_id, relation",
+	} {
+		if err := hashRows(db, h, query); err != nil {
+			return "", fmt.Errorf("failed to compute checksum: %w", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashRows writes every row query returns to w.
+func hashRows(db *DB, w io.Writer, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if !v.Valid {
+				io.WriteString(w, "-;")
+				continue
+			}
+			fmt.Fprintf(w, "%d:%s;", len(v.String), v.String)
+		}
+		io.WriteString(w, "\n")
+	}
+	return rows.Err()
+}
+
+// checkIntegrity runs SQLite's quick integrity check.
+func (db *DB) checkIntegrity() error {
+	rows, err := db.Query("PRAGMA quick_check")
+	if err != nil {
+		return classify(fmt.Errorf("integrity check failed: %w", err))
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return classify(err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return classify(err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// classify wraps err with errCorrupt if SQLite reported a damaged file.
+func classify(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && (se.Code == sqlite3.ErrCorrupt || se.Code == sqlite3.ErrNotADB) {
+		return fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return err
+}
+
+// quarantine moves a corrupt database to dbPath + ".corrupt" for inspection,
+// replacing any earlier one, and removes its WAL files.
+func quarantine(dbPath string) error {
+	if err := os.Rename(dbPath, dbPath+".corrupt"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to move corrupt database aside: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", dbPath+suffix, err)
+		}
+	}
+	return nil
+}
+
 func (db *DB) migrate() error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w (schema version %d, this build supports %d)", ErrNewerSchema, version, SchemaVersion)
+	}
+	if version != SchemaVersion {
+		if version != 0 {
+			log.Printf("Index database schema version %d is incompatible with %d; rebuilding", version, SchemaVersion)
+		}
+		if _, err := db.Exec("DROP TABLE IF EXISTS edges; DROP TABLE IF EXISTS nodes; DROP TABLE IF EXISTS meta;"); err != nil {
+			return fmt.Errorf("failed to drop incompatible schema: %w", err)
+		}
+	}
+
 	schema := `
 	CREATE TABLE IF NOT EXISTS nodes (
 		id TEXT PRIMARY KEY,
@@ -61,6 +301,7 @@ func (db *DB) migrate() error {
 		col_start INTEGER NOT NULL,
 		col_end INTEGER NOT NULL,
 		symbol_uri TEXT,
+		modifiers TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 
@@ -79,15 +320,77 @@ func (db *DB) migrate() error {
 
 	CREATE INDEX IF NOT EXISTS idx_edges_source ON edges(source_id);
 	CREATE INDEX IF NOT EXISTS idx_edges_target ON edges(target_id);
+
+	CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
 	`
 
 	_, err := db.Exec(schema)
 	if err != nil {
 		return fmt.Errorf("schema execution failed: %w", err)
 	}
+
+	// Columns added after the initial schema; older databases need them appended.
+	if err := db.addColumnIfMissing("nodes", "modifiers", "TEXT"); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already present.
+func (db *DB) addColumnIfMissing(table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
+// Close records the checksum of the contents, for the next open to verify,
+// and closes the database. A read-only database is just closed, since another
+// process may still be writing to it.
 func (db *DB) Close() error {
+	if db.readOnly {
+		return db.DB.Close()
+	}
+	sum, err := db.checksum()
+	if err == nil {
+		_, err = db.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", metaChecksum, sum)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record index checksum: %v", err)
+	}
 	return db.DB.Close()
 }
@@ -0,0 +1,366 @@
+// Package download fetches files over HTTP. Transient failures are retried,
+// honouring Retry-After, and a body cut off part way is resumed with a Range
+// request where the server supports it. A download that stops receiving
+// bytes is abandoned and retried rather than waited out. Proxies are taken
+// from the environment (HTTPS_PROXY, HTTP_PROXY, NO_PROXY).
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults used by New. There is no limit on a whole download, which may be
+// large; instead each phase of a request is bounded separately.
+const (
+	DefaultAttempts = 3
+	DefaultBackoff  = time.Second
+
+	DefaultDialTimeout           = 30 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultStallTimeout          = 30 * time.Second
+)
+
+// MaxRetryAfter caps how long a server-supplied Retry-After may delay a retry.
+const MaxRetryAfter = time.Minute
+
+// Client downloads files. The zero value is usable and makes a single
+// attempt with http.DefaultClient.
+type Client struct {
+	HTTP *http.Client
+
+	// Attempts is how many requests are made before giving up.
+	Attempts int
+
+	// Backoff scales the delay between attempts, which grows quadratically.
+	Backoff time.Duration
+
+	// StallTimeout abandons an attempt once no bytes of the body have
+	// arrived for this long, failing it with ErrStalled so it is retried.
+	// Zero means no limit.
+	StallTimeout time.Duration
+
+	// Progress, if set, is called as the body is written.
+	Progress ProgressFunc
+}
+
+// ProgressFunc receives the bytes in the destination so far and the
+// expected total, taken from Content-Length, or -1 if unknown. It is called
+// once as each attempt starts, so a retry that has to start over is seen
+// going back to zero, and then after every write.
+type ProgressFunc func(done, total int64)
+
+// New returns a client with the default attempts, backoff and timeouts.
+func New() *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   DefaultDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+
+	return &Client{
+		HTTP:         &http.Client{Transport: transport, CheckRedirect: CheckRedirect},
+		Attempts:     DefaultAttempts,
+		Backoff:      DefaultBackoff,
+		StallTimeout: DefaultStallTimeout,
+	}
+}
+
+// maxRedirects is how many redirects CheckRedirect follows, as many as the
+// default policy of http.Client.
+const maxRedirects = 10
+
+// CheckRedirect is an http.Client redirect policy that drops the
+// Authorization header once a redirect leaves the original host, so an API
+// token never reaches the signed storage URL or CDN a release asset is served
+// from. The default policy keeps the header for subdomains and other ports.
+func CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// StatusError is a response with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // from the Retry-After header, zero if absent
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
+}
+
+// localError is a failure writing the destination, which no retry fixes.
+type localError struct{ err error }
+
+func (e *localError) Error() string { return e.err.Error() }
+func (e *localError) Unwrap() error { return e.err }
+
+// ErrStalled means a download received no bytes for the client's
+// StallTimeout. It is retried like any other network failure.
+var ErrStalled = errors.New("download stalled")
+
+// errRangeMismatch means the server answered a resume with a different range
+// than was asked for, so the next attempt starts over.
+var errRangeMismatch = errors.New("server did not resume at the requested offset")
+
+// ToFile downloads url into dest, replacing its contents. Errors that a retry
+// cannot fix, such as a 404 or a cancelled context, fail immediately.
+func (c *Client) ToFile(ctx context.Context, url string, dest *os.File) error {
+	attempts := c.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var done int64       // bytes of the body already in dest
+	var validator string // identifies the version of the body in dest
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			backoff := time.Duration(attempt*attempt) * c.Backoff
+			var statusErr *StatusError
+			if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > backoff {
+				backoff = statusErr.RetryAfter
+			}
+			if done > 0 {
+				log.Printf("Retry %d/%d after %v, resuming at %d bytes...", attempt, attempts, backoff, done)
+			} else {
+				log.Printf("Retry %d/%d after %v...", attempt, attempts, backoff)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var err error
+		done, err = c.fetch(ctx, url, dest, done, &validator)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !IsRetryable(ctx, err) {
+			return fmt.Errorf("download of %s failed, not retrying: %w", url, err)
+		}
+	}
+
+	return fmt.Errorf("download failed after %d attempts: %w", attempts, lastErr)
+}
+
+// fetch makes one request for url, asking for the bytes from offset on when
+// offset is non-zero. It returns how many bytes of the body are in dest
+// afterwards, which the next attempt resumes from. *validator is the ETag or
+// Last-Modified of the body in dest: sent as If-Range so that a file changed
+// on the server is downloaded afresh rather than spliced, and updated from
+// each full response.
+func (c *Client) fetch(ctx context.Context, url string, dest *os.File, offset int64, validator *string) (int64, error) {
+	// A stall cancels this attempt only; the caller's ctx is left alone so
+	// the attempt is retried
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var stall *time.Timer
+	if c.StallTimeout > 0 {
+		stall = time.AfterFunc(c.StallTimeout, func() { cancel(ErrStalled) })
+		defer stall.Stop()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, &localError{fmt.Errorf("invalid download request: %w", err)}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if *validator != "" {
+			req.Header.Set("If-Range", *validator)
+		}
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return offset, stallCause(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset = 0 // the server ignored the range, or the file changed; start over
+		*validator = rangeValidator(resp.Header)
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if rangeStart(resp.Header.Get("Content-Range")) != offset {
+			return 0, errRangeMismatch
+		}
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return 0, errRangeMismatch
+	default:
+		return offset, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	if err := dest.Truncate(offset); err != nil {
+		return 0, &localError{err}
+	}
+	if _, err := dest.Seek(offset, io.SeekStart); err != nil {
+		return 0, &localError{err}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	w := &progressWriter{w: dest, done: offset, total: total, report: c.Progress, stall: stall, stallTimeout: c.StallTimeout}
+	if w.report != nil {
+		w.report(w.done, w.total)
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err != nil && w.writeErr != nil {
+		return w.done, &localError{w.writeErr}
+	}
+	if err != nil {
+		err = stallCause(ctx, err)
+	}
+	return w.done, err
+}
+
+// stallCause returns ErrStalled in place of err if the attempt behind ctx
+// was abandoned for stalling.
+func stallCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrStalled) {
+		return cause
+	}
+	return err
+}
+
+// rangeValidator returns the value to send as If-Range when resuming the body
+// of a response with header: its ETag if strong, since If-Range does not
+// allow weak ones, or else its Last-Modified date. It is empty if neither.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// rangeStart returns the first byte position of a "bytes first-last/size"
+// Content-Range header, or -1 if it cannot be parsed.
+func rangeStart(header string) int64 {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !ok {
+		return -1
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// progressWriter counts the bytes written to w, reporting them as it goes.
+// Each write also pushes back the stall timer, if there is one.
+type progressWriter struct {
+	w            io.Writer
+	done         int64
+	total        int64
+	report       ProgressFunc
+	stall        *time.Timer
+	stallTimeout time.Duration
+	writeErr     error // set when w itself failed, as opposed to the body
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if p.stall != nil {
+		p.stall.Reset(p.stallTimeout)
+	}
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if err != nil {
+		p.writeErr = err
+	}
+	if p.report != nil {
+		p.report(p.done, p.total)
+	}
+	return n, err
+}
+
+// IsRetryable reports whether a download error is worth another attempt.
+// Server errors, 408, 429 and network failures are; other 4xx responses,
+// failures writing the destination and cancellation of ctx are not.
+func IsRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var local *localError
+	if errors.As(err, &local) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusRequestTimeout,
+			statusErr.StatusCode == http.StatusTooManyRequests:
+			return true
+		case statusErr.StatusCode >= 500:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Timeouts, connection resets and truncated bodies are transient
+	return true
+}
+
+// ParseRetryAfter parses a Retry-After header given either as seconds or as
+// an HTTP date, capped at MaxRetryAfter. It returns zero if the header is
+// absent or malformed.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+	}
+
+	if d < 0 {
+		return 0
+	}
+	if d > MaxRetryAfter {
+		return MaxRetryAfter
+	}
+	return d
+}
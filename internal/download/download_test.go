@@ -0,0 +1,293 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestToFileRetryClassification(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int // responses before a final 200
+		wantCalls int32
+		wantErr   bool
+	}{
+		{"not found fails fast", []int{404}, 1, true},
+		{"unauthorized fails fast", []int{401}, 1, true},
+		{"server error retries", []int{503, 502}, 3, false},
+		{"rate limit retries", []int{429}, 2, false},
+		{"request timeout retries", []int{408}, 2, false},
+		{"persistent server error gives up", []int{500, 500, 500}, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(calls.Add(1))
+				if n <= len(tt.statuses) {
+					if tt.statuses[n-1] == http.StatusTooManyRequests {
+						w.Header().Set("Retry-After", "0")
+					}
+					w.WriteHeader(tt.statuses[n-1])
+					return
+				}
+				w.Write([]byte("payload"))
+			}))
+			defer srv.Close()
+
+			c := &Client{HTTP: srv.Client(), Attempts: 3, Backoff: time.Millisecond}
+			dest, err := os.CreateTemp(t.TempDir(), "download")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dest.Close()
+
+			err = c.ToFile(context.Background(), srv.URL, dest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("server saw %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestToFileStopsOnCancel(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := &Client{HTTP: srv.Client(), Attempts: 3, Backoff: time.Millisecond}
+	dest, err := os.CreateTemp(t.TempDir(), "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	if err := c.ToFile(ctx, srv.URL, dest); err == nil {
+		t.Fatal("expected an error for a cancelled context")
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("server saw %d requests after cancellation, want 0", got)
+	}
+}
+
+func TestToFileResumesInterruptedBody(t *testing.T) {
+	const payload = "0123456789abcdefghij"
+
+	for _, honourRange := range []bool{true, false} {
+		var ranges, ifRanges []string
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+			if calls.Add(1) == 1 {
+				// Promise the whole body but hang up half way
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+				w.Write([]byte(payload[:10]))
+				return
+			}
+			if honourRange && r.Header.Get("Range") == "bytes=10-" {
+				w.Header().Set("Content-Range", "bytes 10-19/20")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(payload[10:]))
+				return
+			}
+			w.Write([]byte(payload))
+		}))
+
+		var progress []int64
+		c := &Client{HTTP: srv.Client(), Attempts: 2, Backoff: time.Millisecond,
+			Progress: func(done, total int64) {
+				if total != int64(len(payload)) {
+					t.Errorf("honourRange=%v: progress total = %d, want %d", honourRange, total, len(payload))
+				}
+				progress = append(progress, done)
+			}}
+		dest, err := os.CreateTemp(t.TempDir(), "download")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.ToFile(context.Background(), srv.URL, dest); err != nil {
+			t.Fatalf("honourRange=%v: ToFile() error = %v", honourRange, err)
+		}
+		srv.Close()
+		dest.Close()
+
+		if data, _ := os.ReadFile(dest.Name()); string(data) != payload {
+			t.Errorf("honourRange=%v: downloaded %q, want %q", honourRange, data, payload)
+		}
+		if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes=10-" {
+			t.Errorf("honourRange=%v: Range headers = %q, want [\"\" \"bytes=10-\"]", honourRange, ranges)
+		}
+		if len(ifRanges) != 2 || ifRanges[0] != "" || ifRanges[1] != `"v1"` {
+			t.Errorf("honourRange=%v: If-Range headers = %q, want the first response's ETag on the retry", honourRange, ifRanges)
+		}
+		if len(progress) == 0 || progress[len(progress)-1] != int64(len(payload)) {
+			t.Errorf("honourRange=%v: progress = %v, want it to end at %d", honourRange, progress, len(payload))
+		}
+		// The retry reports where it starts: the resume offset, or zero
+		// when the server ignored the range and the file was truncated
+		wantRestart := int64(10)
+		if !honourRange {
+			wantRestart = 0
+		}
+		if len(progress) < 3 || progress[0] != 0 || progress[1] != 10 || progress[2] != wantRestart {
+			t.Errorf("honourRange=%v: progress = %v, want it to start [0 10 %d ...]", honourRange, progress, wantRestart)
+		}
+	}
+}
+
+func TestToFileRetriesStalledBody(t *testing.T) {
+	const payload = "0123456789abcdefghij"
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Send half the body, then go quiet without hanging up
+			w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+			w.Write([]byte(payload[:10]))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if r.Header.Get("Range") == "bytes=10-" {
+			w.Header().Set("Content-Range", "bytes 10-19/20")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(payload[10:]))
+			return
+		}
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+
+	dest, err := os.CreateTemp(t.TempDir(), "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	// One attempt gives up with ErrStalled well before the server would
+	c := &Client{HTTP: srv.Client(), Attempts: 1, StallTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := c.ToFile(context.Background(), srv.URL, dest); !errors.Is(err, ErrStalled) {
+		t.Fatalf("ToFile() error = %v, want ErrStalled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled download took %v to fail", elapsed)
+	}
+
+	// With a retry the stalled attempt resumes where it stopped
+	calls.Store(0)
+	c.Attempts, c.Backoff = 2, time.Millisecond
+	if err := c.ToFile(context.Background(), srv.URL, dest); err != nil {
+		t.Fatalf("ToFile() with retry error = %v", err)
+	}
+	if data, _ := os.ReadFile(dest.Name()); string(data) != payload {
+		t.Errorf("downloaded %q, want %q", data, payload)
+	}
+}
+
+func TestRangeValidator(t *testing.T) {
+	tests := []struct {
+		etag, lastModified, want string
+	}{
+		{`"abc"`, "Wed, 21 Oct 2015 07:28:00 GMT", `"abc"`},
+		{`W/"abc"`, "Wed, 21 Oct 2015 07:28:00 GMT", "Wed, 21 Oct 2015 07:28:00 GMT"},
+		{`W/"abc"`, "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.etag != "" {
+			header.Set("ETag", tt.etag)
+		}
+		if tt.lastModified != "" {
+			header.Set("Last-Modified", tt.lastModified)
+		}
+		if got := rangeValidator(header); got != tt.want {
+			t.Errorf("rangeValidator(ETag %q, Last-Modified %q) = %q, want %q", tt.etag, tt.lastModified, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"3600", MaxRetryAfter},
+		{"-3", 0},
+		{"soon", 0},
+		{now.Add(20 * time.Second).Format(http.TimeFormat), 20 * time.Second},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+	}
+
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRedirectDropsAuthorizationAcrossHosts(t *testing.T) {
+	var assetAuth string
+	asset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assetAuth = r.Header.Get("Authorization")
+		w.Write([]byte("asset"))
+	}))
+	defer asset.Close()
+
+	var originAuth string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/release", http.StatusFound)
+		case "/release":
+			originAuth = r.Header.Get("Authorization")
+			http.Redirect(w, r, asset.URL+"/signed", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	req, err := http.NewRequest("GET", origin.URL+"/moved", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := New().HTTP.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if originAuth != "Bearer secret" {
+		t.Errorf("Authorization after a same-host redirect = %q, want it kept", originAuth)
+	}
+	if assetAuth != "" {
+		t.Errorf("Authorization after a cross-host redirect = %q, want it dropped", assetAuth)
+	}
+}
@@ -0,0 +1,122 @@
+package graph
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"codemap/util"
+)
+
+// Export formats accepted by WriteExport.
+const (
+	FormatJSON = "json"
+	FormatDOT  = "dot"
+)
+
+// exportEdge is an edge as written to an export, with its stable ID.
+type exportEdge struct {
+	ID       string `json:"id"`
+	SourceID string `json:"source_id"`
+	TargetID string `json:"target_id"`
+	Relation string `json:"relation"`
+}
+
+type exportGraph struct {
+	Nodes []Node       `json:"nodes"`
+	Edges []exportEdge `json:"edges"`
+}
+
+// WriteExport encodes g in format to w. Nodes are sorted by ID and edges by
+// (source, target, relation) whatever order g holds them in, and file paths
+// under root are written relative to it, so two exports of the same graph are
+// byte-for-byte identical across runs and checkouts.
+func WriteExport(w io.Writer, g *Subgraph, format, root string) error {
+	out := prepareExport(g, root)
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		_, err = w.Write(data)
+		return err
+	case FormatDOT:
+		return writeDOT(w, out)
+	default:
+		return fmt.Errorf("unknown export format %q (want %s or %s)", format, FormatJSON, FormatDOT)
+	}
+}
+
+// prepareExport copies g into its export form, sorted and with relative paths.
+func prepareExport(g *Subgraph, root string) exportGraph {
+	out := exportGraph{Nodes: []Node{}, Edges: []exportEdge{}}
+	for _, n := range g.Nodes {
+		node := *n
+		node.FilePath = relativePath(root, n.FilePath)
+		out.Nodes = append(out.Nodes, node)
+	}
+	sort.Slice(out.Nodes, func(i, j int) bool { return out.Nodes[i].ID < out.Nodes[j].ID })
+
+	for _, e := range g.Edges {
+		out.Edges = append(out.Edges, exportEdge{
+			ID:       util.GenerateEdgeID(e.SourceID, e.TargetID, e.Relation),
+			SourceID: e.SourceID,
+			TargetID: e.TargetID,
+			Relation: e.Relation,
+		})
+	}
+	sort.Slice(out.Edges, func(i, j int) bool {
+		a, b := out.Edges[i], out.Edges[j]
+		if a.SourceID != b.SourceID {
+			return a.SourceID < b.SourceID
+		}
+		if a.TargetID != b.TargetID {
+			return a.TargetID < b.TargetID
+		}
+		return a.Relation < b.Relation
+	})
+	return out
+}
+
+// relativePath returns path relative to root, slash-separated, or path
+// unchanged if root is empty or does not contain it.
+func relativePath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// writeDOT writes g as a Graphviz digraph, labelling nodes with their name,
+// kind and location and edges with their relation.
+func writeDOT(w io.Writer, g exportGraph) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph codemap {")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s\n%s\n%s:%d", n.Name, n.Kind, n.FilePath, n.LineStart)
+		fmt.Fprintf(bw, "  %s [label=%s];\n", dotQuote(n.ID), dotQuote(label))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(bw, "  %s -> %s [id=%s, label=%s];\n",
+			dotQuote(e.SourceID), dotQuote(e.TargetID), dotQuote(e.ID), dotQuote(e.Relation))
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// dotQuote quotes s as a DOT string; newlines become DOT line breaks.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,74 @@
+package graph
+
+// Canonical node kinds. Node.Kind always holds one of these, whichever
+// language or source (tree-sitter or LSP) the symbol came from.
+const (
+	KindFunction  = "function"
+	KindMethod    = "method"
+	KindClass     = "class"
+	KindInterface = "interface"
+	KindStruct    = "struct"
+	KindEnum      = "enum"
+	KindConstant  = "constant"
+	KindVariable  = "variable"
+	KindField     = "field"
+	KindType      = "type"
+	// KindSymbol is used for definitions that fit none of the kinds above.
+	KindSymbol = "symbol"
+)
+
+// syntaxKinds maps tree-sitter node types of the supported grammars onto
+// canonical kinds. Types whose kind depends on context (a Python function
+// inside a class, a Go type_spec) are refined by the scanner.
+var syntaxKinds = map[string]string{
+	"function_declaration":       KindFunction,
+	"function_definition":        KindFunction,
+	"function_item":              KindFunction,
+	"method_declaration":         KindMethod,
+	"method_definition":          KindMethod,
+	"class_declaration":          KindClass,
+	"class_definition":           KindClass,
+	"abstract_class_declaration": KindClass,
+	"record_declaration":         KindClass,
+	"class_specifier":            KindClass,
+	"interface_declaration":      KindInterface,
+	"protocol_declaration":       KindInterface,
+	"trait_item":                 KindInterface,
+	"interface_type":             KindInterface,
+	"struct_type":                KindStruct,
+	"struct_declaration":         KindStruct,
+	"struct_item":                KindStruct,
+	"struct_specifier":           KindStruct,
+	"enum_declaration":           KindEnum,
+	"enum_item":                  KindEnum,
+	"enum_specifier":             KindEnum,
+	"type_alias_declaration":     KindType,
+	"type_declaration":           KindType,
+	"type_definition":            KindType,
+	"type_spec":                  KindType,
+	"const_declaration":          KindConstant,
+	"variable_declarator":        KindVariable,
+	"variable_declaration":       KindVariable,
+	"assignment_statement":       KindVariable,
+	"field_declaration":          KindField,
+	"public_field_definition":    KindField,
+}
+
+var canonicalKinds = map[string]bool{
+	KindFunction: true, KindMethod: true, KindClass: true, KindInterface: true,
+	KindStruct: true, KindEnum: true, KindConstant: true, KindVariable: true,
+	KindField: true, KindType: true, KindSymbol: true,
+}
+
+// NormalizeKind maps a tree-sitter node type onto its canonical kind.
+// Canonical kinds are returned unchanged and anything unrecognized becomes
+// KindSymbol.
+func NormalizeKind(kind string) string {
+	if canonicalKinds[kind] {
+		return kind
+	}
+	if k, ok := syntaxKinds[kind]; ok {
+		return k
+	}
+	return KindSymbol
+}
@@ -3,9 +3,13 @@ package graph
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"codemap/internal/db"
+	"codemap/util"
 )
 
 type Store struct {
@@ -22,8 +26,8 @@ func (s *Store) UpsertNode(ctx context.Context, n *Node) error {
 
 func (s *Store) upsertNode(ctx context.Context, execer db.Execer, n *Node) error {
 	query := `
-	INSERT INTO nodes (id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO nodes (id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(id) DO UPDATE SET
 		name = excluded.name,
 		kind = excluded.kind,
@@ -33,11 +37,12 @@ func (s *Store) upsertNode(ctx context.Context, execer db.Execer, n *Node) error
 		col_start = excluded.col_start,
 		col_end = excluded.col_end,
 		symbol_uri = excluded.symbol_uri,
+		modifiers = excluded.modifiers,
 		created_at = CURRENT_TIMESTAMP;
 	`
 	_, err := execer.ExecContext(ctx, query,
 		n.ID, n.Name, n.Kind, n.FilePath,
-		n.LineStart, n.LineEnd, n.ColStart, n.ColEnd, n.SymbolURI,
+		n.LineStart, n.LineEnd, n.ColStart, n.ColEnd, n.SymbolURI, encodeModifiers(n.Modifiers),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to upsert node %s: %w", n.ID, err)
@@ -61,6 +66,79 @@ func (s *Store) BulkUpsertNodes(ctx context.Context, nodes []*Node) error {
 	return tx.Commit()
 }
 
+// NodeWriter replaces the nodes of one file after another inside a single
+// transaction, so a streamed scan only becomes visible once it has finished.
+// Commit or Rollback must be called.
+type NodeWriter struct {
+	store *Store
+	tx    *sql.Tx
+}
+
+// BeginNodes starts a NodeWriter.
+func (s *Store) BeginNodes(ctx context.Context) (*NodeWriter, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeWriter{store: s, tx: tx}, nil
+}
+
+// ReplaceFile stores nodes as the only nodes of filePath, dropping those an
+// earlier scan left there, nested symbols from enrichment included. Edges are
+// kept; those of symbols that come back reattach by ID.
+func (w *NodeWriter) ReplaceFile(ctx context.Context, filePath string, nodes []*Node) error {
+	if _, err := w.tx.ExecContext(ctx, `DELETE FROM nodes WHERE file_path = ?`, filePath); err != nil {
+		return fmt.Errorf("failed to replace nodes for file %s: %w", filePath, err)
+	}
+	for _, n := range nodes {
+		if err := w.store.upsertNode(ctx, w.tx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit makes every file replaced so far visible.
+func (w *NodeWriter) Commit() error {
+	return w.tx.Commit()
+}
+
+// Rollback discards the replaced files, leaving the store as it was.
+func (w *NodeWriter) Rollback() error {
+	return w.tx.Rollback()
+}
+
+// ReplaceEdges removes every edge from or to the nodes in ids and stores
+// edges in their place, in one transaction, so recomputed edges for changed
+// symbols never pile up next to stale ones.
+func (s *Store) ReplaceEdges(ctx context.Context, ids []string, edges []*Edge) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, chunk := range chunkStrings(ids, maxQueryParams/2) {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		query := fmt.Sprintf(`DELETE FROM edges WHERE source_id IN (%s) OR target_id IN (%s)`, placeholders, placeholders)
+		args := make([]interface{}, 0, 2*len(chunk))
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		args = append(args, args...)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to delete stale edges: %w", err)
+		}
+	}
+	for _, e := range edges {
+		if err := s.upsertEdge(ctx, tx, e); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (s *Store) UpsertEdge(ctx context.Context, e *Edge) error {
 	return s.upsertEdge(ctx, s.db, e)
 }
@@ -94,6 +172,8 @@ func (s *Store) BulkUpsertEdges(ctx context.Context, edges []*Edge) error {
 	return tx.Commit()
 }
 
+// FindImpact returns the symbols that transitively depend on the symbols
+// named symbolName, ordered by file and position.
 func (s *Store) FindImpact(ctx context.Context, symbolName string) ([]*Node, error) {
 	query := `
 	WITH RECURSIVE impacted AS (
@@ -101,6 +181,7 @@ func (s *Store) FindImpact(ctx context.Context, symbolName string) ([]*Node, err
 		SELECT source_id
 		FROM edges
 		WHERE target_id IN (SELECT id FROM nodes WHERE name = ?)
+		  AND relation NOT IN ('recursive', 'contains')
 		
 		UNION
 		
@@ -108,10 +189,12 @@ func (s *Store) FindImpact(ctx context.Context, symbolName string) ([]*Node, err
 		SELECT e.source_id
 		FROM edges e
 		INNER JOIN impacted i ON e.target_id = i.source_id
+		WHERE e.relation NOT IN ('recursive', 'contains')
 	)
-	SELECT DISTINCT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri
+	SELECT DISTINCT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
 	FROM nodes n
-	JOIN impacted i ON n.id = i.source_id;
+	JOIN impacted i ON n.id = i.source_id
+	ORDER BY n.file_path, n.line_start, n.col_start, n.id;
 	`
 
 	rows, err := s.db.QueryContext(ctx, query, symbolName)
@@ -120,21 +203,330 @@ func (s *Store) FindImpact(ctx context.Context, symbolName string) ([]*Node, err
 	}
 	defer rows.Close()
 
-	var nodes []*Node
+	nodes, err := scanNodes(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// neighborhoodCTE selects the ids of the nodes within ? hops of any node named
+// ?, following edges in either direction.
+const neighborhoodCTE = `
+	WITH RECURSIVE hood(id, depth) AS (
+		SELECT id, 0 FROM nodes WHERE name = ?
+
+		UNION
+
+		SELECT CASE WHEN e.source_id = h.id THEN e.target_id ELSE e.source_id END, h.depth + 1
+		FROM edges e
+		INNER JOIN hood h ON e.source_id = h.id OR e.target_id = h.id
+		WHERE h.depth < ?
+	)
+`
+
+// Neighborhood returns the nodes within radius hops of the symbols named
+// symbolName, in either direction, and every edge between them. It returns
+// an empty neighborhood if no symbol has that name.
+func (s *Store) Neighborhood(ctx context.Context, symbolName string, radius int) (*Subgraph, error) {
+	nodeQuery := neighborhoodCTE + `
+	SELECT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM nodes n
+	WHERE n.id IN (SELECT id FROM hood)
+	ORDER BY n.file_path, n.line_start, n.id;
+	`
+	rows, err := s.db.QueryContext(ctx, nodeQuery, symbolName, radius)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query neighborhood of %s: %w", symbolName, err)
+	}
+	nodes, err := scanNodes(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	edgeQuery := neighborhoodCTE + `
+	SELECT source_id, target_id, relation
+	FROM edges
+	WHERE source_id IN (SELECT id FROM hood) AND target_id IN (SELECT id FROM hood)
+	ORDER BY source_id, target_id, relation;
+	`
+	rows, err = s.db.QueryContext(ctx, edgeQuery, symbolName, radius)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query neighborhood edges of %s: %w", symbolName, err)
+	}
+	defer rows.Close()
+
+	hood := &Subgraph{Nodes: nodes}
 	for rows.Next() {
-		n := &Node{}
-		if err := rows.Scan(&n.ID, &n.Name, &n.Kind, &n.FilePath, &n.LineStart, &n.LineEnd, &n.ColStart, &n.ColEnd, &n.SymbolURI); err != nil {
+		e := &Edge{}
+		if err := rows.Scan(&e.SourceID, &e.TargetID, &e.Relation); err != nil {
 			return nil, err
 		}
-		nodes = append(nodes, n)
+		hood.Edges = append(hood.Edges, e)
 	}
+	return hood, rows.Err()
+}
 
-	return nodes, nil
+// GetFileEdges returns every edge with the symbol at either end in filePath,
+// split into edges leaving the file, entering it and staying within it.
+// Recursive self-edges are left out.
+func (s *Store) GetFileEdges(ctx context.Context, filePath string) (*FileEdges, error) {
+	query := `
+	SELECT e.relation,
+		src.id, src.name, src.kind, src.file_path, src.line_start, src.line_end, src.col_start, src.col_end, src.symbol_uri, src.modifiers,
+		dst.id, dst.name, dst.kind, dst.file_path, dst.line_start, dst.line_end, dst.col_start, dst.col_end, dst.symbol_uri, dst.modifiers
+	FROM edges e
+	JOIN nodes src ON src.id = e.source_id
+	JOIN nodes dst ON dst.id = e.target_id
+	WHERE (src.file_path = ? OR dst.file_path = ?) AND e.relation != 'recursive'
+	ORDER BY e.relation, src.file_path, src.line_start, dst.file_path, dst.line_start;
+	`
+	rows, err := s.db.QueryContext(ctx, query, filePath, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query edges of %s: %w", filePath, err)
+	}
+	defer rows.Close()
+
+	edges := &FileEdges{
+		FilePath: filePath,
+		Outgoing: make(map[string][]*FileEdge),
+		Incoming: make(map[string][]*FileEdge),
+		Internal: make(map[string][]*FileEdge),
+	}
+	for rows.Next() {
+		e := &FileEdge{Source: &Node{}, Target: &Node{}}
+		var srcURI, srcMods, dstURI, dstMods sql.NullString
+		dest := append([]any{&e.Relation}, nodeColumns(e.Source, &srcURI, &srcMods)...)
+		dest = append(dest, nodeColumns(e.Target, &dstURI, &dstMods)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		e.Source.SymbolURI, e.Source.Modifiers = srcURI.String, decodeModifiers(srcMods.String)
+		e.Target.SymbolURI, e.Target.Modifiers = dstURI.String, decodeModifiers(dstMods.String)
+
+		switch {
+		case e.Source.FilePath == filePath && e.Target.FilePath == filePath:
+			edges.Internal[e.Relation] = append(edges.Internal[e.Relation], e)
+		case e.Source.FilePath == filePath:
+			edges.Outgoing[e.Relation] = append(edges.Outgoing[e.Relation], e)
+		default:
+			edges.Incoming[e.Relation] = append(edges.Incoming[e.Relation], e)
+		}
+	}
+	return edges, rows.Err()
+}
+
+// Export returns the whole graph, nodes ordered by ID and edges by
+// (source, target, relation), so identical graphs export identically.
+func (s *Store) Export(ctx context.Context) (*Subgraph, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers
+	FROM nodes
+	ORDER BY id;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export nodes: %w", err)
+	}
+	nodes, err := scanNodes(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+	SELECT source_id, target_id, relation
+	FROM edges
+	ORDER BY source_id, target_id, relation;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export edges: %w", err)
+	}
+	defer rows.Close()
+
+	g := &Subgraph{Nodes: nodes}
+	for rows.Next() {
+		e := &Edge{}
+		if err := rows.Scan(&e.SourceID, &e.TargetID, &e.Relation); err != nil {
+			return nil, err
+		}
+		g.Edges = append(g.Edges, e)
+	}
+	return g, rows.Err()
+}
+
+// Callees returns the symbols the node id calls or references, ordered by
+// name. Recursive self-edges are left out.
+func (s *Store) Callees(ctx context.Context, id string) ([]*Node, error) {
+	query := `
+	SELECT DISTINCT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM edges e
+	JOIN nodes n ON n.id = e.target_id
+	WHERE e.source_id = ? AND e.relation IN ('calls', 'references') AND e.target_id != e.source_id
+	ORDER BY n.name, n.file_path, n.line_start;
+	`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query callees of %s: %w", id, err)
+	}
+	defer rows.Close()
+
+	return scanNodes(rows)
+}
+
+// Callers returns the symbols that call or reference the node id, ordered by
+// name. Recursive self-edges are left out.
+func (s *Store) Callers(ctx context.Context, id string) ([]*Node, error) {
+	query := `
+	SELECT DISTINCT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM edges e
+	JOIN nodes n ON n.id = e.source_id
+	WHERE e.target_id = ? AND e.relation IN ('calls', 'references') AND e.target_id != e.source_id
+	ORDER BY n.name, n.file_path, n.line_start;
+	`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query callers of %s: %w", id, err)
+	}
+	defer rows.Close()
+
+	return scanNodes(rows)
+}
+
+// Implementations returns the symbols with an implements edge to id: the
+// types implementing an interface.
+func (s *Store) Implementations(ctx context.Context, id string) ([]*Node, error) {
+	query := `
+	SELECT DISTINCT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM edges e
+	JOIN nodes n ON n.id = e.source_id
+	WHERE e.target_id = ? AND e.relation = 'implements'
+	ORDER BY n.file_path, n.line_start;
+	`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query implementations of %s: %w", id, err)
+	}
+	defer rows.Close()
+
+	return scanNodes(rows)
+}
+
+// CallTree expands the outgoing calls of every symbol named symbolName, depth
+// levels deep, depth first. Each symbol is expanded at most once across the
+// whole tree; later occurrences are marked Seen.
+func (s *Store) CallTree(ctx context.Context, symbolName string, depth int) ([]*CallTree, error) {
+	roots, err := s.GetSymbolLocation(ctx, symbolName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var expand func(n *Node, remaining int) (*CallTree, error)
+	expand = func(n *Node, remaining int) (*CallTree, error) {
+		t := &CallTree{Name: n.Name, Kind: n.Kind, FilePath: n.FilePath, Line: n.LineStart}
+		if seen[n.ID] {
+			t.Seen = true
+			return t, nil
+		}
+		seen[n.ID] = true
+
+		callees, err := s.Callees(ctx, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		if remaining == 0 {
+			t.Truncated = len(callees) > 0
+			return t, nil
+		}
+		for _, c := range callees {
+			child, err := expand(c, remaining-1)
+			if err != nil {
+				return nil, err
+			}
+			t.Calls = append(t.Calls, child)
+		}
+		return t, nil
+	}
+
+	var trees []*CallTree
+	for _, n := range roots {
+		t, err := expand(n, depth)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, t)
+	}
+	return trees, nil
+}
+
+// MaxCallLevelSymbols caps how many symbols CallerLevels and CalleeLevels
+// list, however densely connected the graph is.
+const MaxCallLevelSymbols = 500
+
+// CallerLevels walks the callers of every symbol named symbolName, breadth
+// first, up to depth levels. It returns nil if no symbol has that name.
+func (s *Store) CallerLevels(ctx context.Context, symbolName string, depth int) (*CallLevels, error) {
+	return s.callLevels(ctx, symbolName, depth, s.Callers)
+}
+
+// CalleeLevels walks the callees of every symbol named symbolName, breadth
+// first, up to depth levels. It returns nil if no symbol has that name.
+func (s *Store) CalleeLevels(ctx context.Context, symbolName string, depth int) (*CallLevels, error) {
+	return s.callLevels(ctx, symbolName, depth, s.Callees)
+}
+
+// callLevels walks next from the symbols named symbolName. Each symbol is
+// visited once, which stops cycles, and the walk ends early once
+// MaxCallLevelSymbols symbols are listed.
+func (s *Store) callLevels(ctx context.Context, symbolName string, depth int, next func(context.Context, string) ([]*Node, error)) (*CallLevels, error) {
+	roots, err := s.GetSymbolLocation(ctx, symbolName)
+	if err != nil || len(roots) == 0 {
+		return nil, err
+	}
+
+	visited := make(map[string]bool)
+	for _, n := range roots {
+		visited[n.ID] = true
+	}
+	res := &CallLevels{Levels: []CallLevel{}}
+	frontier, listed := roots, 0
+	for d := 1; d <= depth && len(frontier) > 0 && !res.Truncated; d++ {
+		level := CallLevel{Depth: d}
+		for _, n := range frontier {
+			found, err := next(ctx, n.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range found {
+				if visited[f.ID] {
+					continue
+				}
+				if listed == MaxCallLevelSymbols {
+					res.Truncated = true
+					break
+				}
+				visited[f.ID] = true
+				level.Symbols = append(level.Symbols, f)
+				listed++
+			}
+			if res.Truncated {
+				break
+			}
+		}
+		if len(level.Symbols) == 0 {
+			break
+		}
+		res.Levels = append(res.Levels, level)
+		frontier = level.Symbols
+	}
+	return res, nil
 }
 
 func (s *Store) GetSymbolLocation(ctx context.Context, symbolName string) ([]*Node, error) {
 	query := `
-	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri
+	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers
 	FROM nodes
 	WHERE name = ?
 	ORDER BY file_path;
@@ -145,23 +537,141 @@ func (s *Store) GetSymbolLocation(ctx context.Context, symbolName string) ([]*No
 	}
 	defer rows.Close()
 
+	nodes, err := scanNodes(rows)
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// GetSymbolsByNames returns every node whose name is one of names.
+func (s *Store) GetSymbolsByNames(ctx context.Context, names []string) ([]*Node, error) {
 	var nodes []*Node
-	for rows.Next() {
-		n := &Node{}
-		if err := rows.Scan(&n.ID, &n.Name, &n.Kind, &n.FilePath, &n.LineStart, &n.LineEnd, &n.ColStart, &n.ColEnd, &n.SymbolURI); err != nil {
+	for _, chunk := range chunkStrings(names, maxQueryParams) {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		query := fmt.Sprintf(`
+		SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers
+		FROM nodes
+		WHERE name IN (%s)
+		ORDER BY file_path, line_start;
+		`, placeholders)
+		args := make([]interface{}, len(chunk))
+		for i, name := range chunk {
+			args[i] = name
+		}
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query symbols by name: %w", err)
+		}
+		found, err := scanNodes(rows)
+		rows.Close()
+		if err != nil {
 			return nil, err
 		}
-		nodes = append(nodes, n)
+		nodes = append(nodes, found...)
 	}
 	return nodes, nil
 }
 
+// SearchSymbols returns up to limit nodes whose name matches query, ignoring
+// case: exact names first, then prefixes, substrings and finally names
+// containing query's characters in order (e.g. "gsl" for GetSymbolLocation).
+// Within each tier the most-referenced come first, so widely used symbols
+// outrank local helpers with similar names.
+func (s *Store) SearchSymbols(ctx context.Context, query string, limit int) ([]*Node, error) {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	escaped := escaper.Replace(query)
+	var subsequence strings.Builder
+	subsequence.WriteString("%")
+	for _, r := range query {
+		subsequence.WriteString(escaper.Replace(string(r)))
+		subsequence.WriteString("%")
+	}
+
+	sqlQuery := `
+	SELECT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM nodes n
+	LEFT JOIN (
+		SELECT target_id, COUNT(DISTINCT source_id) AS refs
+		FROM edges
+		WHERE relation NOT IN ('recursive', 'contains')
+		GROUP BY target_id
+	) r ON r.target_id = n.id
+	WHERE n.name LIKE ? ESCAPE '\'
+	ORDER BY
+		CASE
+			WHEN lower(n.name) = lower(?) THEN 0
+			WHEN n.name LIKE ? ESCAPE '\' THEN 1
+			WHEN n.name LIKE ? ESCAPE '\' THEN 2
+			ELSE 3
+		END,
+		COALESCE(r.refs, 0) DESC, length(n.name) ASC, n.name, n.file_path
+	LIMIT ?;
+	`
+	rows, err := s.db.QueryContext(ctx, sqlQuery, subsequence.String(), query, escaped+"%", "%"+escaped+"%", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search symbols for %s: %w", query, err)
+	}
+	defer rows.Close()
+
+	return scanNodes(rows)
+}
+
+// ReferenceCounts returns, for each of ids, how many distinct symbols have an
+// edge to it. Recursive self-edges and containment do not count; ids without
+// edges map to 0.
+func (s *Store) ReferenceCounts(ctx context.Context, ids []string) (map[string]int, error) {
+	counts := make(map[string]int, len(ids))
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	for _, id := range ids {
+		counts[id] = 0
+	}
+	for _, chunk := range chunkStrings(ids, maxQueryParams) {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		query := fmt.Sprintf(`
+		SELECT target_id, COUNT(DISTINCT source_id)
+		FROM edges
+		WHERE relation NOT IN ('recursive', 'contains') AND target_id IN (%s)
+		GROUP BY target_id;
+		`, placeholders)
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count references: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			var n int
+			if err := rows.Scan(&id, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[id] = n
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// GetSymbolsInFile returns the symbols defined in filePath, ordered by
+// position.
 func (s *Store) GetSymbolsInFile(ctx context.Context, filePath string) ([]*Node, error) {
 	query := `
-	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri
+	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers
 	FROM nodes
 	WHERE file_path = ?
-	ORDER BY line_start;
+	ORDER BY line_start, col_start, id;
 	`
 	rows, err := s.db.QueryContext(ctx, query, filePath)
 	if err != nil {
@@ -169,17 +679,41 @@ func (s *Store) GetSymbolsInFile(ctx context.Context, filePath string) ([]*Node,
 	}
 	defer rows.Close()
 
-	var nodes []*Node
-	for rows.Next() {
-		n := &Node{}
-		if err := rows.Scan(&n.ID, &n.Name, &n.Kind, &n.FilePath, &n.LineStart, &n.LineEnd, &n.ColStart, &n.ColEnd, &n.SymbolURI); err != nil {
-			return nil, err
-		}
-		nodes = append(nodes, n)
+	nodes, err := scanNodes(rows)
+	if err != nil {
+		return nil, err
 	}
 	return nodes, nil
 }
 
+// FileLocalSymbols returns the symbols in filePath that are referenced, but
+// only by symbols in the same file: candidates for narrower visibility.
+// Symbols with no references at all are not included. References from
+// top-level code have no enclosing symbol and are not recorded as edges, so
+// a symbol used only that way from another file can appear here too.
+func (s *Store) FileLocalSymbols(ctx context.Context, filePath string) ([]*Node, error) {
+	query := `
+	SELECT n.id, n.name, n.kind, n.file_path, n.line_start, n.line_end, n.col_start, n.col_end, n.symbol_uri, n.modifiers
+	FROM nodes n
+	WHERE n.file_path = ?
+	AND EXISTS (
+		SELECT 1 FROM edges e JOIN nodes src ON src.id = e.source_id
+		WHERE e.target_id = n.id AND e.relation NOT IN ('recursive', 'contains') AND src.file_path = n.file_path
+	)
+	AND NOT EXISTS (
+		SELECT 1 FROM edges e JOIN nodes src ON src.id = e.source_id
+		WHERE e.target_id = n.id AND e.relation NOT IN ('recursive', 'contains') AND src.file_path != n.file_path
+	)
+	ORDER BY n.line_start;
+	`
+	rows, err := s.db.QueryContext(ctx, query, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file-local symbols for %s: %w", filePath, err)
+	}
+	defer rows.Close()
+	return scanNodes(rows)
+}
+
 // DeleteNodesByFile removes all nodes and associated edges for a given file.
 func (s *Store) DeleteNodesByFile(ctx context.Context, filePath string) error {
 	// SQLite will cascade delete edges due to foreign key constraints
@@ -198,22 +732,60 @@ func (s *Store) Clear(ctx context.Context) error {
 	if _, err := s.db.ExecContext(ctx, "DELETE FROM nodes"); err != nil {
 		return err
 	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM meta"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetMeta returns the value stored under key, or "" if there is none.
+func (s *Store) GetMeta(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read meta %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// SetMeta stores value under key, replacing any previous value.
+func (s *Store) SetMeta(ctx context.Context, key, value string) error {
+	query := `INSERT INTO meta (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`
+	if _, err := s.db.ExecContext(ctx, query, key, value); err != nil {
+		return fmt.Errorf("failed to write meta %s: %w", key, err)
+	}
 	return nil
 }
 
-// FindNode finds the smallest node containing the given position.
+// DeleteMeta removes key; deleting a missing key is not an error.
+func (s *Store) DeleteMeta(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM meta WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to delete meta %s: %w", key, err)
+	}
+	return nil
+}
+
+// FindNode finds the smallest node containing the given position. Lines and
+// columns are 1-based; a col of 0 or less matches any column. Only the end
+// column is checked, since col_start records where the symbol's name begins
+// rather than where its definition does.
 func (s *Store) FindNode(ctx context.Context, path string, line, col int) (*Node, error) {
 	query := `
-	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri
+	SELECT id, name, kind, file_path, line_start, line_end, col_start, col_end, symbol_uri, modifiers
 	FROM nodes
 	WHERE file_path = ? AND line_start <= ? AND line_end >= ?
-	ORDER BY (line_end - line_start) ASC
+	  AND (? <= 0 OR line_end > ? OR col_end > ?)
+	ORDER BY (line_end - line_start) ASC, line_start DESC
 	LIMIT 1;
 	`
-	row := s.db.QueryRowContext(ctx, query, path, line, line)
+	row := s.db.QueryRowContext(ctx, query, path, line, line, col, line, col)
 
-	n := &Node{}
-	if err := row.Scan(&n.ID, &n.Name, &n.Kind, &n.FilePath, &n.LineStart, &n.LineEnd, &n.ColStart, &n.ColEnd, &n.SymbolURI); err != nil {
+	n, err := scanNode(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -222,29 +794,135 @@ func (s *Store) FindNode(ctx context.Context, path string, line, col int) (*Node
 	return n, nil
 }
 
-func (s *Store) PruneStaleFiles(ctx context.Context, foundFilePaths []string) error {
-	// 1. Create a map for O(1) lookups of found files
-	keep := make(map[string]bool)
-	for _, p := range foundFilePaths {
-		keep[p] = true
-	}
-
-	// 2. Get all file paths currently in the DB
-	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT file_path FROM nodes")
+// ListFiles returns every file path that has nodes in the store, sorted.
+func (s *Store) ListFiles(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT file_path FROM nodes ORDER BY file_path")
 	if err != nil {
-		return fmt.Errorf("failed to query existing files: %w", err)
+		return nil, fmt.Errorf("failed to query existing files: %w", err)
 	}
 	defer rows.Close()
 
-	var dbFiles []string
+	var files []string
 	for rows.Next() {
 		var p string
 		if err := rows.Scan(&p); err != nil {
-			return err
+			return nil, err
+		}
+		files = append(files, p)
+	}
+	return files, rows.Err()
+}
+
+// Stats aggregates node and edge counts for the whole graph. top bounds the
+// most-referenced symbol and largest file lists.
+func (s *Store) Stats(ctx context.Context, top int) (*Stats, error) {
+	st := &Stats{
+		NodesByKind:     make(map[string]int),
+		NodesByLanguage: make(map[string]int),
+		EdgesByRelation: make(map[string]int),
+	}
+
+	// Kinds are counted per file so languages can be derived from paths
+	rows, err := s.db.QueryContext(ctx, "SELECT file_path, kind, COUNT(*) FROM nodes GROUP BY file_path, kind")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count nodes: %w", err)
+	}
+	fileSymbols := make(map[string]int)
+	for rows.Next() {
+		var path, kind string
+		var n int
+		if err := rows.Scan(&path, &kind, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		st.Nodes += n
+		st.NodesByKind[kind] += n
+		lang := util.LanguageForPath(path)
+		if lang == "" {
+			lang = "other"
 		}
-		dbFiles = append(dbFiles, p)
+		st.NodesByLanguage[lang] += n
+		fileSymbols[path] += n
 	}
 	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for path, n := range fileSymbols {
+		st.LargestFiles = append(st.LargestFiles, FileCount{FilePath: path, Symbols: n})
+	}
+	sort.Slice(st.LargestFiles, func(i, j int) bool {
+		a, b := st.LargestFiles[i], st.LargestFiles[j]
+		if a.Symbols != b.Symbols {
+			return a.Symbols > b.Symbols
+		}
+		return a.FilePath < b.FilePath
+	})
+	if len(st.LargestFiles) > top {
+		st.LargestFiles = st.LargestFiles[:top]
+	}
+
+	rows, err = s.db.QueryContext(ctx, "SELECT relation, COUNT(*) FROM edges GROUP BY relation")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count edges: %w", err)
+	}
+	for rows.Next() {
+		var relation string
+		var n int
+		if err := rows.Scan(&relation, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		st.Edges += n
+		st.EdgesByRelation[relation] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if st.Nodes > 0 {
+		outgoing := st.Edges - st.EdgesByRelation[RelationRecursive] - st.EdgesByRelation[RelationContains]
+		st.AvgOutDegree = float64(outgoing) / float64(st.Nodes)
+	}
+
+	query := `
+	SELECT n.name, n.kind, n.file_path, COUNT(DISTINCT e.source_id) AS refs
+	FROM edges e
+	JOIN nodes n ON n.id = e.target_id
+	WHERE e.relation NOT IN ('recursive', 'contains')
+	GROUP BY e.target_id
+	ORDER BY refs DESC, n.name ASC
+	LIMIT ?;
+	`
+	rows, err = s.db.QueryContext(ctx, query, top)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank referenced symbols: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sc SymbolCount
+		if err := rows.Scan(&sc.Name, &sc.Kind, &sc.FilePath, &sc.Count); err != nil {
+			return nil, err
+		}
+		st.MostReferenced = append(st.MostReferenced, sc)
+	}
+	return st, rows.Err()
+}
+
+func (s *Store) PruneStaleFiles(ctx context.Context, foundFilePaths []string) error {
+	// 1. Create a map for O(1) lookups of found files
+	keep := make(map[string]bool)
+	for _, p := range foundFilePaths {
+		keep[p] = true
+	}
+
+	// 2. Get all file paths currently in the DB
+	dbFiles, err := s.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
 
 	// 3. Delete files that are in DB but not in the found set
 	for _, file := range dbFiles {
@@ -256,3 +934,77 @@ func (s *Store) PruneStaleFiles(ctx context.Context, foundFilePaths []string) er
 	}
 	return nil
 }
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// nodeColumns returns the scan destinations of the standard node column list.
+// The nullable symbol_uri and modifiers columns go to symbolURI and modifiers.
+func nodeColumns(n *Node, symbolURI, modifiers *sql.NullString) []any {
+	return []any{&n.ID, &n.Name, &n.Kind, &n.FilePath, &n.LineStart, &n.LineEnd, &n.ColStart, &n.ColEnd, symbolURI, modifiers}
+}
+
+// scanNode reads a node from a row selected with the standard node column list.
+func scanNode(row rowScanner) (*Node, error) {
+	n := &Node{}
+	var symbolURI, modifiers sql.NullString
+	if err := row.Scan(nodeColumns(n, &symbolURI, &modifiers)...); err != nil {
+		return nil, err
+	}
+	n.SymbolURI = symbolURI.String
+	n.Modifiers = decodeModifiers(modifiers.String)
+	return n, nil
+}
+
+func scanNodes(rows *sql.Rows) ([]*Node, error) {
+	var nodes []*Node
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// encodeModifiers serializes modifiers for storage; empty lists are stored as NULL.
+func encodeModifiers(mods []string) any {
+	if len(mods) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(mods)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
+
+func decodeModifiers(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var mods []string
+	if err := json.Unmarshal([]byte(s), &mods); err != nil {
+		return nil
+	}
+	return mods
+}
+
+// maxQueryParams keeps IN lists well under SQLite's limit on bound parameters.
+const maxQueryParams = 500
+
+// chunkStrings splits values into slices of at most size elements.
+func chunkStrings(values []string, size int) [][]string {
+	var chunks [][]string
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		chunks = append(chunks, values)
+	}
+	return chunks
+}
@@ -2,22 +2,23 @@ package graph
 
 // Node represents a symbol in the codebase.
 type Node struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Kind      string `json:"kind"`
-	FilePath  string `json:"file_path"`
-	LineStart int    `json:"line_start"`
-	LineEnd   int    `json:"line_end"`
-	ColStart  int    `json:"col_start"`
-	ColEnd    int    `json:"col_end"`
-	SymbolURI string `json:"symbol_uri"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind"`
+	FilePath  string   `json:"file_path"`
+	LineStart int      `json:"line_start"`
+	LineEnd   int      `json:"line_end"`
+	ColStart  int      `json:"col_start"`
+	ColEnd    int      `json:"col_end"`
+	SymbolURI string   `json:"symbol_uri"`
+	Modifiers []string `json:"modifiers,omitempty"` // e.g. async, decorators ("@app.route")
 }
 
 // Edge represents a relationship between two nodes.
 type Edge struct {
 	SourceID string `json:"source_id"`
 	TargetID string `json:"target_id"`
-	Relation string `json:"relation"` // calls, implements, references, imports
+	Relation string `json:"relation"` // calls, implements, references, imports, recursive, contains
 }
 
 const (
@@ -25,4 +26,91 @@ const (
 	RelationImplements = "implements"
 	RelationReferences = "references"
 	RelationImports    = "imports"
+	// RelationRecursive is a self-edge marking a symbol that references itself
+	// from its own body. It is informational and never counts as impact.
+	RelationRecursive = "recursive"
+	// RelationContains links a symbol to one nested inside it, such as a
+	// class to its methods. It is structural and never counts as impact.
+	RelationContains = "contains"
 )
+
+// Subgraph is a set of nodes together with the edges between them, such as the
+// neighborhood of a symbol or a full export of the graph.
+type Subgraph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+}
+
+// FileEdge is an edge together with the symbols at both of its ends.
+type FileEdge struct {
+	Relation string `json:"relation"`
+	Source   *Node  `json:"source"`
+	Target   *Node  `json:"target"`
+}
+
+// FileEdges are the edges with at least one end in a file, by direction and
+// then by relation.
+type FileEdges struct {
+	FilePath string                 `json:"file_path"`
+	Outgoing map[string][]*FileEdge `json:"outgoing"` // from the file's symbols to other files
+	Incoming map[string][]*FileEdge `json:"incoming"` // from other files to the file's symbols
+	Internal map[string][]*FileEdge `json:"internal"` // between symbols of the file
+}
+
+// CallTree is a symbol with the symbols it calls, expanded recursively.
+type CallTree struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	FilePath string `json:"file_path"`
+	Line     int    `json:"line"`
+	// Seen marks a symbol already expanded elsewhere in the tree; its calls
+	// are listed there, which also breaks recursion.
+	Seen bool `json:"seen,omitempty"`
+	// Truncated marks a symbol at the depth limit that calls further symbols.
+	Truncated bool        `json:"truncated,omitempty"`
+	Calls     []*CallTree `json:"calls,omitempty"`
+}
+
+// CallLevels is a breadth-first walk of the callers or callees of a symbol,
+// each symbol listed once at the depth it is first reached.
+type CallLevels struct {
+	Levels []CallLevel `json:"levels"`
+	// Truncated marks a walk stopped at MaxCallLevelSymbols; deeper levels
+	// may be incomplete or missing.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// CallLevel is the symbols first reached at one depth, 1 being the direct
+// callers or callees.
+type CallLevel struct {
+	Depth   int     `json:"depth"`
+	Symbols []*Node `json:"symbols"`
+}
+
+// Stats summarizes the shape of the graph.
+type Stats struct {
+	Nodes           int            `json:"nodes"`
+	Edges           int            `json:"edges"`
+	NodesByKind     map[string]int `json:"nodes_by_kind"`
+	NodesByLanguage map[string]int `json:"nodes_by_language"`
+	EdgesByRelation map[string]int `json:"edges_by_relation"`
+	MostReferenced  []SymbolCount  `json:"most_referenced"`
+	LargestFiles    []FileCount    `json:"largest_files"`
+	// AvgOutDegree is the mean number of outgoing edges per node, leaving
+	// out recursive self-edges and containment.
+	AvgOutDegree float64 `json:"avg_out_degree"`
+}
+
+// SymbolCount is a symbol with the number of distinct symbols pointing at it.
+type SymbolCount struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	FilePath string `json:"file_path"`
+	Count    int    `json:"count"`
+}
+
+// FileCount is a file with the number of symbols defined in it.
+type FileCount struct {
+	FilePath string `json:"file_path"`
+	Symbols  int    `json:"symbols"`
+}
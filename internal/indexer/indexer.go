@@ -0,0 +1,186 @@
+// Package indexer runs the scan → store → prune → enrich pipeline shared by
+// the MCP server and the codemap package, so both index a workspace the same
+// way.
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"codemap/internal/graph"
+	"codemap/internal/lsp"
+	"codemap/internal/scanner"
+)
+
+// Phases times the steps of an index run, so a slow run shows whether
+// parsing, the database or the language servers are to blame.
+type Phases struct {
+	Scan   time.Duration
+	Store  time.Duration // writing nodes and edges
+	Enrich time.Duration
+	Prune  time.Duration
+}
+
+// Indexer indexes workspaces into one store. It does not serialize runs;
+// callers must not start a run while another is in progress.
+type Indexer struct {
+	Scanner *scanner.Scanner
+	Store   *graph.Store
+	LSP     *lsp.Service
+
+	// Progress, if set, is called with the phase timings so far after each
+	// step.
+	Progress func(Phases)
+}
+
+// Symbols describes the symbols StoreSymbols stored.
+type Symbols struct {
+	FilesScanned int
+	Files        []string // files that produced nodes, in scan order
+	Nodes        int
+	Warnings     []string // non-fatal problems that left the index incomplete
+}
+
+// Links describes what Enrich added.
+type Links struct {
+	Nodes    int // nested symbols found in the language servers' document symbols
+	Edges    int
+	Warnings []string
+}
+
+// StoreSymbols scans root, writing each file's nodes while later files are
+// still being parsed and keeping none of them in memory. The writes share one
+// transaction, committed only once the walk has succeeded, so a failed scan
+// leaves the previous index intact. Files that are gone are then pruned. An
+// empty scan prunes nothing, since it usually means the root is wrong or
+// everything was ignored.
+func (ix *Indexer) StoreSymbols(ctx context.Context, root string, phases *Phases) (*Symbols, error) {
+	scan, sym, err := ix.scanAndStore(ctx, root, phases)
+	if err != nil {
+		return nil, err
+	}
+	sym.FilesScanned = scan.FilesScanned
+	if scan.FilesScanned == 0 {
+		return sym, nil
+	}
+
+	for _, e := range scan.Errors {
+		if errors.Is(e, scanner.ErrSyntax) {
+			sym.Warnings = append(sym.Warnings, e.Error()+"; symbols were extracted from a partial parse")
+		} else {
+			sym.Warnings = append(sym.Warnings, "skipped "+e.Error())
+		}
+	}
+
+	start := time.Now()
+	if err := ix.Store.PruneStaleFiles(ctx, sym.Files); err != nil {
+		// Not fatal: stale symbols linger until the next run
+		log.Printf("Warning: Failed to prune stale files: %v", err)
+		sym.Warnings = append(sym.Warnings, fmt.Sprintf("failed to prune stale files: %v", err))
+	}
+	phases.Prune = time.Since(start)
+	ix.progress(*phases)
+	return sym, nil
+}
+
+// scanAndStore streams the scan of root into the store, adding the time
+// spent to phases.
+func (ix *Indexer) scanAndStore(ctx context.Context, root string, phases *Phases) (*scanner.ScanResult, *Symbols, error) {
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+
+	writer, err := ix.Store.BeginNodes(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store nodes: %w", err)
+	}
+	defer writer.Rollback()
+
+	type scanOutcome struct {
+		res *scanner.ScanResult
+		err error
+	}
+	batches := make(chan []*graph.Node, 16)
+	done := make(chan scanOutcome, 1)
+	start := time.Now()
+	go func() {
+		res, err := ix.Scanner.ScanStream(scanCtx, root, batches)
+		done <- scanOutcome{res, err}
+	}()
+
+	sym := &Symbols{}
+	var storeErr error
+	for fileNodes := range batches {
+		if storeErr != nil {
+			continue // drain until the cancelled scan closes the channel
+		}
+		t := time.Now()
+		path := fileNodes[0].FilePath
+		if err := writer.ReplaceFile(ctx, path, fileNodes); err != nil {
+			storeErr = fmt.Errorf("failed to store nodes: %w", err)
+			cancelScan()
+		}
+		phases.Store += time.Since(t)
+		sym.Files = append(sym.Files, path)
+		sym.Nodes += len(fileNodes)
+	}
+
+	outcome := <-done
+	if storeErr == nil && outcome.err == nil {
+		t := time.Now()
+		if err := writer.Commit(); err != nil {
+			storeErr = fmt.Errorf("failed to store nodes: %w", err)
+		}
+		phases.Store += time.Since(t)
+	}
+	phases.Scan = time.Since(start) - phases.Store
+	ix.progress(*phases)
+
+	if storeErr != nil {
+		return nil, nil, storeErr
+	}
+	if outcome.err != nil {
+		return nil, nil, fmt.Errorf("scan failed: %w", outcome.err)
+	}
+	return outcome.res, sym, nil
+}
+
+// Enrich links the symbols of sym through the language servers, reading them
+// back from the store, and stores the edges and nested symbols found.
+func (ix *Indexer) Enrich(ctx context.Context, sym *Symbols, phases *Phases) (*Links, error) {
+	start := time.Now()
+	var nodes []*graph.Node
+	for _, path := range sym.Files {
+		fileNodes, err := ix.Store.GetSymbolsInFile(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load scanned nodes: %w", err)
+		}
+		nodes = append(nodes, fileNodes...)
+	}
+	edges, stats, err := ix.LSP.EnrichWithStats(ctx, nodes, ix.Store)
+	if err != nil {
+		return nil, fmt.Errorf("LSP enrichment failed: %w", err)
+	}
+	phases.Enrich = time.Since(start)
+	ix.progress(*phases)
+
+	start = time.Now()
+	if err := ix.Store.BulkUpsertNodes(ctx, stats.Nodes); err != nil {
+		return nil, fmt.Errorf("failed to store nested nodes: %w", err)
+	}
+	if err := ix.Store.BulkUpsertEdges(ctx, edges); err != nil {
+		return nil, fmt.Errorf("failed to store edges: %w", err)
+	}
+	phases.Store += time.Since(start)
+	ix.progress(*phases)
+
+	return &Links{Nodes: len(stats.Nodes), Edges: len(edges), Warnings: stats.Errors}, nil
+}
+
+func (ix *Indexer) progress(phases Phases) {
+	if ix.Progress != nil {
+		ix.Progress(phases)
+	}
+}
@@ -0,0 +1,90 @@
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// attachEndpoint returns the endpoint of an already-running language server
+// for lang, configured via CODEMAP_LSP_<LANG>_SOCKET, or "" if none is set.
+func attachEndpoint(lang string) string {
+	return strings.TrimSpace(os.Getenv("CODEMAP_LSP_" + strings.ToUpper(lang) + "_SOCKET"))
+}
+
+// parseEndpoint splits an endpoint into a network and address for net.Dial.
+// It accepts "unix://path", "tcp://host:port", a bare socket path, or a bare
+// host:port.
+func parseEndpoint(endpoint string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		network, address = "unix", strings.TrimPrefix(endpoint, "unix://")
+	case strings.HasPrefix(endpoint, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(endpoint, "tcp://")
+	case strings.ContainsAny(endpoint, `/\`):
+		network, address = "unix", endpoint
+	case strings.Contains(endpoint, ":"):
+		network, address = "tcp", endpoint
+	default:
+		return "", "", fmt.Errorf("unrecognized LSP endpoint %q (want unix://path or tcp://host:port)", endpoint)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("empty address in LSP endpoint %q", endpoint)
+	}
+	return network, address, nil
+}
+
+// AttachClient connects to a language server that is already running (for
+// example an editor's gopls started with -listen) instead of launching one.
+// The connection gets its own LSP session; Shutdown only disconnects from it.
+func (s *Service) AttachClient(ctx context.Context, lang string, endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// If already running, return
+	if c, ok := s.clients[lang]; ok && c.running() {
+		return nil
+	}
+
+	network, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s lsp at %s: %w", lang, endpoint, err)
+	}
+
+	c := &Client{
+		conn:      conn,
+		lang:      lang,
+		stdin:     conn,
+		stdout:    bufio.NewReader(conn),
+		rawStdout: conn,
+		errChan:   make(chan error, 1),
+		openDocs:  make(map[string]int),
+		info:      ServerInfo{Language: lang, Path: endpoint, Source: SourceAttached},
+	}
+
+	// Start background reader
+	go c.readLoop()
+
+	if err := c.initialize(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	s.clients[lang] = c
+
+	// initTime stays zero: an attached server has already indexed the
+	// workspace, so enrichment does not need to wait for it.
+	log.Printf("Attached to %s language server at %s", lang, endpoint)
+
+	return nil
+}
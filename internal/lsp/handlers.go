@@ -0,0 +1,131 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// JSON-RPC error codes sent in answer to the server's requests.
+const (
+	CodeMethodNotFound = -32601 // no handler for the method
+	CodeInternalError  = -32603 // the handler failed
+)
+
+// NotificationHandler handles a notification from the server. It runs on
+// the reader goroutine and must not block.
+type NotificationHandler func(params json.RawMessage)
+
+// RequestHandler answers a request from the server with a result, or an
+// error that is sent back in its place. It runs on its own goroutine.
+type RequestHandler func(params json.RawMessage) (interface{}, error)
+
+// defaultRequestHandlers answer the requests servers commonly send while
+// starting up. Left unanswered, some servers wait on them indefinitely and
+// never reply to initialize.
+var defaultRequestHandlers = map[string]RequestHandler{
+	// We have no settings to offer: one null per requested item tells the
+	// server to use its defaults.
+	"workspace/configuration": func(params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(params, &p)
+		return make([]interface{}, len(p.Items)), nil
+	},
+	"window/workDoneProgress/create": acknowledge,
+	"client/registerCapability":      acknowledge,
+	"client/unregisterCapability":    acknowledge,
+}
+
+// acknowledge answers a request with a null result.
+func acknowledge(json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+// handlerRegistry maps the methods of server-initiated messages to their
+// handlers. The zero value is ready to use.
+type handlerRegistry struct {
+	mu            sync.RWMutex
+	notifications map[string]NotificationHandler
+	requests      map[string]RequestHandler
+}
+
+// OnNotification registers h for the server's notifications of method,
+// replacing any handler registered before. Notifications without a handler
+// are dropped.
+func (c *Client) OnNotification(method string, h NotificationHandler) {
+	c.handlers.mu.Lock()
+	defer c.handlers.mu.Unlock()
+	if c.handlers.notifications == nil {
+		c.handlers.notifications = make(map[string]NotificationHandler)
+	}
+	c.handlers.notifications[method] = h
+}
+
+// OnRequest registers h to answer the server's requests of method,
+// replacing any handler registered before, including a default one.
+// Requests without a handler are answered with a method-not-found error.
+func (c *Client) OnRequest(method string, h RequestHandler) {
+	c.handlers.mu.Lock()
+	defer c.handlers.mu.Unlock()
+	if c.handlers.requests == nil {
+		c.handlers.requests = make(map[string]RequestHandler)
+	}
+	c.handlers.requests[method] = h
+}
+
+// serverResponse answers a request from the server. Its ID is echoed back
+// verbatim, since servers may use strings as well as numbers.
+type serverResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// dispatch routes a message the server sent of its own accord: a
+// notification, which has no ID, to its handler, and a request to its
+// handler, whose answer is written back.
+func (c *Client) dispatch(method string, id, params json.RawMessage) {
+	if !hasID(id) {
+		c.handlers.mu.RLock()
+		h := c.handlers.notifications[method]
+		c.handlers.mu.RUnlock()
+		if h != nil {
+			h(params)
+		}
+		return
+	}
+
+	c.handlers.mu.RLock()
+	h, ok := c.handlers.requests[method]
+	c.handlers.mu.RUnlock()
+	if !ok {
+		h = defaultRequestHandlers[method]
+	}
+
+	// Reply off the reader goroutine: the write can block until the server
+	// reads it, and the server may itself be waiting to write to us.
+	go func() {
+		resp := serverResponse{JSONRPC: "2.0", ID: id}
+		if h == nil {
+			resp.Error = &RPCError{Code: CodeMethodNotFound, Message: "method not found: " + method}
+		} else if result, err := h(params); err != nil {
+			resp.Error = &RPCError{Code: CodeInternalError, Message: err.Error()}
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Result = nil
+			resp.Error = &RPCError{Code: CodeInternalError, Message: err.Error()}
+		}
+		if err := c.write(context.Background(), resp); err != nil {
+			log.Printf("Warning: failed to answer %s request from %s lsp: %v", method, c.lang, err)
+		}
+	}()
+}
+
+// hasID reports whether a message's raw ID is present; notifications have
+// none.
+func hasID(id json.RawMessage) bool {
+	return len(id) > 0 && string(id) != "null"
+}
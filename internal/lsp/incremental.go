@@ -0,0 +1,90 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"codemap/internal/graph"
+)
+
+// SymbolIndex finds stored nodes by location and by name, which targeted
+// re-enrichment needs to discover what changed symbols refer to.
+type SymbolIndex interface {
+	NodeResolver
+	GetSymbolsByNames(ctx context.Context, names []string) ([]*graph.Node, error)
+}
+
+// identifierPattern matches identifier tokens in the supported languages.
+var identifierPattern = regexp.MustCompile(`[A-Za-z_$][A-Za-z0-9_$]*`)
+
+// EnrichChanged recomputes only the edges from or to the changed nodes, which
+// must already be stored, instead of re-enriching the whole workspace. Edges
+// into them come from their own references and implementations. Edges out of
+// them come from the references of the stored symbols whose names appear in
+// the changed files, kept only where a changed node is the source.
+//
+// It also returns the nested symbols of the changed files that the scanner
+// did not extract. Callers store those first, then the edges with
+// graph.Store.ReplaceEdges for the changed IDs, which drops the stale edges.
+func (s *Service) EnrichChanged(ctx context.Context, changed []*graph.Node, index SymbolIndex) ([]*graph.Node, []*graph.Edge, error) {
+	if len(changed) == 0 {
+		return nil, nil, nil
+	}
+
+	changedIDs := make(map[string]bool, len(changed))
+	files := make(map[string]bool)
+	for _, n := range changed {
+		changedIDs[n.ID] = true
+		files[n.FilePath] = true
+	}
+
+	// Symbols the changed files may refer to
+	seen := make(map[string]bool)
+	var names []string
+	for path := range files {
+		text, err := s.overlay.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		for _, name := range identifierPattern.FindAllString(string(text), -1) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	candidates, err := index.GetSymbolsByNames(ctx, names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targets := append([]*graph.Node(nil), changed...)
+	for _, n := range candidates {
+		if !changedIDs[n.ID] {
+			targets = append(targets, n)
+		}
+	}
+
+	edges, stats, err := s.EnrichWithStats(ctx, targets, index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Nested symbols of the changed files are new with them
+	var nested []*graph.Node
+	for _, n := range stats.Nodes {
+		if files[n.FilePath] {
+			nested = append(nested, n)
+			changedIDs[n.ID] = true
+		}
+	}
+
+	var touching []*graph.Edge
+	for _, e := range edges {
+		if changedIDs[e.SourceID] || changedIDs[e.TargetID] {
+			touching = append(touching, e)
+		}
+	}
+	return nested, touching, nil
+}
@@ -2,18 +2,28 @@ package lsp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"codemap/internal/budget"
 	"codemap/internal/graph"
+	"codemap/internal/overlay"
 	"codemap/internal/pkgmgr"
 	"codemap/util"
 )
@@ -23,6 +33,7 @@ type Service struct {
 	clients map[string]*Client
 	mu      sync.Mutex
 	pkgMgr  *pkgmgr.Manager
+	overlay *overlay.Overlay // unsaved buffers sent to servers instead of disk
 }
 
 // EnrichmentStats provides statistics about the enrichment process.
@@ -31,7 +42,14 @@ type EnrichmentStats struct {
 	FilesSkipped    int
 	LanguageServers map[string]bool
 	EdgesGenerated  int
-	Errors          []string
+	// UnattributedRefs counts references from top-level code that no stored
+	// symbol encloses; they have no source node and produce no edge.
+	UnattributedRefs int
+	// Nodes are symbols nested in document symbol trees that the scanner did
+	// not extract, such as fields. Callers store them before the edges, as
+	// contains edges point at them.
+	Nodes  []*graph.Node
+	Errors []string
 }
 
 func NewService() *Service {
@@ -55,102 +73,283 @@ func NewService() *Service {
 	}
 }
 
+// Where a language server binary came from, as reported in ServerInfo.Source.
+const (
+	SourceCustom   = "custom"   // a path passed to StartClient
+	SourceAttached = "attached" // an already running server (CODEMAP_LSP_<LANG>_SOCKET)
+	SourceManaged  = "managed"  // installed by the package manager
+	SourcePath     = "path"     // found on the system PATH
+)
+
+// ServerInfo describes the language server behind a client: the binary or
+// endpoint in use, where it came from and what the server reported about
+// itself during initialize.
+type ServerInfo struct {
+	Language string `json:"language"`
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	Name     string `json:"name,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// SetOverlay makes the service open documents with o's buffers where it has
+// them, so positions match what the scanner saw.
+func (s *Service) SetOverlay(o *overlay.Overlay) {
+	s.overlay = o
+}
+
 // Client represents a connection to a language server.
 type Client struct {
-	cmd      *exec.Cmd
-	lang     string
-	stdin    io.Writer
-	stdout   *bufio.Reader
-	seq      int
-	mu       sync.Mutex
-	pending  map[int]chan responseOrError
-	errChan  chan error
-	openDocs map[string]int // URI -> version
-	initTime time.Time      // When the server was initialized
+	cmd    *exec.Cmd
+	conn   net.Conn // set instead of cmd when attached to an existing server
+	lang   string
+	stdin  io.Writer
+	stdout *bufio.Reader
+	// rawStdout is the reader stdout buffers, where read deadlines are set
+	rawStdout io.Reader
+	calls     requestTracker // requests awaiting a response
+	mu        sync.Mutex
+	writeMu   sync.Mutex // serializes messages written to stdin
+	errChan   chan error
+	openDocs  map[string]int    // URI -> version
+	docTexts  map[string]string // URI -> text last sent, to diff changes against
+	// docRefs counts the users of each document opened with acquireDocument;
+	// docsMu serializes acquiring and releasing them.
+	docRefs  map[string]int
+	docsMu   sync.Mutex
+	initTime time.Time // When the server was initialized
+	info     ServerInfo
+	// caps are the capabilities from the initialize response; nil until
+	// then, when every request is attempted.
+	caps *ServerCapabilities
+	// handlers answer the server's own requests and notifications.
+	handlers handlerRegistry
+	// dead is set once the stream has failed, see fail, or on Shutdown.
+	dead     atomic.Bool
+	failOnce sync.Once
+}
+
+// ErrUnsupported is returned for a request whose capability the server did
+// not advertise.
+var ErrUnsupported = errors.New("not supported by the language server")
+
+// require returns ErrUnsupported when the server's initialize response did
+// not advertise the capability that has returns.
+func (c *Client) require(method string, has func(ServerCapabilities) Provider) error {
+	if c.caps == nil || has(*c.caps) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", method, ErrUnsupported)
 }
 
-type responseOrError struct {
-	data json.RawMessage
-	err  error
+// enrichFeatures records which of the requests enrichment makes a client's
+// server supports, so unsupported ones are skipped rather than failing once
+// per symbol.
+type enrichFeatures struct {
+	references      bool
+	implementations bool
+	documentSymbols bool
+}
+
+// enrichFeatures checks c's capabilities for the requests enrichment makes,
+// logging the ones its server lacks.
+func (c *Client) enrichFeatures() enrichFeatures {
+	supports := func(method string, has func(ServerCapabilities) Provider) bool {
+		if err := c.require(method, has); errors.Is(err, ErrUnsupported) {
+			log.Printf("[%s] Skipping %s during enrichment: %v", c.lang, method, ErrUnsupported)
+			return false
+		}
+		return true
+	}
+	return enrichFeatures{
+		references:      supports("textDocument/references", func(sc ServerCapabilities) Provider { return sc.ReferencesProvider }),
+		implementations: supports("textDocument/implementation", func(sc ServerCapabilities) Provider { return sc.ImplementationProvider }),
+		documentSymbols: supports("textDocument/documentSymbol", func(sc ServerCapabilities) Provider { return sc.DocumentSymbolProvider }),
+	}
 }
 
 func (s *Service) getClient(lang string) *Client {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.clients[lang]
+	c := s.clients[lang]
+	if c != nil && c.dead.Load() {
+		delete(s.clients, lang)
+		return nil
+	}
+	return c
 }
 
 // StartClient starts an LSP server for the given language.
 func (s *Service) StartClient(ctx context.Context, lang string, cmdPath string, args []string) error {
+	return s.startClient(ctx, lang, cmdPath, SourceCustom, args)
+}
+
+// startClient starts the server at cmdPath, recording source as where the
+// binary was found.
+func (s *Service) startClient(ctx context.Context, lang, cmdPath, source string, args []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// If already running, return
-	if c, ok := s.clients[lang]; ok && c.cmd.Process != nil {
+	if c, ok := s.clients[lang]; ok && c.running() {
 		return nil
 	}
 
 	cmd := exec.CommandContext(ctx, cmdPath, args...)
-	stdin, err := cmd.StdinPipe()
+
+	// Use an *os.File pipe for stdin (rather than cmd.StdinPipe) so writes
+	// can be given a deadline if the server stops reading.
+	stdinR, stdin, err := os.Pipe()
 	if err != nil {
 		return err
 	}
+	cmd.Stdin = stdinR
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		stdinR.Close()
+		stdin.Close()
 		return err
 	}
 
 	// Stderr to parent stderr for debugging
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	stdinR.Close() // the child holds its own copy
+	if err != nil {
+		stdin.Close()
 		return fmt.Errorf("failed to start %s lsp: %w", lang, err)
 	}
 
 	c := &Client{
-		cmd:      cmd,
-		lang:     lang,
-		stdin:    stdin,
-		stdout:   bufio.NewReader(stdout),
-		seq:      0,
-		pending:  make(map[int]chan responseOrError),
-		errChan:  make(chan error, 1),
-		openDocs: make(map[string]int),
+		cmd:       cmd,
+		lang:      lang,
+		stdin:     stdin,
+		stdout:    bufio.NewReader(stdout),
+		rawStdout: stdout,
+		errChan:   make(chan error, 1),
+		openDocs:  make(map[string]int),
+		info:      ServerInfo{Language: lang, Path: cmdPath, Source: source},
 	}
 	s.clients[lang] = c
 
 	// Start background reader
 	go c.readLoop()
 
-	// Initialize Handshake
+	if err := c.initialize(ctx); err != nil {
+		return err
+	}
+
+	// Store initialization time for later checks
+	c.initTime = time.Now()
+
+	log.Printf("Started %s language server (indexing in background)", lang)
+
+	return nil
+}
+
+// running reports whether the client has a live process or connection.
+func (c *Client) running() bool {
+	if c.dead.Load() {
+		return false
+	}
+	return c.conn != nil || (c.cmd != nil && c.cmd.Process != nil)
+}
+
+// fail marks the client dead after err broke its stream: it closes the
+// connection and stops the server, and fails the requests still waiting.
+// The service drops a dead client, so the next use starts a new one.
+func (c *Client) fail(err error) {
+	c.failOnce.Do(func() {
+		c.dead.Store(true)
+		log.Printf("Warning: %s lsp connection is unusable, restarting it on next use: %v", c.lang, err)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		if closer, ok := c.stdin.(io.Closer); ok {
+			closer.Close()
+		}
+		if c.cmd != nil && c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		c.calls.failAll(fmt.Errorf("%s lsp connection failed: %w", c.lang, err))
+	})
+}
+
+// initialize performs the LSP initialize/initialized handshake.
+func (c *Client) initialize(ctx context.Context) error {
 	cwd, _ := os.Getwd()
 	initParams := InitializeParams{
 		ProcessID:    os.Getpid(),
 		RootURI:      util.PathToURI(cwd),
-		Capabilities: ClientCapabilities{},
+		Capabilities: clientCapabilities,
 	}
 
 	// Use context with timeout for initialization
 	initCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if _, err := c.CallWithContext(initCtx, "initialize", initParams); err != nil {
+	raw, err := c.CallWithContext(initCtx, "initialize", initParams)
+	if err != nil {
 		return fmt.Errorf("initialize failed: %w", err)
 	}
+	var result InitializeResult
+	if err := json.Unmarshal(raw, &result); err == nil {
+		c.caps = &result.Capabilities
+		if result.ServerInfo != nil {
+			c.info.Name = result.ServerInfo.Name
+			c.info.Version = result.ServerInfo.Version
+		}
+	}
 
 	// Send initialized notification
-	notif := Request{
+	notif := Notification{
 		JSONRPC: "2.0",
 		Method:  "initialized",
 		Params:  struct{}{},
 	}
-	WriteMessage(c.stdin, notif)
+	c.write(ctx, notif)
 
-	// Store initialization time for later checks
-	c.initTime = time.Now()
+	return nil
+}
 
-	log.Printf("Started %s language server (indexing in background)", lang)
+// writeTimeout bounds a single message write when the caller's context has no
+// deadline, so a server that stops reading surfaces as an error, not a hang.
+const writeTimeout = 10 * time.Second
+
+// write sends msg to the server. When the transport supports write deadlines
+// (pipes and sockets), the write is bounded by ctx's deadline or writeTimeout.
+// A write that fails may have left part of a message on the stream, which
+// misframes everything after it, so the client is then marked dead.
+func (c *Client) write(ctx context.Context, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.dead.Load() {
+		return fmt.Errorf("%s lsp connection is closed", c.lang)
+	}
+
+	if dw, ok := c.stdin.(deadlineWriter); ok {
+		deadline, hasDeadline := ctx.Deadline()
+		if !hasDeadline {
+			deadline = time.Now().Add(writeTimeout)
+		}
+		if err := dw.SetWriteDeadline(deadline); err == nil {
+			defer dw.SetWriteDeadline(time.Time{})
+		}
+	}
 
+	if err := writeFrame(c.stdin, body); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("write to %s lsp timed out: %w", c.lang, err)
+		}
+		c.fail(err)
+		return err
+	}
 	return nil
 }
 
@@ -161,18 +360,8 @@ func (c *Client) Call(method string, params interface{}) (json.RawMessage, error
 
 // CallWithContext sends a request and waits for the response with context cancellation.
 func (c *Client) CallWithContext(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
-	c.mu.Lock()
-	c.seq++
-	id := c.seq
-	ch := make(chan responseOrError, 1)
-	c.pending[id] = ch
-	c.mu.Unlock()
-
-	defer func() {
-		c.mu.Lock()
-		delete(c.pending, id)
-		c.mu.Unlock()
-	}()
+	id, ch := c.calls.begin()
+	defer c.calls.done(id)
 
 	req := Request{
 		JSONRPC: "2.0",
@@ -181,7 +370,7 @@ func (c *Client) CallWithContext(ctx context.Context, method string, params inte
 		Params:  params,
 	}
 
-	if err := WriteMessage(c.stdin, req); err != nil {
+	if err := c.write(ctx, req); err != nil {
 		return nil, err
 	}
 
@@ -196,73 +385,120 @@ func (c *Client) CallWithContext(ctx context.Context, method string, params inte
 	}
 }
 
+// readTimeout bounds how long a message may take to arrive in full once the
+// server has started sending it, so a server that stalls part way through
+// surfaces as an error rather than wedging the reader. A variable so tests
+// can shorten it.
+var readTimeout = 30 * time.Second
+
+// readNext waits for the next message from the server. The wait for it to
+// begin is unbounded, since servers are quiet while idle; from its first
+// byte, the rest must arrive within readTimeout.
+func (c *Client) readNext() ([]byte, error) {
+	if _, err := c.stdout.Peek(1); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+	return ReadMessageContext(ctx, c.stdout, c.rawStdout)
+}
+
 func (c *Client) readLoop() {
 	for {
-		msgBytes, err := ReadMessage(c.stdout)
+		msgBytes, err := c.readNext()
+		if errors.Is(err, ErrMalformedMessage) {
+			log.Printf("Warning: ignoring message from %s lsp: %v", c.lang, err)
+			c.failMalformed(msgBytes, err)
+			continue
+		}
 		if err != nil {
 			if err != io.EOF && !strings.Contains(err.Error(), "closed") {
-				log.Printf("LSP read error: %v", err)
 				select {
 				case c.errChan <- err:
 				default:
 				}
 			}
+			if c.dead.Load() {
+				// Shut down, or already failed by a write
+				c.calls.failAll(fmt.Errorf("%s lsp connection is closed", c.lang))
+				return
+			}
+			// With no one left reading responses, every waiting call fails
+			// now and the service starts a new client on next use
+			c.fail(fmt.Errorf("read failed: %w", err))
 			return
 		}
 
-		// Try to decode as Response
-		var rawResp struct {
+		var msg struct {
 			Result json.RawMessage `json:"result"`
 			Error  *RPCError       `json:"error"`
-			ID     interface{}     `json:"id"`
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			log.Printf("Warning: ignoring malformed LSP message: %v", err)
+			continue
 		}
 
-		if err := json.Unmarshal(msgBytes, &rawResp); err == nil {
-			// LSP IDs can be int or string
-			var id int
-			var idSet bool
-
-			switch v := rawResp.ID.(type) {
-			case float64:
-				id = int(v)
-				idSet = true
-			case int:
-				id = v
-				idSet = true
-			}
-
-			if idSet {
-				c.mu.Lock()
-				ch, ok := c.pending[id]
-				c.mu.Unlock()
+		// Messages with a method are the server's own requests and
+		// notifications, which servers may send at any time, even before
+		// answering initialize. Their IDs are the server's, so they must not
+		// be matched against pending calls.
+		if msg.Method != "" {
+			c.dispatch(msg.Method, msg.ID, msg.Params)
+			continue
+		}
 
-				if ok {
-					var resErr error
-					if rawResp.Error != nil {
-						resErr = fmt.Errorf("RPC error %d: %s", rawResp.Error.Code, rawResp.Error.Message)
-					}
-					ch <- responseOrError{data: rawResp.Result, err: resErr}
-				}
-			}
+		// Our IDs are integers; anything else is not a response to us
+		var id int
+		if err := json.Unmarshal(msg.ID, &id); err != nil {
+			continue
 		}
-		// Notifications (no ID) or unrecognized messages are ignored for now
+		var resErr error
+		if msg.Error != nil {
+			resErr = fmt.Errorf("RPC error %d: %s", msg.Error.Code, msg.Error.Message)
+		}
+		c.calls.resolve(id, responseOrError{data: msg.Result, err: resErr})
+	}
+}
+
+// failMalformed fails the pending call that the malformed message body
+// answers with err, so the caller does not wait out its timeout. The id can
+// usually still be read, since json.Unmarshal tolerates invalid utf-8.
+func (c *Client) failMalformed(body []byte, err error) {
+	var msg struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if json.Unmarshal(body, &msg) != nil || msg.Method != "" {
+		return
 	}
+	var id int
+	if json.Unmarshal(msg.ID, &id) != nil {
+		return
+	}
+	c.calls.resolve(id, responseOrError{err: err})
 }
 
 // Notify sends a notification (request without expecting a response).
 func (c *Client) Notify(method string, params interface{}) error {
-	notif := Request{
+	notif := Notification{
 		JSONRPC: "2.0",
 		Method:  method,
 		Params:  params,
 	}
-	return WriteMessage(c.stdin, notif)
+	return c.write(context.Background(), notif)
 }
 
 // DidOpen notifies the server that a document has been opened.
 func (c *Client) DidOpen(ctx context.Context, uri, languageID, text string) error {
 	c.mu.Lock()
 	c.openDocs[uri] = 1
+	if c.docTexts == nil {
+		c.docTexts = make(map[string]string)
+	}
+	c.docTexts[uri] = text
 	c.mu.Unlock()
 
 	params := DidOpenTextDocumentParams{
@@ -276,10 +512,83 @@ func (c *Client) DidOpen(ctx context.Context, uri, languageID, text string) erro
 	return c.Notify("textDocument/didOpen", params)
 }
 
+// DidChange sends the new text of an open document. Servers that advertise
+// incremental sync are sent only the edited range, others the whole text,
+// including those that ask for no sync at all, since their answers would
+// otherwise describe stale text.
+func (c *Client) DidChange(ctx context.Context, uri, text string) error {
+	c.mu.Lock()
+	version, ok := c.openDocs[uri]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("document %s is not open", uri)
+	}
+	oldText := c.docTexts[uri]
+	version++
+	c.openDocs[uri] = version
+	c.docTexts[uri] = text
+	c.mu.Unlock()
+
+	kind := TextDocumentSyncFull
+	if c.caps != nil {
+		kind = c.caps.TextDocumentSync.Change
+	}
+	params := DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: uri, Version: version},
+		ContentChanges: []TextDocumentContentChangeEvent{contentChange(oldText, text, kind)},
+	}
+	return c.Notify("textDocument/didChange", params)
+}
+
+// acquireDocument opens a document with text for the caller, or, if someone
+// else already has it open, sends a change if its text differs. Every
+// successful call must be paired with releaseDocument; the document is only
+// closed once its last user releases it, so concurrent users, such as
+// enrichment and a query, never close it under each other.
+func (c *Client) acquireDocument(ctx context.Context, uri, languageID, text string) error {
+	c.docsMu.Lock()
+	defer c.docsMu.Unlock()
+
+	if c.docRefs[uri] == 0 {
+		if err := c.DidOpen(ctx, uri, languageID, text); err != nil {
+			return err
+		}
+	} else {
+		c.mu.Lock()
+		current := c.docTexts[uri]
+		c.mu.Unlock()
+		if current != text {
+			if err := c.DidChange(ctx, uri, text); err != nil {
+				return err
+			}
+		}
+	}
+	if c.docRefs == nil {
+		c.docRefs = make(map[string]int)
+	}
+	c.docRefs[uri]++
+	return nil
+}
+
+// releaseDocument gives up a use of a document taken with acquireDocument,
+// closing it when it was the last one.
+func (c *Client) releaseDocument(ctx context.Context, uri string) {
+	c.docsMu.Lock()
+	defer c.docsMu.Unlock()
+
+	if c.docRefs[uri] > 1 {
+		c.docRefs[uri]--
+		return
+	}
+	delete(c.docRefs, uri)
+	c.DidClose(ctx, uri)
+}
+
 // DidClose notifies the server that a document has been closed.
 func (c *Client) DidClose(ctx context.Context, uri string) error {
 	c.mu.Lock()
 	delete(c.openDocs, uri)
+	delete(c.docTexts, uri)
 	c.mu.Unlock()
 
 	params := DidCloseTextDocumentParams{
@@ -290,6 +599,9 @@ func (c *Client) DidClose(ctx context.Context, uri string) error {
 
 // GetDefinition requests the definition location of a symbol.
 func (c *Client) GetDefinition(ctx context.Context, uri string, line, char int) ([]Location, error) {
+	if err := c.require("textDocument/definition", func(sc ServerCapabilities) Provider { return sc.DefinitionProvider }); err != nil {
+		return nil, err
+	}
 	params := DefinitionParams{
 		TextDocument: TextDocumentIdentifier{URI: uri},
 		Position:     Position{Line: line, Character: char},
@@ -308,6 +620,11 @@ func (c *Client) GetDefinition(ctx context.Context, uri string, line, char int)
 	// For simplicity, handle Location and []Location
 	var locs []Location
 
+	// No definition at the position
+	if trimmed := bytes.TrimSpace(resBytes); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+
 	// Try single Location first
 	var singleLoc Location
 	if err := json.Unmarshal(resBytes, &singleLoc); err == nil && singleLoc.URI != "" {
@@ -324,6 +641,9 @@ func (c *Client) GetDefinition(ctx context.Context, uri string, line, char int)
 
 // GetImplementation requests the implementation locations of a symbol.
 func (c *Client) GetImplementation(ctx context.Context, uri string, line, char int) ([]Location, error) {
+	if err := c.require("textDocument/implementation", func(sc ServerCapabilities) Provider { return sc.ImplementationProvider }); err != nil {
+		return nil, err
+	}
 	params := ImplementationParams{
 		TextDocument: TextDocumentIdentifier{URI: uri},
 		Position:     Position{Line: line, Character: char},
@@ -347,6 +667,9 @@ func (c *Client) GetImplementation(ctx context.Context, uri string, line, char i
 
 // GetReferences requests all references to a symbol.
 func (c *Client) GetReferences(ctx context.Context, uri string, line, char int, includeDeclaration bool) ([]Location, error) {
+	if err := c.require("textDocument/references", func(sc ServerCapabilities) Provider { return sc.ReferencesProvider }); err != nil {
+		return nil, err
+	}
 	params := ReferenceParams{
 		TextDocument: TextDocumentIdentifier{URI: uri},
 		Position:     Position{Line: line, Character: char},
@@ -371,6 +694,9 @@ func (c *Client) GetReferences(ctx context.Context, uri string, line, char int,
 
 // GetHover requests hover information for a symbol.
 func (c *Client) GetHover(ctx context.Context, uri string, line, char int) (*Hover, error) {
+	if err := c.require("textDocument/hover", func(sc ServerCapabilities) Provider { return sc.HoverProvider }); err != nil {
+		return nil, err
+	}
 	params := HoverParams{
 		TextDocument: TextDocumentIdentifier{URI: uri},
 		Position:     Position{Line: line, Character: char},
@@ -394,6 +720,9 @@ func (c *Client) GetHover(ctx context.Context, uri string, line, char int) (*Hov
 
 // GetDocumentSymbols requests all symbols in a document.
 func (c *Client) GetDocumentSymbols(ctx context.Context, uri string) ([]DocumentSymbol, error) {
+	if err := c.require("textDocument/documentSymbol", func(sc ServerCapabilities) Provider { return sc.DocumentSymbolProvider }); err != nil {
+		return nil, err
+	}
 	params := DocumentSymbolParams{
 		TextDocument: TextDocumentIdentifier{URI: uri},
 	}
@@ -420,8 +749,14 @@ type NodeResolver interface {
 }
 
 // Enrich uses LSP to find cross-file references and generate edges.
-// Returns edges and statistics about the enrichment process.
 func (s *Service) Enrich(ctx context.Context, nodes []*graph.Node, resolver NodeResolver) ([]*graph.Edge, error) {
+	edges, _, err := s.EnrichWithStats(ctx, nodes, resolver)
+	return edges, err
+}
+
+// EnrichWithStats is like Enrich but also returns statistics about the
+// enrichment process, including non-fatal errors that left it partial.
+func (s *Service) EnrichWithStats(ctx context.Context, nodes []*graph.Node, resolver NodeResolver) ([]*graph.Edge, *EnrichmentStats, error) {
 	stats := &EnrichmentStats{
 		LanguageServers: make(map[string]bool),
 		Errors:          []string{},
@@ -431,12 +766,12 @@ func (s *Service) Enrich(ctx context.Context, nodes []*graph.Node, resolver Node
 	requiredLangs := s.detectRequiredLanguages(nodes)
 	if len(requiredLangs) == 0 {
 		log.Printf("No supported languages detected")
-		return nil, nil
+		return nil, stats, nil
 	}
 
 	// Validate that language servers are installed
 	if err := s.validateLanguageServers(requiredLangs); err != nil {
-		return nil, err
+		return nil, stats, err
 	}
 
 	// Auto-start language servers based on files we see
@@ -444,32 +779,70 @@ func (s *Service) Enrich(ctx context.Context, nodes []*graph.Node, resolver Node
 	stats.LanguageServers = langServers
 
 	if len(langServers) == 0 {
-		return nil, fmt.Errorf("failed to start any language servers")
+		return nil, stats, fmt.Errorf("failed to start any language servers")
+	}
+
+	var missing []string
+	for lang := range requiredLangs {
+		if !langServers[lang] {
+			missing = append(missing, lang)
+		}
+	}
+	sort.Strings(missing)
+	for _, lang := range missing {
+		stats.Errors = append(stats.Errors, fmt.Sprintf("No %s language server available; references in %s files were not indexed", lang, lang))
 	}
 
 	// Wait adaptively for indexing - only blocks if servers just started
 	s.waitForIndexing(langServers)
 
+	edges := s.enrichNodes(ctx, nodes, resolver, budget.Limit(), stats)
+	log.Printf("Enrichment complete: %d edges generated, %d top-level references skipped", len(edges), stats.UnattributedRefs)
+
+	return edges, stats, nil
+}
+
+// enrichNodes queries the running language servers about nodes with a pool of
+// workers, which open documents and issue requests concurrently. Each request
+// also takes a slot of the concurrency budget, so workers beyond its limit
+// only wait. The counters and errors are recorded in stats.
+func (s *Service) enrichNodes(ctx context.Context, nodes []*graph.Node, resolver NodeResolver, workers int, stats *EnrichmentStats) []*graph.Edge {
 	// Open documents in LSP
 	openedDocs := make(map[string]bool)
+	failedDocs := make(map[string]bool)
 	var docsMu sync.Mutex
 
 	defer func() {
 		// Close all opened documents
 		for uri := range openedDocs {
 			if c := s.getClientByURI(uri); c != nil {
-				c.DidClose(ctx, uri)
+				c.releaseDocument(ctx, uri)
 			}
 		}
 	}()
 
-	// Use a worker pool for enrichment
-	const numWorkers = 10
 	nodeChan := make(chan *graph.Node, len(nodes))
 	edgeChan := make(chan []*graph.Edge, len(nodes))
 	var wg sync.WaitGroup
+	var unattributed atomic.Int64
+	var nestedMu sync.Mutex
+	var nested []*graph.Node
+
+	// Capabilities are checked once per client, not per symbol
+	var featuresMu sync.Mutex
+	clientFeatures := make(map[*Client]enrichFeatures)
+	featuresOf := func(c *Client) enrichFeatures {
+		featuresMu.Lock()
+		defer featuresMu.Unlock()
+		f, ok := clientFeatures[c]
+		if !ok {
+			f = c.enrichFeatures()
+			clientFeatures[c] = f
+		}
+		return f
+	}
 
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < max(workers, 1); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -479,46 +852,84 @@ func (s *Service) Enrich(ctx context.Context, nodes []*graph.Node, resolver Node
 				if client == nil {
 					continue
 				}
+				features := featuresOf(client)
 
 				// Ensure document is open
 				uri := util.PathToURI(n.FilePath)
 				docsMu.Lock()
+				if failedDocs[uri] {
+					docsMu.Unlock()
+					continue
+				}
 				isOpen := openedDocs[uri]
+				opened := false
 				if !isOpen {
-					text, err := os.ReadFile(n.FilePath)
+					text, err := s.overlay.ReadFile(n.FilePath)
 					if err != nil {
 						errMsg := fmt.Sprintf("Failed to read file %s: %v", n.FilePath, err)
 						log.Println(errMsg)
+						failedDocs[uri] = true
+						stats.Errors = append(stats.Errors, errMsg)
 						docsMu.Unlock()
 						continue
 					}
 
-					langID := getLanguageID(lang)
-					if err := client.DidOpen(ctx, uri, langID, string(text)); err != nil {
+					langID := getLanguageID(lang, n.FilePath)
+					if err := client.acquireDocument(ctx, uri, langID, string(text)); err != nil {
 						errMsg := fmt.Sprintf("Failed to open document %s: %v", uri, err)
 						log.Println(errMsg)
+						failedDocs[uri] = true
+						stats.Errors = append(stats.Errors, errMsg)
 						docsMu.Unlock()
 						continue
 					}
 					openedDocs[uri] = true
+					opened = true
 				}
 				docsMu.Unlock()
 
+				// The worker that opens a file also records how its symbols nest
+				if opened && features.documentSymbols && budget.Acquire(ctx) == nil {
+					childNodes, containsEdges := s.symbolHierarchy(ctx, client, n.FilePath, resolver)
+					budget.Release()
+					if len(childNodes) > 0 {
+						nestedMu.Lock()
+						nested = append(nested, childNodes...)
+						nestedMu.Unlock()
+					}
+					if len(containsEdges) > 0 {
+						edgeChan <- containsEdges
+					}
+				}
+
 				// Only process definitions (functions, classes, methods)
 				if n.Name == "" || !isDefinitionKind(n.Kind) {
 					continue
 				}
+				findImplementations := features.implementations && isInterfaceKind(n.Kind)
+				if !features.references && !findImplementations {
+					continue
+				}
 
+				// Each symbol's requests take a slot of the budget shared with
+				// downloads
+				if err := budget.Acquire(ctx); err != nil {
+					continue
+				}
 				var nodeEdges []*graph.Edge
 				// Find references to this symbol
-				refEdges := s.findReferenceEdges(ctx, client, n, resolver)
-				nodeEdges = append(nodeEdges, refEdges...)
+				if features.references {
+					refEdges, skipped := s.findReferenceEdges(ctx, client, n, resolver)
+					nodeEdges = append(nodeEdges, refEdges...)
+					unattributed.Add(int64(skipped))
+				}
 
 				// Find implementations if this is an interface
-				if isInterfaceKind(n.Kind) {
+				if findImplementations {
 					implEdges := s.findImplementationEdges(ctx, client, n, resolver)
 					nodeEdges = append(nodeEdges, implEdges...)
 				}
+				budget.Release()
 				edgeChan <- nodeEdges
 			}
 		}()
@@ -541,32 +952,40 @@ func (s *Service) Enrich(ctx context.Context, nodes []*graph.Node, resolver Node
 		edges = append(edges, eList...)
 	}
 
+	stats.FilesProcessed = len(openedDocs)
+	stats.FilesSkipped = len(failedDocs)
 	stats.EdgesGenerated = len(edges)
-	log.Printf("Enrichment complete: %d edges generated", len(edges))
-
-	return edges, nil
+	stats.UnattributedRefs = int(unattributed.Load())
+	stats.Nodes = nested
+	return edges
 }
 
 // detectAndStartLanguageServers detects languages and starts appropriate servers.
 func (s *Service) detectAndStartLanguageServers(ctx context.Context, nodes []*graph.Node) map[string]bool {
-	langSet := make(map[string]bool)
-	for _, n := range nodes {
-		if lang := getLang(n.FilePath); lang != "" {
-			langSet[lang] = true
-		}
-	}
+	langSet := s.detectRequiredLanguages(nodes)
+	metadata := s.resolveMissingServers(ctx, langSet)
 
 	started := make(map[string]bool)
 	for lang := range langSet {
-		// Ensure LSP is available (system PATH → package manager)
-		cmdPath, err := s.ensureLSPAvailable(ctx, lang)
+		// Prefer a server the user already runs, if one is configured
+		if endpoint := attachEndpoint(lang); endpoint != "" {
+			if err := s.AttachClient(ctx, lang, endpoint); err != nil {
+				log.Printf("Warning: Failed to attach to %s language server at %s, launching one instead: %v", lang, endpoint, err)
+			} else {
+				started[lang] = true
+				continue
+			}
+		}
+
+		// Ensure LSP is available (package manager or system PATH)
+		cmdPath, source, err := s.ensureLSPAvailable(ctx, lang, metadata[lang])
 		if err != nil {
 			log.Printf("Warning: Failed to get %s language server: %v", lang, err)
 			continue
 		}
 
 		args := s.getLanguageServerArgs(lang)
-		if err := s.StartClient(ctx, lang, cmdPath, args); err != nil {
+		if err := s.startClient(ctx, lang, cmdPath, source, args); err != nil {
 			log.Printf("Warning: Failed to start %s language server: %v", lang, err)
 		} else {
 			started[lang] = true
@@ -577,12 +996,42 @@ func (s *Service) detectAndStartLanguageServers(ctx context.Context, nodes []*gr
 	return started
 }
 
-// detectRequiredLanguages scans nodes and returns unique languages needed.
+// versionResolveTimeout bounds how long startup waits for the latest versions
+// of language servers that are about to be downloaded.
+const versionResolveTimeout = 5 * time.Second
+
+// resolveMissingServers resolves, concurrently, the metadata of the languages
+// in langSet that may need a download: those neither attached to nor already
+// installed. A language that is on the system PATH is resolved too, as
+// whether it will be used is only decided later.
+func (s *Service) resolveMissingServers(ctx context.Context, langSet map[string]bool) map[string]*pkgmgr.LSPMetadata {
+	if s.pkgMgr == nil {
+		return nil
+	}
+	var langs []string
+	for lang := range langSet {
+		if attachEndpoint(lang) != "" {
+			continue
+		}
+		if installed, _, _ := s.pkgMgr.IsInstalled(lang); installed {
+			continue
+		}
+		langs = append(langs, lang)
+	}
+	if len(langs) == 0 {
+		return nil
+	}
+	return pkgmgr.ResolveLSPMetadata(ctx, langs, versionResolveTimeout)
+}
+
+// detectRequiredLanguages scans nodes and returns unique languages needed,
+// leaving out any excluded by CODEMAP_LANGUAGES.
 func (s *Service) detectRequiredLanguages(nodes []*graph.Node) map[string]bool {
+	enabled := util.EnabledLanguages()
 	langSet := make(map[string]bool)
 	for _, n := range nodes {
 		lang := getLang(n.FilePath)
-		if lang != "" {
+		if lang != "" && (enabled == nil || enabled[lang]) {
 			langSet[lang] = true
 		}
 	}
@@ -628,35 +1077,62 @@ func (s *Service) waitForIndexing(langServers map[string]bool) {
 	}
 }
 
-// findReferenceEdges finds all references to a symbol and creates edges.
-func (s *Service) findReferenceEdges(ctx context.Context, client *Client, n *graph.Node, resolver NodeResolver) []*graph.Edge {
+// findReferenceEdges finds all references to a symbol and creates edges. It
+// also returns how many references could not be attributed to any symbol.
+func (s *Service) findReferenceEdges(ctx context.Context, client *Client, n *graph.Node, resolver NodeResolver) ([]*graph.Edge, int) {
 	var edges []*graph.Edge
 
 	uri := util.PathToURI(n.FilePath)
 	locs, err := client.GetReferences(ctx, uri, n.LineStart-1, n.ColStart-1, false)
 	if err != nil {
 		// Not all symbols have references, this is expected
-		return edges
+		return edges, 0
 	}
 
+	recursive := false
+	unattributed := 0
 	for _, loc := range locs {
-		targetPath := util.URIToPath(loc.URI)
-		// Look up the node that contains this reference (the caller)
-		sourceNode, err := resolver.FindNode(ctx, targetPath, loc.Range.Start.Line+1, loc.Range.Start.Character+1)
+		// The node that contains this reference is the caller
+		sourceNode, err := enclosingNode(ctx, resolver, loc)
 		if err != nil {
 			continue // Skip if lookup fails
 		}
+		if sourceNode == nil {
+			unattributed++
+			continue
+		}
 
-		if sourceNode != nil && sourceNode.ID != n.ID {
-			edges = append(edges, &graph.Edge{
-				SourceID: sourceNode.ID,
-				TargetID: n.ID,
-				Relation: "references",
-			})
+		// A reference from inside the symbol's own body is recursion or local
+		// reuse, not impact; flag it once instead of emitting a references edge.
+		if sourceNode.ID == n.ID {
+			if !recursive {
+				recursive = true
+				edges = append(edges, &graph.Edge{
+					SourceID: n.ID,
+					TargetID: n.ID,
+					Relation: graph.RelationRecursive,
+				})
+			}
+			continue
 		}
+
+		edges = append(edges, &graph.Edge{
+			SourceID: sourceNode.ID,
+			TargetID: n.ID,
+			Relation: "references",
+		})
 	}
 
-	return edges
+	return edges, unattributed
+}
+
+// enclosingNode returns the innermost stored node whose range contains the
+// start of loc. It returns nil for sites in top-level or module code, which
+// no symbol encloses; callers skip those rather than inventing a file node.
+func enclosingNode(ctx context.Context, resolver NodeResolver, loc Location) (*graph.Node, error) {
+	path := util.URIToPath(loc.URI)
+	// LSP positions are 0-based; stored nodes are 1-based
+	return resolver.FindNode(ctx, path, loc.Range.Start.Line+1, loc.Range.Start.Character+1)
 }
 
 // findImplementationEdges finds implementations of an interface.
@@ -670,8 +1146,7 @@ func (s *Service) findImplementationEdges(ctx context.Context, client *Client, n
 	}
 
 	for _, loc := range locs {
-		targetPath := util.URIToPath(loc.URI)
-		implNode, err := resolver.FindNode(ctx, targetPath, loc.Range.Start.Line+1, loc.Range.Start.Character+1)
+		implNode, err := enclosingNode(ctx, resolver, loc)
 		if err != nil {
 			continue
 		}
@@ -688,6 +1163,120 @@ func (s *Service) findImplementationEdges(ctx context.Context, client *Client, n
 	return edges
 }
 
+// symbolHierarchy walks the document symbol tree of path and returns a
+// contains edge from each symbol to every symbol nested directly inside it.
+// Nested symbols already stored are linked as they are; the rest are
+// returned as new nodes, identified by their parent. A top-level symbol with
+// no stored node is skipped together with everything nested in it.
+func (s *Service) symbolHierarchy(ctx context.Context, client *Client, path string, resolver NodeResolver) ([]*graph.Node, []*graph.Edge) {
+	symbols, err := client.GetDocumentSymbols(ctx, util.PathToURI(path))
+	if err != nil {
+		// Servers without document symbols, or flat SymbolInformation
+		// replies, leave the graph as scanned
+		return nil, nil
+	}
+
+	var nodes []*graph.Node
+	var edges []*graph.Edge
+	var walk func(parent *graph.Node, children []DocumentSymbol)
+	walk = func(parent *graph.Node, children []DocumentSymbol) {
+		for _, sym := range children {
+			child := storedSymbol(ctx, resolver, path, sym, parent)
+			if child == nil && parent != nil {
+				child = &graph.Node{
+					ID:        util.GenerateNodeID(parent.ID, sym.Name),
+					Name:      sym.Name,
+					Kind:      SymbolKindToNodeKind(sym.Kind),
+					FilePath:  path,
+					LineStart: sym.SelectionRange.Start.Line + 1,
+					ColStart:  sym.SelectionRange.Start.Character + 1,
+					LineEnd:   sym.Range.End.Line + 1,
+					ColEnd:    sym.Range.End.Character + 1,
+					SymbolURI: util.PathToURI(path),
+				}
+				nodes = append(nodes, child)
+			}
+			if child == nil {
+				continue
+			}
+			if parent != nil {
+				edges = append(edges, &graph.Edge{
+					SourceID: parent.ID,
+					TargetID: child.ID,
+					Relation: graph.RelationContains,
+				})
+			}
+			walk(child, sym.Children)
+		}
+	}
+	walk(nil, symbols)
+	return nodes, edges
+}
+
+// storedSymbol returns the stored node for sym: the innermost node at its
+// name that has the same name and is not parent.
+func storedSymbol(ctx context.Context, resolver NodeResolver, path string, sym DocumentSymbol, parent *graph.Node) *graph.Node {
+	pos := sym.SelectionRange.Start
+	n, err := resolver.FindNode(ctx, path, pos.Line+1, pos.Character+1)
+	if err != nil || n == nil || n.Name != sym.Name {
+		return nil
+	}
+	if parent != nil && n.ID == parent.ID {
+		return nil
+	}
+	return n
+}
+
+// FindDefinition asks the running language server for path's language where
+// the identifier at line:char (0-based) is defined. The document is opened for
+// the query if enrichment does not already have it open.
+func (s *Service) FindDefinition(ctx context.Context, path string, line, char int) ([]Location, error) {
+	return s.queryDocument(ctx, path, func(client *Client, uri string) ([]Location, error) {
+		return client.GetDefinition(ctx, uri, line, char)
+	})
+}
+
+// FindImplementations asks the running language server for path's language
+// where the interface or method at line:char (0-based) is implemented.
+func (s *Service) FindImplementations(ctx context.Context, path string, line, char int) ([]Location, error) {
+	return s.queryDocument(ctx, path, func(client *Client, uri string) ([]Location, error) {
+		return client.GetImplementation(ctx, uri, line, char)
+	})
+}
+
+// FindReferences asks the running language server for path's language where
+// the symbol at line:char (0-based) is used, including its declaration when
+// includeDeclaration is set.
+func (s *Service) FindReferences(ctx context.Context, path string, line, char int, includeDeclaration bool) ([]Location, error) {
+	return s.queryDocument(ctx, path, func(client *Client, uri string) ([]Location, error) {
+		return client.GetReferences(ctx, uri, line, char, includeDeclaration)
+	})
+}
+
+// queryDocument runs query against the language server for path, opening the
+// document for it or sharing the copy enrichment has open.
+func (s *Service) queryDocument(ctx context.Context, path string, query func(client *Client, uri string) ([]Location, error)) ([]Location, error) {
+	lang := getLang(path)
+	client := s.getClient(lang)
+	if client == nil || !client.running() {
+		return nil, fmt.Errorf("no %s language server is running", lang)
+	}
+
+	// Enrichment may already have the document open, but with text that
+	// has since been edited
+	uri := util.PathToURI(path)
+	text, err := s.overlay.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := client.acquireDocument(ctx, uri, getLanguageID(lang, path), string(text)); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", uri, err)
+	}
+	defer client.releaseDocument(ctx, uri)
+
+	return query(client, uri)
+}
+
 // getClientByURI returns the client for a given URI.
 func (s *Service) getClientByURI(uri string) *Client {
 	// Extract language from URI (simplified)
@@ -696,10 +1285,31 @@ func (s *Service) getClientByURI(uri string) *Client {
 	return s.getClient(lang)
 }
 
+// Servers describes the running language servers, ordered by language.
+func (s *Service) Servers() []ServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []ServerInfo
+	for _, c := range s.clients {
+		if c.running() {
+			servers = append(servers, c.info)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Language < servers[j].Language })
+	return servers
+}
+
 func (s *Service) Shutdown() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, c := range s.clients {
+		c.dead.Store(true)
+		if c.conn != nil {
+			// Attached servers are owned by someone else; just disconnect.
+			c.conn.Close()
+			continue
+		}
 		if c.cmd.Process != nil {
 			c.cmd.Process.Kill()
 		}
@@ -715,38 +1325,10 @@ func ensureTimeout(ctx context.Context, timeout time.Duration) (context.Context,
 }
 
 func getLang(path string) string {
-	// Simple mapping based on file extension
-	if len(path) > 3 && path[len(path)-3:] == ".go" {
-		return "go"
-	}
-	if len(path) > 3 && path[len(path)-3:] == ".py" {
-		return "python"
-	}
-	if len(path) > 3 && path[len(path)-3:] == ".js" {
-		return "javascript"
-	}
-	if len(path) > 3 && path[len(path)-3:] == ".ts" {
-		return "typescript"
-	}
-	if len(path) > 4 && path[len(path)-4:] == ".tsx" {
-		return "typescript"
-	}
-	if len(path) > 4 && path[len(path)-4:] == ".jsx" {
-		return "javascript"
-	}
-	if len(path) > 4 && path[len(path)-4:] == ".lua" {
-		return "lua"
-	}
-	if len(path) > 4 && path[len(path)-4:] == ".zig" {
-		return "zig"
-	}
-	if len(path) > 6 && path[len(path)-6:] == ".templ" {
-		return "templ"
-	}
-	return ""
+	return util.LanguageForPath(path)
 }
 
-func getLanguageID(lang string) string {
+func getLanguageID(lang, path string) string {
 	// LSP language IDs
 	switch lang {
 	case "go":
@@ -761,6 +1343,16 @@ func getLanguageID(lang string) string {
 		return "lua"
 	case "zig":
 		return "zig"
+	case "rust":
+		return "rust"
+	case "java":
+		return "java"
+	case "cpp":
+		// clangd serves C sources too, but as C
+		if strings.EqualFold(filepath.Ext(path), ".c") {
+			return "c"
+		}
+		return "cpp"
 	case "templ":
 		return "templ"
 	default:
@@ -779,7 +1371,7 @@ func (s *Service) getLanguageServerArgs(lang string) []string {
 		return []string{"--stdio"}
 	case "lua":
 		return []string{"--stdio"}
-	case "zig":
+	case "zig", "rust", "java", "cpp":
 		return nil
 	case "templ":
 		return []string{"lsp"}
@@ -788,82 +1380,182 @@ func (s *Service) getLanguageServerArgs(lang string) []string {
 	}
 }
 
+// preferManaged reports whether CODEMAP_PREFER_MANAGED asks for CodeMap's own
+// downloaded servers over ones found on the system PATH.
+func preferManaged() bool {
+	prefer, _ := strconv.ParseBool(os.Getenv("CODEMAP_PREFER_MANAGED"))
+	return prefer
+}
+
 // ensureLSPAvailable ensures an LSP server is available for the given language.
-// Priority: system PATH → CodeMap packages (auto-download)
-func (s *Service) ensureLSPAvailable(ctx context.Context, lang string) (string, error) {
+// Priority: CodeMap packages (installed) → system PATH → auto-download. With
+// CODEMAP_PREFER_MANAGED set, auto-download comes before the system PATH, which
+// is then only a fallback when the download fails. It also returns where the
+// binary came from (SourceManaged or SourcePath). metadata, if not nil, is
+// the language's already resolved metadata.
+func (s *Service) ensureLSPAvailable(ctx context.Context, lang string, metadata *pkgmgr.LSPMetadata) (string, string, error) {
 	if s.pkgMgr == nil {
 		// Fallback: try to find in system PATH
 		metadata, err := pkgmgr.GetLSPMetadata(lang)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		if systemPath, err := findInPath(metadata.BinaryName); err == nil {
-			return systemPath, nil
+			return systemPath, SourcePath, nil
 		}
-		return "", fmt.Errorf("package manager not available and %s not found in PATH", metadata.BinaryName)
+		return "", "", fmt.Errorf("package manager not available and %s not found in PATH", metadata.BinaryName)
 	}
 
 	// Priority 1: Check if already installed via package manager
 	if installed, _, _ := s.pkgMgr.IsInstalled(lang); installed {
 		binPath, err := s.pkgMgr.GetBinaryPath(lang)
 		if err == nil {
+			// npm-based servers are launchers that still need node at run time
+			if metadata, ok := pkgmgr.LookupLSPMetadata(lang); ok {
+				if err := pkgmgr.CheckRuntime(metadata); err != nil {
+					return "", "", err
+				}
+			}
 			log.Printf("[%s] Using package manager LSP: %s", lang, binPath)
-			return binPath, nil
+			return binPath, SourceManaged, nil
 		}
 	}
 
 	// Priority 2: Check system PATH
-	metadata, err := pkgmgr.GetLSPMetadata(lang)
-	if err != nil {
-		return "", err
+	if metadata == nil {
+		var err error
+		if metadata, err = pkgmgr.GetLSPMetadata(lang); err != nil {
+			return "", "", err
+		}
 	}
 
-	if systemPath, err := findInPath(metadata.BinaryName); err == nil {
-		log.Printf("[%s] Using system LSP: %s", lang, systemPath)
-		return systemPath, nil
+	managed := preferManaged()
+	if !managed {
+		if systemPath, err := findInPath(metadata.BinaryName); err == nil {
+			log.Printf("[%s] Using system LSP: %s", lang, systemPath)
+			return systemPath, SourcePath, nil
+		}
 	}
 
 	// Priority 3: Download and install via package manager
-	log.Printf("[%s] LSP not found, downloading %s %s...", lang, metadata.Name, metadata.Version)
+	if managed {
+		log.Printf("[%s] Managed LSP preferred, downloading %s %s...", lang, metadata.Name, metadata.Version)
+	} else {
+		log.Printf("[%s] LSP not found, downloading %s %s...", lang, metadata.Name, metadata.Version)
+	}
 
 	installer := pkgmgr.NewInstaller(s.pkgMgr)
 	if err := installer.Install(ctx, lang, metadata); err != nil {
-		return "", fmt.Errorf("failed to install %s: %w", metadata.Name, err)
+		if managed && ctx.Err() == nil {
+			if systemPath, pathErr := findInPath(metadata.BinaryName); pathErr == nil {
+				log.Printf("[%s] Warning: failed to install %s (%v), falling back to system LSP: %s", lang, metadata.Name, err, systemPath)
+				return systemPath, SourcePath, nil
+			}
+		}
+		return "", "", fmt.Errorf("failed to install %s: %w", metadata.Name, err)
 	}
 
 	binPath, err := s.pkgMgr.GetBinaryPath(lang)
 	if err != nil {
-		return "", fmt.Errorf("failed to get installed binary path: %w", err)
+		return "", "", fmt.Errorf("failed to get installed binary path: %w", err)
 	}
 
-	return binPath, nil
+	return binPath, SourceManaged, nil
 }
 
 // findInPath searches for a binary in the system PATH.
 func findInPath(binaryName string) (string, error) {
-	path, err := exec.LookPath(binaryName)
-	if err != nil {
+	path, ok := lookPath(binaryName, runtime.GOOS, os.Getenv)
+	if !ok {
 		return "", fmt.Errorf("%s not found in PATH", binaryName)
 	}
 	return path, nil
 }
 
+// defaultPathExt is used when PATHEXT is unset on Windows.
+const defaultPathExt = ".COM;.EXE;.BAT;.CMD"
+
+// lookPath finds binaryName in the PATH from getenv. On Windows it tries the
+// name with each extension in PATHEXT, so .bat and .cmd shims such as those
+// the package manager writes are found as well as .exe files; elsewhere a
+// match must be an executable regular file.
+func lookPath(binaryName, goos string, getenv func(string) string) (string, bool) {
+	candidates := []string{binaryName}
+	if goos == "windows" {
+		pathext := getenv("PATHEXT")
+		if pathext == "" {
+			pathext = defaultPathExt
+		}
+		candidates = nil
+		if filepath.Ext(binaryName) != "" {
+			candidates = append(candidates, binaryName)
+		}
+		for _, ext := range strings.Split(pathext, ";") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				candidates = append(candidates, binaryName+strings.ToLower(ext))
+			}
+		}
+	}
+
+	for _, dir := range filepath.SplitList(getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		for _, name := range candidates {
+			path := filepath.Join(dir, name)
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if goos != "windows" && info.Mode().Perm()&0111 == 0 {
+				continue
+			}
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// SymbolKindToNodeKind maps an LSP SymbolKind onto the canonical graph kind,
+// so symbols reported by a language server line up with scanned ones.
+func SymbolKindToNodeKind(kind int) string {
+	switch kind {
+	case SymbolKindFunction, SymbolKindOperator:
+		return graph.KindFunction
+	case SymbolKindMethod, SymbolKindConstructor:
+		return graph.KindMethod
+	case SymbolKindClass:
+		return graph.KindClass
+	case SymbolKindInterface:
+		return graph.KindInterface
+	case SymbolKindStruct:
+		return graph.KindStruct
+	case SymbolKindEnum:
+		return graph.KindEnum
+	case SymbolKindConstant, SymbolKindEnumMember:
+		return graph.KindConstant
+	case SymbolKindVariable:
+		return graph.KindVariable
+	case SymbolKindField, SymbolKindProperty:
+		return graph.KindField
+	case SymbolKindTypeParameter:
+		return graph.KindType
+	default:
+		return graph.KindSymbol
+	}
+}
+
 func isDefinitionKind(kind string) bool {
 	// Check if this node kind represents a definition we want to track
-	definitionKinds := map[string]bool{
-		"function_declaration":  true,
-		"method_declaration":    true,
-		"method_definition":     true,
-		"function_definition":   true,
-		"class_definition":      true,
-		"class_declaration":     true,
-		"interface_declaration": true,
-		"type_definition":       true,
+	switch kind {
+	case graph.KindFunction, graph.KindMethod, graph.KindClass, graph.KindInterface,
+		graph.KindStruct, graph.KindEnum, graph.KindType:
+		return true
 	}
-	return definitionKinds[kind]
+	return false
 }
 
 func isInterfaceKind(kind string) bool {
 	// Check if this is an interface/protocol that can be implemented
-	return kind == "interface_declaration" || kind == "protocol_declaration"
+	return kind == graph.KindInterface
 }
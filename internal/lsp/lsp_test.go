@@ -1,14 +1,27 @@
 package lsp
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	"codemap/internal/budget"
 	"codemap/internal/graph"
+	"codemap/internal/pkgmgr"
 	"codemap/util"
 )
 
@@ -165,7 +178,7 @@ func Helper() {}
 		{
 			ID:        "main:MainFunc",
 			Name:      "MainFunc",
-			Kind:      "function_declaration",
+			Kind:      graph.KindFunction,
 			FilePath:  mainFile,
 			LineStart: 3,
 			ColStart:  6,
@@ -175,7 +188,7 @@ func Helper() {}
 		{
 			ID:        "main:Helper",
 			Name:      "Helper",
-			Kind:      "function_declaration",
+			Kind:      graph.KindFunction,
 			FilePath:  helperFile,
 			LineStart: 3,
 			ColStart:  6,
@@ -237,11 +250,13 @@ func TestIsDefinitionKind(t *testing.T) {
 		kind string
 		want bool
 	}{
-		{"function_declaration", true},
-		{"method_definition", true},
-		{"class_definition", true},
-		{"interface_declaration", true},
-		{"variable_declaration", false},
+		{graph.KindFunction, true},
+		{graph.KindMethod, true},
+		{graph.KindClass, true},
+		{graph.KindInterface, true},
+		{graph.KindStruct, true},
+		{graph.KindVariable, false},
+		{"function_declaration", false},
 		{"unknown", false},
 	}
 
@@ -252,15 +267,46 @@ func TestIsDefinitionKind(t *testing.T) {
 	}
 }
 
+func TestSymbolKindToNodeKind(t *testing.T) {
+	tests := []struct {
+		kind int
+		want string
+	}{
+		{SymbolKindFunction, graph.KindFunction},
+		{SymbolKindOperator, graph.KindFunction},
+		{SymbolKindMethod, graph.KindMethod},
+		{SymbolKindConstructor, graph.KindMethod},
+		{SymbolKindClass, graph.KindClass},
+		{SymbolKindInterface, graph.KindInterface},
+		{SymbolKindStruct, graph.KindStruct},
+		{SymbolKindEnum, graph.KindEnum},
+		{SymbolKindConstant, graph.KindConstant},
+		{SymbolKindEnumMember, graph.KindConstant},
+		{SymbolKindVariable, graph.KindVariable},
+		{SymbolKindField, graph.KindField},
+		{SymbolKindProperty, graph.KindField},
+		{SymbolKindTypeParameter, graph.KindType},
+		{SymbolKindModule, graph.KindSymbol},
+		{SymbolKindKey, graph.KindSymbol},
+		{0, graph.KindSymbol},
+		{99, graph.KindSymbol},
+	}
+
+	for _, tt := range tests {
+		if got := SymbolKindToNodeKind(tt.kind); got != tt.want {
+			t.Errorf("SymbolKindToNodeKind(%d) = %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+}
+
 func TestIsInterfaceKind(t *testing.T) {
 	tests := []struct {
 		kind string
 		want bool
 	}{
-		{"interface_declaration", true},
-		{"protocol_declaration", true},
-		{"class_definition", false},
-		{"function_declaration", false},
+		{graph.KindInterface, true},
+		{graph.KindClass, false},
+		{graph.KindFunction, false},
 	}
 
 	for _, tt := range tests {
@@ -269,3 +315,989 @@ func TestIsInterfaceKind(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint    string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{"unix:///tmp/gopls.sock", "unix", "/tmp/gopls.sock", false},
+		{"tcp://localhost:37374", "tcp", "localhost:37374", false},
+		{"/tmp/gopls.sock", "unix", "/tmp/gopls.sock", false},
+		{"127.0.0.1:37374", "tcp", "127.0.0.1:37374", false},
+		{"gopls", "", "", true},
+		{"tcp://", "", "", true},
+	}
+
+	for _, tt := range tests {
+		network, address, err := parseEndpoint(tt.endpoint)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEndpoint(%q) error = %v, wantErr %v", tt.endpoint, err, tt.wantErr)
+			continue
+		}
+		if network != tt.wantNetwork || address != tt.wantAddress {
+			t.Errorf("parseEndpoint(%q) = %q, %q, want %q, %q", tt.endpoint, network, address, tt.wantNetwork, tt.wantAddress)
+		}
+	}
+}
+
+func TestAttachClient(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "lsp.sock")
+
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	defer ln.Close()
+
+	// Minimal server: identify itself on initialize and answer every other
+	// request with an empty result.
+	methods := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     *int   `json:"id"`
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &req)
+			methods <- req.Method
+			if req.ID != nil {
+				var result interface{} = struct{}{}
+				if req.Method == "initialize" {
+					result = map[string]interface{}{"serverInfo": map[string]string{"name": "gopls", "version": "v0.16.0"}}
+				}
+				WriteMessage(conn, Response{JSONRPC: "2.0", ID: *req.ID, Result: result})
+			}
+		}
+	}()
+
+	svc := &Service{clients: make(map[string]*Client)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := svc.AttachClient(ctx, "go", "unix://"+sock); err != nil {
+		t.Fatalf("AttachClient failed: %v", err)
+	}
+
+	client := svc.getClient("go")
+	if client == nil || client.conn == nil {
+		t.Fatal("expected an attached go client")
+	}
+	if !client.initTime.IsZero() {
+		t.Error("attached client should not wait for indexing")
+	}
+
+	want := ServerInfo{Language: "go", Path: "unix://" + sock, Source: SourceAttached, Name: "gopls", Version: "v0.16.0"}
+	if servers := svc.Servers(); len(servers) != 1 || servers[0] != want {
+		t.Errorf("Servers() = %+v, want [%+v]", servers, want)
+	}
+
+	for _, want := range []string{"initialize", "initialized"} {
+		select {
+		case got := <-methods:
+			if got != want {
+				t.Errorf("server received %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	svc.Shutdown()
+}
+
+func TestStalledReadFailsClient(t *testing.T) {
+	orig := readTimeout
+	readTimeout = 100 * time.Millisecond
+	defer func() { readTimeout = orig }()
+
+	dir, err := os.MkdirTemp("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "lsp.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	defer ln.Close()
+
+	// Each connection answers initialize, then, once two other requests are
+	// waiting, starts a response it never finishes
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				waiting := 0
+				for {
+					msg, err := ReadMessage(r)
+					if err != nil {
+						return
+					}
+					var req struct {
+						ID     *int   `json:"id"`
+						Method string `json:"method"`
+					}
+					json.Unmarshal(msg, &req)
+					switch {
+					case req.ID == nil:
+					case req.Method == "initialize":
+						WriteMessage(conn, Response{JSONRPC: "2.0", ID: *req.ID, Result: struct{}{}})
+					default:
+						if waiting++; waiting == 2 {
+							io.WriteString(conn, "Content-Length: 100\r\n\r\n{\"jsonrpc\":")
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	svc := &Service{clients: make(map[string]*Client)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.AttachClient(ctx, "go", "unix://"+sock); err != nil {
+		t.Fatalf("AttachClient failed: %v", err)
+	}
+	defer svc.Shutdown()
+	first := svc.getClient("go")
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := first.CallWithContext(ctx, "test/slow", nil)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("call succeeded on a stalled stream")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("pending calls waited out their own timeout")
+		}
+	}
+
+	if got := svc.getClient("go"); got != nil {
+		t.Fatal("service still hands out the client whose reader stopped")
+	}
+	if err := svc.AttachClient(ctx, "go", "unix://"+sock); err != nil {
+		t.Fatalf("reattaching failed: %v", err)
+	}
+	if got := svc.getClient("go"); got == nil || got == first {
+		t.Error("next getClient did not return a new client")
+	}
+}
+
+// newFakeClient returns a Client connected over an in-memory pipe to a fake
+// server that answers each request with handle(method). Requests are
+// answered concurrently, so a slow handler does not hold up the others.
+func newFakeClient(t testing.TB, handle func(method string) interface{}) *Client {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	var writeMu sync.Mutex
+	go func() {
+		r := bufio.NewReader(serverConn)
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     *int   `json:"id"`
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &req)
+			if req.ID != nil {
+				go func(id int, method string) {
+					res := Response{JSONRPC: "2.0", ID: id, Result: handle(method)}
+					writeMu.Lock()
+					defer writeMu.Unlock()
+					WriteMessage(serverConn, res)
+				}(*req.ID, req.Method)
+			}
+		}
+	}()
+
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	go c.readLoop()
+	return c
+}
+
+func TestOverlappingRequestsGetTheirResponses(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server collects every request before answering any, answers them
+	// in reverse order and slips a notification in first
+	const n = 5
+	go func() {
+		r := bufio.NewReader(serverConn)
+		type request struct {
+			ID     *int            `json:"id"`
+			Params json.RawMessage `json:"params"`
+		}
+		var reqs []request
+		for len(reqs) < n {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req request
+			json.Unmarshal(msg, &req)
+			if req.ID != nil {
+				reqs = append(reqs, req)
+			}
+		}
+		WriteMessage(serverConn, Notification{JSONRPC: "2.0", Method: "window/logMessage", Params: map[string]interface{}{"type": 3, "message": "indexing"}})
+		for i := len(reqs) - 1; i >= 0; i-- {
+			WriteMessage(serverConn, Response{JSONRPC: "2.0", ID: *reqs[i].ID, Result: reqs[i].Params})
+		}
+	}()
+
+	notified := make(chan string, 1)
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	c.OnNotification("window/logMessage", func(params json.RawMessage) {
+		notified <- "window/logMessage"
+	})
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := c.CallWithContext(ctx, "test/echo", map[string]int{"n": i})
+			if err != nil {
+				errs <- err
+				return
+			}
+			var got struct{ N int }
+			if err := json.Unmarshal(res, &got); err != nil || got.N != i {
+				errs <- fmt.Errorf("request %d got response %s", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	select {
+	case method := <-notified:
+		if method != "window/logMessage" {
+			t.Errorf("notification handler got %q, want window/logMessage", method)
+		}
+	case <-ctx.Done():
+		t.Error("notification was not routed to the handler")
+	}
+}
+
+func TestMalformedResponseFailsItsCall(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server answers with a body that is not valid utf-8
+	go func() {
+		msg, err := ReadMessage(bufio.NewReader(serverConn))
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID int `json:"id"`
+		}
+		json.Unmarshal(msg, &req)
+		writeFrame(serverConn, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"`+"\xff"+`"}`, req.ID)))
+	}()
+
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.CallWithContext(ctx, "test/echo", nil); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("call error = %v, want ErrMalformedMessage", err)
+	}
+}
+
+func TestNotificationsCarryNoID(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	received := make(chan map[string]json.RawMessage, 1)
+	go func() {
+		msg, err := ReadMessage(bufio.NewReader(serverConn))
+		if err != nil {
+			return
+		}
+		var fields map[string]json.RawMessage
+		json.Unmarshal(msg, &fields)
+		received <- fields
+	}()
+
+	c := &Client{conn: clientConn, stdin: clientConn}
+	if err := c.Notify("textDocument/didClose", DidCloseTextDocumentParams{}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case fields := <-received:
+		if _, ok := fields["id"]; ok {
+			t.Errorf("notification has an id: %v", fields)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the notification")
+	}
+}
+
+func TestInitializeIgnoresEarlyServerMessages(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server logs, reports progress and makes a request of its own, with
+	// an ID that collides with the client's, before answering initialize
+	go func() {
+		r := bufio.NewReader(serverConn)
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     *int   `json:"id"`
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &req)
+			if req.Method != "initialize" {
+				continue
+			}
+			WriteMessage(serverConn, map[string]interface{}{"jsonrpc": "2.0", "method": "window/logMessage",
+				"params": map[string]interface{}{"type": 3, "message": "starting"}})
+			WriteMessage(serverConn, map[string]interface{}{"jsonrpc": "2.0", "method": "$/progress",
+				"params": map[string]interface{}{"token": "load", "value": map[string]string{"kind": "begin"}}})
+			WriteMessage(serverConn, map[string]interface{}{"jsonrpc": "2.0", "id": *req.ID, "method": "window/workDoneProgress/create",
+				"params": map[string]string{"token": "load"}})
+			WriteMessage(serverConn, Response{JSONRPC: "2.0", ID: *req.ID + 100, Result: "stray"})
+			WriteMessage(serverConn, Response{JSONRPC: "2.0", ID: *req.ID,
+				Result: map[string]interface{}{"serverInfo": map[string]string{"name": "fake-ls", "version": "1.2.3"}}})
+		}
+	}()
+
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+	if c.info.Name != "fake-ls" || c.info.Version != "1.2.3" {
+		t.Errorf("server info = %+v, want it from the initialize response", c.info)
+	}
+}
+
+func TestInitializeAnswersServerRequests(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// Like some servers do, this one asks for its configuration and will not
+	// answer initialize until it has it. It also makes a request the client
+	// does not implement.
+	replies := make(chan map[string]json.RawMessage, 2)
+	go func() {
+		r := bufio.NewReader(serverConn)
+		var initID int
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var m map[string]json.RawMessage
+			json.Unmarshal(msg, &m)
+			var method string
+			json.Unmarshal(m["method"], &method)
+			switch {
+			case method == "initialize":
+				json.Unmarshal(m["id"], &initID)
+				WriteMessage(serverConn, map[string]interface{}{"jsonrpc": "2.0", "id": "cfg-1", "method": "workspace/configuration",
+					"params": map[string]interface{}{"items": []map[string]string{{"section": "gopls"}, {"section": "go"}}}})
+				WriteMessage(serverConn, map[string]interface{}{"jsonrpc": "2.0", "id": 7, "method": "workspace/unknown"})
+			case method == "" && string(m["id"]) == `"cfg-1"`:
+				replies <- m
+				WriteMessage(serverConn, Response{JSONRPC: "2.0", ID: initID, Result: map[string]interface{}{}})
+			case method == "" && string(m["id"]) == "7":
+				replies <- m
+			}
+		}
+	}()
+
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var m map[string]json.RawMessage
+		select {
+		case m = <-replies:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the replies to the server's requests")
+		}
+		switch string(m["id"]) {
+		case `"cfg-1"`:
+			if got := string(m["result"]); got != "[null,null]" {
+				t.Errorf("workspace/configuration result = %s, want one null per item", got)
+			}
+		case "7":
+			var rpcErr RPCError
+			if err := json.Unmarshal(m["error"], &rpcErr); err != nil || rpcErr.Code != CodeMethodNotFound {
+				t.Errorf("unknown request answered with %s, want a method-not-found error", m["error"])
+			}
+		}
+	}
+}
+
+func TestInitializeAdvertisesCapabilities(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server records the initialize params and supports implementation
+	// (as an options object) and references, but not document symbols.
+	sent := make(chan json.RawMessage, 1)
+	go func() {
+		r := bufio.NewReader(serverConn)
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     *int            `json:"id"`
+				Method string          `json:"method"`
+				Params json.RawMessage `json:"params"`
+			}
+			json.Unmarshal(msg, &req)
+			if req.Method != "initialize" {
+				continue
+			}
+			sent <- req.Params
+			WriteMessage(serverConn, Response{JSONRPC: "2.0", ID: *req.ID, Result: map[string]interface{}{
+				"capabilities": map[string]interface{}{
+					"implementationProvider": map[string]bool{"workDoneProgress": true},
+					"referencesProvider":     true,
+					"documentSymbolProvider": false,
+				},
+			}})
+		}
+	}()
+
+	c := &Client{
+		conn:     clientConn,
+		lang:     "go",
+		stdin:    clientConn,
+		stdout:   bufio.NewReader(clientConn),
+		errChan:  make(chan error, 1),
+		openDocs: make(map[string]int),
+	}
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	var params struct {
+		Capabilities struct {
+			TextDocument struct {
+				DocumentSymbol *struct {
+					HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport"`
+				} `json:"documentSymbol"`
+				Implementation *json.RawMessage `json:"implementation"`
+				CallHierarchy  *json.RawMessage `json:"callHierarchy"`
+			} `json:"textDocument"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(<-sent, &params); err != nil {
+		t.Fatalf("failed to parse initialize params: %v", err)
+	}
+	td := params.Capabilities.TextDocument
+	if td.DocumentSymbol == nil || !td.DocumentSymbol.HierarchicalDocumentSymbolSupport {
+		t.Error("initialize should advertise hierarchicalDocumentSymbolSupport")
+	}
+	if td.Implementation == nil {
+		t.Error("initialize should advertise textDocument.implementation")
+	}
+	// There is no call hierarchy support to advertise yet
+	if td.CallHierarchy != nil {
+		t.Error("initialize should not advertise textDocument.callHierarchy")
+	}
+
+	if c.caps == nil || !c.caps.ImplementationProvider || !c.caps.ReferencesProvider {
+		t.Fatalf("server capabilities = %+v, want implementation and references", c.caps)
+	}
+	if _, err := c.GetDocumentSymbols(ctx, "file:///tmp/main.go"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("GetDocumentSymbols error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestFindReferenceEdgesSkipsSelfReferences(t *testing.T) {
+	file := "/src/fact.go"
+	fact := &graph.Node{ID: "fact", Name: "fact", Kind: graph.KindFunction, FilePath: file, LineStart: 3, ColStart: 6, LineEnd: 8, ColEnd: 2}
+	caller := &graph.Node{ID: "caller", Name: "caller", Kind: graph.KindFunction, FilePath: file, LineStart: 10, ColStart: 6, LineEnd: 12, ColEnd: 2}
+	resolver := &MockNodeResolver{nodes: []*graph.Node{fact, caller}}
+
+	uri := util.PathToURI(file)
+	at := func(line int) Location {
+		return Location{URI: uri, Range: Range{Start: Position{Line: line - 1, Character: 8}}}
+	}
+	client := newFakeClient(t, func(method string) interface{} {
+		if method == "textDocument/references" {
+			// Two recursive calls inside fact, one call from caller and
+			// one from package-level code outside any symbol
+			return []Location{at(5), at(6), at(11), at(14)}
+		}
+		return nil
+	})
+
+	svc := &Service{clients: make(map[string]*Client)}
+	edges, unattributed := svc.findReferenceEdges(context.Background(), client, fact, resolver)
+	if unattributed != 1 {
+		t.Errorf("unattributed = %d, want 1", unattributed)
+	}
+
+	var refs, recursive int
+	for _, e := range edges {
+		switch {
+		case e.Relation == graph.RelationRecursive && e.SourceID == "fact" && e.TargetID == "fact":
+			recursive++
+		case e.Relation == graph.RelationReferences && e.SourceID == "caller" && e.TargetID == "fact":
+			refs++
+		default:
+			t.Errorf("unexpected edge %+v", e)
+		}
+	}
+	if refs != 1 || recursive != 1 {
+		t.Errorf("got %d references and %d recursive edges, want 1 and 1", refs, recursive)
+	}
+}
+
+func TestEnrichNodesSkipsUnsupportedRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shapes.go")
+	if err := os.WriteFile(path, []byte("package shapes\n\ntype Shape interface{}\n\nfunc Area() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*graph.Node{
+		{ID: "shape", Name: "Shape", Kind: graph.KindInterface, FilePath: path, LineStart: 3, ColStart: 6, LineEnd: 3},
+		{ID: "area", Name: "Area", Kind: graph.KindFunction, FilePath: path, LineStart: 5, ColStart: 6, LineEnd: 5},
+	}
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	client := newFakeClient(t, func(method string) interface{} {
+		mu.Lock()
+		requests[method]++
+		mu.Unlock()
+		return nil
+	})
+	// The server only finds implementations
+	client.caps = &ServerCapabilities{ImplementationProvider: true}
+	svc := &Service{clients: map[string]*Client{"go": client}}
+
+	stats := &EnrichmentStats{LanguageServers: map[string]bool{"go": true}}
+	svc.enrichNodes(context.Background(), nodes, &MockNodeResolver{nodes: nodes}, 2, stats)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests["textDocument/references"] != 0 || requests["textDocument/documentSymbol"] != 0 {
+		t.Errorf("requests = %v, want no references or documentSymbol requests", requests)
+	}
+	if requests["textDocument/implementation"] != 1 {
+		t.Errorf("requests = %v, want one implementation request for the interface", requests)
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("stats.Errors = %v, want none for unsupported requests", stats.Errors)
+	}
+}
+
+func TestSymbolHierarchyWalksNestedSymbols(t *testing.T) {
+	file := "/src/Outer.java"
+	outer := &graph.Node{ID: "outer", Name: "Outer", Kind: graph.KindClass, FilePath: file, LineStart: 1, LineEnd: 20}
+	area := &graph.Node{ID: "area", Name: "area", Kind: graph.KindMethod, FilePath: file, LineStart: 3, LineEnd: 5}
+	resolver := &MockNodeResolver{nodes: []*graph.Node{outer, area}}
+
+	at := func(line, endLine int) (Range, Range) {
+		return Range{Start: Position{Line: line - 1}, End: Position{Line: endLine - 1, Character: 1}},
+			Range{Start: Position{Line: line - 1, Character: 4}}
+	}
+	sym := func(name string, kind, line, endLine int, children ...DocumentSymbol) DocumentSymbol {
+		r, sel := at(line, endLine)
+		return DocumentSymbol{Name: name, Kind: kind, Range: r, SelectionRange: sel, Children: children}
+	}
+	tree := []DocumentSymbol{
+		sym("Outer", SymbolKindClass, 1, 20,
+			// A constructor shares its class's name but is not the class
+			sym("Outer", SymbolKindConstructor, 2, 2),
+			sym("area", SymbolKindMethod, 3, 5),
+			sym("Inner", SymbolKindClass, 7, 15,
+				sym("size", SymbolKindField, 8, 8),
+				sym("grow", SymbolKindMethod, 10, 12),
+			),
+		),
+		// Nothing stored here, so neither it nor its children are kept
+		sym("orphan", SymbolKindFunction, 30, 32,
+			sym("local", SymbolKindVariable, 31, 31),
+		),
+	}
+	client := newFakeClient(t, func(method string) interface{} {
+		if method == "textDocument/documentSymbol" {
+			return tree
+		}
+		return nil
+	})
+
+	svc := &Service{clients: make(map[string]*Client)}
+	nodes, edges := svc.symbolHierarchy(context.Background(), client, file, resolver)
+
+	byName := make(map[string]*graph.Node)
+	for _, n := range nodes {
+		byName[n.Name] = n
+	}
+	if len(nodes) != 4 || byName["Outer"] == nil || byName["Inner"] == nil || byName["size"] == nil || byName["grow"] == nil {
+		t.Fatalf("new nodes = %v, want the constructor, Inner, size and grow", nodes)
+	}
+	inner := byName["Inner"]
+	if inner.ID != util.GenerateNodeID("outer", "Inner") || inner.Kind != graph.KindClass {
+		t.Errorf("Inner = %+v, want a class identified by its parent", inner)
+	}
+	if inner.LineStart != 7 || inner.ColStart != 5 || inner.LineEnd != 15 || inner.ColEnd != 2 {
+		t.Errorf("Inner spans %d:%d-%d:%d, want 7:5-15:2", inner.LineStart, inner.ColStart, inner.LineEnd, inner.ColEnd)
+	}
+	if byName["size"].Kind != graph.KindField || byName["grow"].Kind != graph.KindMethod {
+		t.Errorf("size is a %s and grow a %s, want field and method", byName["size"].Kind, byName["grow"].Kind)
+	}
+
+	got := make(map[string]bool)
+	for _, e := range edges {
+		if e.Relation != graph.RelationContains {
+			t.Errorf("unexpected relation in %+v", e)
+		}
+		got[e.SourceID+" -> "+e.TargetID] = true
+	}
+	want := []string{
+		"outer -> " + byName["Outer"].ID,
+		"outer -> area",
+		"outer -> " + inner.ID,
+		inner.ID + " -> " + byName["size"].ID,
+		inner.ID + " -> " + byName["grow"].ID,
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("missing contains edge %s", w)
+		}
+	}
+	if len(edges) != len(want) {
+		t.Errorf("got %d contains edges, want %d", len(edges), len(want))
+	}
+}
+
+func TestDetectRequiredLanguagesHonorsAllowlist(t *testing.T) {
+	nodes := []*graph.Node{
+		{FilePath: "/src/main.go"},
+		{FilePath: "/src/app.ts"},
+		{FilePath: "/src/init.lua"},
+	}
+	svc := NewService()
+
+	if got := svc.detectRequiredLanguages(nodes); len(got) != 3 {
+		t.Errorf("without allowlist got %v, want go, typescript and lua", got)
+	}
+
+	t.Setenv("CODEMAP_LANGUAGES", "go,typescript")
+	got := svc.detectRequiredLanguages(nodes)
+	if len(got) != 2 || !got["go"] || !got["typescript"] {
+		t.Errorf("with allowlist got %v, want go and typescript", got)
+	}
+}
+
+func TestFindDefinitionOpensDocument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() { helper() }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Location{URI: "file:///deps/helper.go", Range: Range{Start: Position{Line: 4, Character: 5}}}
+	client := newFakeClient(t, func(method string) interface{} {
+		if method == "textDocument/definition" {
+			return []Location{want}
+		}
+		return nil
+	})
+	svc := &Service{clients: map[string]*Client{"go": client}}
+
+	locs, err := svc.FindDefinition(context.Background(), path, 2, 14)
+	if err != nil {
+		t.Fatalf("FindDefinition failed: %v", err)
+	}
+	if len(locs) != 1 || locs[0] != want {
+		t.Errorf("FindDefinition() = %+v, want %+v", locs, want)
+	}
+	if len(client.openDocs) != 0 {
+		t.Errorf("document left open after the query: %v", client.openDocs)
+	}
+
+	if _, err := svc.FindDefinition(context.Background(), "/src/app.py", 0, 0); err == nil {
+		t.Error("expected an error without a python language server")
+	}
+}
+
+func TestGetDefinitionResponseShapes(t *testing.T) {
+	loc := Location{URI: "file:///src/helper.go", Range: Range{Start: Position{Line: 4, Character: 5}, End: Position{Line: 4, Character: 11}}}
+	other := Location{URI: "file:///src/other.go", Range: Range{Start: Position{Line: 9}}}
+	tests := []struct {
+		name     string
+		response interface{}
+		want     []Location
+	}{
+		{"single location", loc, []Location{loc}},
+		{"location array", []Location{loc, other}, []Location{loc, other}},
+		{"no definition", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeClient(t, func(method string) interface{} {
+				if method == "textDocument/definition" {
+					return tt.response
+				}
+				return nil
+			})
+			got, err := client.GetDefinition(context.Background(), "file:///src/main.go", 2, 14)
+			if err != nil {
+				t.Fatalf("GetDefinition failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetDefinition() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookPathFindsWindowsShims(t *testing.T) {
+	binDir := t.TempDir()
+	otherDir := t.TempDir()
+	// A shim as pkgmgr's createWindowsShim writes it: no execute bit needed
+	if err := os.WriteFile(filepath.Join(binDir, "gopls.bat"), []byte("@echo off\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(otherDir, "pyright-langserver.cmd"), []byte("@echo off\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"PATH":    otherDir + string(os.PathListSeparator) + binDir,
+		"PATHEXT": ".COM;.EXE;.BAT;.CMD",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	if got, ok := lookPath("gopls", "windows", getenv); !ok || got != filepath.Join(binDir, "gopls.bat") {
+		t.Errorf("lookPath(gopls) = %q, %v, want the .bat shim", got, ok)
+	}
+	if got, ok := lookPath("pyright-langserver", "windows", getenv); !ok || got != filepath.Join(otherDir, "pyright-langserver.cmd") {
+		t.Errorf("lookPath(pyright-langserver) = %q, %v, want the .cmd shim", got, ok)
+	}
+
+	// Without PATHEXT the default list still includes .bat
+	delete(env, "PATHEXT")
+	if _, ok := lookPath("gopls", "windows", getenv); !ok {
+		t.Error("lookPath(gopls) missed the shim with PATHEXT unset")
+	}
+
+	// Elsewhere names are used as-is and must be executable
+	if _, ok := lookPath("gopls", "linux", getenv); ok {
+		t.Error("lookPath matched a .bat shim on linux")
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "zls"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookPath("zls", "linux", getenv); ok {
+		t.Error("lookPath matched a non-executable file on linux")
+	}
+	if err := os.Chmod(filepath.Join(binDir, "zls"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := lookPath("zls", "linux", getenv); !ok || got != filepath.Join(binDir, "zls") {
+		t.Errorf("lookPath(zls) = %q, %v", got, ok)
+	}
+}
+
+func TestEnsureLSPAvailablePreferManaged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the fake server")
+	}
+	script := []byte("#!/bin/sh\necho fake-ls 1.0.0\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(script)
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	pathDir := t.TempDir()
+	systemBin := filepath.Join(pathDir, "fake-ls")
+	if err := os.WriteFile(systemBin, script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", pathDir)
+
+	mgr, err := pkgmgr.NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	svc := &Service{clients: make(map[string]*Client), pkgMgr: mgr}
+	ctx := context.Background()
+	metadata := &pkgmgr.LSPMetadata{Name: "fake-ls", Version: "1.0.0", BinaryName: "fake-ls",
+		DownloadURLs: map[string]string{pkgmgr.GetPlatformKey(): srv.URL + "/fake-ls"}}
+
+	// By default the system PATH wins over a download
+	if path, source, err := svc.ensureLSPAvailable(ctx, "fake", metadata); err != nil || source != SourcePath || path != systemBin {
+		t.Errorf("default = %q, %q, %v, want the PATH binary", path, source, err)
+	}
+
+	t.Setenv("CODEMAP_PREFER_MANAGED", "1")
+	if _, source, err := svc.ensureLSPAvailable(ctx, "fake", metadata); err != nil || source != SourceManaged {
+		t.Errorf("prefer managed = %q, %v, want a managed install", source, err)
+	}
+	if installed, _, _ := mgr.IsInstalled("fake"); !installed {
+		t.Error("prefer managed did not install the server")
+	}
+
+	// A download that fails still falls back to the PATH
+	broken := &pkgmgr.LSPMetadata{Name: "fake-ls", Version: "1.0.0", BinaryName: "fake-ls"}
+	if path, source, err := svc.ensureLSPAvailable(ctx, "broken", broken); err != nil || source != SourcePath || path != systemBin {
+		t.Errorf("failed download = %q, %q, %v, want the PATH binary", path, source, err)
+	}
+}
+
+// BenchmarkEnrichNodes compares serial enrichment with the worker pool on
+// synthetic symbols, against a fake server that takes a millisecond per
+// request. The pool is as large as the concurrency budget, so on a machine
+// with few cores set CODEMAP_MAX_CONCURRENCY to see it overlap requests.
+func BenchmarkEnrichNodes(b *testing.B) {
+	dir := b.TempDir()
+	var nodes []*graph.Node
+	for f := 0; f < 10; f++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d.go", f))
+		if err := os.WriteFile(path, []byte("package bench\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("fn%d_%d", f, i)
+			nodes = append(nodes, &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: path, LineStart: i*5 + 1, ColStart: 6, LineEnd: i*5 + 4})
+		}
+	}
+	resolver := &MockNodeResolver{nodes: nodes}
+	caller := Location{URI: util.PathToURI(nodes[0].FilePath), Range: Range{Start: Position{Line: 2}}}
+
+	client := newFakeClient(b, func(method string) interface{} {
+		if method == "textDocument/references" {
+			time.Sleep(time.Millisecond)
+			return []Location{caller}
+		}
+		return nil
+	})
+	svc := &Service{clients: map[string]*Client{"go": client}}
+
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 1},
+		{"pooled", budget.Limit()},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				stats := &EnrichmentStats{LanguageServers: map[string]bool{"go": true}}
+				if edges := svc.enrichNodes(context.Background(), nodes, resolver, bm.workers, stats); len(edges) == 0 {
+					b.Fatal("enrichment produced no edges")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package lsp
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// contentChange describes the edit from oldText to newText in the shape a
+// server with the given sync kind expects: the whole new text, or, for
+// incremental sync, the one range that differs between the two.
+func contentChange(oldText, newText string, kind TextDocumentSyncKind) TextDocumentContentChangeEvent {
+	if kind != TextDocumentSyncIncremental {
+		return TextDocumentContentChangeEvent{Text: newText}
+	}
+
+	// Trim the common prefix and suffix, never splitting a character or a
+	// \r\n line ending, and replace what lies between
+	prefix := 0
+	for prefix < len(oldText) && prefix < len(newText) && oldText[prefix] == newText[prefix] {
+		prefix++
+	}
+	for prefix > 0 && (!boundary(oldText, prefix) || !boundary(newText, prefix)) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(oldText)-prefix && suffix < len(newText)-prefix &&
+		oldText[len(oldText)-1-suffix] == newText[len(newText)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && (!boundary(oldText, len(oldText)-suffix) || !boundary(newText, len(newText)-suffix)) {
+		suffix--
+	}
+
+	replaced := oldText[prefix : len(oldText)-suffix]
+	return TextDocumentContentChangeEvent{
+		Range: &Range{
+			Start: offsetPosition(oldText, prefix),
+			End:   offsetPosition(oldText, len(oldText)-suffix),
+		},
+		RangeLength: utf16Len(replaced),
+		Text:        newText[prefix : len(newText)-suffix],
+	}
+}
+
+// boundary reports whether a byte offset into text may start or end a
+// range: it falls neither inside a UTF-8 sequence nor between \r and \n.
+func boundary(text string, offset int) bool {
+	if offset <= 0 || offset >= len(text) {
+		return true
+	}
+	return utf8.RuneStart(text[offset]) && !(text[offset-1] == '\r' && text[offset] == '\n')
+}
+
+// offsetPosition converts a byte offset into text to an LSP position, whose
+// character counts UTF-16 code units.
+func offsetPosition(text string, offset int) Position {
+	before := text[:offset]
+	line := strings.Count(before, "\n")
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return Position{Line: line, Character: utf16Len(before[lineStart:])}
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,189 @@
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestContentChange(t *testing.T) {
+	rng := func(sl, sc, el, ec int) *Range {
+		return &Range{Start: Position{Line: sl, Character: sc}, End: Position{Line: el, Character: ec}}
+	}
+	tests := []struct {
+		name     string
+		old, new string
+		kind     TextDocumentSyncKind
+		want     TextDocumentContentChangeEvent
+	}{
+		{"full sync", "a\nb\n", "a\nc\n", TextDocumentSyncFull, TextDocumentContentChangeEvent{Text: "a\nc\n"}},
+		{"no sync sends everything", "a\n", "b\n", TextDocumentSyncNone, TextDocumentContentChangeEvent{Text: "b\n"}},
+		{"replace on second line", "func a() {}\nfunc b() {}\n", "func a() {}\nfunc bc() {}\n", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(1, 6, 1, 6), Text: "c"}},
+		{"delete a line", "x\ny\nz\n", "x\nz\n", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(1, 0, 2, 0), RangeLength: 2}},
+		{"append", "x", "xy\n", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(0, 1, 0, 1), Text: "y\n"}},
+		{"utf-16 columns", "s := \"😀a\"", "s := \"😀b\"", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(0, 8, 0, 9), RangeLength: 1, Text: "b"}},
+		{"does not split a character", "é", "è", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(0, 0, 0, 1), RangeLength: 1, Text: "è"}},
+		{"does not split crlf", "a\r\nb", "a\nb", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(0, 1, 1, 0), RangeLength: 2, Text: "\n"}},
+		{"unchanged", "same", "same", TextDocumentSyncIncremental,
+			TextDocumentContentChangeEvent{Range: rng(0, 4, 0, 4)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentChange(tt.old, tt.new, tt.kind); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("contentChange = %+v (range %+v), want %+v (range %+v)", got, got.Range, tt.want, tt.want.Range)
+			}
+		})
+	}
+}
+
+func TestDidChangeFollowsSyncCapability(t *testing.T) {
+	tests := []struct {
+		name        string
+		caps        string
+		incremental bool
+	}{
+		{"incremental kind", `{"textDocumentSync": 2}`, true},
+		{"incremental options", `{"textDocumentSync": {"openClose": true, "change": 2}}`, true},
+		{"full options", `{"textDocumentSync": {"openClose": true, "change": 1}}`, false},
+		{"not advertised", `{}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			changes := make(chan DidChangeTextDocumentParams, 1)
+			go func() {
+				r := bufio.NewReader(serverConn)
+				for {
+					msg, err := ReadMessage(r)
+					if err != nil {
+						return
+					}
+					var n struct {
+						Method string                      `json:"method"`
+						Params DidChangeTextDocumentParams `json:"params"`
+					}
+					json.Unmarshal(msg, &n)
+					if n.Method == "textDocument/didChange" {
+						changes <- n.Params
+					}
+				}
+			}()
+
+			var caps ServerCapabilities
+			if err := json.Unmarshal([]byte(tt.caps), &caps); err != nil {
+				t.Fatal(err)
+			}
+			c := &Client{lang: "go", stdin: clientConn, openDocs: make(map[string]int), caps: &caps}
+
+			ctx := context.Background()
+			const uri = "file:///tmp/main.go"
+			if err := c.DidOpen(ctx, uri, "go", "package main\n\nfunc a() {}\n"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.DidChange(ctx, uri, "package main\n\nfunc ab() {}\n"); err != nil {
+				t.Fatal(err)
+			}
+
+			var got DidChangeTextDocumentParams
+			select {
+			case got = <-changes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no didChange notification")
+			}
+			if got.TextDocument.Version != 2 || len(got.ContentChanges) != 1 {
+				t.Fatalf("didChange = %+v, want version 2 and one change", got)
+			}
+			change := got.ContentChanges[0]
+			if tt.incremental {
+				want := Range{Start: Position{Line: 2, Character: 6}, End: Position{Line: 2, Character: 6}}
+				if change.Range == nil || *change.Range != want || change.Text != "b" {
+					t.Errorf("change = %+v (range %+v), want %q at %+v", change, change.Range, "b", want)
+				}
+			} else if change.Range != nil || change.Text != "package main\n\nfunc ab() {}\n" {
+				t.Errorf("change = %+v, want the whole text", change)
+			}
+		})
+	}
+}
+
+func TestDocumentsStayOpenUntilLastRelease(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	methods := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(serverConn)
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var n struct {
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &n)
+			methods <- n.Method
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case m := <-methods:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification")
+			return ""
+		}
+	}
+
+	c := &Client{lang: "go", stdin: clientConn, openDocs: make(map[string]int)}
+	ctx := context.Background()
+	const uri = "file:///tmp/main.go"
+
+	// Enrichment opens the document, then a query shares it with new text
+	if err := c.acquireDocument(ctx, uri, "go", "package main\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.acquireDocument(ctx, uri, "go", "package main\n\nfunc A() {}\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got != "textDocument/didOpen" {
+		t.Fatalf("first acquire sent %s, want didOpen", got)
+	}
+	if got := next(); got != "textDocument/didChange" {
+		t.Fatalf("second acquire sent %s, want didChange", got)
+	}
+
+	// The query finishing must not close the document enrichment still uses
+	c.releaseDocument(ctx, uri)
+	c.mu.Lock()
+	_, open := c.openDocs[uri]
+	c.mu.Unlock()
+	if !open {
+		t.Fatal("document closed while still in use")
+	}
+
+	c.releaseDocument(ctx, uri)
+	if got := next(); got != "textDocument/didClose" {
+		t.Fatalf("last release sent %s, want didClose", got)
+	}
+	select {
+	case m := <-methods:
+		t.Errorf("unexpected %s", m)
+	default:
+	}
+}
@@ -0,0 +1,70 @@
+package lsp
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// responseOrError is the outcome of a request: the raw result, or the error
+// the server answered with.
+type responseOrError struct {
+	data json.RawMessage
+	err  error
+}
+
+// requestTracker correlates responses with the requests awaiting them. IDs
+// come from an atomic counter, so concurrent callers never share one, and
+// each in-flight request has a channel the reader delivers its response on.
+// The zero value is ready to use.
+type requestTracker struct {
+	next    atomic.Int64
+	mu      sync.Mutex
+	pending map[int]chan responseOrError
+}
+
+// begin allocates an ID for a new request and returns it together with the
+// channel its response will arrive on. Callers must call done with the ID
+// once they stop waiting.
+func (t *requestTracker) begin() (int, <-chan responseOrError) {
+	id := int(t.next.Add(1))
+	ch := make(chan responseOrError, 1)
+	t.mu.Lock()
+	if t.pending == nil {
+		t.pending = make(map[int]chan responseOrError)
+	}
+	t.pending[id] = ch
+	t.mu.Unlock()
+	return id, ch
+}
+
+// done forgets the request id; a response arriving later is dropped.
+func (t *requestTracker) done(id int) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// failAll resolves every waiting request with err.
+func (t *requestTracker) failAll(err error) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	for _, ch := range pending {
+		ch <- responseOrError{err: err}
+	}
+}
+
+// resolve delivers res to the request id and reports whether one was
+// waiting. Each request receives at most one response.
+func (t *requestTracker) resolve(id int, res responseOrError) bool {
+	t.mu.Lock()
+	ch, ok := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+	if ok {
+		ch <- res
+	}
+	return ok
+}
@@ -2,17 +2,31 @@ package lsp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// ErrMalformedMessage is wrapped by ReadMessage errors for a message that
+// was read in full but cannot be used, such as one with a malformed header,
+// a charset other than utf-8 or a body that is not valid utf-8. The stream
+// is still in sync after one, so the next message can be read. ReadMessage
+// returns the body along with such an error, so the caller can still make
+// out which request it answers.
+var ErrMalformedMessage = errors.New("malformed LSP message")
+
 // ReadMessage reads an LSP message (header + body) from the reader.
 func ReadMessage(r *bufio.Reader) ([]byte, error) {
 	// 1. Read Headers
 	var contentLength int
+	var headerErr error
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil {
@@ -24,12 +38,26 @@ func ReadMessage(r *bufio.Reader) ([]byte, error) {
 			break
 		}
 
-		parts := strings.SplitN(line, ": ", 2)
-		if len(parts) == 2 && parts[0] == "Content-Length" {
-			contentLength, err = strconv.Atoi(parts[1])
+		// A bad header other than Content-Length does not stop us reading
+		// the body, which keeps the stream in sync for the next message
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			if headerErr == nil {
+				headerErr = fmt.Errorf("malformed header line %q", line)
+			}
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength, err = strconv.Atoi(value)
 			if err != nil {
 				return nil, fmt.Errorf("invalid Content-Length: %v", err)
 			}
+		case strings.EqualFold(name, "Content-Type"):
+			if err := checkContentType(value); err != nil && headerErr == nil {
+				headerErr = err
+			}
 		}
 	}
 
@@ -44,22 +72,104 @@ func ReadMessage(r *bufio.Reader) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read body: %v", err)
 	}
 
+	if headerErr != nil {
+		return body, fmt.Errorf("%w: %v", ErrMalformedMessage, headerErr)
+	}
+	if !utf8.Valid(body) {
+		return body, fmt.Errorf("%w: body is not valid utf-8", ErrMalformedMessage)
+	}
 	return body, nil
 }
 
-// WriteMessage writes an LSP message to the writer.
+// ReadMessageContext reads a message like ReadMessage, giving up with ctx's
+// error once ctx is done. src is the reader that r buffers; a blocked read
+// can only be interrupted if src supports read deadlines, as net.Conn and
+// *os.File pipes do. For any other src it behaves like ReadMessage and
+// blocks for as long as the server stalls.
+func ReadMessageContext(ctx context.Context, r *bufio.Reader, src io.Reader) ([]byte, error) {
+	dr, ok := src.(deadlineReader)
+	if !ok {
+		return ReadMessage(r)
+	}
+
+	// When ctx is done, a deadline in the past unblocks the read
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		dr.SetReadDeadline(time.Unix(1, 0))
+		close(fired)
+	})
+	defer func() {
+		if !stop() {
+			<-fired
+		}
+		dr.SetReadDeadline(time.Time{})
+	}()
+
+	msg, err := ReadMessage(r)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("reading LSP message: %w", ctx.Err())
+	}
+	return msg, err
+}
+
+// checkContentType validates a Content-Type header value. The only charset
+// the spec allows is utf-8, which is also the default; utf8 is accepted for
+// backwards compatibility.
+func checkContentType(value string) error {
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %q: %v", value, err)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+		return fmt.Errorf("unsupported charset %q in Content-Type, want utf-8", charset)
+	}
+	return nil
+}
+
+// WriteMessage writes an LSP message to the writer. The header and body are
+// written as a single buffer, retrying short writes until every byte is out.
 func WriteMessage(w io.Writer, msg interface{}) error {
 	body, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %v", err)
 	}
+	return writeFrame(w, body)
+}
 
+// writeFrame writes body with its Content-Length header.
+func writeFrame(w io.Writer, body []byte) error {
 	header := fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))
-	if _, err := w.Write([]byte(header)); err != nil {
-		return err
-	}
-	if _, err := w.Write(body); err != nil {
-		return err
+	buf := make([]byte, 0, len(header)+len(body))
+	buf = append(buf, header...)
+	buf = append(buf, body...)
+	return writeFull(w, buf)
+}
+
+// writeFull writes all of buf to w. Writers that report a short write without
+// an error are retried with the remainder; a write of zero bytes is an error
+// so a misbehaving writer cannot spin forever.
+func writeFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
 	}
 	return nil
 }
+
+// deadlineWriter is implemented by writers that support write deadlines,
+// such as net.Conn and *os.File pipes.
+type deadlineWriter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineReader is implemented by readers that support read deadlines,
+// such as net.Conn and *os.File pipes.
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
@@ -0,0 +1,230 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shortWriter accepts at most max bytes per Write and never reports an error.
+type shortWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriteMessageShortWrites(t *testing.T) {
+	w := &shortWriter{max: 7}
+	req := Request{JSONRPC: "2.0", ID: 1, Method: "textDocument/references", Params: map[string]string{"uri": "file:///tmp/main.go"}}
+
+	if err := WriteMessage(w, req); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	body, err := ReadMessage(bufio.NewReader(&w.buf))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	var got Request
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	if got.Method != req.Method || got.ID != req.ID {
+		t.Errorf("round trip = %+v, want %+v", got, req)
+	}
+}
+
+func TestReadMessageHeaders(t *testing.T) {
+	const body = `{"jsonrpc":"2.0","id":1,"result":null}`
+	tests := []struct {
+		name    string
+		headers string
+		body    string
+		wantErr bool
+	}{
+		{"content length only", "Content-Length: 38\r\n", body, false},
+		{"with content type", "Content-Length: 38\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n", body, false},
+		{"legacy utf8 charset", "Content-Type: application/vscode-jsonrpc; charset=utf8\r\nContent-Length: 38\r\n", body, false},
+		{"content type without charset", "Content-Length: 38\r\nContent-Type: application/vscode-jsonrpc\r\n", body, false},
+		{"lowercase names, no space", "content-length:38\r\ncontent-type:application/vscode-jsonrpc; charset=UTF-8\r\n", body, false},
+		{"other charset", "Content-Length: 38\r\nContent-Type: application/vscode-jsonrpc; charset=latin1\r\n", body, true},
+		{"invalid content type", "Content-Length: 38\r\nContent-Type: ;;\r\n", body, true},
+		{"malformed header", "Content-Length: 38\r\nX-Broken\r\n", body, true},
+		{"invalid utf-8 body", "Content-Length: 38\r\n", `{"jsonrpc":"2.0","id":1,"result":"` + "\xff\xfe" + `"}`, true},
+	}
+
+	// Every message is followed by a good one, which must still be readable
+	const next = `{"jsonrpc":"2.0","id":2,"result":null}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := tt.headers + "\r\n" + tt.body + "Content-Length: 38\r\n\r\n" + next
+			r := bufio.NewReader(strings.NewReader(stream))
+
+			got, err := ReadMessage(r)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformedMessage) || string(got) != tt.body {
+					t.Errorf("ReadMessage = %q, %v; want the body and ErrMalformedMessage", got, err)
+				}
+			} else if err != nil || string(got) != tt.body {
+				t.Errorf("ReadMessage = %q, %v; want %q", got, err, tt.body)
+			}
+
+			got, err = ReadMessage(r)
+			if err != nil || string(got) != next {
+				t.Errorf("next message = %q, %v; want %q", got, err, next)
+			}
+		})
+	}
+}
+
+func TestReadMessageContextStalledBody(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server announces a body it never finishes sending
+	go io.WriteString(serverConn, "Content-Length: 100\r\n\r\n{\"jsonrpc\":")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ReadMessageContext(ctx, bufio.NewReader(clientConn), clientConn)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("read error = %v, want a deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not honor its deadline")
+	}
+
+	// The deadline is cleared afterwards, so the connection stays usable
+	go io.WriteString(serverConn, "Content-Length: 2\r\n\r\n{}")
+	if msg, err := ReadMessage(bufio.NewReader(clientConn)); err != nil || string(msg) != "{}" {
+		t.Errorf("read after timeout = %q, %v; want {}", msg, err)
+	}
+}
+
+// zeroWriter reports success without consuming anything.
+type zeroWriter struct{}
+
+func (zeroWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestWriteMessageZeroWrite(t *testing.T) {
+	if err := WriteMessage(zeroWriter{}, Request{JSONRPC: "2.0", Method: "exit"}); err != io.ErrShortWrite {
+		t.Errorf("WriteMessage error = %v, want io.ErrShortWrite", err)
+	}
+}
+
+func TestClientWriteDeadline(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// Nobody reads r, so a message larger than the pipe buffer blocks
+	c := &Client{lang: "go", stdin: w}
+	msg := Request{JSONRPC: "2.0", Method: "textDocument/didOpen", Params: strings.Repeat("x", 1<<20)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- c.write(ctx, msg) }()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("write error = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write did not honor its deadline")
+	}
+}
+
+// brokenWriter accepts the first n bytes, then fails every write.
+type brokenWriter struct {
+	n      int
+	closed bool
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func (w *brokenWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestFailedWriteKillsClient(t *testing.T) {
+	// The first message breaks off part way through its body
+	w := &brokenWriter{n: 30}
+	c := &Client{lang: "go", stdin: w, openDocs: make(map[string]int), errChan: make(chan error, 1)}
+	s := &Service{clients: map[string]*Client{"go": c}}
+
+	// A request already waiting on a response fails with the client
+	waitID, waiting := c.calls.begin()
+	defer c.calls.done(waitID)
+
+	if err := c.Notify("textDocument/didOpen", map[string]string{"text": strings.Repeat("x", 100)}); err == nil {
+		t.Fatal("Notify succeeded on a broken stream")
+	}
+	select {
+	case res := <-waiting:
+		if res.err == nil {
+			t.Error("pending request resolved without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending request was not failed")
+	}
+	if !w.closed {
+		t.Error("stdin was not closed")
+	}
+
+	// Nothing more is written to the misframed stream
+	w.n = 1 << 20
+	if _, err := c.Call("shutdown", nil); err == nil {
+		t.Error("Call succeeded on a dead client")
+	}
+	if w.n != 1<<20 {
+		t.Error("dead client kept writing")
+	}
+	if c.running() {
+		t.Error("dead client still reports running")
+	}
+	if got := s.getClient("go"); got != nil {
+		t.Error("service still hands out the dead client")
+	}
+	if _, ok := s.clients["go"]; ok {
+		t.Error("dead client was not dropped, so it would never restart")
+	}
+}
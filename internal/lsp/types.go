@@ -1,5 +1,7 @@
 package lsp
 
+import "encoding/json"
+
 // JSON-RPC 2.0 Types
 
 type Request struct {
@@ -9,6 +11,14 @@ type Request struct {
 	Params  interface{} `json:"params,omitempty"`
 }
 
+// Notification is a message that expects no response; unlike a Request it
+// carries no ID.
+type Notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
 type Response struct {
 	JSONRPC string      `json:"jsonrpc"`
 	ID      int         `json:"id"`
@@ -30,17 +40,100 @@ type InitializeParams struct {
 	Capabilities ClientCapabilities `json:"capabilities"`
 }
 
+// ClientCapabilities advertises the features the client relies on. Servers
+// leave some results out or flatten them unless the client asks for them.
 type ClientCapabilities struct {
-	// Minimal for now
+	TextDocument TextDocumentClientCapabilities `json:"textDocument"`
+}
+
+type TextDocumentClientCapabilities struct {
+	DocumentSymbol DocumentSymbolClientCapabilities `json:"documentSymbol"`
+	Implementation ImplementationClientCapabilities `json:"implementation"`
+}
+
+type DocumentSymbolClientCapabilities struct {
+	// HierarchicalDocumentSymbolSupport asks for nested DocumentSymbols
+	// instead of a flat list of SymbolInformation.
+	HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport"`
+}
+
+type ImplementationClientCapabilities struct {
+	DynamicRegistration bool `json:"dynamicRegistration"`
+	// LinkSupport stays off: responses are parsed as Locations, not
+	// LocationLinks.
+	LinkSupport bool `json:"linkSupport"`
+}
+
+// clientCapabilities is what the client sends in the initialize request.
+var clientCapabilities = ClientCapabilities{
+	TextDocument: TextDocumentClientCapabilities{
+		DocumentSymbol: DocumentSymbolClientCapabilities{HierarchicalDocumentSymbolSupport: true},
+	},
 }
 
 type InitializeResult struct {
 	Capabilities ServerCapabilities `json:"capabilities"`
+	ServerInfo   *struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"serverInfo,omitempty"`
 }
 
+// ServerCapabilities are the features a server reported in its initialize
+// response.
 type ServerCapabilities struct {
-	ReferencesProvider bool `json:"referencesProvider,omitempty"`
-	// Add others as needed
+	DefinitionProvider     Provider         `json:"definitionProvider,omitempty"`
+	ReferencesProvider     Provider         `json:"referencesProvider,omitempty"`
+	ImplementationProvider Provider         `json:"implementationProvider,omitempty"`
+	HoverProvider          Provider         `json:"hoverProvider,omitempty"`
+	DocumentSymbolProvider Provider         `json:"documentSymbolProvider,omitempty"`
+	CallHierarchyProvider  Provider         `json:"callHierarchyProvider,omitempty"`
+	TextDocumentSync       TextDocumentSync `json:"textDocumentSync"`
+}
+
+// TextDocumentSyncKind is how a server wants document changes sent.
+type TextDocumentSyncKind int
+
+const (
+	TextDocumentSyncNone        TextDocumentSyncKind = 0
+	TextDocumentSyncFull        TextDocumentSyncKind = 1 // the whole text on every change
+	TextDocumentSyncIncremental TextDocumentSyncKind = 2 // only the edited ranges
+)
+
+// TextDocumentSync is the textDocumentSync capability, sent either as a
+// TextDocumentSyncKind or as an options object whose change field holds one.
+type TextDocumentSync struct {
+	Change TextDocumentSyncKind
+}
+
+func (s *TextDocumentSync) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Change); err == nil {
+		return nil
+	}
+	var opts struct {
+		Change TextDocumentSyncKind `json:"change"`
+	}
+	json.Unmarshal(data, &opts) // anything else leaves the default, no sync
+	s.Change = opts.Change
+	return nil
+}
+
+func (s TextDocumentSync) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Change)
+}
+
+// Provider is a server capability, sent either as a boolean or as an options
+// object. Any options object means the feature is supported.
+type Provider bool
+
+func (p *Provider) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*p = Provider(b)
+		return nil
+	}
+	*p = true // an options object
+	return nil
 }
 
 type ReferenceParams struct {
@@ -95,8 +188,13 @@ type VersionedTextDocumentIdentifier struct {
 	Version int    `json:"version"`
 }
 
+// TextDocumentContentChangeEvent replaces Range with Text, or the whole
+// document when Range is nil. RangeLength is the length of the replaced
+// text in UTF-16 code units; it is deprecated but some servers still read it.
 type TextDocumentContentChangeEvent struct {
-	Text string `json:"text"`
+	Range       *Range `json:"range,omitempty"`
+	RangeLength int    `json:"rangeLength,omitempty"`
+	Text        string `json:"text"`
 }
 
 type DidCloseTextDocumentParams struct {
@@ -151,22 +249,30 @@ type DocumentSymbol struct {
 
 // Symbol Kinds
 const (
-	SymbolKindFile        = 1
-	SymbolKindModule      = 2
-	SymbolKindNamespace   = 3
-	SymbolKindPackage     = 4
-	SymbolKindClass       = 5
-	SymbolKindMethod      = 6
-	SymbolKindProperty    = 7
-	SymbolKindField       = 8
-	SymbolKindConstructor = 9
-	SymbolKindEnum        = 10
-	SymbolKindInterface   = 11
-	SymbolKindFunction    = 12
-	SymbolKindVariable    = 13
-	SymbolKindConstant    = 14
-	SymbolKindString      = 15
-	SymbolKindNumber      = 16
-	SymbolKindBoolean     = 17
-	SymbolKindArray       = 18
+	SymbolKindFile          = 1
+	SymbolKindModule        = 2
+	SymbolKindNamespace     = 3
+	SymbolKindPackage       = 4
+	SymbolKindClass         = 5
+	SymbolKindMethod        = 6
+	SymbolKindProperty      = 7
+	SymbolKindField         = 8
+	SymbolKindConstructor   = 9
+	SymbolKindEnum          = 10
+	SymbolKindInterface     = 11
+	SymbolKindFunction      = 12
+	SymbolKindVariable      = 13
+	SymbolKindConstant      = 14
+	SymbolKindString        = 15
+	SymbolKindNumber        = 16
+	SymbolKindBoolean       = 17
+	SymbolKindArray         = 18
+	SymbolKindObject        = 19
+	SymbolKindKey           = 20
+	SymbolKindNull          = 21
+	SymbolKindEnumMember    = 22
+	SymbolKindStruct        = 23
+	SymbolKindEvent         = 24
+	SymbolKindOperator      = 25
+	SymbolKindTypeParameter = 26
 )
@@ -0,0 +1,78 @@
+// Package overlay holds the unsaved contents of files open in an editor, which
+// take the place of the files on disk until they are saved or closed.
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Overlay maps absolute file paths to buffer contents. It is safe for
+// concurrent use. A nil *Overlay reads as an empty one, but only one made by
+// New can be Set.
+type Overlay struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// New returns an empty overlay.
+func New() *Overlay {
+	return &Overlay{files: make(map[string][]byte)}
+}
+
+// Set records content as the current text of path. o must not be nil.
+func (o *Overlay) Set(path string, content []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.files[filepath.Clean(path)] = append([]byte(nil), content...)
+}
+
+// Clear drops the buffer for path, reporting whether there was one.
+func (o *Overlay) Clear(path string) bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	path = filepath.Clean(path)
+	_, ok := o.files[path]
+	delete(o.files, path)
+	return ok
+}
+
+// Get returns the buffer for path, if there is one.
+func (o *Overlay) Get(path string) ([]byte, bool) {
+	if o == nil {
+		return nil, false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	content, ok := o.files[filepath.Clean(path)]
+	return content, ok
+}
+
+// ReadFile returns the buffer for path, or the file's contents on disk when
+// there is none.
+func (o *Overlay) ReadFile(path string) ([]byte, error) {
+	if content, ok := o.Get(path); ok {
+		return content, nil
+	}
+	return os.ReadFile(path)
+}
+
+// Paths returns the paths with a buffer, sorted.
+func (o *Overlay) Paths() []string {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	paths := make([]string, 0, len(o.files))
+	for path := range o.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
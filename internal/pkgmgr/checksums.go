@@ -0,0 +1,101 @@
+package pkgmgr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxChecksumFileSize bounds a published checksum file. Release checksum
+// lists are a few kilobytes; anything larger is not one.
+const maxChecksumFileSize = 1 << 20
+
+// publishedChecksum fetches the checksum file metadata.ChecksumsURL points to
+// and returns the checksum it lists for downloadURL.
+func (i *Installer) publishedChecksum(ctx context.Context, metadata *LSPMetadata, downloadURL string) (string, error) {
+	fileName := downloadFileName(downloadURL)
+	checksumsURL := strings.ReplaceAll(metadata.ChecksumsURL, "{file}", fileName)
+
+	tmpFile, err := os.CreateTemp(i.manager.tmpDir, "codemap-checksums-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	dl := *i.downloader("")
+	dl.Progress = nil
+	if err := dl.ToFile(ctx, checksumsURL, tmpFile); err != nil {
+		return "", err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(tmpFile, maxChecksumFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxChecksumFileSize {
+		return "", fmt.Errorf("checksum file %s is larger than %d bytes", checksumsURL, maxChecksumFileSize)
+	}
+
+	checksum, ok := parseChecksumFile(data, fileName)
+	if !ok {
+		return "", fmt.Errorf("no checksum for %s in %s", fileName, checksumsURL)
+	}
+	return checksum, nil
+}
+
+// parseChecksumFile returns the checksum data lists for fileName. It reads
+// the "<hex>  <name>" lines of sha256sum output and goreleaser checksums.txt
+// files, including the "*<name>" binary-mode marker, as well as sidecar files
+// holding nothing but the checksum of the one file they describe.
+func parseChecksumFile(data []byte, fileName string) (string, bool) {
+	var lines [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || !isHex(fields[0]) {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+
+	for _, fields := range lines {
+		if len(fields) >= 2 && path.Base(strings.TrimPrefix(fields[1], "*")) == fileName {
+			return fields[0], true
+		}
+	}
+	// A sidecar names no file, or only the one it describes
+	if len(lines) == 1 && len(lines[0]) == 1 {
+		return lines[0][0], true
+	}
+	return "", false
+}
+
+// downloadFileName returns the last path element of downloadURL, which is how
+// checksum files name it.
+func downloadFileName(downloadURL string) string {
+	if u, err := url.Parse(downloadURL); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+	return path.Base(downloadURL)
+}
+
+// isHex reports whether s is a non-empty run of hex digits.
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,52 @@
+package pkgmgr
+
+import "errors"
+
+// Errors returned, wrapped with details, by installs and package management.
+// Test for them with errors.Is.
+var (
+	// ErrUnknownLanguage means no language server is configured for a language.
+	ErrUnknownLanguage = errors.New("no metadata for language")
+
+	// ErrPlatformUnsupported means a package has no download for this platform.
+	ErrPlatformUnsupported = errors.New("no download URL for platform")
+
+	// ErrChecksumMismatch means a download did not match its expected checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrChecksumUnavailable means checksums are required but none could be
+	// found for a download.
+	ErrChecksumUnavailable = errors.New("checksum unavailable")
+
+	// ErrBinaryNotInArchive means no archive entry matched the binary to install.
+	ErrBinaryNotInArchive = errors.New("binary not found in archive")
+
+	// ErrAmbiguousArchive means several archive entries matched equally well.
+	ErrAmbiguousArchive = errors.New("ambiguous archive")
+
+	// ErrUnsafeArchive means an archive entry would be written outside the
+	// install directory.
+	ErrUnsafeArchive = errors.New("archive entry escapes destination")
+
+	// ErrExtractLimit means an archive expanded beyond the extraction limits.
+	ErrExtractLimit = errors.New("extraction size limit exceeded")
+
+	// ErrBrokenBinary means an installed binary is missing, empty or not
+	// executable, so the install was abandoned.
+	ErrBrokenBinary = errors.New("installed binary failed verification")
+
+	// ErrOffline means a package had to be downloaded while CODEMAP_OFFLINE
+	// forbids network access.
+	ErrOffline = errors.New("offline mode")
+
+	// ErrRateLimited means a version lookup was refused because the API rate
+	// limit is used up.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrDistTagNotFound means an npm package has no dist-tag of the name a
+	// resolver follows.
+	ErrDistTagNotFound = errors.New("dist-tag not found")
+
+	// ErrNotInstalled means an operation needs a package that is not installed.
+	ErrNotInstalled = errors.New("package not installed")
+)
@@ -0,0 +1,29 @@
+package pkgmgr
+
+import (
+	"io"
+	"os"
+)
+
+// writeFS is the part of the filesystem that archive extraction writes to.
+// Installs use the real filesystem; tests substitute one that fails part way
+// through to check that partial extractions are cleaned up.
+type writeFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	Chmod(name string, mode os.FileMode) error
+	Remove(name string) error
+}
+
+// osFS is the writeFS backed by the os package.
+type osFS struct{}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
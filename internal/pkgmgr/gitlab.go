@@ -0,0 +1,128 @@
+package pkgmgr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"codemap/internal/download"
+)
+
+// GitLabReleaseResolver resolves versions from the releases of a project on
+// gitlab.com or a self-hosted GitLab instance.
+type GitLabReleaseResolver struct {
+	projectPath string // e.g. "group/subgroup/project"
+	baseURL     string // instance root, e.g. "https://gitlab.com"
+	token       string // API token; empty means GITLAB_TOKEN
+	httpClient  *http.Client
+}
+
+// NewGitLabResolver creates a resolver for the releases of projectPath on the
+// GitLab instance at host, such as "gitlab.com" or
+// "https://gitlab.example.com". A host without a scheme uses HTTPS.
+func NewGitLabResolver(host, projectPath string) *GitLabReleaseResolver {
+	host = strings.TrimRight(host, "/")
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return &GitLabReleaseResolver{
+		projectPath: strings.Trim(projectPath, "/"),
+		baseURL:     host,
+		httpClient: &http.Client{
+			Timeout:       resolverTimeout,
+			CheckRedirect: download.CheckRedirect,
+		},
+	}
+}
+
+// WithToken makes r authenticate to the GitLab API with token instead of
+// GITLAB_TOKEN, and returns r.
+func (r *GitLabReleaseResolver) WithToken(token string) *GitLabReleaseResolver {
+	r.token = token
+	return r
+}
+
+// ResolveLatestVersion fetches the tag of the project's newest release.
+func (r *GitLabReleaseResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
+	releases, err := r.listReleases(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(releases) == 0 {
+		return "", fmt.Errorf("GitLab project %s has no releases", r.projectPath)
+	}
+	return releases[0].TagName, nil
+}
+
+// ListVersions fetches the tags of the project's most recent releases.
+func (r *GitLabReleaseResolver) ListVersions(ctx context.Context) ([]string, error) {
+	releases, err := r.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(releases))
+	for _, rel := range releases {
+		versions = append(versions, rel.TagName)
+	}
+	return versions, nil
+}
+
+// gitLabRelease is the part of a GitLab release the resolver uses.
+type gitLabRelease struct {
+	TagName  string `json:"tag_name"`
+	Upcoming bool   `json:"upcoming_release"`
+}
+
+// listReleases fetches the project's most recent releases, newest first,
+// leaving out upcoming ones whose release date is still in the future.
+func (r *GitLabReleaseResolver) listReleases(ctx context.Context) ([]gitLabRelease, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	// The project is addressed by its path, URL-encoded as a single segment
+	endpoint := fmt.Sprintf("%s/api/v4/projects/%s/releases?order_by=released_at&sort=desc&per_page=100",
+		r.baseURL, url.PathEscape(r.projectPath))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token := r.token
+	if token == "" {
+		token = strings.TrimSpace(os.Getenv("GITLAB_TOKEN"))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch GitLab releases: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return nil, fmt.Errorf("GitLab API returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var releases []gitLabRelease
+
+	if err := decodeJSONBody(resp.Body, maxListResponseBytes, &releases); err != nil {
+		return nil, fmt.Errorf("failed to decode GitLab response: %w", err)
+	}
+
+	published := releases[:0]
+	for _, rel := range releases {
+		if !rel.Upcoming {
+			published = append(published, rel)
+		}
+	}
+	return published, nil
+}
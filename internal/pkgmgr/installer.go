@@ -3,41 +3,194 @@ package pkgmgr
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"codemap/internal/budget"
+	"codemap/internal/download"
 )
 
 // Installer handles downloading and installing packages.
 type Installer struct {
-	manager    *Manager
-	httpClient *http.Client
+	manager *Manager
+
+	// download fetches package archives. Nil means download.New().
+	download *download.Client
+
+	// keepDownloads preserves the downloaded archive in the tmp directory when
+	// extraction fails, so it can be inspected. Set via CODEMAP_KEEP_DOWNLOADS.
+	keepDownloads bool
+
+	// offline refuses every download, so an install succeeds only if the
+	// package is already present. Set via CODEMAP_OFFLINE.
+	offline bool
+
+	// VerifyChecksums refuses downloads that have no known or published
+	// checksum, instead of installing them unverified. NewInstaller sets it
+	// from CODEMAP_VERIFY_CHECKSUMS; callers may change it before installing.
+	VerifyChecksums bool
+
+	// fs receives extracted files. Nil means the real filesystem.
+	fs writeFS
+
+	// limits bounds how much an archive may expand to on disk. Zero fields
+	// mean the defaults. Set via CODEMAP_MAX_EXTRACT_MB and CODEMAP_MAX_ENTRY_MB.
+	limits extractLimits
+}
+
+// Default extraction limits. Language server archives are tens of megabytes
+// unpacked; these leave ample room while stopping decompression bombs.
+const (
+	defaultMaxExtractSize = 1 << 30
+	defaultMaxEntrySize   = 512 << 20
+)
+
+// extractLimits bounds the bytes written by one extraction.
+type extractLimits struct {
+	Total int64 // all files together
+	Entry int64 // any single file
+}
+
+// orDefault fills zero fields with the default limits.
+func (l extractLimits) orDefault() extractLimits {
+	if l.Total <= 0 {
+		l.Total = defaultMaxExtractSize
+	}
+	if l.Entry <= 0 {
+		l.Entry = defaultMaxEntrySize
+	}
+	return l
+}
+
+// limitsFromEnv reads extraction limits in megabytes from the environment,
+// ignoring values that are not positive integers.
+func limitsFromEnv() extractLimits {
+	mb := func(key string) int64 {
+		raw := os.Getenv(key)
+		if raw == "" {
+			return 0
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			log.Printf("Warning: ignoring invalid %s=%q", key, raw)
+			return 0
+		}
+		return n << 20
+	}
+	return extractLimits{Total: mb("CODEMAP_MAX_EXTRACT_MB"), Entry: mb("CODEMAP_MAX_ENTRY_MB")}
 }
 
 // NewInstaller creates a new installer instance.
 func NewInstaller(manager *Manager) *Installer {
+	keep, _ := strconv.ParseBool(os.Getenv("CODEMAP_KEEP_DOWNLOADS"))
+	verify, _ := strconv.ParseBool(os.Getenv("CODEMAP_VERIFY_CHECKSUMS"))
 	return &Installer{
-		manager: manager,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
+		manager:         manager,
+		download:        download.New(),
+		keepDownloads:   keep,
+		offline:         Offline(),
+		VerifyChecksums: verify,
+		fs:              osFS{},
+		limits:          limitsFromEnv(),
+	}
+}
+
+// filesystem returns the filesystem extraction writes to.
+func (i *Installer) filesystem() writeFS {
+	if i.fs == nil {
+		return osFS{}
+	}
+	return i.fs
+}
+
+// downloader returns a client for package downloads that logs the progress
+// of packageName.
+func (i *Installer) downloader(packageName string) *download.Client {
+	dl := download.New()
+	if i.download != nil {
+		copied := *i.download
+		dl = &copied
+	}
+	dl.Progress = logProgress(packageName)
+	return dl
+}
+
+// expectedChecksum returns the checksum a download for platform must match:
+// the one in metadata, or else the one published at metadata.ChecksumsURL.
+// A checksum file that cannot be fetched or does not list the download only
+// fails the install in strict mode; otherwise the download goes unverified.
+func (i *Installer) expectedChecksum(ctx context.Context, packageName string, metadata *LSPMetadata, platform, downloadURL string) (string, error) {
+	if checksum := metadata.Checksums[platform]; checksum != "" {
+		return checksum, nil
+	}
+	if metadata.ChecksumsURL != "" {
+		checksum, err := i.publishedChecksum(ctx, metadata, downloadURL)
+		if err == nil {
+			return checksum, nil
+		}
+		if i.VerifyChecksums || ctx.Err() != nil {
+			return "", fmt.Errorf("%w: %w", ErrChecksumUnavailable, err)
+		}
+		log.Printf("[%s] Warning: installing without checksum verification: %v", packageName, err)
+		return "", nil
+	}
+	if i.VerifyChecksums {
+		return "", fmt.Errorf("%w: none known or published for %s", ErrChecksumUnavailable, platform)
+	}
+	return "", nil
+}
+
+// Offline reports whether CODEMAP_OFFLINE forbids network access: no version
+// lookups, update checks or downloads. Only language servers already
+// installed or on the system PATH are used.
+func Offline() bool {
+	offline, _ := strconv.ParseBool(os.Getenv("CODEMAP_OFFLINE"))
+	return offline
+}
+
+// logProgress returns a download progress callback that logs each quarter of
+// a download of known size, starting over when a retry does.
+func logProgress(packageName string) download.ProgressFunc {
+	logged := 0
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		quarter := int(done * 4 / total)
+		if quarter < logged {
+			logged = quarter
+		}
+		if quarter > logged && quarter < 4 {
+			logged = quarter
+			log.Printf("[%s] Downloaded %d%% (%d of %d bytes)", packageName, quarter*25, done, total)
+		}
 	}
 }
 
 // Install downloads and installs a package.
 func (i *Installer) Install(ctx context.Context, packageName string, metadata *LSPMetadata) error {
-	// Check if already installed
-	if installed, version, _ := i.manager.IsInstalled(packageName); installed {
+	// Check if this version is already installed; another installed version
+	// is replaced by switching the current link below
+	if installed, version, _ := i.manager.IsInstalled(packageName); installed && version == metadata.Version {
 		log.Printf("[%s] Already installed (version %s)", packageName, version)
 		return nil
 	}
@@ -45,50 +198,101 @@ func (i *Installer) Install(ctx context.Context, packageName string, metadata *L
 	platform := GetPlatformKey()
 	downloadURL, ok := metadata.DownloadURLs[platform]
 	if !ok {
-		return fmt.Errorf("no download URL for platform: %s", platform)
+		return fmt.Errorf("%w: %s", ErrPlatformUnsupported, platform)
+	}
+
+	// Downloads share the concurrency budget with enrichment
+	if err := budget.Acquire(ctx); err != nil {
+		return err
+	}
+	defer budget.Release()
+
+	// Don't download a package that could not be launched anyway
+	if err := CheckRuntime(metadata); err != nil {
+		return err
+	}
+
+	if i.offline {
+		return fmt.Errorf("%w: %s %s is not installed and cannot be downloaded; put %s on PATH or stage it in %s",
+			ErrOffline, metadata.Name, metadata.Version, metadata.BinaryName, filepath.Join(i.manager.packagesDir, packageName, metadata.Version))
 	}
 
 	log.Printf("[%s] Installing version %s...", packageName, metadata.Version)
 
-	// Create version directory
-	versionDir := filepath.Join(i.manager.packagesDir, packageName, metadata.Version)
-	if err := os.MkdirAll(versionDir, 0755); err != nil {
-		return fmt.Errorf("failed to create version directory: %w", err)
+	checksum, err := i.expectedChecksum(ctx, packageName, metadata, platform, downloadURL)
+	if err != nil {
+		return err
+	}
+
+	// Unpack into a staging directory beside the version directory and only
+	// move it into place once verified, so a failed or cancelled install
+	// never touches a working one
+	pkgDir := filepath.Join(i.manager.packagesDir, packageName)
+	versionDir := filepath.Join(pkgDir, metadata.Version)
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		return fmt.Errorf("failed to create package directory: %w", err)
 	}
+	stageDir, err := os.MkdirTemp(pkgDir, ".staging-"+metadata.Version+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stageDir) // gone already once promoted
 
 	// Download to temporary file
 	tmpFile, err := os.CreateTemp(i.manager.tmpDir, fmt.Sprintf("codemap-%s-*", packageName))
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
+	keepArchive := false
+	defer func() {
+		tmpFile.Close()
+		if !keepArchive {
+			os.Remove(tmpFile.Name())
+		}
+	}()
 
-	if err := i.downloadFile(ctx, downloadURL, tmpFile); err != nil {
+	if err := i.downloader(packageName).ToFile(ctx, downloadURL, tmpFile); err != nil {
 		return fmt.Errorf("download failed: %w", err)
 	}
 
-	// Verify checksum if provided
-	if checksum := metadata.Checksums[platform]; checksum != "" {
-		if err := verifyChecksum(tmpFile.Name(), checksum); err != nil {
+	// Verify checksum if one is known
+	if checksum != "" {
+		if err := verifyChecksum(tmpFile.Name(), metadata.ChecksumAlgo, checksum); err != nil {
 			return fmt.Errorf("checksum verification failed: %w", err)
 		}
 	}
 
 	// Extract or copy binary
 	var binaryPath string
-	if metadata.IsArchive {
-		binaryPath, err = i.extractArchive(tmpFile.Name(), versionDir, metadata, platform)
+	if metadata.Runtime == RuntimeNode {
+		binaryPath, err = installNodePackage(ctx, i.filesystem(), i.limits.orDefault(), tmpFile.Name(), stageDir, metadata, platform)
+		if err != nil {
+			return fmt.Errorf("failed to install npm package: %w", err)
+		}
+	} else if metadata.Runtime == RuntimeJava {
+		binaryPath, err = installJavaPackage(ctx, i.filesystem(), i.limits.orDefault(), tmpFile.Name(), stageDir, metadata, platform)
+		if err != nil {
+			return fmt.Errorf("failed to install Java package: %w", err)
+		}
+	} else if metadata.ExtractAll {
+		binaryPath, err = i.extractAll(ctx, tmpFile.Name(), stageDir, metadata, platform)
+		if err != nil {
+			return fmt.Errorf("extraction failed: %w", err)
+		}
+	} else if metadata.IsArchive {
+		binaryPath, err = i.extractArchive(ctx, tmpFile.Name(), stageDir, metadata, platform)
 		if err != nil {
+			if i.keepDownloads {
+				keepArchive = true
+				kept := keepDownload(tmpFile, downloadURL)
+				log.Printf("[%s] Kept downloaded archive for inspection: %s", packageName, kept)
+				return fmt.Errorf("extraction failed (archive kept at %s): %w", kept, err)
+			}
 			return fmt.Errorf("extraction failed: %w", err)
 		}
 	} else {
 		// Direct binary download
-		binaryName := metadata.BinaryName
-		if runtime.GOOS == "windows" && filepath.Ext(binaryName) != ".exe" {
-			binaryName += ".exe"
-		}
-		binaryPath = filepath.Join(versionDir, binaryName)
+		binaryPath = filepath.Join(stageDir, executableName(metadata.BinaryName, runtime.GOOS))
 		if err := copyFile(tmpFile.Name(), binaryPath); err != nil {
 			return fmt.Errorf("failed to copy binary: %w", err)
 		}
@@ -97,33 +301,79 @@ func (i *Installer) Install(ctx context.Context, packageName string, metadata *L
 		}
 	}
 
+	rel, err := filepath.Rel(stageDir, binaryPath)
+	if err != nil {
+		return fmt.Errorf("failed to locate binary in staging directory: %w", err)
+	}
+
+	// Move the verified install into place. Reinstalling a version sets the
+	// old directory aside and puts it back if the install does not complete
+	backup, err := promoteStaged(stageDir, versionDir)
+	if err != nil {
+		return err
+	}
+	installed := false
+	defer func() {
+		if installed {
+			if backup != "" {
+				os.RemoveAll(backup)
+			}
+			return
+		}
+		os.RemoveAll(versionDir)
+		if backup != "" {
+			os.Rename(backup, versionDir)
+		}
+	}()
+
+	// The launcher names its entry script by absolute path, which moved
+	if metadata.Runtime == RuntimeNode {
+		entry := filepath.Join(versionDir, filepath.FromSlash(metadata.archivePathFor(platform)))
+		if _, err := writeNodeLauncher(versionDir, metadata.BinaryName, entry); err != nil {
+			return err
+		}
+	}
+
+	// Run the binary before it goes live, recording what it reports, which
+	// can differ from the package version
+	reported, err := smokeTestBinary(ctx, filepath.Join(versionDir, rel), metadata.VersionArgs)
+	if err != nil {
+		return err
+	}
+	if reported == "" {
+		log.Printf("[%s] Warning: the installed binary printed no version", packageName)
+	}
+
 	// Write package metadata
 	pkg := &Package{
-		Name:        packageName,
-		Version:     metadata.Version,
-		BinaryName:  metadata.BinaryName,
-		InstalledAt: time.Now().Format(time.RFC3339),
-		DownloadURL: downloadURL,
-		Checksum:    metadata.Checksums[platform],
+		Name:         packageName,
+		Version:      metadata.Version,
+		BinaryName:   metadata.BinaryName,
+		InstalledAt:  time.Now().Format(time.RFC3339),
+		DownloadURL:  downloadURL,
+		Checksum:     checksum,
+		ChecksumAlgo: checksumAlgo(metadata.ChecksumAlgo),
+
+		ReportedVersion: reported,
 	}
 	if err := i.manager.writePackageMetadata(packageName, metadata.Version, pkg); err != nil {
 		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
-	// Create 'current' symlink to this version
-	pkgDir := filepath.Join(i.manager.packagesDir, packageName)
-	currentLink := filepath.Join(pkgDir, "current")
-	_ = os.Remove(currentLink) // Remove existing
-	if err := os.Symlink(metadata.Version, currentLink); err != nil {
-		return fmt.Errorf("failed to create current version link: %w", err)
+	// Point 'current' at this version; from here on the install is live
+	if err := i.manager.activateVersion(packageName, metadata.Version); err != nil {
+		return err
 	}
+	installed = true
 
-	// Create binary symlink in bin directory
+	// Create binary symlink in bin directory, resolving through 'current' so
+	// later upgrades only need to swap that link
 	binPath, err := GetBinaryPath(metadata.BinaryName)
 	if err != nil {
 		return err
 	}
-	if err := createSymlink(binaryPath, binPath); err != nil {
+	currentBinary := filepath.Join(i.manager.packagesDir, packageName, "current", rel)
+	if err := createSymlink(currentBinary, binPath); err != nil {
 		return fmt.Errorf("failed to create binary symlink: %w", err)
 	}
 
@@ -131,69 +381,176 @@ func (i *Installer) Install(ctx context.Context, packageName string, metadata *L
 	return nil
 }
 
-// downloadFile downloads a file with retries.
-func (i *Installer) downloadFile(ctx context.Context, url string, dest *os.File) error {
-	const maxRetries = 3
-	var lastErr error
+// smokeTestBinary checks that an installed binary is a non-empty regular file
+// and, outside Windows, executable, then runs it with its version args, so a
+// truncated file, the wrong archive entry or a binary for another platform is
+// rejected before it goes live. It returns the version the binary reports, ""
+// if it printed none.
+func smokeTestBinary(ctx context.Context, path string, versionArgs []string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBrokenBinary, err)
+	}
+	switch {
+	case !info.Mode().IsRegular():
+		return "", fmt.Errorf("%w: %s is not a regular file", ErrBrokenBinary, path)
+	case info.Size() == 0:
+		return "", fmt.Errorf("%w: %s is empty", ErrBrokenBinary, path)
+	case runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0:
+		return "", fmt.Errorf("%w: %s is not executable", ErrBrokenBinary, path)
+	}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 1 {
-			backoff := time.Duration(attempt*attempt) * time.Second
-			log.Printf("Retry %d/%d after %v...", attempt, maxRetries, backoff)
-			select {
-			case <-time.After(backoff):
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+	version, err := reportedVersion(ctx, path, versionArgs)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBrokenBinary, err)
+	}
+	return version, nil
+}
 
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			lastErr = err
-			continue
-		}
+// reportedVersionTimeout bounds running a freshly installed binary to ask
+// its version.
+const reportedVersionTimeout = 5 * time.Second
 
-		resp, err := i.httpClient.Do(req)
-		if err != nil {
-			lastErr = err
-			continue
-		}
+// reportedVersionPattern finds a dotted version in a binary's version output,
+// such as "golang.org/x/tools/gopls v0.21.1" or "4.3.3".
+var reportedVersionPattern = regexp.MustCompile(`v?[0-9]+\.[0-9]+(\.[0-9]+)*([-+][0-9A-Za-z.+-]+)?`)
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			lastErr = fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
-			continue
-		}
+// reportedVersion runs the binary at path with args (--version if empty)
+// and returns the first version in its output, or "" if there is none. Stdin
+// is empty, so a server that ignores the arguments and starts up exits at
+// once. Exiting with a failure is not an error, since not every server knows
+// a version flag; failing to start or to exit within reportedVersionTimeout
+// is.
+func reportedVersion(ctx context.Context, path string, args []string) (string, error) {
+	if len(args) == 0 {
+		args = []string{"--version"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportedVersionTimeout)
+	defer cancel()
 
-		// Reset file position
-		if _, err := dest.Seek(0, 0); err != nil {
-			resp.Body.Close()
-			return err
-		}
+	cmd := exec.CommandContext(ctx, path, args...)
+	// A child that inherited the output pipe must not keep Wait blocked
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "", fmt.Errorf("%s %s did not exit within %s", filepath.Base(path), strings.Join(args, " "), reportedVersionTimeout)
+	case ctx.Err() != nil:
+		return "", ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && !errors.Is(err, exec.ErrWaitDelay) {
+		return "", fmt.Errorf("%s %s: %w", filepath.Base(path), strings.Join(args, " "), err)
+	}
+	return reportedVersionPattern.FindString(string(out)), nil
+}
 
-		_, err = io.Copy(dest, resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			lastErr = err
-			continue
+// promoteStaged renames stageDir to versionDir. An existing versionDir is
+// renamed aside first and its new path returned, for the caller to remove
+// once the install is live or to restore if it fails; on error here it has
+// already been restored.
+func promoteStaged(stageDir, versionDir string) (string, error) {
+	var backup string
+	if _, err := os.Stat(versionDir); err == nil {
+		backup = fmt.Sprintf("%s.old-%d", versionDir, time.Now().UnixNano())
+		if err := os.Rename(versionDir, backup); err != nil {
+			return "", fmt.Errorf("failed to set aside version directory: %w", err)
 		}
-
-		return nil
 	}
+	if err := os.Rename(stageDir, versionDir); err != nil {
+		if backup != "" {
+			os.Rename(backup, versionDir)
+		}
+		return "", fmt.Errorf("failed to move install into place: %w", err)
+	}
+	return backup, nil
+}
 
-	return fmt.Errorf("download failed after %d attempts: %w", maxRetries, lastErr)
+// keepDownload renames a downloaded temp file so it carries the archive
+// extension from url, making it easy to open. It returns the final path.
+func keepDownload(f *os.File, url string) string {
+	f.Close()
+	var ext string
+	switch {
+	case strings.HasSuffix(url, ".tar.gz"), strings.HasSuffix(url, ".tgz"):
+		ext = ".tar.gz"
+	case strings.HasSuffix(url, ".zip"):
+		ext = ".zip"
+	case strings.HasSuffix(url, ".gz"):
+		ext = ".gz"
+	default:
+		return f.Name()
+	}
+	kept := f.Name() + ext
+	if err := os.Rename(f.Name(), kept); err != nil {
+		return f.Name()
+	}
+	return kept
 }
 
 // extractArchive extracts an archive and returns the path to the binary.
-func (i *Installer) extractArchive(archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
-	if strings.HasSuffix(archivePath, ".zip") {
-		return i.extractZip(archivePath, destDir, metadata)
+// It stops with ctx.Err() if ctx is cancelled part way through.
+func (i *Installer) extractArchive(ctx context.Context, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	if strings.HasSuffix(archivePath, ".zip") || isZip(archivePath) {
+		return i.extractZip(ctx, archivePath, destDir, metadata, platform)
+	}
+	isTar, err := gzipHoldsTar(archivePath)
+	if err != nil {
+		return "", err
+	}
+	if !isTar {
+		return i.extractGzip(ctx, archivePath, destDir, metadata, platform)
+	}
+	return i.extractTarGz(ctx, archivePath, destDir, metadata, platform)
+}
+
+// isZip reports whether the file at path starts with a zip local file header.
+func isZip(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
 	}
-	return i.extractTarGz(archivePath, destDir, metadata)
+	return bytes.Equal(magic, []byte("PK\x03\x04"))
 }
 
-// extractTarGz extracts a .tar.gz archive.
-func (i *Installer) extractTarGz(archivePath, destDir string, metadata *LSPMetadata) (string, error) {
+// gzipHoldsTar reports whether the gzip file at path decompresses to a tar
+// archive rather than a bare file, judged by whether its first block is a
+// valid tar header. Downloads are saved without their extension, so the
+// content is all there is to go on.
+func gzipHoldsTar(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return false, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+
+	block := make([]byte, 512)
+	if _, err := io.ReadFull(gzr, block); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil // too short to be a tar archive
+		}
+		return false, fmt.Errorf("gzip read error: %w", err)
+	}
+	_, err = tar.NewReader(bytes.NewReader(block)).Next()
+	return err == nil, nil
+}
+
+// extractGzip decompresses a download that is a single gzipped binary, as
+// rust-analyzer publishes, rather than an archive.
+func (i *Installer) extractGzip(ctx context.Context, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	goos, _, _ := strings.Cut(platform, "-")
+
 	file, err := os.Open(archivePath)
 	if err != nil {
 		return "", err
@@ -206,10 +563,45 @@ func (i *Installer) extractTarGz(archivePath, destDir string, metadata *LSPMetad
 	}
 	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	binaryPath := filepath.Join(destDir, executableName(metadata.BinaryName, goos))
+	if err := extractFile(ctx, i.filesystem(), gzr, binaryPath, 0755, i.maxBinarySize()); err != nil {
+		return "", err
+	}
+	return binaryPath, nil
+}
+
+// extractTarGz extracts the binary from a .tar.gz archive built for platform.
+func (i *Installer) extractTarGz(ctx context.Context, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	goos, _, _ := strings.Cut(platform, "-")
+
+	// A tar stream cannot be rewound, so entries are listed in a first pass
+	// and the chosen one extracted in a second
+	entries, err := listTarFiles(ctx, archivePath)
+	if err != nil {
+		return "", err
+	}
+	targetPath, err := chooseArchiveEntry(entries, metadata, platform)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
 
-	targetPath := metadata.ArchivePath
+	tr := tar.NewReader(gzr)
 	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -218,73 +610,356 @@ func (i *Installer) extractTarGz(archivePath, destDir string, metadata *LSPMetad
 			return "", fmt.Errorf("tar read error: %w", err)
 		}
 
-		if strings.HasSuffix(header.Name, targetPath) || header.Name == targetPath {
-			binaryName := metadata.BinaryName
-			if runtime.GOOS == "windows" && filepath.Ext(binaryName) != ".exe" {
-				binaryName += ".exe"
-			}
-			binaryPath := filepath.Join(destDir, binaryName)
-			if err := extractFile(tr, binaryPath, header.FileInfo().Mode()); err != nil {
+		if header.Typeflag == tar.TypeReg && header.Name == targetPath {
+			binaryPath := filepath.Join(destDir, executableName(metadata.BinaryName, goos))
+			if err := extractFile(ctx, i.filesystem(), tr, binaryPath, header.FileInfo().Mode(), i.maxBinarySize()); err != nil {
 				return "", err
 			}
 			return binaryPath, nil
 		}
 	}
 
-	return "", fmt.Errorf("binary not found in archive: %s", targetPath)
+	return "", fmt.Errorf("%w: %s", ErrBinaryNotInArchive, targetPath)
 }
 
-// extractZip extracts a .zip archive.
-func (i *Installer) extractZip(archivePath, destDir string, metadata *LSPMetadata) (string, error) {
+// extractZip extracts the binary from a .zip archive built for platform.
+func (i *Installer) extractZip(ctx context.Context, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	goos, _, _ := strings.Cut(platform, "-")
 	r, err := zip.OpenReader(archivePath)
 	if err != nil {
 		return "", err
 	}
 	defer r.Close()
 
-	targetPath := metadata.ArchivePath
+	var entries []archiveEntry
+	for _, f := range r.File {
+		if f.Mode().IsRegular() {
+			entries = append(entries, archiveEntry{Name: f.Name, Mode: f.Mode()})
+		}
+	}
+	targetPath, err := chooseArchiveEntry(entries, metadata, platform)
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if f.Name != targetPath || !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		binaryPath := filepath.Join(destDir, executableName(metadata.BinaryName, goos))
+		if err := extractFile(ctx, i.filesystem(), rc, binaryPath, f.Mode(), i.maxBinarySize()); err != nil {
+			return "", err
+		}
+		return binaryPath, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrBinaryNotInArchive, targetPath)
+}
+
+// extractAll unpacks a whole .zip or .tar.gz archive into destDir and returns
+// the path of the binary built for platform among the unpacked files.
+func (i *Installer) extractAll(ctx context.Context, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	var entries []archiveEntry
+	if strings.HasSuffix(archivePath, ".zip") || isZip(archivePath) {
+		if err := extractZipAll(ctx, i.filesystem(), i.limits.orDefault(), archivePath, destDir); err != nil {
+			return "", err
+		}
+		r, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Mode().IsRegular() {
+				entries = append(entries, archiveEntry{Name: f.Name, Mode: f.Mode()})
+			}
+		}
+	} else {
+		if err := extractTarGzAll(ctx, i.filesystem(), i.limits.orDefault(), archivePath, destDir); err != nil {
+			return "", err
+		}
+		var err error
+		if entries, err = listTarFiles(ctx, archivePath); err != nil {
+			return "", err
+		}
+	}
+
+	name, err := chooseArchiveEntry(entries, metadata, platform)
+	if err != nil {
+		return "", err
+	}
+	binaryPath := filepath.Join(destDir, filepath.FromSlash(name))
+	// Archives built on Windows carry no execute bits
+	if err := i.filesystem().Chmod(binaryPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to make binary executable: %w", err)
+	}
+	return binaryPath, nil
+}
+
+// extractZipAll unpacks every file of a .zip archive into destDir, within
+// limits. Files written before an error are removed again.
+func extractZipAll(ctx context.Context, fsys writeFS, limits extractLimits, archivePath, destDir string) (err error) {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	root := filepath.Clean(destDir) + string(os.PathSeparator)
+	var written []string
+	var total int64
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				fsys.Remove(path)
+			}
+		}
+	}()
 	for _, f := range r.File {
-		if strings.HasSuffix(f.Name, targetPath) || f.Name == targetPath {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(target, root) {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchive, f.Name)
+		}
+
+		switch {
+		case f.Mode().IsDir():
+			if err := fsys.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+		case f.Mode().IsRegular():
+			size := int64(f.UncompressedSize64)
+			if f.UncompressedSize64 > uint64(limits.Entry) || size > limits.Total-total {
+				return fmt.Errorf("failed to extract %s: %w: entry of %d bytes", target, ErrExtractLimit, f.UncompressedSize64)
+			}
+			if err := fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
 			rc, err := f.Open()
 			if err != nil {
-				return "", err
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+			out, err := fsys.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+			if err != nil {
+				rc.Close()
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+			written = append(written, target)
+			// The header's size is not trusted; the copy enforces the limits
+			n, err := copyLimited(out, ctxReader{ctx: ctx, r: rc}, min(limits.Entry, limits.Total-total))
+			total += n
+			rc.Close()
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
 			}
-			defer rc.Close()
+		}
+	}
+	return nil
+}
+
+// archiveEntry is a regular file in an archive.
+type archiveEntry struct {
+	Name string
+	Mode os.FileMode
+}
 
-			binaryName := metadata.BinaryName
-			if runtime.GOOS == "windows" && filepath.Ext(binaryName) != ".exe" {
-				binaryName += ".exe"
+// chooseArchiveEntry picks the entry holding the binary: the only executable
+// with ExtractSingleBinary, otherwise the best match for platform's archive path.
+func chooseArchiveEntry(entries []archiveEntry, metadata *LSPMetadata, platform string) (string, error) {
+	if metadata.ExtractSingleBinary {
+		var candidates []string
+		for _, e := range entries {
+			if isExecutableEntry(e.Name, e.Mode) {
+				candidates = append(candidates, e.Name)
 			}
-			binaryPath := filepath.Join(destDir, binaryName)
-			if err := extractFile(rc, binaryPath, f.Mode()); err != nil {
-				return "", err
+		}
+		return onlyBinary(candidates)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	goos, _, _ := strings.Cut(platform, "-")
+	return pickArchivePath(names, metadata.archivePathFor(platform), goos)
+}
+
+// pickArchivePath chooses among the entry names matching archivePath,
+// independent of archive order: an exact match wins over suffix matches, and
+// among suffix matches the shortest path wins. Several exact matches, or
+// several shortest suffix matches, are ambiguous and an error.
+func pickArchivePath(names []string, archivePath, goos string) (string, error) {
+	var exact, suffix []string
+	for _, name := range names {
+		switch {
+		case name == archivePath || (goos == "windows" && trimExe(name) == trimExe(archivePath)):
+			exact = append(exact, name)
+		case matchesArchivePath(name, archivePath, goos):
+			suffix = append(suffix, name)
+		}
+	}
+
+	best := exact
+	if len(best) == 0 {
+		for _, name := range suffix {
+			switch {
+			case len(best) == 0 || len(name) < len(best[0]):
+				best = []string{name}
+			case len(name) == len(best[0]):
+				best = append(best, name)
 			}
-			return binaryPath, nil
 		}
 	}
 
-	return "", fmt.Errorf("binary not found in archive: %s", targetPath)
+	switch len(best) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrBinaryNotInArchive, archivePath)
+	case 1:
+		return best[0], nil
+	default:
+		sort.Strings(best)
+		return "", fmt.Errorf("%w: %d entries match %s (%s); set ArchivePath to the full entry path",
+			ErrAmbiguousArchive, len(best), archivePath, strings.Join(best, ", "))
+	}
 }
 
-// extractFile extracts a single file from a reader.
-func extractFile(r io.Reader, destPath string, mode os.FileMode) error {
-	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-		return err
+// maxBinarySize is the most a single extracted binary may take up: the
+// smaller of the entry and total limits.
+func (i *Installer) maxBinarySize() int64 {
+	l := i.limits.orDefault()
+	return min(l.Entry, l.Total)
+}
+
+// executableName returns binaryName as it is installed on goos: with exactly
+// one .exe suffix on Windows, whether or not binaryName already has one.
+func executableName(binaryName, goos string) string {
+	if goos == "windows" && !strings.EqualFold(filepath.Ext(binaryName), ".exe") {
+		return binaryName + ".exe"
+	}
+	return binaryName
+}
+
+// matchesArchivePath reports whether the archive entry name is the file
+// archivePath describes, by suffix. Windows archives may add or omit the .exe
+// suffix relative to archivePath, so on Windows both spellings match.
+func matchesArchivePath(name, archivePath, goos string) bool {
+	if name == archivePath || strings.HasSuffix(name, archivePath) {
+		return true
+	}
+	if goos != "windows" {
+		return false
+	}
+	name, archivePath = trimExe(name), trimExe(archivePath)
+	return name == archivePath || strings.HasSuffix(name, archivePath)
+}
+
+// trimExe removes a trailing .exe, in any case, from s.
+func trimExe(s string) string {
+	if strings.EqualFold(filepath.Ext(s), ".exe") {
+		return s[:len(s)-len(".exe")]
+	}
+	return s
+}
+
+// listTarFiles returns the regular files in a .tar.gz archive.
+func listTarFiles(ctx context.Context, archivePath string) ([]archiveEntry, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	gzr, err := gzip.NewReader(file)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 	}
-	defer out.Close()
+	defer gzr.Close()
 
-	if _, err := io.Copy(out, r); err != nil {
+	var entries []archiveEntry
+	tr := tar.NewReader(gzr)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar read error: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			entries = append(entries, archiveEntry{Name: header.Name, Mode: header.FileInfo().Mode()})
+		}
+	}
+	return entries, nil
+}
+
+// isExecutableEntry reports whether an archive entry looks like a program:
+// it has an execute bit, or, for archives built on Windows, an .exe name.
+func isExecutableEntry(name string, mode os.FileMode) bool {
+	return mode&0111 != 0 || strings.EqualFold(filepath.Ext(name), ".exe")
+}
+
+// onlyBinary returns the single candidate, or an error naming how many were
+// found so a misconfigured ExtractSingleBinary is easy to diagnose.
+func onlyBinary(candidates []string) (string, error) {
+	switch len(candidates) {
+	case 1:
+		return candidates[0], nil
+	case 0:
+		return "", fmt.Errorf("%w: no executable entry", ErrBinaryNotInArchive)
+	default:
+		return "", fmt.Errorf("%w: %d executables (%s); expected exactly one",
+			ErrAmbiguousArchive, len(candidates), strings.Join(candidates, ", "))
+	}
+}
+
+// extractFile extracts a single file from a reader into fsys, writing at most
+// maxSize bytes. A write interrupted by an error, by exceeding maxSize or by
+// cancellation of ctx removes the partially written file. Errors name
+// destPath.
+func extractFile(ctx context.Context, fsys writeFS, r io.Reader, destPath string, mode os.FileMode, maxSize int64) (err error) {
+	if err := fsys.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", destPath, err)
+	}
+
+	out, err := fsys.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", destPath, err)
+	}
+	defer func() {
+		if err != nil {
+			fsys.Remove(destPath)
+			err = fmt.Errorf("failed to extract %s: %w", destPath, err)
+		}
+	}()
+
+	if _, err := copyLimited(out, ctxReader{ctx: ctx, r: r}, maxSize); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
 		return err
 	}
 
 	// Ensure executable
 	if runtime.GOOS != "windows" {
-		if err := os.Chmod(destPath, 0755); err != nil {
+		if err := fsys.Chmod(destPath, 0755); err != nil {
 			return err
 		}
 	}
@@ -292,22 +967,87 @@ func extractFile(r io.Reader, destPath string, mode os.FileMode) error {
 	return nil
 }
 
-// verifyChecksum verifies the SHA256 checksum of a file.
-func verifyChecksum(filePath, expectedChecksum string) error {
+// copyLimited copies src to dst, failing with ErrExtractLimit once more than
+// limit bytes would be written. At most limit bytes reach dst.
+func copyLimited(dst io.Writer, src io.Reader, limit int64) (int64, error) {
+	n, err := io.Copy(dst, io.LimitReader(src, limit))
+	if err != nil {
+		return n, err
+	}
+	if n == limit {
+		// Probe for a byte past the limit
+		var probe [1]byte
+		if m, _ := io.ReadFull(src, probe[:]); m > 0 {
+			return n, fmt.Errorf("%w: more than %d bytes", ErrExtractLimit, limit)
+		}
+	}
+	return n, nil
+}
+
+// ctxReader fails reads once ctx is done, so copying a single large archive
+// entry still stops promptly on cancellation.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Checksum algorithms for LSPMetadata.ChecksumAlgo.
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+	ChecksumSHA1   = "sha1"
+)
+
+// checksumAlgo returns algo lower-cased, or ChecksumSHA256 if it is empty.
+func checksumAlgo(algo string) string {
+	if algo == "" {
+		return ChecksumSHA256
+	}
+	return strings.ToLower(algo)
+}
+
+// newChecksumHash returns the hash for a checksum algorithm.
+func newChecksumHash(algo string) (hash.Hash, error) {
+	switch checksumAlgo(algo) {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+}
+
+// verifyChecksum verifies the checksum of a file, hex-encoded in either case,
+// computed with algo (SHA256 if empty).
+func verifyChecksum(filePath, algo, expectedChecksum string) error {
+	h, err := newChecksumHash(algo)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return err
 	}
 
 	actualChecksum := hex.EncodeToString(h.Sum(nil))
-	if actualChecksum != expectedChecksum {
-		return fmt.Errorf("checksum mismatch: expected %s, got %s", expectedChecksum, actualChecksum)
+	if !strings.EqualFold(actualChecksum, strings.TrimSpace(expectedChecksum)) {
+		return fmt.Errorf("%w: expected %s %s, got %s", ErrChecksumMismatch, checksumAlgo(algo), expectedChecksum, actualChecksum)
 	}
 
 	return nil
@@ -336,9 +1076,12 @@ func copyFile(src, dst string) error {
 
 // GetPlatformKey returns the platform key for the current system.
 func GetPlatformKey() string {
-	os := runtime.GOOS
-	arch := runtime.GOARCH
+	return platformKey(runtime.GOOS, runtime.GOARCH)
+}
 
+// platformKey returns the key DownloadURLs, Checksums and ArchivePaths use
+// for goos and goarch, such as "linux-x86_64" or "darwin-arm64".
+func platformKey(os, arch string) string {
 	// Normalize arch names
 	switch arch {
 	case "amd64":
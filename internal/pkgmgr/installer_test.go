@@ -0,0 +1,1070 @@
+package pkgmgr
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInstallKeepsArchiveOnExtractionFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a gzip archive"))
+	}))
+	defer srv.Close()
+
+	for _, keep := range []bool{false, true} {
+		t.Setenv("CODEMAP_HOME", t.TempDir())
+		if keep {
+			t.Setenv("CODEMAP_KEEP_DOWNLOADS", "1")
+		} else {
+			t.Setenv("CODEMAP_KEEP_DOWNLOADS", "")
+		}
+
+		mgr, err := NewManager()
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		metadata := &LSPMetadata{
+			Name:         "fake-ls",
+			Version:      "1.0.0",
+			BinaryName:   "fake-ls",
+			DownloadURLs: map[string]string{GetPlatformKey(): srv.URL + "/fake-ls.tar.gz"},
+			IsArchive:    true,
+		}
+
+		installErr := NewInstaller(mgr).Install(context.Background(), "fake-ls", metadata)
+		if installErr == nil {
+			t.Fatalf("keep=%v: expected extraction to fail", keep)
+		}
+
+		entries, err := os.ReadDir(mgr.tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keep {
+			if len(entries) != 0 {
+				t.Errorf("keep=false: tmp dir should be empty, found %d entries", len(entries))
+			}
+			continue
+		}
+		if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".tar.gz") {
+			t.Fatalf("keep=true: expected one kept .tar.gz archive, found %v", entries)
+		}
+		if !strings.Contains(installErr.Error(), entries[0].Name()) {
+			t.Errorf("keep=true: error %q should mention the kept archive", installErr)
+		}
+	}
+}
+
+func TestExtractSingleBinary(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		mode int64
+	}{
+		{"dist/README.md", 0644},
+		{"dist/fake-ls-1.2.3-x86_64-linux", 0755},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: f.mode, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "fake-ls.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inst := &Installer{}
+	meta := &LSPMetadata{BinaryName: "fake-ls", ArchivePath: "fake-ls", ExtractSingleBinary: true}
+	got, err := inst.extractArchive(context.Background(), archive, dir, meta, GetPlatformKey())
+	if err != nil {
+		t.Fatalf("extractArchive failed: %v", err)
+	}
+	if filepath.Base(got) != "fake-ls" && filepath.Base(got) != "fake-ls.exe" {
+		t.Errorf("binary extracted to %s, want it named after BinaryName", got)
+	}
+
+	// Without the flag, the suffix match on ArchivePath finds nothing
+	meta.ExtractSingleBinary = false
+	if _, err := inst.extractArchive(context.Background(), archive, t.TempDir(), meta, GetPlatformKey()); !errors.Is(err, ErrBinaryNotInArchive) {
+		t.Error("expected ArchivePath matching to fail for an unpredictable name")
+	}
+}
+
+func TestExtractGzippedBinary(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("binary"))
+	gz.Close()
+
+	// Downloads are saved without an extension, so the content decides
+	dir := t.TempDir()
+	download := filepath.Join(dir, "codemap-rust-analyzer-123")
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inst := &Installer{}
+	meta := &LSPMetadata{BinaryName: "rust-analyzer", IsArchive: true}
+	got, err := inst.extractArchive(context.Background(), download, filepath.Join(dir, "out"), meta, GetPlatformKey())
+	if err != nil {
+		t.Fatalf("extractArchive failed: %v", err)
+	}
+	if name := strings.TrimSuffix(filepath.Base(got), ".exe"); name != "rust-analyzer" {
+		t.Errorf("binary extracted to %s, want it named after BinaryName", got)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil || string(data) != "binary" {
+		t.Errorf("extracted %q (%v), want the decompressed binary", data, err)
+	}
+	if info, err := os.Stat(got); err == nil && runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		t.Errorf("extracted binary mode %v, want it executable", info.Mode())
+	}
+}
+
+func TestExtractTarGzWithoutExtension(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "bin/fake-ls", Mode: 0755, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("data"))
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	download := filepath.Join(dir, "codemap-fake-ls-123")
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inst := &Installer{}
+	meta := &LSPMetadata{BinaryName: "fake-ls", ArchivePath: "bin/fake-ls", IsArchive: true}
+	got, err := inst.extractArchive(context.Background(), download, filepath.Join(dir, "out"), meta, GetPlatformKey())
+	if err != nil {
+		t.Fatalf("extractArchive failed: %v", err)
+	}
+	if data, err := os.ReadFile(got); err != nil || string(data) != "data" {
+		t.Errorf("extracted %q (%v), want the archive entry rather than the raw tar stream", data, err)
+	}
+}
+
+func TestExtractZipWithoutExtension(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"clangd_19.1.2/lib/clang/19/include/stddef.h", "clangd_19.1.2/bin/clangd"} {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name})
+		w.Write([]byte("data"))
+	}
+	zw.Close()
+
+	dir := t.TempDir()
+	download := filepath.Join(dir, "codemap-cpp-123")
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &LSPMetadata{BinaryName: "clangd", ArchivePath: "bin/clangd", IsArchive: true}
+	got, err := (&Installer{}).extractArchive(context.Background(), download, filepath.Join(dir, "out"), meta, "linux-amd64")
+	if err != nil {
+		t.Fatalf("extractArchive failed: %v", err)
+	}
+	if filepath.Base(got) != "clangd" {
+		t.Errorf("binary extracted to %s, want it named after BinaryName", got)
+	}
+}
+
+func TestExtractAllKeepsFilesBesideBinary(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"clangd_19.1.2/lib/clang/19/include/stddef.h", "clangd_19.1.2/bin/clangd"} {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name})
+		w.Write([]byte("data"))
+	}
+	zw.Close()
+
+	dir := t.TempDir()
+	download := filepath.Join(dir, "codemap-cpp-123")
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &LSPMetadata{BinaryName: "clangd", ArchivePath: "bin/clangd", IsArchive: true, ExtractAll: true}
+	out := filepath.Join(dir, "out")
+	got, err := (&Installer{}).extractAll(context.Background(), download, out, meta, "linux-x86_64")
+	if err != nil {
+		t.Fatalf("extractAll failed: %v", err)
+	}
+	if got != filepath.Join(out, "clangd_19.1.2", "bin", "clangd") {
+		t.Errorf("binary = %s, want it where the archive keeps it", got)
+	}
+	if info, err := os.Stat(got); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("binary is not executable: %v, %v", info, err)
+	}
+	// clangd finds its builtin headers relative to its own path
+	if _, err := os.Stat(filepath.Join(out, "clangd_19.1.2", "lib", "clang", "19", "include", "stddef.h")); err != nil {
+		t.Errorf("headers were not extracted: %v", err)
+	}
+
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "../escape"})
+	w.Write([]byte("data"))
+	zw.Close()
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Installer{}).extractAll(context.Background(), download, t.TempDir(), meta, "linux-x86_64"); !errors.Is(err, ErrUnsafeArchive) {
+		t.Errorf("extractAll of an escaping entry = %v, want ErrUnsafeArchive", err)
+	}
+}
+
+func TestInstallJavaPackage(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		mode int64
+	}{
+		{"bin/jdtls", 0755},
+		{"bin/jdtls.bat", 0644},
+		{"plugins/org.eclipse.jdt.ls.core.jar", 0644},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: f.mode, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	download := filepath.Join(dir, "codemap-java-123")
+	if err := os.WriteFile(download, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &LSPMetadata{Name: "jdtls", BinaryName: "jdtls", ArchivePath: "bin/jdtls",
+		ArchivePaths: map[string]string{"windows-x86_64": "bin/jdtls.bat"}, Runtime: RuntimeJava}
+	out := filepath.Join(dir, "out")
+	got, err := installJavaPackage(context.Background(), osFS{}, extractLimits{}.orDefault(), download, out, meta, "windows-x86_64")
+	if err != nil {
+		t.Fatalf("installJavaPackage failed: %v", err)
+	}
+	if got != filepath.Join(out, "bin", "jdtls.bat") {
+		t.Errorf("launcher = %s, want the platform's launch script", got)
+	}
+	// The whole distribution is unpacked, not just the launcher
+	if _, err := os.Stat(filepath.Join(out, "plugins", "org.eclipse.jdt.ls.core.jar")); err != nil {
+		t.Errorf("plugins were not extracted: %v", err)
+	}
+
+	meta.ArchivePath = "bin/missing"
+	if _, err := installJavaPackage(context.Background(), osFS{}, extractLimits{}.orDefault(), download, t.TempDir(), meta, "linux-x86_64"); err == nil {
+		t.Error("expected an error for a package without its launch script")
+	}
+}
+
+func TestCheckJavaNeedsPython(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "java"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	meta := &LSPMetadata{Name: "jdtls", Runtime: RuntimeJava}
+	if err := CheckRuntime(meta); err == nil || !strings.Contains(err.Error(), "python3 was not found") {
+		t.Errorf("CheckRuntime without python3 = %v, want a not found error", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "python3"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckRuntime(meta); err != nil {
+		t.Errorf("CheckRuntime with java and python3 failed: %v", err)
+	}
+}
+
+func TestExtractSingleBinaryRejectsAmbiguousZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"bin/tool-a.exe", "bin/tool-b.exe"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("data"))
+	}
+	zw.Close()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tools.zip")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &LSPMetadata{BinaryName: "tool", ExtractSingleBinary: true}
+	_, err := (&Installer{}).extractArchive(context.Background(), archive, dir, meta, GetPlatformKey())
+	if !errors.Is(err, ErrAmbiguousArchive) || !strings.Contains(err.Error(), "2 executables") {
+		t.Errorf("extractArchive() error = %v, want an ambiguity error", err)
+	}
+}
+
+// cancelAfterRead cancels its context as soon as the first chunk is read,
+// simulating cancellation in the middle of a large entry.
+type cancelAfterRead struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelAfterRead) Read(p []byte) (int, error) {
+	c.cancel()
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestExtractionStopsOnCancel(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"package/a.js", "package/b.js", "bin/fake-ls"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := filepath.Join(t.TempDir(), "fake-ls.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dir := t.TempDir()
+	meta := &LSPMetadata{BinaryName: "fake-ls", ArchivePath: "bin/fake-ls"}
+	if _, err := (&Installer{}).extractArchive(ctx, archive, dir, meta, GetPlatformKey()); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractArchive() error = %v, want context.Canceled", err)
+	}
+	if err := extractTarGzAll(ctx, osFS{}, extractLimits{}.orDefault(), archive, dir); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractTarGzAll() error = %v, want context.Canceled", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cancelled extraction left %d entries behind", len(entries))
+	}
+
+	// Cancelling part way through an entry removes the partial file
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	dest := filepath.Join(dir, "partial")
+	if err := extractFile(ctx, osFS{}, cancelAfterRead{cancel}, dest, 0755, defaultMaxEntrySize); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractFile() error = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("partial file still present: %v", err)
+	}
+}
+
+// fakeServer returns a shell script standing in for a language server binary.
+// It prints a version, and carries tag in a comment so tests can tell
+// downloads apart. Tests installing it skip on Windows.
+func fakeServer(tag string) string {
+	return "#!/bin/sh\n# " + tag + "\necho fake-ls 1.0.0\n"
+}
+
+func TestInstallUpgradeSwapsCurrentVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fakeServer("binary " + r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	install := func(version string) {
+		t.Helper()
+		metadata := &LSPMetadata{
+			Name:         "fake-ls",
+			Version:      version,
+			BinaryName:   "fake-ls",
+			DownloadURLs: map[string]string{GetPlatformKey(): srv.URL + "/" + version},
+		}
+		if err := NewInstaller(mgr).Install(context.Background(), "fake-ls", metadata); err != nil {
+			t.Fatalf("Install(%s) failed: %v", version, err)
+		}
+	}
+
+	install("1.0.0")
+	install("2.0.0")
+
+	if installed, version, _ := mgr.IsInstalled("fake-ls"); !installed || version != "2.0.0" {
+		t.Errorf("IsInstalled() = %v, %s, want true, 2.0.0", installed, version)
+	}
+
+	// The old version stays until pruned, and pruning spares in-flight installs
+	pkgDir := filepath.Join(mgr.packagesDir, "fake-ls")
+	if _, err := os.Stat(filepath.Join(pkgDir, "1.0.0")); err != nil {
+		t.Errorf("install removed the old version: %v", err)
+	}
+	staging := filepath.Join(pkgDir, ".staging-3.0.0-1")
+	if err := os.Mkdir(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := mgr.PruneVersions("fake-ls"); err != nil || removed != 1 {
+		t.Errorf("PruneVersions() = %d, %v, want 1", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(pkgDir, "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("old version was not pruned: %v", err)
+	}
+	if _, err := os.Stat(staging); err != nil {
+		t.Errorf("pruning removed a staging directory: %v", err)
+	}
+
+	// The bin symlink resolves through current to the new binary
+	binPath, _ := GetBinaryPath("fake-ls")
+	target, err := os.Readlink(binPath)
+	if err != nil || !strings.Contains(target, filepath.Join("fake-ls", "current")) {
+		t.Errorf("bin link = %q, %v, want it to go through current", target, err)
+	}
+	data, err := os.ReadFile(binPath)
+	if err != nil || string(data) != fakeServer("binary /2.0.0") {
+		t.Errorf("bin link reads %q, %v, want the 2.0.0 binary", data, err)
+	}
+}
+
+func TestFailedReinstallKeepsWorkingBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	body := fakeServer("good binary")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	metadata := &LSPMetadata{
+		Name:         "fake-ls",
+		Version:      "1.0.0",
+		BinaryName:   "fake-ls",
+		DownloadURLs: map[string]string{GetPlatformKey(): srv.URL},
+	}
+	pkgDir := filepath.Join(mgr.packagesDir, "fake-ls")
+	binary := filepath.Join(pkgDir, "1.0.0", executableName("fake-ls", runtime.GOOS))
+	reinstall := func() error {
+		t.Helper()
+		// Without current the version counts as not installed and is redone
+		os.Remove(filepath.Join(pkgDir, "current"))
+		return NewInstaller(mgr).Install(context.Background(), "fake-ls", metadata)
+	}
+
+	if err := NewInstaller(mgr).Install(context.Background(), "fake-ls", metadata); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+
+	// An empty download fails verification and leaves the old binary alone
+	body = ""
+	if err := reinstall(); !errors.Is(err, ErrBrokenBinary) {
+		t.Fatalf("reinstall error = %v, want ErrBrokenBinary", err)
+	}
+	if data, err := os.ReadFile(binary); err != nil || string(data) != fakeServer("good binary") {
+		t.Errorf("binary after failed reinstall = %q, %v, want the original", data, err)
+	}
+
+	// So does one that cannot be run
+	body = "not a program"
+	if err := reinstall(); !errors.Is(err, ErrBrokenBinary) {
+		t.Fatalf("reinstall error = %v, want ErrBrokenBinary", err)
+	}
+	if data, err := os.ReadFile(binary); err != nil || string(data) != fakeServer("good binary") {
+		t.Errorf("binary after failed reinstall = %q, %v, want the original", data, err)
+	}
+
+	// A good download replaces it, leaving no staging or backup directories
+	body = fakeServer("new binary")
+	if err := reinstall(); err != nil {
+		t.Fatalf("reinstall failed: %v", err)
+	}
+	if data, err := os.ReadFile(binary); err != nil || string(data) != fakeServer("new binary") {
+		t.Errorf("binary after reinstall = %q, %v, want the new one", data, err)
+	}
+	entries, err := os.ReadDir(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "1.0.0" && e.Name() != "current" {
+			t.Errorf("leftover %s in package directory", e.Name())
+		}
+	}
+}
+
+func TestInstallRecordsReportedVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#!/bin/sh\necho \"fake-ls $1: fake-ls 2.3.4-beta (built today)\"\n"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	metadata := &LSPMetadata{
+		Name:         "fake-ls",
+		Version:      "1.0.0",
+		BinaryName:   "fake-ls",
+		DownloadURLs: map[string]string{GetPlatformKey(): srv.URL},
+		VersionArgs:  []string{"version"},
+	}
+	if err := NewInstaller(mgr).Install(context.Background(), "fake-ls", metadata); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+
+	packages, err := mgr.ListInstalled()
+	if err != nil || len(packages) != 1 {
+		t.Fatalf("ListInstalled = %v, %v; want the one package", packages, err)
+	}
+	if got := packages[0]; got.Version != "1.0.0" || got.ReportedVersion != "2.3.4-beta" {
+		t.Errorf("Version %q, ReportedVersion %q; want 1.0.0 and 2.3.4-beta", got.Version, got.ReportedVersion)
+	}
+
+	// The diagnostics report both versions too
+	env, err := ResolveEnvironment()
+	if err != nil {
+		t.Fatalf("ResolveEnvironment failed: %v", err)
+	}
+	if len(env.Installed) != 1 || env.Installed[0].ReportedVersion != "2.3.4-beta" {
+		t.Errorf("Environment.Installed = %+v, want fake-ls reporting 2.3.4-beta", env.Installed)
+	}
+}
+
+func TestReportedVersionIgnoresLingeringChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	// The background sleep inherits stdout and keeps it open after the
+	// script exits
+	path := filepath.Join(t.TempDir(), "fake-ls")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 30 &\necho fake-ls 1.2.3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	version, err := reportedVersion(context.Background(), path, nil)
+	if err != nil || version != "1.2.3" {
+		t.Errorf("reportedVersion = %q, %v; want 1.2.3", version, err)
+	}
+	if elapsed := time.Since(start); elapsed >= reportedVersionTimeout {
+		t.Errorf("reportedVersion took %s, want it not to wait for the child", elapsed)
+	}
+}
+
+func TestVerifyChecksumAlgorithms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "download")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algo, checksum string
+		wantErr        error
+	}{
+		{"", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", nil},
+		{"sha256", "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824", nil},
+		{"SHA512", "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043", nil},
+		{"sha1", "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", nil},
+		{"sha1", strings.Repeat("0", 40), ErrChecksumMismatch},
+		{"", "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		if err := verifyChecksum(path, tt.algo, tt.checksum); !errors.Is(err, tt.wantErr) {
+			t.Errorf("verifyChecksum(%q, %.8s) = %v, want %v", tt.algo, tt.checksum, err, tt.wantErr)
+		}
+	}
+
+	if err := verifyChecksum(path, "md5", "5d41402abc4b2a76b9719d911017c592"); err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("verifyChecksum(md5) = %v, want an unsupported algorithm error", err)
+	}
+}
+
+func TestInstallUsesPublishedChecksum(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	binary := fakeServer("hello")
+	sum := sha256.Sum256([]byte(binary))
+	binarySHA256 := hex.EncodeToString(sum[:])
+	checksums := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/fake-ls-linux":
+			w.Write([]byte(binary))
+		case "/v1/checksums.txt":
+			if checksums == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(checksums))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	metadata := &LSPMetadata{
+		Name:         "fake-ls",
+		Version:      "1.0.0",
+		BinaryName:   "fake-ls",
+		DownloadURLs: map[string]string{GetPlatformKey(): srv.URL + "/v1/fake-ls-linux"},
+		ChecksumsURL: srv.URL + "/v1/checksums.txt",
+	}
+	install := func(strict bool) error {
+		t.Helper()
+		mgr.Uninstall(context.Background(), "fake-ls")
+		inst := NewInstaller(mgr)
+		inst.VerifyChecksums = strict
+		return inst.Install(context.Background(), "fake-ls", metadata)
+	}
+
+	checksums = binarySHA256 + "  fake-ls-linux\n" + strings.Repeat("1", 64) + "  fake-ls-darwin\n"
+	if err := install(true); err != nil {
+		t.Errorf("Install with a matching published checksum failed: %v", err)
+	}
+	if pkgs, err := mgr.ListInstalled(); err != nil || len(pkgs) != 1 || pkgs[0].Checksum != binarySHA256 {
+		t.Errorf("installed packages = %+v, %v; want the verified checksum recorded", pkgs, err)
+	}
+
+	checksums = strings.Repeat("0", 64) + "  fake-ls-linux\n"
+	if err := install(false); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Install with a wrong published checksum = %v, want ErrChecksumMismatch", err)
+	}
+
+	// Unpublished checksums are best effort unless strict
+	checksums = ""
+	if err := install(false); err != nil {
+		t.Errorf("Install without a published checksum failed: %v", err)
+	}
+	if err := install(true); !errors.Is(err, ErrChecksumUnavailable) {
+		t.Errorf("strict Install without a published checksum = %v, want ErrChecksumUnavailable", err)
+	}
+	metadata.ChecksumsURL = ""
+	if err := install(true); !errors.Is(err, ErrChecksumUnavailable) {
+		t.Errorf("strict Install without a checksums URL = %v, want ErrChecksumUnavailable", err)
+	}
+}
+
+func TestOfflineMakesNoRequests(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"tag_name": "v9.9.9"}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	t.Setenv("CODEMAP_OFFLINE", "1")
+	resolver := NewGitHubResolver("owner", "repo", "")
+	resolver.baseURL = srv.URL
+	lspMetadata["offline-lang"] = &LSPMetadata{
+		Name:            "fake-ls",
+		Version:         "1.0.0",
+		BinaryName:      "fake-ls",
+		DownloadURLs:    map[string]string{GetPlatformKey(): srv.URL + "/{version}/fake-ls"},
+		ChecksumsURL:    srv.URL + "/{version}/checksums.txt",
+		VersionResolver: resolver,
+	}
+	defer delete(lspMetadata, "offline-lang")
+
+	metadata, err := GetLSPMetadata("offline-lang")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if metadata.Version != "1.0.0" {
+		t.Errorf("offline version = %q, want the fallback 1.0.0", metadata.Version)
+	}
+
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	err = NewInstaller(mgr).Install(context.Background(), "offline-lang", metadata)
+	if !errors.Is(err, ErrOffline) {
+		t.Fatalf("offline Install() error = %v, want ErrOffline", err)
+	}
+	if want := filepath.Join(mgr.packagesDir, "offline-lang", "1.0.0"); !strings.Contains(err.Error(), want) {
+		t.Errorf("offline Install() error = %v, want it to name %s", err, want)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server saw %d requests in offline mode, want 0", n)
+	}
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	sum := strings.Repeat("a", 64)
+	other := strings.Repeat("b", 64)
+	tests := []struct {
+		name, data, file string
+		want             string
+		wantOK           bool
+	}{
+		{"checksums.txt", other + "  templ_Darwin_arm64.tar.gz\n" + sum + "  templ_Linux_x86_64.tar.gz\n", "templ_Linux_x86_64.tar.gz", sum, true},
+		{"binary mode marker", sum + " *dist/tool.zip\n", "tool.zip", sum, true},
+		{"bare sidecar", sum + "\n", "tool.zip", sum, true},
+		{"sidecar naming the file", sum + "  tool.zip", "tool.zip", sum, true},
+		{"file not listed", other + "  other.zip\n", "tool.zip", "", false},
+		{"not a checksum file", "<html>Not Found</html>", "tool.zip", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseChecksumFile([]byte(tt.data), tt.file)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: parseChecksumFile() = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestExtractWindowsExecutableSuffix(t *testing.T) {
+	tarGz := func(t *testing.T, entry string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: entry, Mode: 0755, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+		tw.Close()
+		gz.Close()
+		archive := filepath.Join(t.TempDir(), "zls.tar.gz")
+		if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return archive
+	}
+	zipFile := func(t *testing.T, entry string) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create(entry)
+		w.Write([]byte("data"))
+		zw.Close()
+		archive := filepath.Join(t.TempDir(), "zls.zip")
+		if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return archive
+	}
+
+	// Every combination of entry and ArchivePath spelling installs zls.exe once
+	for _, entry := range []string{"zls-windows/zls", "zls-windows/zls.exe"} {
+		for _, archivePath := range []string{"zls", "zls.exe"} {
+			for _, build := range []func(*testing.T, string) string{tarGz, zipFile} {
+				archive := build(t, entry)
+				meta := &LSPMetadata{BinaryName: "zls", ArchivePath: archivePath}
+				got, err := (&Installer{}).extractArchive(context.Background(), archive, t.TempDir(), meta, "windows-x86_64")
+				if err != nil {
+					t.Errorf("entry %s, ArchivePath %s (%s): %v", entry, archivePath, filepath.Base(archive), err)
+					continue
+				}
+				if filepath.Base(got) != "zls.exe" {
+					t.Errorf("entry %s, ArchivePath %s (%s): installed as %s, want zls.exe",
+						entry, archivePath, filepath.Base(archive), filepath.Base(got))
+				}
+			}
+		}
+	}
+
+	// Other platforms match entries exactly
+	meta := &LSPMetadata{BinaryName: "zls", ArchivePath: "zls"}
+	if _, err := (&Installer{}).extractArchive(context.Background(), tarGz(t, "zls-windows/zls.exe"), t.TempDir(), meta, "linux-x86_64"); err == nil {
+		t.Error("zls.exe entry matched ArchivePath zls outside Windows")
+	}
+
+	for _, tt := range []struct{ name, goos, want string }{
+		{"zls", "windows", "zls.exe"},
+		{"zls.exe", "windows", "zls.exe"},
+		{"ZLS.EXE", "windows", "ZLS.EXE"},
+		{"zls", "linux", "zls"},
+	} {
+		if got := executableName(tt.name, tt.goos); got != tt.want {
+			t.Errorf("executableName(%q, %s) = %q, want %q", tt.name, tt.goos, got, tt.want)
+		}
+	}
+}
+
+// faultyFS wraps the real filesystem, failing writes once limit bytes have
+// been written in total, or failing OpenFile for paths in denied.
+type faultyFS struct {
+	osFS
+	limit   int
+	written int
+	denied  map[string]bool
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+func (f *faultyFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if f.denied[name] {
+		return nil, os.ErrPermission
+	}
+	w, err := f.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{WriteCloser: w, fs: f}, nil
+}
+
+type faultyFile struct {
+	io.WriteCloser
+	fs *faultyFS
+}
+
+func (w *faultyFile) Write(p []byte) (int, error) {
+	if w.fs.written+len(p) > w.fs.limit {
+		return 0, errDiskFull
+	}
+	w.fs.written += len(p)
+	return w.WriteCloser.Write(p)
+}
+
+func TestExtractionCleansUpOnWriteFailure(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"package/a.js", "package/b.js", "bin/fake-ls"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := filepath.Join(t.TempDir(), "fake-ls.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The disk fills up on the second file; the first is removed too
+	dir := t.TempDir()
+	err := extractTarGzAll(context.Background(), &faultyFS{limit: 6}, extractLimits{}.orDefault(), archive, dir)
+	if !errors.Is(err, errDiskFull) || !strings.Contains(err.Error(), filepath.Join(dir, "package", "b.js")) {
+		t.Errorf("extractTarGzAll() error = %v, want disk full naming b.js", err)
+	}
+	for _, name := range []string{"a.js", "b.js"} {
+		if _, err := os.Stat(filepath.Join(dir, "package", name)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after failed extraction: %v", name, err)
+		}
+	}
+
+	// A single-binary extraction that runs out of space removes the binary
+	dir = t.TempDir()
+	inst := &Installer{fs: &faultyFS{limit: 2}}
+	meta := &LSPMetadata{BinaryName: "fake-ls", ArchivePath: "bin/fake-ls"}
+	binary := filepath.Join(dir, executableName("fake-ls", runtime.GOOS))
+	_, err = inst.extractArchive(context.Background(), archive, dir, meta, GetPlatformKey())
+	if !errors.Is(err, errDiskFull) || !strings.Contains(err.Error(), binary) {
+		t.Errorf("extractArchive() error = %v, want disk full naming %s", err, binary)
+	}
+	if _, err := os.Stat(binary); !os.IsNotExist(err) {
+		t.Errorf("partial binary left behind: %v", err)
+	}
+
+	// Permission errors name the destination too
+	inst = &Installer{fs: &faultyFS{limit: 1 << 20, denied: map[string]bool{binary: true}}}
+	_, err = inst.extractArchive(context.Background(), archive, dir, meta, GetPlatformKey())
+	if !errors.Is(err, os.ErrPermission) || !strings.Contains(err.Error(), binary) {
+		t.Errorf("extractArchive() error = %v, want permission denied naming %s", err, binary)
+	}
+}
+
+func TestExtractionSizeLimits(t *testing.T) {
+	// A small archive that expands to 1 MiB per entry
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	payload := make([]byte, 1<<20)
+	for _, name := range []string{"package/a.js", "package/b.js", "bin/fake-ls"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(payload)), Typeflag: tar.TypeReg})
+		tw.Write(payload)
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := filepath.Join(t.TempDir(), "bomb.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		limits extractLimits
+		ok     bool
+	}{
+		{"within limits", extractLimits{Total: 4 << 20, Entry: 1 << 20}, true},
+		{"entry too large", extractLimits{Total: 4 << 20, Entry: 1<<20 - 1}, false},
+		{"total too large", extractLimits{Total: 2 << 20, Entry: 1 << 20}, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		err := extractTarGzAll(context.Background(), osFS{}, tt.limits, archive, dir)
+		if tt.ok != (err == nil) || (!tt.ok && !errors.Is(err, ErrExtractLimit)) {
+			t.Errorf("%s: extractTarGzAll() error = %v", tt.name, err)
+		}
+		if !tt.ok {
+			if entries, _ := os.ReadDir(filepath.Join(dir, "package")); len(entries) != 0 {
+				t.Errorf("%s: left %d files behind", tt.name, len(entries))
+			}
+		}
+	}
+
+	// A single binary over the limit is rejected and removed
+	dir := t.TempDir()
+	inst := &Installer{limits: extractLimits{Entry: 1 << 19}}
+	meta := &LSPMetadata{BinaryName: "fake-ls", ArchivePath: "bin/fake-ls"}
+	if _, err := inst.extractArchive(context.Background(), archive, dir, meta, GetPlatformKey()); !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("extractArchive() error = %v, want ErrExtractLimit", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("oversized binary left %d entries behind", len(entries))
+	}
+
+	// Limits come from the environment in megabytes; bad values are ignored
+	t.Setenv("CODEMAP_MAX_EXTRACT_MB", "64")
+	t.Setenv("CODEMAP_MAX_ENTRY_MB", "lots")
+	if got := limitsFromEnv().orDefault(); got.Total != 64<<20 || got.Entry != defaultMaxEntrySize {
+		t.Errorf("limitsFromEnv() = %+v", got)
+	}
+}
+
+func TestExtractPrefersClosestArchivePathMatch(t *testing.T) {
+	tarGz := func(t *testing.T, entries ...string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, name := range entries {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(name)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(name))
+		}
+		tw.Close()
+		gz.Close()
+		archive := filepath.Join(t.TempDir(), "lua-language-server.tar.gz")
+		if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return archive
+	}
+
+	tests := []struct {
+		name        string
+		entries     []string
+		archivePath string
+		want        string // entry extracted, or "" for an ambiguity error
+	}{
+		{"exact match wins in either order", []string{"doc/bin/lua-language-server", "bin/lua-language-server"}, "bin/lua-language-server", "bin/lua-language-server"},
+		{"exact match wins, reversed", []string{"bin/lua-language-server", "doc/bin/lua-language-server"}, "bin/lua-language-server", "bin/lua-language-server"},
+		{"shortest suffix match wins", []string{"pkg/extra/bin/lua-language-server", "pkg/bin/lua-language-server"}, "bin/lua-language-server", "pkg/bin/lua-language-server"},
+		{"equally close matches are ambiguous", []string{"a/bin/lua-language-server", "b/bin/lua-language-server"}, "bin/lua-language-server", ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		meta := &LSPMetadata{BinaryName: "lua-language-server", ArchivePath: tt.archivePath}
+		got, err := (&Installer{}).extractArchive(context.Background(), tarGz(t, tt.entries...), dir, meta, "linux-x86_64")
+		if tt.want == "" {
+			if !errors.Is(err, ErrAmbiguousArchive) {
+				t.Errorf("%s: error = %v, want an ambiguity error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if data, _ := os.ReadFile(got); string(data) != tt.want {
+			t.Errorf("%s: extracted %q, want %s", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestArchivePathPerPlatform(t *testing.T) {
+	meta := &LSPMetadata{
+		BinaryName:   "foo",
+		ArchivePath:  "bin/foo",
+		ArchivePaths: map[string]string{"windows-x86_64": "foo.exe"},
+	}
+	unix := []archiveEntry{{Name: "foo-1.0/bin/foo", Mode: 0755}, {Name: "foo-1.0/README", Mode: 0644}}
+	windows := []archiveEntry{{Name: "foo.exe", Mode: 0644}, {Name: "README", Mode: 0644}}
+
+	if got, err := chooseArchiveEntry(unix, meta, "linux-x86_64"); err != nil || got != "foo-1.0/bin/foo" {
+		t.Errorf("linux: got %q, %v; want the ArchivePath fallback", got, err)
+	}
+	if got, err := chooseArchiveEntry(windows, meta, "windows-x86_64"); err != nil || got != "foo.exe" {
+		t.Errorf("windows: got %q, %v; want the platform override", got, err)
+	}
+	if _, err := chooseArchiveEntry(windows, meta, "windows-arm64"); !errors.Is(err, ErrBinaryNotInArchive) {
+		t.Errorf("windows-arm64 without an override: error = %v, want ErrBinaryNotInArchive", err)
+	}
+}
+
+func TestInstallErrorsAreInspectable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("binary"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	inst := NewInstaller(mgr)
+
+	// No download for this platform
+	metadata := &LSPMetadata{Name: "fake-ls", Version: "1.0.0", BinaryName: "fake-ls",
+		DownloadURLs: map[string]string{"plan9-mips": srv.URL}}
+	if err := inst.Install(context.Background(), "fake-ls", metadata); !errors.Is(err, ErrPlatformUnsupported) {
+		t.Errorf("Install() error = %v, want ErrPlatformUnsupported", err)
+	}
+
+	// Download does not match its checksum
+	metadata.DownloadURLs = map[string]string{GetPlatformKey(): srv.URL}
+	metadata.Checksums = map[string]string{GetPlatformKey(): strings.Repeat("0", 64)}
+	if err := inst.Install(context.Background(), "fake-ls", metadata); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Install() error = %v, want ErrChecksumMismatch", err)
+	}
+
+	if _, err := GetLSPMetadata("cobol"); !errors.Is(err, ErrUnknownLanguage) {
+		t.Errorf("GetLSPMetadata() error = %v, want ErrUnknownLanguage", err)
+	}
+	if err := mgr.Uninstall(context.Background(), "fake-ls"); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("Uninstall() error = %v, want ErrNotInstalled", err)
+	}
+}
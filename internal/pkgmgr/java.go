@@ -0,0 +1,46 @@
+package pkgmgr
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// RuntimeJava marks LSP packages that are Java distributions: a tarball
+// unpacked whole, launched through the script at their ArchivePath.
+const RuntimeJava = "java"
+
+// checkJava verifies that a Java runtime is on PATH, and the Python that
+// jdtls's launch script is written in.
+func checkJava(metadata *LSPMetadata) error {
+	if _, err := exec.LookPath("java"); err != nil {
+		return fmt.Errorf("%s requires a Java runtime, but java was not found on PATH; install a JDK from https://adoptium.net",
+			metadata.Name)
+	}
+	python := "python3"
+	if runtime.GOOS == "windows" {
+		python = "python"
+	}
+	if _, err := exec.LookPath(python); err != nil {
+		return fmt.Errorf("%s is launched by a Python script, but %s was not found on PATH; install it from https://www.python.org",
+			metadata.Name, python)
+	}
+	return nil
+}
+
+// installJavaPackage unpacks a Java distribution into destDir and returns
+// the path of its launch script for platform.
+func installJavaPackage(ctx context.Context, fsys writeFS, limits extractLimits, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	if err := extractTarGzAll(ctx, fsys, limits, archivePath, destDir); err != nil {
+		return "", err
+	}
+
+	launcher := filepath.Join(destDir, filepath.FromSlash(metadata.archivePathFor(platform)))
+	if _, err := os.Stat(launcher); err != nil {
+		return "", fmt.Errorf("launch script not found in package: %s", metadata.archivePathFor(platform))
+	}
+	return launcher, nil
+}
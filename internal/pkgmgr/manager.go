@@ -8,6 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Manager handles package installation, updates, and lifecycle.
@@ -16,8 +19,20 @@ type Manager struct {
 	binDir      string
 	registryDir string
 	tmpDir      string
+
+	versionsMu    sync.Mutex
+	versionsCache map[string]cachedVersions // packageName -> available versions
+}
+
+// cachedVersions holds a version listing and when it was fetched.
+type cachedVersions struct {
+	versions  []string
+	fetchedAt time.Time
 }
 
+// versionsCacheTTL bounds how long AvailableVersions reuses a listing.
+const versionsCacheTTL = 10 * time.Minute
+
 // Package represents an installed package.
 type Package struct {
 	Name         string `json:"name"`
@@ -26,6 +41,10 @@ type Package struct {
 	InstalledAt  string `json:"installed_at"`
 	DownloadURL  string `json:"download_url"`
 	Checksum     string `json:"checksum"`
+	ChecksumAlgo string `json:"checksum_algo,omitempty"`
+	// ReportedVersion is what the installed binary says its version is,
+	// which can differ from Version, e.g. for an npm wrapper package.
+	ReportedVersion string `json:"reported_version,omitempty"`
 }
 
 // NewManager creates a new package manager instance.
@@ -125,7 +144,7 @@ func (m *Manager) Uninstall(ctx context.Context, packageName string) error {
 		return err
 	}
 	if !installed {
-		return fmt.Errorf("package not installed: %s", packageName)
+		return fmt.Errorf("%w: %s", ErrNotInstalled, packageName)
 	}
 
 	log.Printf("Uninstalling %s version %s...", packageName, version)
@@ -149,6 +168,62 @@ func (m *Manager) Uninstall(ctx context.Context, packageName string) error {
 	return nil
 }
 
+// Purge removes everything cached for a package, installed or not: its
+// package directory with every downloaded version, and its bin shim. Unlike
+// Uninstall it also works on broken installs, so the next Install starts fresh.
+func (m *Manager) Purge(packageName string) error {
+	if packageName == "" || packageName == "." || packageName == ".." ||
+		strings.ContainsAny(packageName, `/\`) {
+		return fmt.Errorf("invalid package name: %q", packageName)
+	}
+
+	// Prefer the installed metadata, falling back to the static table when
+	// the install is too broken to read
+	binaryName := ""
+	if pkg, err := m.readPackageMetadata(packageName); err == nil {
+		binaryName = pkg.BinaryName
+	} else if meta, ok := lspMetadata[packageName]; ok {
+		binaryName = meta.BinaryName
+	}
+	if binaryName != "" {
+		binaryName = executableName(binaryName, runtime.GOOS)
+		if err := removeSymlink(filepath.Join(m.binDir, binaryName)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove binary shim: %w", err)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(m.packagesDir, packageName)); err != nil {
+		return fmt.Errorf("failed to remove package directory: %w", err)
+	}
+
+	m.versionsMu.Lock()
+	delete(m.versionsCache, packageName)
+	m.versionsMu.Unlock()
+
+	log.Printf("Purged %s", packageName)
+	return nil
+}
+
+// PurgeAll removes every installed package, bin shim and leftover download,
+// leaving empty directories behind for the next install.
+func (m *Manager) PurgeAll() error {
+	for _, dir := range []string{m.packagesDir, m.binDir, m.tmpDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	m.versionsMu.Lock()
+	m.versionsCache = nil
+	m.versionsMu.Unlock()
+
+	log.Printf("Purged all packages")
+	return nil
+}
+
 // GetBinaryPath returns the path to an installed package's binary.
 func (m *Manager) GetBinaryPath(packageName string) (string, error) {
 	pkg, err := m.readPackageMetadata(packageName)
@@ -204,16 +279,23 @@ func (m *Manager) writePackageMetadata(packageName, version string, pkg *Package
 
 // createSymlink creates a symlink or shim for the binary.
 func createSymlink(source, target string) error {
-	// Remove existing symlink if present
-	_ = os.Remove(target)
-
 	if runtime.GOOS == "windows" {
 		// On Windows, create a .bat shim instead of symlink
+		_ = os.Remove(target)
 		return createWindowsShim(source, target)
 	}
 
-	// Unix-like: create symlink
-	return os.Symlink(source, target)
+	// Unix-like: create the symlink beside the target and rename it over,
+	// so the old link keeps working until the new one is complete
+	tmp := fmt.Sprintf("%s.%d.tmp", target, time.Now().UnixNano())
+	if err := os.Symlink(source, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 // removeSymlink removes a symlink or shim.
@@ -250,3 +332,209 @@ func (m *Manager) AddToPath() error {
 	newPath := m.binDir + string(os.PathListSeparator) + currentPath
 	return os.Setenv("PATH", newPath)
 }
+
+// AvailableVersions returns the installable versions of a package, newest
+// first. Resolvers that implement VersionLister report every release; others
+// only report their latest version. Results are cached for a few minutes.
+func (m *Manager) AvailableVersions(ctx context.Context, packageName string, resolver VersionResolver) ([]string, error) {
+	if resolver == nil {
+		return nil, fmt.Errorf("no version resolver for package: %s", packageName)
+	}
+
+	m.versionsMu.Lock()
+	if cached, ok := m.versionsCache[packageName]; ok && time.Since(cached.fetchedAt) < versionsCacheTTL {
+		m.versionsMu.Unlock()
+		return append([]string(nil), cached.versions...), nil
+	}
+	m.versionsMu.Unlock()
+
+	var raw []string
+	if lister, ok := resolver.(VersionLister); ok {
+		listed, err := lister.ListVersions(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions for %s: %w", packageName, err)
+		}
+		raw = listed
+	} else {
+		latest, err := resolver.ResolveLatestVersion(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve latest version for %s: %w", packageName, err)
+		}
+		raw = []string{latest}
+	}
+
+	// Drop tag path prefixes and anything that is not a version
+	seen := make(map[string]bool)
+	var versions []string
+	for _, v := range raw {
+		if i := strings.LastIndex(v, "/"); i >= 0 {
+			v = v[i+1:]
+		}
+		if _, err := normalizeVersion(v, ""); err != nil || seen[v] {
+			continue
+		}
+		seen[v] = true
+		versions = append(versions, v)
+	}
+	sortVersionsDesc(versions)
+
+	m.versionsMu.Lock()
+	if m.versionsCache == nil {
+		m.versionsCache = make(map[string]cachedVersions)
+	}
+	m.versionsCache[packageName] = cachedVersions{versions: versions, fetchedAt: time.Now()}
+	m.versionsMu.Unlock()
+
+	return append([]string(nil), versions...), nil
+}
+
+// activateVersion points a package's current link at version. The new link is
+// created beside the old one and renamed over it, so readers always see
+// either the old version or the new one.
+func (m *Manager) activateVersion(packageName, version string) error {
+	pkgDir := filepath.Join(m.packagesDir, packageName)
+	currentLink := filepath.Join(pkgDir, "current")
+	tmpLink := fmt.Sprintf("%s.%d.tmp", currentLink, time.Now().UnixNano())
+
+	if err := os.Symlink(version, tmpLink); err != nil {
+		return fmt.Errorf("failed to create current version link: %w", err)
+	}
+	if err := os.Rename(tmpLink, currentLink); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("failed to switch current version link: %w", err)
+	}
+	return nil
+}
+
+// PruneVersions removes every downloaded version of a package except the one
+// current points at, returning how many were removed. A package without a
+// current version is left alone; use Purge to clear it. Staging directories
+// and upgrade backups belong to installs that may still be running, so they
+// are left to CleanOrphans. Installs never prune on their own: a running
+// server may still be using an older version.
+func (m *Manager) PruneVersions(packageName string) (int, error) {
+	installed, current, err := m.IsInstalled(packageName)
+	if err != nil || !installed {
+		return 0, err
+	}
+
+	pkgDir := filepath.Join(m.packagesDir, packageName)
+	entries, err := os.ReadDir(pkgDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read package directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// Only version directories; the current link is not a directory entry
+		if !entry.IsDir() || entry.Name() == current || inFlightDir(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(pkgDir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove version %s: %w", entry.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// inFlightAge is how long a staging directory or upgrade backup may exist
+// before ListOrphans assumes the install that made it has died.
+const inFlightAge = time.Hour
+
+// inFlightDir reports whether name is the staging directory of an install or
+// the backup an upgrade keeps until it succeeds.
+func inFlightDir(name string) bool {
+	return strings.HasPrefix(name, ".staging-") || strings.Contains(name, ".old-")
+}
+
+// Orphan is an entry in the packages directory that no valid install refers
+// to, typically left behind by a failed or interrupted install.
+type Orphan struct {
+	Package string
+	Version string
+	Path    string
+	Reason  string
+}
+
+// ListOrphans reports version directories that the current link does not
+// point at, version directories missing .metadata.json, and current links
+// that point at a missing or incomplete version. Staging directories and
+// upgrade backups younger than inFlightAge may belong to a running install,
+// so they are left out.
+func (m *Manager) ListOrphans() ([]Orphan, error) {
+	entries, err := os.ReadDir(m.packagesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read packages directory: %w", err)
+	}
+
+	var orphans []Orphan
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		packageName := entry.Name()
+		pkgDir := filepath.Join(m.packagesDir, packageName)
+
+		current := ""
+		currentLink := filepath.Join(pkgDir, "current")
+		if target, err := os.Readlink(currentLink); err == nil {
+			current = filepath.Base(target)
+		}
+
+		versions, err := os.ReadDir(pkgDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read package directory: %w", err)
+		}
+		currentValid := false
+		for _, v := range versions {
+			path := filepath.Join(pkgDir, v.Name())
+			if !v.IsDir() {
+				// Leftover from an interrupted switch of the current link
+				if v.Name() != "current" && strings.HasPrefix(v.Name(), "current.") {
+					orphans = append(orphans, Orphan{Package: packageName, Path: path, Reason: "leftover temporary link"})
+				}
+				continue
+			}
+			if inFlightDir(v.Name()) {
+				if info, err := v.Info(); err == nil && time.Since(info.ModTime()) >= inFlightAge {
+					orphans = append(orphans, Orphan{Package: packageName, Path: path, Reason: "leftover of an interrupted install"})
+				}
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(path, ".metadata.json")); err != nil {
+				orphans = append(orphans, Orphan{Package: packageName, Version: v.Name(), Path: path, Reason: "missing .metadata.json"})
+				continue
+			}
+			if v.Name() != current {
+				orphans = append(orphans, Orphan{Package: packageName, Version: v.Name(), Path: path, Reason: "not the current version"})
+				continue
+			}
+			currentValid = true
+		}
+		if current != "" && !currentValid {
+			orphans = append(orphans, Orphan{Package: packageName, Version: current, Path: currentLink, Reason: "current points at a missing or incomplete version"})
+		}
+	}
+	return orphans, nil
+}
+
+// CleanOrphans removes everything ListOrphans reports and returns what was
+// removed, for the caller to report. A package left with no valid version is
+// reinstalled on next use.
+func (m *Manager) CleanOrphans() ([]Orphan, error) {
+	orphans, err := m.ListOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, o := range orphans {
+		if err := os.RemoveAll(o.Path); err != nil {
+			return orphans[:i], fmt.Errorf("failed to remove %s: %w", o.Path, err)
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,190 @@
+package pkgmgr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeLister struct {
+	versions []string
+	calls    int
+}
+
+func (f *fakeLister) ResolveLatestVersion(ctx context.Context) (string, error) {
+	return f.versions[0], nil
+}
+
+func (f *fakeLister) ListVersions(ctx context.Context) ([]string, error) {
+	f.calls++
+	return f.versions, nil
+}
+
+func TestAvailableVersions(t *testing.T) {
+	m := &Manager{}
+	lister := &fakeLister{versions: []string{"gopls/v0.20.0", "gopls/v0.21.1", "nightly", "gopls/v0.21.0-pre.1", "gopls/v0.9.5"}}
+
+	got, err := m.AvailableVersions(context.Background(), "go", lister)
+	if err != nil {
+		t.Fatalf("AvailableVersions failed: %v", err)
+	}
+	want := []string{"v0.21.1", "v0.21.0-pre.1", "v0.20.0", "v0.9.5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailableVersions = %v, want %v", got, want)
+	}
+
+	// A second call within the TTL reuses the cached listing
+	if _, err := m.AvailableVersions(context.Background(), "go", lister); err != nil {
+		t.Fatalf("AvailableVersions failed: %v", err)
+	}
+	if lister.calls != 1 {
+		t.Errorf("ListVersions called %d times, want 1", lister.calls)
+	}
+}
+
+func TestAvailableVersionsLatestOnly(t *testing.T) {
+	m := &Manager{}
+
+	got, err := m.AvailableVersions(context.Background(), "test", staticResolver("1.4.2"))
+	if err != nil {
+		t.Fatalf("AvailableVersions failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"1.4.2"}) {
+		t.Errorf("AvailableVersions = %v, want [1.4.2]", got)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	m, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	// A broken install: versions on disk but no current link or metadata
+	goDir := filepath.Join(m.packagesDir, "go")
+	if err := os.MkdirAll(filepath.Join(goDir, "v0.20.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	shim, _ := GetBinaryPath("gopls")
+	if err := os.WriteFile(shim, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	luaDir := filepath.Join(m.packagesDir, "lua", "3.17.1")
+	if err := os.MkdirAll(luaDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Purge("go"); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	if _, err := os.Stat(goDir); !os.IsNotExist(err) {
+		t.Errorf("package dir still exists after Purge: %v", err)
+	}
+	if _, err := os.Lstat(shim); !os.IsNotExist(err) {
+		t.Errorf("bin shim still exists after Purge: %v", err)
+	}
+	if _, err := os.Stat(luaDir); err != nil {
+		t.Errorf("Purge(go) removed another package: %v", err)
+	}
+
+	// Purging something that was never installed is not an error
+	if err := m.Purge("zig"); err != nil {
+		t.Errorf("Purge(zig) failed: %v", err)
+	}
+	for _, name := range []string{"", "..", "../bin"} {
+		if err := m.Purge(name); err == nil {
+			t.Errorf("Purge(%q) should be rejected", name)
+		}
+	}
+
+	if err := m.PurgeAll(); err != nil {
+		t.Fatalf("PurgeAll failed: %v", err)
+	}
+	entries, err := os.ReadDir(m.packagesDir)
+	if err != nil {
+		t.Fatalf("packages dir missing after PurgeAll: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("PurgeAll left %d packages behind", len(entries))
+	}
+}
+
+func TestListAndCleanOrphans(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	m, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	mkVersion := func(pkg, version string, withMetadata bool) string {
+		dir := filepath.Join(m.packagesDir, pkg, version)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if withMetadata {
+			if err := m.writePackageMetadata(pkg, version, &Package{Name: pkg, Version: version}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	// go: healthy current version, a stale old one and a failed install
+	goCurrent := mkVersion("go", "v0.21.0", true)
+	goOld := mkVersion("go", "v0.20.0", true)
+	goFailed := mkVersion("go", "v0.22.0", false)
+	if err := m.activateVersion("go", "v0.21.0"); err != nil {
+		t.Fatal(err)
+	}
+	// An install in progress is not an orphan, but one that died long ago is
+	staging := mkVersion("go", ".staging-v0.23.0-1", false)
+	stale := mkVersion("go", ".staging-v0.19.0-1", false)
+	longAgo := time.Now().Add(-2 * inFlightAge)
+	if err := os.Chtimes(stale, longAgo, longAgo); err != nil {
+		t.Fatal(err)
+	}
+	// lua: current points at a version that was removed
+	luaOnly := mkVersion("lua", "3.16.0", true)
+	if err := os.Symlink("3.17.1", filepath.Join(m.packagesDir, "lua", "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := m.ListOrphans()
+	if err != nil {
+		t.Fatalf("ListOrphans failed: %v", err)
+	}
+	got := make(map[string]string)
+	for _, o := range orphans {
+		got[o.Path] = o.Reason
+	}
+	want := map[string]string{
+		goOld:    "not the current version",
+		goFailed: "missing .metadata.json",
+		stale:    "leftover of an interrupted install",
+		luaOnly:  "not the current version",
+		filepath.Join(m.packagesDir, "lua", "current"): "current points at a missing or incomplete version",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListOrphans() = %v, want %v", got, want)
+	}
+
+	if _, err := m.CleanOrphans(); err != nil {
+		t.Fatalf("CleanOrphans failed: %v", err)
+	}
+	if orphans, _ := m.ListOrphans(); len(orphans) != 0 {
+		t.Errorf("orphans left after CleanOrphans: %v", orphans)
+	}
+	if installed, version, _ := m.IsInstalled("go"); !installed || version != "v0.21.0" {
+		t.Errorf("CleanOrphans broke the healthy install: %v %s", installed, version)
+	}
+	if _, err := os.Stat(goCurrent); err != nil {
+		t.Errorf("current version removed: %v", err)
+	}
+	if _, err := os.Stat(staging); err != nil {
+		t.Errorf("CleanOrphans removed an install in progress: %v", err)
+	}
+}
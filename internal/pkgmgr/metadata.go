@@ -4,51 +4,160 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"codemap/internal/budget"
 )
 
 // LSPMetadata defines version and download information for an LSP server.
 type LSPMetadata struct {
-	Name            string
-	Version         string            // Used as fallback if version resolution fails
-	BinaryName      string            // name of the executable in the archive
-	DownloadURLs    map[string]string // platform -> download URL template (use {version} placeholder)
-	Checksums       map[string]string // platform -> SHA256 checksum
-	IsArchive       bool              // whether download is an archive (tar.gz/zip)
-	ArchivePath     string            // path to binary within archive (if applicable)
-	VersionResolver VersionResolver   // Optional: resolver for fetching latest version dynamically
+	Name         string
+	Version      string            // Used as fallback if version resolution fails
+	BinaryName   string            // name of the executable in the archive
+	DownloadURLs map[string]string // platform -> download URL template (use {version} placeholder)
+	Checksums    map[string]string // platform -> hex checksum, computed with ChecksumAlgo
+	ChecksumAlgo string            // ChecksumSHA256 (the default when empty), ChecksumSHA512 or ChecksumSHA1
+	// ChecksumsURL is where the release publishes checksums of its downloads,
+	// used for platforms with no entry in Checksums: a checksums.txt listing
+	// or a per-file sidecar. {version} and {file}, the download's file name,
+	// are substituted.
+	ChecksumsURL string
+	IsArchive    bool              // whether download is an archive (tar.gz/zip) or a gzipped binary (.gz)
+	ArchivePath  string            // path to binary within archive (if applicable)
+	ArchivePaths map[string]string // platform -> ArchivePath, for platforms whose archive is laid out differently
+	// ExtractSingleBinary extracts the archive's only executable whatever its
+	// name, for releases that embed the version or target in the file name.
+	// ArchivePath is ignored when set.
+	ExtractSingleBinary bool
+	VersionResolver     VersionResolver // Optional: resolver for fetching latest version dynamically
+	VersionPrefix       string          // prefix the URL templates expect on {version} ("v" or "")
+	Runtime             string          // RuntimeNode for npm packages launched with node, RuntimeJava for Java distributions; "" for native binaries
+	VersionArgs         []string        // arguments that make the binary print its version; nil means --version
+	// ExtractAll unpacks the whole archive rather than the binary alone, for
+	// binaries that need files shipped beside them. ArchivePath then locates
+	// the binary among the unpacked files.
+	ExtractAll bool
 }
 
 // GetLSPMetadata returns metadata for a given language's LSP server.
 // It resolves the latest version dynamically if a VersionResolver is configured.
+// A latest version resolved within the version cache TTL is reused.
 func GetLSPMetadata(lang string) (*LSPMetadata, error) {
+	metadata, _, err := resolveLSPMetadata(context.Background(), lang, false)
+	return metadata, err
+}
+
+// RefreshLSPMetadata is GetLSPMetadata, but always asks the VersionResolver
+// for the latest version instead of reusing a cached one.
+func RefreshLSPMetadata(lang string) (*LSPMetadata, error) {
+	metadata, _, err := resolveLSPMetadata(context.Background(), lang, true)
+	return metadata, err
+}
+
+// ResolveLSPMetadata returns the metadata of each of langs, resolving their
+// latest versions concurrently. Resolution stops when ctx is done or timeout
+// has passed, whichever is first; languages not resolved by then keep their
+// fallback versions, and are logged. Unknown languages are left out.
+func ResolveLSPMetadata(ctx context.Context, langs []string, timeout time.Duration) map[string]*LSPMetadata {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		lang     string
+		metadata *LSPMetadata
+		resolved bool
+	}
+	results := make(chan result, len(langs))
+	for _, lang := range langs {
+		go func() {
+			// A lookup that cannot get a slot before the deadline falls back
+			if err := budget.Acquire(ctx); err == nil {
+				defer budget.Release()
+			}
+			metadata, resolved, err := resolveLSPMetadata(ctx, lang, false)
+			if err != nil {
+				log.Printf("[%s] Warning: %v", lang, err)
+			}
+			results <- result{lang, metadata, resolved}
+		}()
+	}
+
+	all := make(map[string]*LSPMetadata, len(langs))
+	var fellBack []string
+	for range langs {
+		r := <-results
+		if r.metadata == nil {
+			continue
+		}
+		all[r.lang] = r.metadata
+		if !r.resolved && r.metadata.VersionResolver != nil {
+			fellBack = append(fellBack, r.lang)
+		}
+	}
+	if len(fellBack) > 0 {
+		sort.Strings(fellBack)
+		log.Printf("Using fallback language server versions for: %s", strings.Join(fellBack, ", "))
+	}
+	return all
+}
+
+// resolveLSPMetadata implements GetLSPMetadata, giving up on the version
+// resolver when ctx is done. A version pinned with CODEMAP_LSP_VERSION_<LANG>
+// is used as is, and a pinned range resolved to its highest release.
+// Otherwise, unless refresh is set, a latest version cached within the TTL is
+// used without asking the resolver. It also reports whether the version was
+// pinned or resolved, rather than the fallback used.
+func resolveLSPMetadata(ctx context.Context, lang string, refresh bool) (*LSPMetadata, bool, error) {
 	metadata, ok := lspMetadata[lang]
 	if !ok {
-		return nil, fmt.Errorf("no metadata for language: %s", lang)
+		return nil, false, fmt.Errorf("%w: %s", ErrUnknownLanguage, lang)
 	}
 
 	// Clone metadata to avoid modifying the original
-	resolved := &LSPMetadata{
-		Name:            metadata.Name,
-		Version:         metadata.Version,
-		BinaryName:      metadata.BinaryName,
-		DownloadURLs:    make(map[string]string),
-		Checksums:       metadata.Checksums,
-		IsArchive:       metadata.IsArchive,
-		ArchivePath:     metadata.ArchivePath,
-		VersionResolver: metadata.VersionResolver,
-	}
-
-	// Resolve latest version if resolver is configured
-	if metadata.VersionResolver != nil {
-		ctx := context.Background()
-		latestVersion, err := metadata.VersionResolver.ResolveLatestVersion(ctx)
+	clone := *metadata
+	resolved := &clone
+	resolved.DownloadURLs = make(map[string]string)
+
+	// Use a pinned version, or resolve the latest if a resolver is configured
+	latest := false
+	if pinned := pinnedVersion(lang); pinned != "" {
+		version, err := resolvePinnedVersion(ctx, metadata, pinned)
 		if err != nil {
-			log.Printf("[%s] Warning: failed to resolve latest version, using fallback %s: %v",
+			return nil, false, fmt.Errorf("CODEMAP_LSP_VERSION_%s: %w", strings.ToUpper(lang), err)
+		}
+		resolved.Version = version
+		latest = true
+	} else if metadata.VersionResolver != nil && !Offline() {
+		ttl := versionCacheTTL()
+		cached, haveCached := cachedLatestVersion(lang, metadata.VersionResolver)
+		if !refresh && haveCached && ttl > 0 && time.Since(cached.ResolvedAt) < ttl {
+			resolved.Version = cached.Version
+			latest = true
+		} else if latestVersion, err := metadata.VersionResolver.ResolveLatestVersion(ctx); err != nil {
+			if haveCached {
+				// A version that was the latest recently beats the fallback
+				log.Printf("[%s] Warning: failed to resolve latest version, using %s resolved %s: %v",
+					lang, cached.Version, cached.ResolvedAt.Format(time.RFC3339), err)
+				resolved.Version = cached.Version
+				latest = true
+			} else {
+				log.Printf("[%s] Warning: failed to resolve latest version, using fallback %s: %v",
+					lang, metadata.Version, err)
+			}
+		} else if version, err := normalizeVersion(latestVersion, metadata.VersionPrefix); err != nil {
+			log.Printf("[%s] Warning: resolved version is unusable, using fallback %s: %v",
 				lang, metadata.Version, err)
 		} else {
-			resolved.Version = latestVersion
-			log.Printf("[%s] Resolved latest version: %s", lang, latestVersion)
+			resolved.Version = version
+			latest = true
+			log.Printf("[%s] Resolved latest version: %s", lang, version)
+			if ttl > 0 {
+				storeLatestVersion(lang, metadata.VersionResolver, version)
+			}
 		}
 	}
 
@@ -56,8 +165,84 @@ func GetLSPMetadata(lang string) (*LSPMetadata, error) {
 	for platform, urlTemplate := range metadata.DownloadURLs {
 		resolved.DownloadURLs[platform] = strings.ReplaceAll(urlTemplate, "{version}", resolved.Version)
 	}
+	resolved.ChecksumsURL = strings.ReplaceAll(metadata.ChecksumsURL, "{version}", resolved.Version)
+
+	return resolved, latest, nil
+}
+
+// pinnedVersion returns the version of lang's server pinned with
+// CODEMAP_LSP_VERSION_<LANG>, e.g. CODEMAP_LSP_VERSION_GO=v0.20.0, or "".
+func pinnedVersion(lang string) string {
+	return strings.TrimSpace(os.Getenv("CODEMAP_LSP_VERSION_" + strings.ToUpper(lang)))
+}
+
+// resolvePinnedVersion turns a pin into the version to install. An exact
+// version is used as is; a range such as "~0.18" is resolved to the highest
+// matching release the VersionResolver lists.
+func resolvePinnedVersion(ctx context.Context, metadata *LSPMetadata, pinned string) (string, error) {
+	if !isVersionRange(pinned) {
+		return normalizeVersion(pinned, metadata.VersionPrefix)
+	}
+
+	match, err := parseVersionRange(pinned)
+	if err != nil {
+		return "", err
+	}
+	lister, ok := metadata.VersionResolver.(VersionLister)
+	if !ok {
+		return "", fmt.Errorf("cannot resolve range %q: %s releases cannot be listed", pinned, metadata.Name)
+	}
+	if Offline() {
+		return "", fmt.Errorf("cannot resolve range %q offline; pin an exact version", pinned)
+	}
+	versions, err := lister.ListVersions(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve range %q: %w", pinned, err)
+	}
+
+	best := ""
+	for _, v := range versions {
+		if _, err := normalizeVersion(v, ""); err != nil || !match(v) {
+			continue
+		}
+		if best == "" || compareVersions(v, best) > 0 {
+			best = v
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no %s release matches %q", metadata.Name, pinned)
+	}
+	return normalizeVersion(best, metadata.VersionPrefix)
+}
+
+// archivePathFor returns where the binary lives in platform's archive: its
+// ArchivePaths entry if there is one, otherwise ArchivePath.
+func (m *LSPMetadata) archivePathFor(platform string) string {
+	if path, ok := m.ArchivePaths[platform]; ok && path != "" {
+		return path
+	}
+	return m.ArchivePath
+}
+
+// versionPattern matches a bare dotted version with an optional pre-release or
+// build suffix, e.g. "0.21.1", "1.1.408" or "0.3.1001-rc.1", or a date tag
+// such as rust-analyzer's "2025-10-13".
+var versionPattern = regexp.MustCompile(`^([0-9]+(\.[0-9]+)+([-+][0-9A-Za-z.+-]+)?|[0-9]{4}-[0-9]{2}-[0-9]{2})$`)
+
+// normalizeVersion turns a resolver result into the form the URL templates
+// expect. It drops tag path prefixes ("gopls/v0.21.1" → "v0.21.1"), applies
+// prefix ("v" or none) and rejects anything that does not look like a version.
+func normalizeVersion(raw, prefix string) (string, error) {
+	version := strings.TrimSpace(raw)
+	if i := strings.LastIndex(version, "/"); i >= 0 {
+		version = version[i+1:]
+	}
+	version = strings.TrimPrefix(version, "v")
 
-	return resolved, nil
+	if !versionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid version %q", raw)
+	}
+	return prefix + version, nil
 }
 
 // LSP metadata with dynamic version resolution
@@ -82,7 +267,9 @@ var lspMetadata = map[string]*LSPMetadata{
 		},
 		IsArchive:       true,
 		ArchivePath:     "gopls",
-		VersionResolver: NewGitHubResolver("golang", "tools", ""),
+		VersionResolver: NewGitHubResolver("golang", "tools", "gopls/"),
+		VersionPrefix:   "v",
+		VersionArgs:     []string{"version"},
 	},
 	"python": {
 		Name:       "pyright",
@@ -105,6 +292,7 @@ var lspMetadata = map[string]*LSPMetadata{
 		IsArchive:       true,
 		ArchivePath:     "package/langserver.index.js",
 		VersionResolver: NewNPMResolver("pyright"),
+		Runtime:         RuntimeNode,
 	},
 	"typescript": {
 		Name:       "typescript-language-server",
@@ -127,6 +315,7 @@ var lspMetadata = map[string]*LSPMetadata{
 		IsArchive:       true,
 		ArchivePath:     "package/lib/cli.mjs",
 		VersionResolver: NewNPMResolver("typescript-language-server"),
+		Runtime:         RuntimeNode,
 	},
 	"lua": {
 		Name:       "lua-language-server",
@@ -172,6 +361,73 @@ var lspMetadata = map[string]*LSPMetadata{
 		ArchivePath:     "zls",
 		VersionResolver: NewGitHubResolver("zigtools", "zls", ""),
 	},
+	"rust": {
+		Name:       "rust-analyzer",
+		Version:    "2025-10-13", // Fallback version
+		BinaryName: "rust-analyzer",
+		DownloadURLs: map[string]string{
+			"linux-x86_64":   "https://github.com/rust-lang/rust-analyzer/releases/download/{version}/rust-analyzer-x86_64-unknown-linux-gnu.gz",
+			"linux-arm64":    "https://github.com/rust-lang/rust-analyzer/releases/download/{version}/rust-analyzer-aarch64-unknown-linux-gnu.gz",
+			"darwin-x86_64":  "https://github.com/rust-lang/rust-analyzer/releases/download/{version}/rust-analyzer-x86_64-apple-darwin.gz",
+			"darwin-arm64":   "https://github.com/rust-lang/rust-analyzer/releases/download/{version}/rust-analyzer-aarch64-apple-darwin.gz",
+			"windows-x86_64": "https://github.com/rust-lang/rust-analyzer/releases/download/{version}/rust-analyzer-x86_64-pc-windows-msvc.gz",
+		},
+		Checksums: map[string]string{
+			"linux-x86_64":   "",
+			"linux-arm64":    "",
+			"darwin-x86_64":  "",
+			"darwin-arm64":   "",
+			"windows-x86_64": "",
+		},
+		IsArchive:       true, // a single gzipped binary
+		VersionResolver: NewGitHubResolver("rust-lang", "rust-analyzer", ""),
+	},
+	"java": {
+		Name:       "jdtls",
+		Version:    "latest", // unversioned snapshots: installed once and never updated; purge java for a newer one
+		BinaryName: "jdtls",
+		DownloadURLs: map[string]string{
+			"linux-x86_64":   "https://download.eclipse.org/jdtls/snapshots/jdt-language-server-latest.tar.gz",
+			"linux-arm64":    "https://download.eclipse.org/jdtls/snapshots/jdt-language-server-latest.tar.gz",
+			"darwin-x86_64":  "https://download.eclipse.org/jdtls/snapshots/jdt-language-server-latest.tar.gz",
+			"darwin-arm64":   "https://download.eclipse.org/jdtls/snapshots/jdt-language-server-latest.tar.gz",
+			"windows-x86_64": "https://download.eclipse.org/jdtls/snapshots/jdt-language-server-latest.tar.gz",
+		},
+		Checksums: map[string]string{
+			"linux-x86_64":   "",
+			"linux-arm64":    "",
+			"darwin-x86_64":  "",
+			"darwin-arm64":   "",
+			"windows-x86_64": "",
+		},
+		IsArchive:    true,
+		ArchivePath:  "bin/jdtls",
+		ArchivePaths: map[string]string{"windows-x86_64": "bin/jdtls.bat"},
+		Runtime:      RuntimeJava,
+	},
+	"cpp": {
+		Name:       "clangd",
+		Version:    "19.1.2", // Fallback version
+		BinaryName: "clangd",
+		// clangd publishes no linux-arm64 build, and one macOS build for both
+		// architectures
+		DownloadURLs: map[string]string{
+			"linux-x86_64":   "https://github.com/clangd/clangd/releases/download/{version}/clangd-linux-{version}.zip",
+			"darwin-x86_64":  "https://github.com/clangd/clangd/releases/download/{version}/clangd-mac-{version}.zip",
+			"darwin-arm64":   "https://github.com/clangd/clangd/releases/download/{version}/clangd-mac-{version}.zip",
+			"windows-x86_64": "https://github.com/clangd/clangd/releases/download/{version}/clangd-windows-{version}.zip",
+		},
+		Checksums: map[string]string{
+			"linux-x86_64":   "",
+			"darwin-x86_64":  "",
+			"darwin-arm64":   "",
+			"windows-x86_64": "",
+		},
+		IsArchive:       true,
+		ArchivePath:     "bin/clangd", // under clangd_<version>/
+		ExtractAll:      true,         // clangd finds its builtin headers in lib/ beside bin/
+		VersionResolver: NewGitHubResolver("clangd", "clangd", ""),
+	},
 	"templ": {
 		Name:       "templ",
 		Version:    "v0.3.1001", // Fallback version
@@ -193,11 +449,35 @@ var lspMetadata = map[string]*LSPMetadata{
 			"windows-arm64":  "",
 		},
 		IsArchive:       true,
+		ChecksumsURL:    "https://github.com/a-h/templ/releases/download/{version}/checksums.txt",
 		ArchivePath:     "templ",
 		VersionResolver: NewGitHubResolver("a-h", "templ", ""),
+		VersionPrefix:   "v",
+		VersionArgs:     []string{"version"},
 	},
 }
 
+// LookupLSPMetadata returns a copy of the static metadata for lang without
+// resolving the latest version, so {version} placeholders are left intact.
+func LookupLSPMetadata(lang string) (*LSPMetadata, bool) {
+	metadata, ok := lspMetadata[lang]
+	if !ok {
+		return nil, false
+	}
+	clone := *metadata
+	return &clone, true
+}
+
+// SupportedLanguages returns the languages that have LSP metadata, sorted.
+func SupportedLanguages() []string {
+	langs := make([]string, 0, len(lspMetadata))
+	for lang := range lspMetadata {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
 // GetLanguageByBinaryName maps a binary name back to its language identifier.
 func GetLanguageByBinaryName(binaryName string) string {
 	for lang, meta := range lspMetadata {
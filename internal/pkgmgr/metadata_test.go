@@ -0,0 +1,460 @@
+package pkgmgr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeVersion(t *testing.T) {
+	tests := []struct {
+		raw     string
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"v0.21.1", "v", "v0.21.1", false},
+		{"0.21.1", "v", "v0.21.1", false},
+		{"gopls/v0.21.1", "v", "v0.21.1", false},
+		{"v3.17.1", "", "3.17.1", false},
+		{" 1.1.408\n", "", "1.1.408", false},
+		{"0.3.1001-rc.1", "v", "v0.3.1001-rc.1", false},
+		{"2025-10-13", "", "2025-10-13", false},
+		{"2025-10", "", "", true},
+		{"", "", "", true},
+		{"   ", "v", "", true},
+		{"Release 3.17.1", "", "", true},
+		{"3.17.1\nextra", "", "", true},
+		{"latest", "", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeVersion(tt.raw, tt.prefix)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeVersion(%q, %q) error = %v, wantErr %v", tt.raw, tt.prefix, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeVersion(%q, %q) = %q, want %q", tt.raw, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRustMetadataURLs(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	t.Setenv("CODEMAP_LSP_VERSION_RUST", "2025-10-13")
+
+	meta, err := GetLSPMetadata("rust")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if meta.BinaryName != "rust-analyzer" || meta.Version != "2025-10-13" {
+		t.Errorf("BinaryName %q, Version %q; want rust-analyzer 2025-10-13", meta.BinaryName, meta.Version)
+	}
+	for _, goos := range []string{"linux", "darwin", "windows"} {
+		for _, goarch := range []string{"amd64", "arm64"} {
+			if goos == "windows" && goarch == "arm64" {
+				continue
+			}
+			platform := platformKey(goos, goarch)
+			url := meta.DownloadURLs[platform]
+			if !strings.HasPrefix(url, "https://github.com/rust-lang/rust-analyzer/releases/download/2025-10-13/rust-analyzer-") ||
+				!strings.HasSuffix(url, ".gz") || strings.HasSuffix(url, ".tar.gz") {
+				t.Errorf("%s: URL %q, want a gzipped rust-analyzer binary from the 2025-10-13 release", platform, url)
+			}
+		}
+	}
+	for platform := range meta.Checksums {
+		if _, ok := meta.DownloadURLs[platform]; !ok {
+			t.Errorf("checksum for %s, which has no download", platform)
+		}
+	}
+
+	// The installer looks downloads up by GetPlatformKey
+	if _, ok := meta.DownloadURLs[GetPlatformKey()]; !ok && runtime.GOARCH == "amd64" {
+		t.Errorf("no rust-analyzer download for this host (%s)", GetPlatformKey())
+	}
+}
+
+func TestJavaAndCppPlatformURLs(t *testing.T) {
+	platforms := []string{
+		platformKey("linux", "amd64"), platformKey("linux", "arm64"),
+		platformKey("darwin", "amd64"), platformKey("darwin", "arm64"),
+		platformKey("windows", "amd64"),
+	}
+	tests := []struct {
+		lang    string
+		missing string // platform without a published build
+	}{
+		{"java", ""},
+		{"cpp", "linux-arm64"},
+	}
+	for _, tt := range tests {
+		meta, ok := LookupLSPMetadata(tt.lang)
+		if !ok {
+			t.Errorf("%s: no LSP metadata", tt.lang)
+			continue
+		}
+		for _, platform := range platforms {
+			url, ok := meta.DownloadURLs[platform]
+			if platform == tt.missing {
+				if ok {
+					t.Errorf("%s: unexpected URL for %s", tt.lang, platform)
+				}
+				continue
+			}
+			if !ok || !strings.HasPrefix(url, "https://") {
+				t.Errorf("%s: URL for %s = %q, want one", tt.lang, platform, url)
+			}
+			if _, ok := meta.Checksums[platform]; !ok {
+				t.Errorf("%s: no Checksums entry for %s", tt.lang, platform)
+			}
+		}
+		if len(meta.DownloadURLs) != len(meta.Checksums) {
+			t.Errorf("%s: %d download URLs but %d checksum entries", tt.lang, len(meta.DownloadURLs), len(meta.Checksums))
+		}
+		for platform := range meta.ArchivePaths {
+			if _, ok := meta.DownloadURLs[platform]; !ok {
+				t.Errorf("%s: ArchivePaths entry for %s, which is not a platform key with a download", tt.lang, platform)
+			}
+		}
+	}
+
+	// clangd's URLs follow the resolved version
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	t.Setenv("CODEMAP_LSP_VERSION_CPP", "20.1.0")
+	meta, err := GetLSPMetadata("cpp")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if got := meta.DownloadURLs[platformKey("linux", "amd64")]; got != "https://github.com/clangd/clangd/releases/download/20.1.0/clangd-linux-20.1.0.zip" {
+		t.Errorf("clangd linux URL = %q", got)
+	}
+}
+
+type staticResolver string
+
+func (r staticResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
+	return string(r), nil
+}
+
+func TestGetLSPMetadataFallsBackOnInvalidVersion(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	lspMetadata["test-lang"] = &LSPMetadata{
+		Name:            "test-ls",
+		Version:         "1.0.0",
+		DownloadURLs:    map[string]string{"linux-amd64": "https://example.com/{version}/test-ls.tar.gz"},
+		VersionResolver: staticResolver("Release title"),
+		ChecksumAlgo:    ChecksumSHA512,
+		Runtime:         RuntimeNode,
+	}
+	defer delete(lspMetadata, "test-lang")
+
+	meta, err := GetLSPMetadata("test-lang")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if meta.Version != "1.0.0" {
+		t.Errorf("Version = %q, want fallback 1.0.0", meta.Version)
+	}
+	if got := meta.DownloadURLs["linux-amd64"]; got != "https://example.com/1.0.0/test-ls.tar.gz" {
+		t.Errorf("DownloadURL = %q", got)
+	}
+	if meta.ChecksumAlgo != ChecksumSHA512 || meta.Runtime != RuntimeNode {
+		t.Errorf("resolved metadata dropped fields: ChecksumAlgo %q, Runtime %q", meta.ChecksumAlgo, meta.Runtime)
+	}
+}
+
+func TestGetLSPMetadataKeepsRuntime(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	t.Setenv("CODEMAP_OFFLINE", "1")
+	meta, err := GetLSPMetadata("python")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if meta.Runtime != RuntimeNode {
+		t.Errorf("python Runtime = %q, want %q", meta.Runtime, RuntimeNode)
+	}
+}
+
+func TestGetLSPMetadataKeepsExtractSingleBinary(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	lspMetadata["single-lang"] = &LSPMetadata{Name: "single-ls", Version: "1.0.0",
+		DownloadURLs: map[string]string{"linux-amd64": "https://example.com/{version}/ls.zip"}, ExtractSingleBinary: true}
+	defer delete(lspMetadata, "single-lang")
+
+	meta, err := GetLSPMetadata("single-lang")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if !meta.ExtractSingleBinary {
+		t.Error("resolved metadata dropped ExtractSingleBinary")
+	}
+}
+
+// blockingResolver never answers before its context is done.
+type blockingResolver struct{}
+
+func (blockingResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestResolveLSPMetadataFallsBackOnTimeout(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	lspMetadata["fast-lang"] = &LSPMetadata{Name: "fast-ls", Version: "1.0.0", VersionResolver: staticResolver("2.0.0")}
+	lspMetadata["slow-lang"] = &LSPMetadata{Name: "slow-ls", Version: "1.0.0", VersionResolver: blockingResolver{}}
+	defer delete(lspMetadata, "fast-lang")
+	defer delete(lspMetadata, "slow-lang")
+
+	start := time.Now()
+	all := ResolveLSPMetadata(context.Background(), []string{"fast-lang", "slow-lang", "cobol"}, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("resolution took %s despite the timeout", elapsed)
+	}
+
+	if len(all) != 2 {
+		t.Fatalf("resolved %d languages, want 2 (unknown ones left out)", len(all))
+	}
+	if got := all["fast-lang"].Version; got != "2.0.0" {
+		t.Errorf("fast-lang version = %q, want the resolved 2.0.0", got)
+	}
+	if got := all["slow-lang"].Version; got != "1.0.0" {
+		t.Errorf("slow-lang version = %q, want the fallback 1.0.0", got)
+	}
+}
+
+// countingResolver answers with version, or fails if version is empty, and
+// counts how often it was asked.
+type countingResolver struct {
+	version string
+	calls   int
+}
+
+func (r *countingResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
+	r.calls++
+	if r.version == "" {
+		return "", errors.New("rate limited")
+	}
+	return r.version, nil
+}
+
+func TestGetLSPMetadataCachesLatestVersion(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	resolver := &countingResolver{version: "2.0.0"}
+	lspMetadata["cached-lang"] = &LSPMetadata{Name: "cached-ls", Version: "1.0.0",
+		DownloadURLs: map[string]string{"linux-amd64": "https://example.com/{version}/ls"}, VersionResolver: resolver}
+	defer delete(lspMetadata, "cached-lang")
+
+	for i := 0; i < 2; i++ {
+		meta, err := GetLSPMetadata("cached-lang")
+		if err != nil {
+			t.Fatalf("GetLSPMetadata failed: %v", err)
+		}
+		if meta.Version != "2.0.0" || meta.DownloadURLs["linux-amd64"] != "https://example.com/2.0.0/ls" {
+			t.Errorf("call %d: Version %q, URL %q; want 2.0.0 from the cache", i, meta.Version, meta.DownloadURLs["linux-amd64"])
+		}
+	}
+	if resolver.calls != 1 {
+		t.Errorf("resolver called %d times, want 1 (second call cached)", resolver.calls)
+	}
+
+	resolver.version = "2.1.0"
+	if meta, err := RefreshLSPMetadata("cached-lang"); err != nil || meta.Version != "2.1.0" {
+		t.Errorf("RefreshLSPMetadata = %v, %v; want 2.1.0 resolved live", meta, err)
+	}
+	if resolver.calls != 2 {
+		t.Errorf("resolver called %d times, want 2 after a refresh", resolver.calls)
+	}
+
+	// An unreachable resolver is worked around with the last known version
+	t.Setenv("CODEMAP_VERSION_CACHE_TTL", "1ns")
+	resolver.version = ""
+	if meta, err := GetLSPMetadata("cached-lang"); err != nil || meta.Version != "2.1.0" {
+		t.Errorf("GetLSPMetadata with a failing resolver = %v, %v; want the stale 2.1.0", meta, err)
+	}
+
+	// A TTL of zero turns the cache off
+	t.Setenv("CODEMAP_VERSION_CACHE_TTL", "0")
+	resolver.version = "3.0.0"
+	calls := resolver.calls
+	for i := 0; i < 2; i++ {
+		if _, err := GetLSPMetadata("cached-lang"); err != nil {
+			t.Fatalf("GetLSPMetadata failed: %v", err)
+		}
+	}
+	if resolver.calls != calls+2 {
+		t.Errorf("resolver called %d times with TTL 0, want %d", resolver.calls-calls, 2)
+	}
+}
+
+// sourcedResolver is a countingResolver that names its source, as the GitHub
+// and npm resolvers do.
+type sourcedResolver struct {
+	countingResolver
+	source string
+}
+
+func (r *sourcedResolver) String() string { return r.source }
+
+func TestGetLSPMetadataCacheFollowsResolver(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	stable := &sourcedResolver{countingResolver{version: "2.0.0"}, "npm:cached-ls@latest"}
+	lspMetadata["cached-lang"] = &LSPMetadata{Name: "cached-ls", Version: "1.0.0", VersionResolver: stable}
+	defer delete(lspMetadata, "cached-lang")
+
+	if meta, err := GetLSPMetadata("cached-lang"); err != nil || meta.Version != "2.0.0" {
+		t.Fatalf("GetLSPMetadata = %v, %v; want 2.0.0", meta, err)
+	}
+
+	// Switching to another dist-tag must not reuse the cached version
+	next := &sourcedResolver{countingResolver{version: "3.0.0-rc.1"}, "npm:cached-ls@next"}
+	lspMetadata["cached-lang"].VersionResolver = next
+	if meta, err := GetLSPMetadata("cached-lang"); err != nil || meta.Version != "3.0.0-rc.1" || next.calls != 1 {
+		t.Errorf("GetLSPMetadata = %v, %v after %d calls; want 3.0.0-rc.1 resolved live", meta, err, next.calls)
+	}
+
+	// Each resolver keeps its own entry
+	lspMetadata["cached-lang"].VersionResolver = stable
+	if meta, err := GetLSPMetadata("cached-lang"); err != nil || meta.Version != "2.0.0" || stable.calls != 1 {
+		t.Errorf("GetLSPMetadata = %v, %v after %d calls; want the cached 2.0.0", meta, err, stable.calls)
+	}
+}
+
+func TestResolverCacheIdentity(t *testing.T) {
+	keys := map[string]bool{}
+	for _, r := range []VersionResolver{
+		NewGitHubResolver("golang", "tools", "gopls/"),
+		NewGitHubResolver("golang", "tools", "gopls/").WithPrefixStripped(),
+		NewGitHubResolver("golang", "tools", ""),
+		NewNPMResolver("pyright"),
+		NewNPMResolver("pyright").WithDistTag("next"),
+	} {
+		key := versionCacheKey("lang", r)
+		if keys[key] {
+			t.Errorf("resolvers share the cache key %q", key)
+		}
+		keys[key] = true
+	}
+	if got := versionCacheKey("lang", NewNPMResolver("pyright").WithDistTag("latest")); got != versionCacheKey("lang", NewNPMResolver("pyright")) {
+		t.Errorf("explicit latest dist-tag has key %q, want the default's", got)
+	}
+}
+
+func TestGetLSPMetadataIgnoresCorruptVersionCache(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	resolver := &countingResolver{version: "2.0.0"}
+	lspMetadata["cached-lang"] = &LSPMetadata{Name: "cached-ls", Version: "1.0.0", VersionResolver: resolver}
+	defer delete(lspMetadata, "cached-lang")
+
+	path, err := versionCachePath()
+	if err != nil {
+		t.Fatalf("versionCachePath failed: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"cached-lang": {"version": "9.9`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := GetLSPMetadata("cached-lang")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if meta.Version != "2.0.0" || resolver.calls != 1 {
+		t.Errorf("Version = %q after %d resolver calls, want 2.0.0 resolved live", meta.Version, resolver.calls)
+	}
+
+	// The corrupt cache is replaced by a usable one
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading version cache: %v", err)
+	}
+	if !strings.Contains(string(data), `"version": "2.0.0"`) {
+		t.Errorf("version cache = %s, want the resolved version", data)
+	}
+}
+
+func TestGetLSPMetadataUsesPinnedVersion(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	resolver := &countingResolver{version: "2.0.0"}
+	lspMetadata["pinned-lang"] = &LSPMetadata{Name: "pinned-ls", Version: "1.0.0", VersionPrefix: "v",
+		DownloadURLs: map[string]string{"linux-amd64": "https://example.com/{version}/ls"}, VersionResolver: resolver}
+	defer delete(lspMetadata, "pinned-lang")
+
+	t.Setenv("CODEMAP_LSP_VERSION_PINNED-LANG", "1.5.0")
+	meta, err := GetLSPMetadata("pinned-lang")
+	if err != nil {
+		t.Fatalf("GetLSPMetadata failed: %v", err)
+	}
+	if meta.Version != "v1.5.0" || meta.DownloadURLs["linux-amd64"] != "https://example.com/v1.5.0/ls" {
+		t.Errorf("Version %q, URL %q; want the pinned v1.5.0", meta.Version, meta.DownloadURLs["linux-amd64"])
+	}
+	if resolver.calls != 0 {
+		t.Errorf("resolver called %d times despite the pin", resolver.calls)
+	}
+
+	// A pin is an exact request, so a malformed one is an error, not a fallback
+	t.Setenv("CODEMAP_LSP_VERSION_PINNED-LANG", "latest")
+	if _, err := GetLSPMetadata("pinned-lang"); err == nil || !strings.Contains(err.Error(), "CODEMAP_LSP_VERSION_PINNED-LANG") {
+		t.Errorf("GetLSPMetadata with an invalid pin error = %v, want one naming the variable", err)
+	}
+}
+
+// listingResolver lists a fixed set of releases.
+type listingResolver []string
+
+func (r listingResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
+	return r[0], nil
+}
+
+func (r listingResolver) ListVersions(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+func TestGetLSPMetadataResolvesPinnedRange(t *testing.T) {
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	lspMetadata["range-lang"] = &LSPMetadata{Name: "range-ls", Version: "v0.21.1", VersionPrefix: "v",
+		DownloadURLs: map[string]string{"linux-amd64": "https://example.com/{version}/ls"},
+		VersionResolver: listingResolver{"gopls/v0.21.1", "gopls/v0.18.1", "gopls/v0.19.0-pre.1",
+			"gopls/v0.18.10", "gopls/v0.17.3", "not-a-version"}}
+	defer delete(lspMetadata, "range-lang")
+
+	tests := []struct {
+		pin  string
+		want string
+	}{
+		{"~0.18", "v0.18.10"},
+		{"v0.18.1", "v0.18.1"},
+		{"^0.17.0", "v0.17.3"},
+		{"0.x", "v0.21.1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("CODEMAP_LSP_VERSION_RANGE-LANG", tt.pin)
+		meta, err := GetLSPMetadata("range-lang")
+		if err != nil {
+			t.Errorf("pin %q: GetLSPMetadata failed: %v", tt.pin, err)
+			continue
+		}
+		if meta.Version != tt.want || meta.DownloadURLs["linux-amd64"] != "https://example.com/"+tt.want+"/ls" {
+			t.Errorf("pin %q: Version %q, URL %q; want %s", tt.pin, meta.Version, meta.DownloadURLs["linux-amd64"], tt.want)
+		}
+	}
+
+	// A range nothing matches, or that cannot be listed, is an error
+	t.Setenv("CODEMAP_LSP_VERSION_RANGE-LANG", "~0.30")
+	if _, err := GetLSPMetadata("range-lang"); err == nil {
+		t.Error("GetLSPMetadata with an unmatched range succeeded")
+	}
+	lspMetadata["range-lang"].VersionResolver = staticResolver("v0.21.1")
+	t.Setenv("CODEMAP_LSP_VERSION_RANGE-LANG", "~0.18")
+	if _, err := GetLSPMetadata("range-lang"); err == nil {
+		t.Error("GetLSPMetadata resolved a range without a release list")
+	}
+}
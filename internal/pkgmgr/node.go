@@ -0,0 +1,182 @@
+package pkgmgr
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// RuntimeNode marks LSP packages that are npm tarballs run with node.
+const RuntimeNode = "node"
+
+// minNodeMajor is the oldest Node.js major version the npm-based servers
+// (pyright, typescript-language-server) support.
+const minNodeMajor = 18
+
+// nodeVersion runs "node --version"; a variable so tests can stub it.
+var nodeVersion = func(nodePath string) (string, error) {
+	out, err := exec.Command(nodePath, "--version").Output()
+	return string(out), err
+}
+
+// CheckRuntime verifies that the runtime a package needs to launch is present.
+// Packages without a runtime need nothing and always pass.
+func CheckRuntime(metadata *LSPMetadata) error {
+	if metadata.Runtime == RuntimeJava {
+		return checkJava(metadata)
+	}
+	if metadata.Runtime != RuntimeNode {
+		return nil
+	}
+
+	nodePath, err := exec.LookPath("node")
+	if err != nil {
+		return fmt.Errorf("%s requires Node.js %d or newer, but node was not found on PATH; install it from https://nodejs.org",
+			metadata.Name, minNodeMajor)
+	}
+	raw, err := nodeVersion(nodePath)
+	if err != nil {
+		return fmt.Errorf("%s requires Node.js %d or newer, but %s --version failed: %w",
+			metadata.Name, minNodeMajor, nodePath, err)
+	}
+	major, err := parseNodeMajor(raw)
+	if err != nil {
+		return fmt.Errorf("%s requires Node.js %d or newer: %w", metadata.Name, minNodeMajor, err)
+	}
+	if major < minNodeMajor {
+		return fmt.Errorf("%s requires Node.js %d or newer, but %s is %s; upgrade it from https://nodejs.org",
+			metadata.Name, minNodeMajor, nodePath, strings.TrimSpace(raw))
+	}
+	return nil
+}
+
+// parseNodeMajor extracts the major version from "node --version" output
+// such as "v20.11.1".
+func parseNodeMajor(raw string) (int, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(raw), "v")
+	if i := strings.Index(v, "."); i >= 0 {
+		v = v[:i]
+	}
+	major, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("unrecognized node version %q", strings.TrimSpace(raw))
+	}
+	return major, nil
+}
+
+// installNodePackage unpacks a whole npm tarball into destDir, since the entry
+// script needs the rest of the package beside it, and writes an executable
+// launcher that runs platform's entry with node. It returns the launcher's
+// path.
+func installNodePackage(ctx context.Context, fsys writeFS, limits extractLimits, archivePath, destDir string, metadata *LSPMetadata, platform string) (string, error) {
+	if err := extractTarGzAll(ctx, fsys, limits, archivePath, destDir); err != nil {
+		return "", err
+	}
+
+	entry := filepath.Join(destDir, filepath.FromSlash(metadata.archivePathFor(platform)))
+	if _, err := os.Stat(entry); err != nil {
+		return "", fmt.Errorf("entry script not found in package: %s", metadata.archivePathFor(platform))
+	}
+	return writeNodeLauncher(destDir, metadata.BinaryName, entry)
+}
+
+// writeNodeLauncher writes a script named binaryName in dir that runs entry
+// with node, passing its arguments through.
+func writeNodeLauncher(dir, binaryName, entry string) (string, error) {
+	var path, script string
+	if runtime.GOOS == "windows" {
+		path = filepath.Join(dir, binaryName+".cmd")
+		script = fmt.Sprintf("@echo off\r\nnode \"%s\" %%*\r\n", entry)
+	} else {
+		path = filepath.Join(dir, binaryName)
+		script = fmt.Sprintf("#!/bin/sh\nexec node '%s' \"$@\"\n", strings.ReplaceAll(entry, "'", `'\''`))
+	}
+
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return "", fmt.Errorf("failed to write launcher: %w", err)
+	}
+	return path, nil
+}
+
+// extractTarGzAll extracts every regular file and directory of a .tar.gz
+// archive into destDir on fsys, refusing entries that would land outside it
+// and stopping once a file or the archive as a whole exceeds limits. If ctx is
+// cancelled it stops between entries and returns ctx.Err(). On any error it
+// removes the files it already wrote.
+func extractTarGzAll(ctx context.Context, fsys writeFS, limits extractLimits, archivePath, destDir string) (err error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	root := filepath.Clean(destDir) + string(os.PathSeparator)
+	var written []string
+	var total int64
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				fsys.Remove(path)
+			}
+		}
+	}()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar read error: %w", err)
+		}
+
+		target := filepath.Join(destDir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, root) {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchive, header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := fsys.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+		case tar.TypeReg:
+			if header.Size > limits.Entry || header.Size > limits.Total-total {
+				return fmt.Errorf("failed to extract %s: %w: entry of %d bytes", target, ErrExtractLimit, header.Size)
+			}
+			if err := fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+			out, err := fsys.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm()|0600)
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+			written = append(written, target)
+			n, err := copyLimited(out, ctxReader{ctx: ctx, r: tr}, min(limits.Entry, limits.Total-total))
+			total += n
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", target, err)
+			}
+		}
+	}
+}
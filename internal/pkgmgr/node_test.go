@@ -0,0 +1,158 @@
+package pkgmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseNodeMajor(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{"v20.11.1\n", 20, false},
+		{"v18.0.0", 18, false},
+		{"22", 22, false},
+		{"", 0, true},
+		{"node: command not found", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseNodeMajor(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseNodeMajor(%q) = %d, %v; want %d, wantErr %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// fakeNode puts a "node" script on PATH that prints its arguments.
+func fakeNode(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell launcher test")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "node"), []byte("#!/bin/sh\necho \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCheckRuntime(t *testing.T) {
+	fakeNode(t)
+	orig := nodeVersion
+	defer func() { nodeVersion = orig }()
+
+	meta := &LSPMetadata{Name: "pyright", Runtime: RuntimeNode}
+
+	nodeVersion = func(string) (string, error) { return "v20.11.1\n", nil }
+	if err := CheckRuntime(meta); err != nil {
+		t.Errorf("CheckRuntime with node 20 failed: %v", err)
+	}
+
+	nodeVersion = func(string) (string, error) { return "v16.20.0\n", nil }
+	if err := CheckRuntime(meta); err == nil || !strings.Contains(err.Error(), "Node.js 18") {
+		t.Errorf("CheckRuntime with node 16 = %v, want a minimum version error", err)
+	}
+
+	if err := CheckRuntime(&LSPMetadata{Name: "gopls"}); err != nil {
+		t.Errorf("native package should need no runtime: %v", err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if err := CheckRuntime(meta); err == nil || !strings.Contains(err.Error(), "node was not found") {
+		t.Errorf("CheckRuntime without node = %v, want a not found error", err)
+	}
+}
+
+func TestInstallNodePackage(t *testing.T) {
+	fakeNode(t)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range map[string]string{
+		"package/package.json":        "{}",
+		"package/langserver.index.js": "require('./dist/server')",
+		"package/dist/server.js":      "// server",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := filepath.Join(t.TempDir(), "pyright.tgz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := t.TempDir()
+	meta := &LSPMetadata{
+		Name:         "pyright",
+		BinaryName:   "pyright-langserver",
+		ArchivePath:  "package/langserver.index.js",
+		ArchivePaths: map[string]string{"other-platform": "package/dist/server.js"},
+		Runtime:      RuntimeNode,
+	}
+	launcher, err := installNodePackage(context.Background(), osFS{}, extractLimits{}.orDefault(), archive, destDir, meta, GetPlatformKey())
+	if err != nil {
+		t.Fatalf("installNodePackage failed: %v", err)
+	}
+
+	// The rest of the package is unpacked beside the entry script
+	if _, err := os.Stat(filepath.Join(destDir, "package", "dist", "server.js")); err != nil {
+		t.Errorf("package files not extracted: %v", err)
+	}
+
+	out, err := exec.Command(launcher, "--stdio").Output()
+	if err != nil {
+		t.Fatalf("running launcher failed: %v", err)
+	}
+	want := filepath.Join(destDir, "package", "langserver.index.js") + " --stdio"
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("launcher ran node %q, want %q", got, want)
+	}
+
+	// A platform's own entry script takes precedence
+	destDir = t.TempDir()
+	launcher, err = installNodePackage(context.Background(), osFS{}, extractLimits{}.orDefault(), archive, destDir, meta, "other-platform")
+	if err != nil {
+		t.Fatalf("installNodePackage failed: %v", err)
+	}
+	out, err = exec.Command(launcher).Output()
+	if err != nil {
+		t.Fatalf("running launcher failed: %v", err)
+	}
+	want = filepath.Join(destDir, "package", "dist", "server.js")
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("launcher ran node %q, want %q", got, want)
+	}
+}
+
+func TestExtractTarGzAllRejectsEscapingEntries(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "../evil.js", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gz.Close()
+
+	archive := filepath.Join(t.TempDir(), "evil.tgz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractTarGzAll(context.Background(), osFS{}, extractLimits{}.orDefault(), archive, t.TempDir()); err == nil {
+		t.Error("expected an error for an entry outside the destination")
+	}
+}
@@ -5,34 +5,66 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 // GetCodeMapHome returns the root directory for CodeMap package management.
-// Priority: $CODEMAP_HOME -> $XDG_CACHE_HOME/codemap -> ~/.cache/codemap (Unix) / %LOCALAPPDATA%\codemap (Windows)
+// Priority: $CODEMAP_HOME -> $CODEMAP_CACHE_DIR -> $XDG_CACHE_HOME/codemap -> ~/.cache/codemap (Unix) / %LOCALAPPDATA%\codemap (Windows)
 func GetCodeMapHome() (string, error) {
+	return resolveCodeMapHome(os.Getenv, runtime.GOOS, os.UserHomeDir)
+}
+
+// resolveCodeMapHome implements GetCodeMapHome with its environment, OS and
+// home directory lookup injected so every platform's precedence can be tested.
+// Variables that are set but empty (or only whitespace) count as unset.
+func resolveCodeMapHome(getenv func(string) string, goos string, userHomeDir func() (string, error)) (string, error) {
+	home, _, err := resolveCodeMapHomeSource(getenv, goos, userHomeDir)
+	return home, err
+}
+
+// resolveCodeMapHomeSource is resolveCodeMapHome that also reports which
+// environment variable the home came from, or "" for the built-in default.
+func resolveCodeMapHomeSource(getenv func(string) string, goos string, userHomeDir func() (string, error)) (string, string, error) {
+	env := func(key string) string {
+		return strings.TrimSpace(getenv(key))
+	}
+
 	// Priority 1: CODEMAP_HOME environment variable
-	if home := os.Getenv("CODEMAP_HOME"); home != "" {
-		return home, nil
+	if home := env("CODEMAP_HOME"); home != "" {
+		return home, "CODEMAP_HOME", nil
 	}
 
-	// Priority 2: XDG_CACHE_HOME on Unix-like systems
-	if runtime.GOOS != "windows" {
-		if xdgCache := os.Getenv("XDG_CACHE_HOME"); xdgCache != "" {
-			return filepath.Join(xdgCache, "codemap"), nil
+	// Priority 2: CODEMAP_CACHE_DIR, the older name for the same setting
+	if home := env("CODEMAP_CACHE_DIR"); home != "" {
+		return home, "CODEMAP_CACHE_DIR", nil
+	}
+
+	// Priority 3: XDG_CACHE_HOME on Unix-like systems. The spec says relative
+	// paths are invalid and must be ignored.
+	if goos != "windows" {
+		if xdgCache := env("XDG_CACHE_HOME"); xdgCache != "" && filepath.IsAbs(xdgCache) {
+			return filepath.Join(xdgCache, "codemap"), "XDG_CACHE_HOME", nil
+		}
+	}
+
+	// Priority 4: Platform-specific defaults. On Windows this is the same for
+	// every architecture (amd64 and arm64 alike).
+	if goos == "windows" {
+		if localAppData := env("LOCALAPPDATA"); localAppData != "" {
+			return filepath.Join(localAppData, "codemap"), "LOCALAPPDATA", nil
 		}
 	}
 
-	// Priority 3: Platform-specific defaults
-	userHome, err := os.UserHomeDir()
+	userHome, err := userHomeDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to get user home directory: %w", err)
+		return "", "", fmt.Errorf("failed to get user home directory: %w", err)
 	}
 
-	switch runtime.GOOS {
+	switch goos {
 	case "windows":
-		return filepath.Join(userHome, "AppData", "Local", "codemap"), nil
+		return filepath.Join(userHome, "AppData", "Local", "codemap"), "", nil
 	default:
-		return filepath.Join(userHome, ".cache", "codemap"), nil
+		return filepath.Join(userHome, ".cache", "codemap"), "", nil
 	}
 }
 
@@ -98,9 +130,7 @@ func GetBinaryPath(binaryName string) (string, error) {
 	}
 	
 	// Add .exe on Windows
-	if runtime.GOOS == "windows" && filepath.Ext(binaryName) != ".exe" {
-		binaryName += ".exe"
-	}
+	binaryName = executableName(binaryName, runtime.GOOS)
 	
 	return filepath.Join(binDir, binaryName), nil
 }
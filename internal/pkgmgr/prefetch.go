@@ -0,0 +1,57 @@
+package pkgmgr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// prefetchResolveTimeout bounds the latest-version lookups of a prefetch.
+// Unlike at startup nothing is waiting on it, so it is more patient.
+const prefetchResolveTimeout = 30 * time.Second
+
+// PrefetchResult is the outcome of installing one language's server ahead of
+// time.
+type PrefetchResult struct {
+	Language string
+	Name     string // package name, e.g. "gopls"
+	Version  string
+	Err      error // nil if the server is installed and verified
+}
+
+// PrefetchAll installs the language server of every supported language, as
+// Prefetch does.
+func (i *Installer) PrefetchAll(ctx context.Context) []PrefetchResult {
+	return i.Prefetch(ctx, SupportedLanguages())
+}
+
+// Prefetch downloads, verifies and installs the latest language server of
+// each of langs unless that version is already installed, so indexing works
+// later without network access. Languages are installed concurrently within
+// the shared concurrency budget, and a failure is reported in its result
+// without stopping the others. Results are in the order of langs.
+func (i *Installer) Prefetch(ctx context.Context, langs []string) []PrefetchResult {
+	resolved := ResolveLSPMetadata(ctx, langs, prefetchResolveTimeout)
+
+	results := make([]PrefetchResult, len(langs))
+	var wg sync.WaitGroup
+	for idx, lang := range langs {
+		results[idx].Language = lang
+		metadata, ok := resolved[lang]
+		if !ok {
+			results[idx].Err = fmt.Errorf("%w: %s", ErrUnknownLanguage, lang)
+			continue
+		}
+		results[idx].Name = metadata.Name
+		results[idx].Version = metadata.Version
+
+		wg.Add(1)
+		go func(result *PrefetchResult) {
+			defer wg.Done()
+			result.Err = i.Install(ctx, lang, metadata)
+		}(&results[idx])
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,54 @@
+package pkgmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestPrefetchReportsEachLanguage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the binary")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/good" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(fakeServer("binary")))
+	}))
+	defer srv.Close()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	lspMetadata["good-lang"] = &LSPMetadata{Name: "good-ls", Version: "1.0.0", BinaryName: "good-ls",
+		DownloadURLs: map[string]string{GetPlatformKey(): srv.URL + "/good"}}
+	lspMetadata["bad-lang"] = &LSPMetadata{Name: "bad-ls", Version: "2.0.0", BinaryName: "bad-ls",
+		DownloadURLs: map[string]string{GetPlatformKey(): srv.URL + "/bad"}}
+	defer delete(lspMetadata, "good-lang")
+	defer delete(lspMetadata, "bad-lang")
+
+	mgr, err := NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	results := NewInstaller(mgr).Prefetch(context.Background(), []string{"bad-lang", "cobol", "good-lang"})
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if r := results[0]; r.Language != "bad-lang" || r.Name != "bad-ls" || r.Version != "2.0.0" || r.Err == nil {
+		t.Errorf("bad-lang result = %+v, want a failure", r)
+	}
+	if r := results[1]; r.Language != "cobol" || !errors.Is(r.Err, ErrUnknownLanguage) {
+		t.Errorf("cobol result = %+v, want ErrUnknownLanguage", r)
+	}
+	if r := results[2]; r.Language != "good-lang" || r.Err != nil {
+		t.Errorf("good-lang result = %+v, want success despite the other failures", r)
+	}
+	if installed, version, _ := mgr.IsInstalled("good-lang"); !installed || version != "1.0.0" {
+		t.Errorf("IsInstalled(good-lang) = %v, %s; want true, 1.0.0", installed, version)
+	}
+}
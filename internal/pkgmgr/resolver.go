@@ -6,7 +6,28 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"codemap/internal/download"
+)
+
+const (
+	// resolverTimeout bounds a whole resolver request, including reading the body.
+	resolverTimeout = 10 * time.Second
+
+	// maxResponseBytes caps "latest version" responses, which are a few KB.
+	maxResponseBytes = 512 << 10
+
+	// maxListResponseBytes caps version listings; the npm document for a
+	// package with a long release history runs to several MB.
+	maxListResponseBytes = 32 << 20
+
+	// maxErrorBodyBytes caps how much of an error response is quoted back.
+	maxErrorBodyBytes = 4 << 10
 )
 
 // VersionResolver fetches the latest version for an LSP server.
@@ -14,17 +35,28 @@ type VersionResolver interface {
 	ResolveLatestVersion(ctx context.Context) (string, error)
 }
 
+// VersionLister is implemented by resolvers that can enumerate every
+// published version, not just the latest.
+type VersionLister interface {
+	ListVersions(ctx context.Context) ([]string, error)
+}
+
 // GitHubReleaseResolver resolves versions from GitHub releases.
 type GitHubReleaseResolver struct {
 	owner      string
 	repo       string
 	tagPrefix  string // optional prefix like "gopls/" for gopls releases
+	strip      bool   // return tags without tagPrefix
+	baseURL    string // GitHub API root, overridable in tests
+	token      string // API token; empty means GITHUB_TOKEN
 	httpClient *http.Client
 }
 
 // NPMResolver resolves versions from npm registry.
 type NPMResolver struct {
 	packageName string
+	distTag     string // release channel, e.g. "next"; empty means "latest"
+	baseURL     string // registry root, overridable in tests
 	httpClient  *http.Client
 }
 
@@ -34,33 +66,70 @@ func NewGitHubResolver(owner, repo, tagPrefix string) *GitHubReleaseResolver {
 		owner:     owner,
 		repo:      repo,
 		tagPrefix: tagPrefix,
+		baseURL:   "https://api.github.com",
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:       resolverTimeout,
+			CheckRedirect: download.CheckRedirect,
 		},
 	}
 }
 
+// WithToken makes r authenticate to the GitHub API with token instead of
+// GITHUB_TOKEN, and returns r.
+func (r *GitHubReleaseResolver) WithToken(token string) *GitHubReleaseResolver {
+	r.token = token
+	return r
+}
+
+// WithPrefixStripped makes r return versions without its tag prefix,
+// "v0.21.1" rather than "gopls/v0.21.1", and returns r.
+func (r *GitHubReleaseResolver) WithPrefixStripped() *GitHubReleaseResolver {
+	r.strip = true
+	return r
+}
+
+// String identifies where r finds versions, e.g. "github:golang/tools@gopls/".
+func (r *GitHubReleaseResolver) String() string {
+	s := "github:" + r.owner + "/" + r.repo
+	if r.tagPrefix != "" {
+		s += "@" + r.tagPrefix
+	}
+	if r.strip {
+		s += " (stripped)"
+	}
+	return s
+}
+
 // NewNPMResolver creates a resolver for npm packages.
 func NewNPMResolver(packageName string) *NPMResolver {
 	return &NPMResolver{
 		packageName: packageName,
+		baseURL:     "https://registry.npmjs.org",
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:       resolverTimeout,
+			CheckRedirect: download.CheckRedirect,
 		},
 	}
 }
 
-// ResolveLatestVersion fetches the latest GitHub release version.
+// ResolveLatestVersion fetches the latest GitHub release version. With a tag
+// prefix it is the highest stable release tagged with the prefix, since the
+// repository's latest release may belong to another of its components.
 func (r *GitHubReleaseResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", r.owner, r.repo)
+	if r.tagPrefix != "" {
+		return r.resolveLatestPrefixed(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/repos/%s/%s/releases/latest", r.baseURL, r.owner, r.repo)
 	
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := r.newRequest(ctx, url)
 	if err != nil {
 		return "", err
 	}
 	
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch GitHub release: %w", err)
@@ -68,15 +137,14 @@ func (r *GitHubReleaseResolver) ResolveLatestVersion(ctx context.Context) (strin
 	defer resp.Body.Close()
 	
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, string(body))
+		return "", gitHubError(resp)
 	}
 	
 	var release struct {
 		TagName string `json:"tag_name"`
 	}
 	
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+	if err := decodeJSONBody(resp.Body, maxResponseBytes, &release); err != nil {
 		return "", fmt.Errorf("failed to decode GitHub response: %w", err)
 	}
 	
@@ -84,9 +152,33 @@ func (r *GitHubReleaseResolver) ResolveLatestVersion(ctx context.Context) (strin
 	return release.TagName, nil
 }
 
-// ResolveLatestVersion fetches the latest npm package version.
+// WithDistTag makes r follow the npm dist-tag tag, such as "next" or "beta",
+// instead of "latest", and returns r.
+func (r *NPMResolver) WithDistTag(tag string) *NPMResolver {
+	r.distTag = tag
+	return r
+}
+
+// String identifies where r finds versions, e.g. "npm:pyright@latest".
+func (r *NPMResolver) String() string {
+	tag := r.distTag
+	if tag == "" {
+		tag = "latest"
+	}
+	return "npm:" + r.packageName + "@" + tag
+}
+
+// ResolveLatestVersion fetches the version of the npm package its dist-tag
+// points at, "latest" unless set with WithDistTag.
 func (r *NPMResolver) ResolveLatestVersion(ctx context.Context) (string, error) {
-	url := fmt.Sprintf("https://registry.npmjs.org/%s/latest", r.packageName)
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	tag := r.distTag
+	if tag == "" {
+		tag = "latest"
+	}
+	url := fmt.Sprintf("%s/%s/%s", r.baseURL, r.packageName, tag)
 	
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -99,8 +191,15 @@ func (r *NPMResolver) ResolveLatestVersion(ctx context.Context) (string, error)
 	}
 	defer resp.Body.Close()
 	
+	if resp.StatusCode == http.StatusNotFound {
+		// Tell a missing dist-tag apart from a missing package
+		if pkg, err := r.packument(ctx); err == nil {
+			return "", fmt.Errorf("%w: %s has no dist-tag %q; available: %s",
+				ErrDistTagNotFound, r.packageName, tag, strings.Join(pkg.tags(), ", "))
+		}
+	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
 		return "", fmt.Errorf("npm registry returned %d: %s", resp.StatusCode, string(body))
 	}
 	
@@ -108,9 +207,223 @@ func (r *NPMResolver) ResolveLatestVersion(ctx context.Context) (string, error)
 		Version string `json:"version"`
 	}
 	
-	if err := json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
+	if err := decodeJSONBody(resp.Body, maxResponseBytes, &pkg); err != nil {
 		return "", fmt.Errorf("failed to decode npm response: %w", err)
 	}
 	
 	return pkg.Version, nil
 }
+
+// resolveLatestPrefixed returns the highest version among the releases tagged
+// with the resolver's prefix, skipping pre-releases.
+func (r *GitHubReleaseResolver) resolveLatestPrefixed(ctx context.Context) (string, error) {
+	releases, err := r.listReleases(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	for _, rel := range releases {
+		version := strings.TrimPrefix(strings.TrimPrefix(rel.TagName, r.tagPrefix), "v")
+		if rel.Prerelease || !versionPattern.MatchString(version) {
+			continue
+		}
+		if latest == "" || compareVersions(rel.TagName, latest) > 0 {
+			latest = rel.TagName
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no GitHub release of %s/%s is tagged %s<version>", r.owner, r.repo, r.tagPrefix)
+	}
+	return r.version(latest), nil
+}
+
+// ListVersions fetches the tags of the most recent published GitHub releases.
+func (r *GitHubReleaseResolver) ListVersions(ctx context.Context) ([]string, error) {
+	releases, err := r.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(releases))
+	for _, rel := range releases {
+		versions = append(versions, r.version(rel.TagName))
+	}
+	return versions, nil
+}
+
+// gitHubRelease is the part of a GitHub release the resolver uses.
+type gitHubRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// listReleases fetches the most recent published releases tagged with the
+// resolver's prefix.
+func (r *GitHubReleaseResolver) listReleases(ctx context.Context) ([]gitHubRelease, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/repos/%s/%s/releases?per_page=100", r.baseURL, r.owner, r.repo)
+
+	req, err := r.newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch GitHub releases: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, gitHubError(resp)
+	}
+
+	var releases []gitHubRelease
+
+	if err := decodeJSONBody(resp.Body, maxListResponseBytes, &releases); err != nil {
+		return nil, fmt.Errorf("failed to decode GitHub response: %w", err)
+	}
+
+	published := releases[:0]
+	for _, rel := range releases {
+		if rel.Draft || !strings.HasPrefix(rel.TagName, r.tagPrefix) {
+			continue
+		}
+		published = append(published, rel)
+	}
+	return published, nil
+}
+
+// version returns the version tag reports, without the tag prefix if the
+// resolver strips it.
+func (r *GitHubReleaseResolver) version(tag string) string {
+	if r.strip {
+		return strings.TrimPrefix(tag, r.tagPrefix)
+	}
+	return tag
+}
+
+// newRequest builds a GitHub API request for url, authenticated with the
+// resolver's token or GITHUB_TOKEN if either is set. Unauthenticated requests
+// are limited to 60 an hour per IP address, which shared CI runners exhaust.
+func (r *GitHubReleaseResolver) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	token := r.token
+	if token == "" {
+		token = strings.TrimSpace(os.Getenv("GITHUB_TOKEN"))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// gitHubError describes a failed GitHub API response. Running out of the
+// rate limit is reported as ErrRateLimited, with the time the limit resets.
+func gitHubError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0")
+	if !limited {
+		return fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	hint := ""
+	if resp.Request == nil || resp.Request.Header.Get("Authorization") == "" {
+		hint = "; set GITHUB_TOKEN to raise the limit"
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return fmt.Errorf("%w: GitHub API limit resets at %s%s",
+			ErrRateLimited, time.Unix(reset, 0).Format(time.RFC3339), hint)
+	}
+	return fmt.Errorf("%w: GitHub API returned %d%s", ErrRateLimited, resp.StatusCode, hint)
+}
+
+// ListVersions fetches every published version of the npm package.
+func (r *NPMResolver) ListVersions(ctx context.Context) ([]string, error) {
+	pkg, err := r.packument(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(pkg.Versions))
+	for v := range pkg.Versions {
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// npmPackument is the part of an npm package document the resolver uses.
+type npmPackument struct {
+	DistTags map[string]string          `json:"dist-tags"`
+	Versions map[string]json.RawMessage `json:"versions"`
+}
+
+// tags returns the package's dist-tags, sorted.
+func (p *npmPackument) tags() []string {
+	tags := make([]string, 0, len(p.DistTags))
+	for tag := range p.DistTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// packument fetches the package document, which lists every version and
+// dist-tag.
+func (r *NPMResolver) packument(ctx context.Context) (*npmPackument, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s", r.baseURL, r.packageName)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The abbreviated document is much smaller and still lists versions
+	req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch npm package: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return nil, fmt.Errorf("npm registry returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var pkg npmPackument
+
+	if err := decodeJSONBody(resp.Body, maxListResponseBytes, &pkg); err != nil {
+		return nil, fmt.Errorf("failed to decode npm response: %w", err)
+	}
+	return &pkg, nil
+}
+
+// decodeJSONBody decodes a JSON response body into v, failing with a clear
+// error instead of reading further once the body exceeds limit bytes.
+func decodeJSONBody(body io.Reader, limit int64, v interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return fmt.Errorf("response body exceeds %d bytes", limit)
+	}
+	return json.Unmarshal(data, v)
+}
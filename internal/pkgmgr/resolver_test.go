@@ -0,0 +1,253 @@
+package pkgmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolversDecodeLatestVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/golang/tools/releases/latest":
+			fmt.Fprint(w, `{"tag_name": "gopls/v0.21.1"}`)
+		case "/pyright/latest":
+			fmt.Fprint(w, `{"version": "1.1.408"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	gh := NewGitHubResolver("golang", "tools", "")
+	gh.baseURL = srv.URL
+	if got, err := gh.ResolveLatestVersion(context.Background()); err != nil || got != "gopls/v0.21.1" {
+		t.Errorf("GitHub ResolveLatestVersion = %q, %v", got, err)
+	}
+
+	npm := NewNPMResolver("pyright")
+	npm.baseURL = srv.URL
+	if got, err := npm.ResolveLatestVersion(context.Background()); err != nil || got != "1.1.408" {
+		t.Errorf("npm ResolveLatestVersion = %q, %v", got, err)
+	}
+}
+
+func TestResolversRejectOversizedBodies(t *testing.T) {
+	// A syntactically valid but huge document: without the cap the decoder
+	// would happily read all of it.
+	padding := strings.Repeat(" ", maxResponseBytes+1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"tag_name": "v1.0.0", "version": "1.0.0"%s}`, padding)
+	}))
+	defer srv.Close()
+
+	gh := NewGitHubResolver("owner", "repo", "")
+	gh.baseURL = srv.URL
+	if _, err := gh.ResolveLatestVersion(context.Background()); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("GitHub ResolveLatestVersion error = %v, want size limit error", err)
+	}
+
+	npm := NewNPMResolver("pkg")
+	npm.baseURL = srv.URL
+	if _, err := npm.ResolveLatestVersion(context.Background()); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("npm ResolveLatestVersion error = %v, want size limit error", err)
+	}
+}
+
+func TestGitHubResolverSendsToken(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"tag_name": "v1.0.0"}`)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		envToken string
+		token    string
+		want     string
+	}{
+		{"none", "", "", ""},
+		{"environment", "env-token", "", "Bearer env-token"},
+		{"explicit", "env-token", "own-token", "Bearer own-token"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GITHUB_TOKEN", tt.envToken)
+		gh := NewGitHubResolver("owner", "repo", "").WithToken(tt.token)
+		gh.baseURL = srv.URL
+		if _, err := gh.ResolveLatestVersion(context.Background()); err != nil {
+			t.Fatalf("%s: ResolveLatestVersion failed: %v", tt.name, err)
+		}
+		if auth != tt.want {
+			t.Errorf("%s: Authorization = %q, want %q", tt.name, auth, tt.want)
+		}
+	}
+}
+
+func TestGitHubResolverReportsRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/latest") {
+			http.Error(w, `{"message": "Resource not accessible"}`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "1767225600")
+		http.Error(w, `{"message": "API rate limit exceeded"}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	t.Setenv("GITHUB_TOKEN", "")
+	gh := NewGitHubResolver("owner", "repo", "")
+	gh.baseURL = srv.URL
+
+	_, err := gh.ResolveLatestVersion(context.Background())
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("ResolveLatestVersion error = %v, want ErrRateLimited", err)
+	}
+	if reset := time.Unix(1767225600, 0).Format(time.RFC3339); !strings.Contains(err.Error(), reset) {
+		t.Errorf("error %q does not mention the reset time %s", err, reset)
+	}
+	if !strings.Contains(err.Error(), "GITHUB_TOKEN") {
+		t.Errorf("error %q does not suggest GITHUB_TOKEN", err)
+	}
+
+	// A 403 for any other reason is not a rate limit
+	if _, err := gh.ListVersions(context.Background()); err == nil || errors.Is(err, ErrRateLimited) {
+		t.Errorf("ListVersions error = %v, want a plain 403", err)
+	}
+}
+
+func TestGitHubResolverFiltersByTagPrefix(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/golang/tools/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"tag_name": "v0.30.0"},
+			{"tag_name": "gopls/v0.22.0-pre.1", "prerelease": true},
+			{"tag_name": "gopls/v0.21.1"},
+			{"tag_name": "gopls/v0.23.0", "draft": true},
+			{"tag_name": "gopls/v0.9.5"},
+			{"tag_name": "gopls/v0.21.10"},
+			{"tag_name": "goplsx/v1.0.0"}
+		]`)
+	}))
+	defer srv.Close()
+
+	gh := NewGitHubResolver("golang", "tools", "gopls/")
+	gh.baseURL = srv.URL
+	if got, err := gh.ResolveLatestVersion(context.Background()); err != nil || got != "gopls/v0.21.10" {
+		t.Errorf("ResolveLatestVersion = %q, %v; want gopls/v0.21.10", got, err)
+	}
+	versions, err := gh.ListVersions(context.Background())
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if want := "gopls/v0.22.0-pre.1 gopls/v0.21.1 gopls/v0.9.5 gopls/v0.21.10"; strings.Join(versions, " ") != want {
+		t.Errorf("ListVersions = %v, want %s", versions, want)
+	}
+
+	gh.WithPrefixStripped()
+	if got, err := gh.ResolveLatestVersion(context.Background()); err != nil || got != "v0.21.10" {
+		t.Errorf("stripped ResolveLatestVersion = %q, %v; want v0.21.10", got, err)
+	}
+
+	none := NewGitHubResolver("golang", "tools", "zls/")
+	none.baseURL = srv.URL
+	if _, err := none.ResolveLatestVersion(context.Background()); err == nil {
+		t.Error("ResolveLatestVersion with no matching releases succeeded")
+	}
+}
+
+func TestNPMResolverDistTags(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/typescript-language-server":
+			fmt.Fprint(w, `{"dist-tags": {"latest": "4.3.3", "next": "5.0.0-rc.1", "beta": "4.4.0-beta.2"}, "versions": {}}`)
+		case "/typescript-language-server/latest":
+			fmt.Fprint(w, `{"version": "4.3.3"}`)
+		case "/typescript-language-server/next":
+			fmt.Fprint(w, `{"version": "5.0.0-rc.1"}`)
+		default:
+			http.Error(w, `"version not found"`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"", "4.3.3"},
+		{"next", "5.0.0-rc.1"},
+	}
+	for _, tt := range tests {
+		npm := NewNPMResolver("typescript-language-server").WithDistTag(tt.tag)
+		npm.baseURL = srv.URL
+		if got, err := npm.ResolveLatestVersion(context.Background()); err != nil || got != tt.want {
+			t.Errorf("dist-tag %q: ResolveLatestVersion = %q, %v; want %s", tt.tag, got, err, tt.want)
+		}
+	}
+
+	npm := NewNPMResolver("typescript-language-server").WithDistTag("canary")
+	npm.baseURL = srv.URL
+	_, err := npm.ResolveLatestVersion(context.Background())
+	if !errors.Is(err, ErrDistTagNotFound) {
+		t.Fatalf("missing dist-tag error = %v, want ErrDistTagNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "available: beta, latest, next") {
+		t.Errorf("error %q does not list the available dist-tags", err)
+	}
+
+	// A missing package is not a missing dist-tag
+	missing := NewNPMResolver("no-such-package")
+	missing.baseURL = srv.URL
+	if _, err := missing.ResolveLatestVersion(context.Background()); err == nil || errors.Is(err, ErrDistTagNotFound) {
+		t.Errorf("missing package error = %v, want a plain 404", err)
+	}
+}
+
+func TestGitLabResolver(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/projects/tools%2Flsp%2Fmy-ls/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		fmt.Fprint(w, `[
+			{"tag_name": "v2.0.0", "upcoming_release": true},
+			{"tag_name": "v1.4.2"},
+			{"tag_name": "v1.4.1"}
+		]`)
+	}))
+	defer srv.Close()
+
+	t.Setenv("GITLAB_TOKEN", "gl-token")
+	gl := NewGitLabResolver(srv.URL+"/", "tools/lsp/my-ls")
+	if got, err := gl.ResolveLatestVersion(context.Background()); err != nil || got != "v1.4.2" {
+		t.Errorf("ResolveLatestVersion = %q, %v; want v1.4.2", got, err)
+	}
+	if auth != "Bearer gl-token" {
+		t.Errorf("Authorization = %q, want the GITLAB_TOKEN", auth)
+	}
+	if versions, err := gl.ListVersions(context.Background()); err != nil || strings.Join(versions, " ") != "v1.4.2 v1.4.1" {
+		t.Errorf("ListVersions = %v, %v; want the published releases", versions, err)
+	}
+
+	if got := NewGitLabResolver("gitlab.example.com", "group/ls").baseURL; got != "https://gitlab.example.com" {
+		t.Errorf("baseURL for a bare host = %q, want https://gitlab.example.com", got)
+	}
+
+	unknown := NewGitLabResolver(srv.URL, "tools/other")
+	if _, err := unknown.ResolveLatestVersion(context.Background()); err == nil {
+		t.Error("ResolveLatestVersion for an unknown project succeeded")
+	}
+}
@@ -0,0 +1,182 @@
+package pkgmgr
+
+import (
+	"cmp"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// compareVersions compares two version strings in semver order, returning -1,
+// 0 or 1. A leading "v" and any tag path prefix ("gopls/v0.21.1") are ignored,
+// missing components count as zero, and a pre-release sorts before its release.
+func compareVersions(a, b string) int {
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
+
+	for i := 0; i < len(aCore) || i < len(bCore); i++ {
+		var x, y int
+		if i < len(aCore) {
+			x = aCore[i]
+		}
+		if i < len(bCore) {
+			y = bCore[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	default:
+		return comparePrerelease(aPre, bPre)
+	}
+}
+
+// comparePrerelease compares two pre-release suffixes as semver does:
+// dot-separated identifiers in turn, numeric ones numerically and below
+// alphanumeric ones, which compare lexically. A longer suffix wins when the
+// shared identifiers are equal, so rc.9 < rc.10 and alpha < alpha.1.
+func comparePrerelease(a, b string) int {
+	aIDs, bIDs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		x, xErr := strconv.Atoi(aIDs[i])
+		y, yErr := strconv.Atoi(bIDs[i])
+		switch {
+		case xErr == nil && yErr == nil:
+			if x != y {
+				return cmp.Compare(x, y)
+			}
+		case xErr == nil:
+			return -1
+		case yErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aIDs[i], bIDs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp.Compare(len(aIDs), len(bIDs))
+}
+
+// splitVersion returns the numeric components and pre-release suffix of v.
+// Build metadata ("+build") is dropped, as semver ignores it for ordering.
+func splitVersion(v string) ([]int, string) {
+	if i := strings.LastIndex(v, "/"); i >= 0 {
+		v = v[i+1:]
+	}
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var pre string
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+
+	var core []int
+	for _, part := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(part)
+		core = append(core, n)
+	}
+	return core, pre
+}
+
+// sortVersionsDesc sorts versions newest first.
+func sortVersionsDesc(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) > 0
+	})
+}
+
+// isVersionRange reports whether v is a range parseVersionRange accepts
+// rather than an exact version.
+func isVersionRange(v string) bool {
+	v = strings.TrimSpace(v)
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		// A pre-release or build suffix is not a wildcard
+		v = v[:i]
+	}
+	return strings.HasPrefix(v, "~") || strings.HasPrefix(v, "^") || strings.ContainsAny(v, "xX*")
+}
+
+// parseVersionRange parses a version range in npm's notation and returns a
+// matcher for it. Supported are tilde ranges ("~0.18" or "~0.18.1": that
+// minor version, at least the given patch), caret ranges ("^1.2.3": that
+// major version, or that minor version below 1.0) and wildcards ("0.18.x",
+// "1.*"). Pre-releases never match.
+func parseVersionRange(r string) (func(version string) bool, error) {
+	r = strings.TrimSpace(r)
+	op := ""
+	if strings.HasPrefix(r, "~") || strings.HasPrefix(r, "^") {
+		op, r = r[:1], r[1:]
+	}
+	r = strings.TrimPrefix(r, "v")
+
+	var parts []int
+	wildcard := false
+	for _, part := range strings.Split(r, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			wildcard = true
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || wildcard {
+			return nil, fmt.Errorf("invalid version range %q", op+r)
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) == 0 || len(parts) > 3 || (wildcard && op != "") {
+		return nil, fmt.Errorf("invalid version range %q", op+r)
+	}
+
+	// Versions from lower up to, but excluding, upper match. bump is the
+	// component of lower that is one higher in upper.
+	bump := len(parts) - 1
+	switch {
+	case op == "~" && len(parts) > 1:
+		bump = 1
+	case op == "~":
+		bump = 0
+	case op == "^":
+		bump = len(parts) - 1
+		for i, n := range parts {
+			if n != 0 {
+				bump = i
+				break
+			}
+		}
+	}
+	upper := make([]int, bump+1)
+	copy(upper, parts)
+	upper[bump]++
+
+	lower, limit := joinVersion(parts), joinVersion(upper)
+	return func(version string) bool {
+		if _, pre := splitVersion(version); pre != "" {
+			return false
+		}
+		return compareVersions(version, lower) >= 0 && compareVersions(version, limit) < 0
+	}, nil
+}
+
+// joinVersion formats version components as "1.2.3".
+func joinVersion(parts []int) string {
+	s := make([]string, len(parts))
+	for i, n := range parts {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ".")
+}
@@ -0,0 +1,88 @@
+package pkgmgr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"gopls/v0.21.1", "v0.21.0", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2", "1.2.0", 0},
+		{"1.2.0-rc.1", "1.2.0", -1},
+		{"1.2.0-alpha", "1.2.0-beta", -1},
+		{"1.2.0+build.5", "1.2.0", 0},
+		{"1.2.0-rc.10", "1.2.0-rc.9", 1},
+		{"1.2.0-alpha", "1.2.0-alpha.1", -1},
+		{"1.2.0-1", "1.2.0-alpha", -1},
+		{"1.2.0-beta.2", "1.2.0-beta.11", -1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSortVersionsDesc(t *testing.T) {
+	versions := []string{"1.1.9", "1.1.10", "1.2.0-rc.1", "1.0.0", "1.2.0"}
+	sortVersionsDesc(versions)
+
+	want := []string{"1.2.0", "1.2.0-rc.1", "1.1.10", "1.1.9", "1.0.0"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("sortVersionsDesc = %v, want %v", versions, want)
+	}
+}
+
+func TestParseVersionRange(t *testing.T) {
+	tests := []struct {
+		r       string
+		match   []string
+		noMatch []string
+	}{
+		{"~0.18", []string{"0.18.0", "v0.18.9", "gopls/v0.18.1"}, []string{"0.17.9", "0.19.0", "0.18.2-pre.1"}},
+		{"~0.18.1", []string{"0.18.1", "0.18.7"}, []string{"0.18.0", "0.19.0"}},
+		{"~1", []string{"1.0.0", "1.9.3"}, []string{"2.0.0", "0.9.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"0.18.x", []string{"0.18.0", "0.18.5"}, []string{"0.19.0", "0.17.0"}},
+		{"v1.*", []string{"1.0.0", "1.42.1"}, []string{"2.0.0"}},
+	}
+
+	for _, tt := range tests {
+		match, err := parseVersionRange(tt.r)
+		if err != nil {
+			t.Errorf("parseVersionRange(%q) failed: %v", tt.r, err)
+			continue
+		}
+		for _, v := range tt.match {
+			if !match(v) {
+				t.Errorf("%q does not match %s", tt.r, v)
+			}
+		}
+		for _, v := range tt.noMatch {
+			if match(v) {
+				t.Errorf("%q matches %s", tt.r, v)
+			}
+		}
+	}
+
+	for _, r := range []string{"~", "^x", "*", "1.x.3", "~1.x", "~latest", "1.2.3.4.x"} {
+		if _, err := parseVersionRange(r); err == nil {
+			t.Errorf("parseVersionRange(%q) succeeded", r)
+		}
+	}
+	for _, v := range []string{"0.18.1", "v0.3.1001-rc.x"} {
+		if isVersionRange(v) {
+			t.Errorf("isVersionRange(%q) = true for an exact version", v)
+		}
+	}
+}
@@ -69,7 +69,7 @@ func recordUpdateCheck() error {
 // This is non-blocking and safe to call on startup.
 func (m *Manager) CheckAndUpdateInBackground(ctx context.Context) {
 	// Check if we should update (throttle to once per day)
-	if !shouldCheckForUpdates() {
+	if Offline() || !shouldCheckForUpdates() {
 		return
 	}
 
@@ -108,8 +108,8 @@ func (m *Manager) CheckAndUpdateInBackground(ctx context.Context) {
 			default:
 			}
 
-			// Get latest metadata for this language
-			metadata, err := GetLSPMetadata(pkg.Name)
+			// Get latest metadata for this language, bypassing the version cache
+			metadata, err := RefreshLSPMetadata(pkg.Name)
 			if err != nil {
 				log.Printf("[Auto-Update] Failed to get metadata for %s: %v", pkg.Name, err)
 				continue
@@ -0,0 +1,132 @@
+package pkgmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultVersionCacheTTL is how long a resolved latest version is reused
+// before the resolver is asked again.
+const DefaultVersionCacheTTL = 24 * time.Hour
+
+// versionCacheFile, in the registry directory, holds the latest version
+// resolved for each language and resolver.
+const versionCacheFile = "latest_versions.json"
+
+// cachedVersion is a latest version and when it was resolved.
+type cachedVersion struct {
+	Version    string    `json:"version"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// versionCacheMu serializes updates of the cache file by concurrent
+// resolutions in this process.
+var versionCacheMu sync.Mutex
+
+// versionCacheTTL returns the cache lifetime from CODEMAP_VERSION_CACHE_TTL,
+// a Go duration such as "6h". Zero turns the cache off.
+func versionCacheTTL() time.Duration {
+	raw := os.Getenv("CODEMAP_VERSION_CACHE_TTL")
+	if raw == "" {
+		return DefaultVersionCacheTTL
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl < 0 {
+		log.Printf("Warning: ignoring invalid CODEMAP_VERSION_CACHE_TTL=%q", raw)
+		return DefaultVersionCacheTTL
+	}
+	return ttl
+}
+
+// versionCachePath returns where the version cache is stored.
+func versionCachePath() (string, error) {
+	dir, err := GetRegistryDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, versionCacheFile), nil
+}
+
+// readVersionCache loads the version cache. A missing or unreadable cache is
+// empty, so resolution falls back to asking the resolvers.
+func readVersionCache() map[string]cachedVersion {
+	cache := make(map[string]cachedVersion)
+	path, err := versionCachePath()
+	if err != nil {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Warning: ignoring corrupt version cache %s: %v", path, err)
+		return make(map[string]cachedVersion)
+	}
+	return cache
+}
+
+// versionCacheKey returns the cache key of lang's latest version from
+// resolver. A resolver that describes itself, as the GitHub and npm ones do,
+// is part of the key, so changing a tag prefix or dist-tag does not reuse a
+// version resolved under the old one.
+func versionCacheKey(lang string, resolver VersionResolver) string {
+	if s, ok := resolver.(fmt.Stringer); ok {
+		return lang + " " + s.String()
+	}
+	return lang
+}
+
+// cachedLatestVersion returns the version last resolved for lang by
+// resolver, if any.
+func cachedLatestVersion(lang string, resolver VersionResolver) (cachedVersion, bool) {
+	versionCacheMu.Lock()
+	defer versionCacheMu.Unlock()
+	entry, ok := readVersionCache()[versionCacheKey(lang, resolver)]
+	return entry, ok && entry.Version != ""
+}
+
+// storeLatestVersion records version as the latest for lang from resolver.
+// The file is replaced atomically so a concurrent reader never sees it half
+// written.
+func storeLatestVersion(lang string, resolver VersionResolver, version string) {
+	versionCacheMu.Lock()
+	defer versionCacheMu.Unlock()
+
+	path, err := versionCachePath()
+	if err != nil {
+		return
+	}
+	cache := readVersionCache()
+	cache[versionCacheKey(lang, resolver)] = cachedVersion{Version: version, ResolvedAt: time.Now()}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Warning: failed to cache latest version of %s: %v", lang, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), versionCacheFile+".*")
+	if err != nil {
+		log.Printf("Warning: failed to cache latest version of %s: %v", lang, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Warning: failed to cache latest version of %s: %v", lang, err)
+	}
+}
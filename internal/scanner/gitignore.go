@@ -0,0 +1,120 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	ignore "github.com/sabhiram/go-gitignore"
+
+	"codemap/util"
+)
+
+// Gitignore matches paths against the .gitignore files of the git repository
+// a directory belongs to. As in git, each .gitignore applies to the paths
+// beneath its own directory, a pattern in a deeper file overrides one in a
+// shallower file, and .git itself is always ignored. Each .gitignore is read
+// the first time a path beneath it is matched.
+type Gitignore struct {
+	root string // the repository root, or the directory itself outside one
+
+	mu   sync.Mutex
+	dirs map[string]*dirIgnore // absolute directory -> rules applying in it
+}
+
+// dirIgnore holds the patterns of every .gitignore from the root down to a
+// directory, rewritten relative to the root so one matcher applies them in
+// order.
+type dirIgnore struct {
+	lines   []string
+	matcher *ignore.GitIgnore
+}
+
+// NewGitignore returns the matcher for dir, anchored at the root of the git
+// repository containing it so that .gitignore files above dir apply too.
+func NewGitignore(dir string) *Gitignore {
+	root, ok := util.FindGitRootFrom(dir, util.DefaultGitRootOptions())
+	if !ok {
+		root, _ = filepath.Abs(dir)
+	}
+	return &Gitignore{root: filepath.Clean(root), dirs: make(map[string]*dirIgnore)}
+}
+
+// Matches reports whether path, a directory when isDir is set, is ignored.
+// Paths outside the repository never are.
+func (g *Gitignore) Matches(path string, isDir bool) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if filepath.Base(abs) == ".git" {
+		return true
+	}
+	rel, err := filepath.Rel(g.root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if isDir {
+		// Patterns with a trailing slash only match directories
+		rel += "/"
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d := g.rulesFor(filepath.Dir(abs))
+	return d.matcher != nil && d.matcher.MatchesPath(rel)
+}
+
+// rulesFor returns the rules that apply to the entries of dir, which must be
+// the root or beneath it. g.mu must be held.
+func (g *Gitignore) rulesFor(dir string) *dirIgnore {
+	if d, ok := g.dirs[dir]; ok {
+		return d
+	}
+
+	parent := &dirIgnore{}
+	if dir != g.root && filepath.Dir(dir) != dir {
+		parent = g.rulesFor(filepath.Dir(dir))
+	}
+	d := parent
+	if data, err := os.ReadFile(filepath.Join(dir, ".gitignore")); err == nil {
+		rel, _ := filepath.Rel(g.root, dir)
+		lines := append(slices.Clone(parent.lines), anchorIgnoreLines(filepath.ToSlash(rel), string(data))...)
+		d = &dirIgnore{lines: lines, matcher: ignore.CompileIgnoreLines(lines...)}
+	}
+	g.dirs[dir] = d
+	return d
+}
+
+// anchorIgnoreLines rewrites the patterns of the .gitignore in dir, relative
+// to the root, so they only match beneath dir. A pattern with a slash other
+// than a trailing one is relative to dir; any other matches at any depth.
+func anchorIgnoreLines(dir, content string) []string {
+	lines := strings.Split(content, "\n")
+	if dir == "." {
+		return lines
+	}
+
+	var anchored []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		line = strings.TrimPrefix(line, "!")
+		if strings.Contains(strings.TrimSuffix(line, "/"), "/") {
+			line = "/" + dir + "/" + strings.TrimPrefix(line, "/")
+		} else {
+			line = "/" + dir + "/**/" + line
+		}
+		if negate {
+			line = "!" + line
+		}
+		anchored = append(anchored, line)
+	}
+	return anchored
+}
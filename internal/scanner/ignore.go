@@ -0,0 +1,87 @@
+package scanner
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"codemap/util"
+)
+
+// ignoreRule skips directories named Dir. A rule with a Marker only applies
+// where that file sits beside the directory, so a Go package called build is
+// still scanned while a JavaScript project's build output is not.
+type ignoreRule struct {
+	Dir    string
+	Marker string // file in the parent directory; "" to always apply
+}
+
+// nodeIgnoreRules are shared by JavaScript and TypeScript.
+var nodeIgnoreRules = []ignoreRule{{Dir: "node_modules"}, {Dir: "dist", Marker: "package.json"}, {Dir: "build", Marker: "package.json"}}
+
+// defaultIgnoreRules are the dependency, cache and build output directories
+// of each supported language, skipped unless CODEMAP_IGNORE_DIRS says
+// otherwise.
+var defaultIgnoreRules = map[string][]ignoreRule{
+	"javascript": nodeIgnoreRules,
+	"typescript": nodeIgnoreRules,
+	"go":         {{Dir: "vendor"}},
+	"python":     {{Dir: "__pycache__"}, {Dir: ".venv"}},
+	"rust":       {{Dir: "target", Marker: "Cargo.toml"}},
+	"zig":        {{Dir: "zig-cache"}, {Dir: "zig-out"}},
+}
+
+// ignoreRulesFromEnv returns the rules to apply. By default these are the
+// rules of the languages CODEMAP_LANGUAGES leaves enabled, so a JavaScript
+// project's own vendor directory is scanned when Go is not indexed.
+// CODEMAP_IGNORE_DIRS, a comma-separated list of directory names, replaces
+// them for every language; "none" disables them. Hidden directories and
+// .gitignore apply either way.
+func ignoreRulesFromEnv() []ignoreRule {
+	raw := strings.TrimSpace(os.Getenv("CODEMAP_IGNORE_DIRS"))
+	if raw == "" {
+		var rules []ignoreRule
+		for lang, langRules := range defaultIgnoreRules {
+			if util.LanguageEnabled(lang) {
+				rules = append(rules, langRules...)
+			}
+		}
+		return rules
+	}
+	if strings.EqualFold(raw, "none") {
+		return nil
+	}
+
+	var rules []ignoreRule
+	for _, dir := range strings.Split(raw, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		if strings.ContainsAny(dir, `/\`) {
+			log.Printf("Warning: CODEMAP_IGNORE_DIRS entry %q is not a directory name; ignoring it", dir)
+			continue
+		}
+		rules = append(rules, ignoreRule{Dir: dir})
+	}
+	return rules
+}
+
+// IgnoresDir reports whether the directory at path is skipped as dependency,
+// cache or build output.
+func (s *Scanner) IgnoresDir(path string) bool {
+	name := filepath.Base(path)
+	for _, r := range s.ignoreRules {
+		if r.Dir != name {
+			continue
+		}
+		if r.Marker == "" {
+			return true
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), r.Marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
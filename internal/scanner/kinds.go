@@ -0,0 +1,158 @@
+package scanner
+
+import (
+	"codemap/internal/graph"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// kindRefiners adjust the canonical kind of a definition where the node type
+// alone is ambiguous, keyed by the language key used in Queries.
+var kindRefiners = map[string]func(kind string, def, name *sitter.Node) string{
+	"go":         goKind,
+	"python":     pythonKind,
+	"javascript": jsKind,
+	"typescript": jsKind,
+	"lua":        luaKind,
+	"zig":        zigKind,
+	"rust":       rustKind,
+	"cpp":        cppKind,
+}
+
+// canonicalKind returns the canonical kind of the definition def whose name is
+// name, refined by language where the node type is not enough.
+func canonicalKind(langKey string, def, name *sitter.Node) string {
+	kind := graph.NormalizeKind(def.Kind())
+	if refine, ok := kindRefiners[langKey]; ok {
+		kind = refine(kind, def, name)
+	}
+	return kind
+}
+
+// goKind tells structs and interfaces apart from other named types by the
+// type_spec's underlying type.
+func goKind(kind string, def, name *sitter.Node) string {
+	if kind != graph.KindType {
+		return kind
+	}
+	spec := name.Parent()
+	if spec == nil || spec.Kind() != "type_spec" {
+		return kind
+	}
+	if typ := spec.ChildByFieldName("type"); typ != nil {
+		switch typ.Kind() {
+		case "struct_type":
+			return graph.KindStruct
+		case "interface_type":
+			return graph.KindInterface
+		}
+	}
+	return kind
+}
+
+// pythonKind reports functions defined directly in a class body as methods.
+func pythonKind(kind string, def, name *sitter.Node) string {
+	if kind != graph.KindFunction {
+		return kind
+	}
+	parent := def.Parent()
+	if parent != nil && parent.Kind() == "decorated_definition" {
+		parent = parent.Parent()
+	}
+	if parent != nil && parent.Kind() == "block" {
+		if class := parent.Parent(); class != nil && class.Kind() == "class_definition" {
+			return graph.KindMethod
+		}
+	}
+	return kind
+}
+
+// jsKind reports variables bound to a function as functions and const
+// bindings of anything else as constants.
+func jsKind(kind string, def, name *sitter.Node) string {
+	if def.Kind() != "variable_declarator" {
+		return kind
+	}
+	if value := def.ChildByFieldName("value"); value != nil {
+		switch value.Kind() {
+		case "arrow_function", "function_expression", "function":
+			return graph.KindFunction
+		}
+	}
+	if decl := def.Parent(); decl != nil && decl.Kind() == "lexical_declaration" {
+		if first := decl.Child(0); first != nil && first.Kind() == "const" {
+			return graph.KindConstant
+		}
+	}
+	return kind
+}
+
+// luaKind reports functions declared with colon syntax (function T:m()) as
+// methods.
+func luaKind(kind string, def, name *sitter.Node) string {
+	if kind == graph.KindFunction && name.Kind() == "method_index_expression" {
+		return graph.KindMethod
+	}
+	return kind
+}
+
+// zigContainerKinds maps the container expressions a Zig const or var can be
+// bound to onto kinds. Zig has no other way to declare a named type.
+var zigContainerKinds = map[string]string{
+	"struct_declaration": graph.KindStruct,
+	"enum_declaration":   graph.KindEnum,
+	"union_declaration":  graph.KindType,
+	"opaque_declaration": graph.KindType,
+}
+
+// zigKind reports bindings of container types by the container's kind and
+// functions declared inside a container as methods.
+func zigKind(kind string, def, name *sitter.Node) string {
+	switch kind {
+	case graph.KindVariable:
+		for i := uint(0); i < def.NamedChildCount(); i++ {
+			if k, ok := zigContainerKinds[def.NamedChild(i).Kind()]; ok {
+				return k
+			}
+		}
+	case graph.KindFunction:
+		if parent := def.Parent(); parent != nil {
+			if _, ok := zigContainerKinds[parent.Kind()]; ok {
+				return graph.KindMethod
+			}
+		}
+	}
+	return kind
+}
+
+// rustKind reports functions declared in an impl or trait body as methods.
+func rustKind(kind string, def, name *sitter.Node) string {
+	if kind != graph.KindFunction {
+		return kind
+	}
+	if body := def.Parent(); body != nil && body.Kind() == "declaration_list" {
+		if owner := body.Parent(); owner != nil && (owner.Kind() == "impl_item" || owner.Kind() == "trait_item") {
+			return graph.KindMethod
+		}
+	}
+	return kind
+}
+
+// cppKind reports functions defined in a class or struct body, or outside it
+// under a qualified name (Shape::area), as methods.
+func cppKind(kind string, def, name *sitter.Node) string {
+	if kind != graph.KindFunction {
+		return kind
+	}
+	if name.Kind() == "qualified_identifier" {
+		return graph.KindMethod
+	}
+	parent := def.Parent()
+	if parent != nil && parent.Kind() == "template_declaration" {
+		parent = parent.Parent()
+	}
+	if parent != nil && parent.Kind() == "field_declaration_list" {
+		return graph.KindMethod
+	}
+	return kind
+}
@@ -0,0 +1,231 @@
+package scanner
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// modifierExtractors returns language-specific modifiers for a definition node,
+// keyed by the language key used in Queries.
+var modifierExtractors = map[string]func(def *sitter.Node, name string, content []byte) []string{
+	"go":         goModifiers,
+	"python":     pythonModifiers,
+	"javascript": jsModifiers,
+	"typescript": jsModifiers,
+	"lua":        luaModifiers,
+	"zig":        zigModifiers,
+	"rust":       rustModifiers,
+	"java":       javaModifiers,
+}
+
+// extractModifiers returns the modifiers attached to def, or nil if the
+// language has no extractor or the definition carries none.
+func extractModifiers(langKey string, def *sitter.Node, name string, content []byte) []string {
+	extract, ok := modifierExtractors[langKey]
+	if !ok || def == nil {
+		return nil
+	}
+	return extract(def, name, content)
+}
+
+// goModifiers marks identifiers that are exported from their package.
+func goModifiers(def *sitter.Node, name string, content []byte) []string {
+	r, _ := utf8.DecodeRuneInString(name)
+	if unicode.IsUpper(r) {
+		return []string{"exported"}
+	}
+	return nil
+}
+
+// pythonModifiers reports decorators (as "@name", without call arguments) from
+// an enclosing decorated_definition, followed by "async" for async defs.
+func pythonModifiers(def *sitter.Node, name string, content []byte) []string {
+	var mods []string
+
+	if parent := def.Parent(); parent != nil && parent.Kind() == "decorated_definition" {
+		for i := uint(0); i < parent.NamedChildCount(); i++ {
+			child := parent.NamedChild(i)
+			if child == nil || child.Kind() != "decorator" {
+				continue
+			}
+			if dn := decoratorName(child, content); dn != "" {
+				mods = append(mods, "@"+dn)
+			}
+		}
+	}
+
+	if first := def.Child(0); first != nil && first.Kind() == "async" {
+		mods = append(mods, "async")
+	}
+
+	return mods
+}
+
+// jsKeywords are the modifier tokens that can precede a JS/TS declaration.
+var jsKeywords = map[string]bool{
+	"static":   true,
+	"async":    true,
+	"get":      true,
+	"set":      true,
+	"abstract": true,
+	"readonly": true,
+	"declare":  true,
+}
+
+// jsModifiers reports decorators, export/default, accessibility and keyword
+// modifiers for JavaScript and TypeScript declarations.
+func jsModifiers(def *sitter.Node, name string, content []byte) []string {
+	var mods []string
+
+	// Method decorators are preceding siblings in the class body; class
+	// decorators are children of the declaration itself.
+	var decorators []string
+	for prev := def.PrevNamedSibling(); prev != nil && prev.Kind() == "decorator"; prev = prev.PrevNamedSibling() {
+		decorators = append([]string{"@" + decoratorName(prev, content)}, decorators...)
+	}
+	mods = append(mods, decorators...)
+	for i := uint(0); i < def.NamedChildCount(); i++ {
+		if child := def.NamedChild(i); child != nil && child.Kind() == "decorator" {
+			mods = append(mods, "@"+decoratorName(child, content))
+		}
+	}
+
+	// Variable declarators are nested one level deeper inside the export.
+	exportParent := def.Parent()
+	if def.Kind() == "variable_declarator" && exportParent != nil {
+		exportParent = exportParent.Parent()
+	}
+	if exportParent != nil && exportParent.Kind() == "export_statement" {
+		mods = append(mods, "export")
+		for i := uint(0); i < exportParent.ChildCount(); i++ {
+			if child := exportParent.Child(i); child != nil && child.Kind() == "default" {
+				mods = append(mods, "default")
+			}
+		}
+	}
+
+	for i := uint(0); i < def.ChildCount(); i++ {
+		child := def.Child(i)
+		if child == nil {
+			continue
+		}
+		switch {
+		case child.Kind() == "accessibility_modifier" || child.Kind() == "override_modifier":
+			mods = append(mods, child.Utf8Text(content))
+		case !child.IsNamed() && jsKeywords[child.Kind()]:
+			mods = append(mods, child.Kind())
+		}
+	}
+
+	// const handler = async () => {}
+	if def.Kind() == "variable_declarator" {
+		if value := def.ChildByFieldName("value"); value != nil {
+			if first := value.Child(0); first != nil && first.Kind() == "async" {
+				mods = append(mods, "async")
+			}
+		}
+	}
+
+	return mods
+}
+
+// luaModifiers marks local functions and variables.
+func luaModifiers(def *sitter.Node, name string, content []byte) []string {
+	if first := def.Child(0); first != nil && first.Kind() == "local" {
+		return []string{"local"}
+	}
+	if parent := def.Parent(); parent != nil && parent.Kind() == "variable_declaration" {
+		return []string{"local"}
+	}
+	return nil
+}
+
+// zigKeywords are the modifier tokens that can precede a Zig declaration.
+var zigKeywords = map[string]bool{
+	"pub":      true,
+	"export":   true,
+	"extern":   true,
+	"inline":   true,
+	"noinline": true,
+}
+
+// zigModifiers reports visibility and linkage keywords on Zig declarations.
+func zigModifiers(def *sitter.Node, name string, content []byte) []string {
+	var mods []string
+	for i := uint(0); i < def.ChildCount(); i++ {
+		child := def.Child(i)
+		if child == nil || child.IsNamed() {
+			continue
+		}
+		if !zigKeywords[child.Kind()] {
+			break
+		}
+		mods = append(mods, child.Kind())
+	}
+	return mods
+}
+
+// rustModifiers reports the visibility ("pub", "pub(crate)") of a Rust item
+// followed by function qualifiers such as async, const, unsafe and extern.
+func rustModifiers(def *sitter.Node, name string, content []byte) []string {
+	var mods []string
+	for i := uint(0); i < def.NamedChildCount(); i++ {
+		child := def.NamedChild(i)
+		switch child.Kind() {
+		case "visibility_modifier":
+			mods = append(mods, child.Utf8Text(content))
+		case "function_modifiers":
+			for j := uint(0); j < child.ChildCount(); j++ {
+				if qualifier := child.Child(j); qualifier.Kind() == "extern_modifier" {
+					mods = append(mods, "extern")
+				} else {
+					mods = append(mods, qualifier.Kind())
+				}
+			}
+		}
+	}
+	return mods
+}
+
+// javaModifiers reports annotations (as "@name", without arguments) and
+// keywords such as public, static and final from a Java declaration's
+// modifiers, in source order.
+func javaModifiers(def *sitter.Node, name string, content []byte) []string {
+	var mods []string
+	for i := uint(0); i < def.NamedChildCount(); i++ {
+		list := def.NamedChild(i)
+		if list.Kind() != "modifiers" {
+			continue
+		}
+		for j := uint(0); j < list.ChildCount(); j++ {
+			child := list.Child(j)
+			switch {
+			case child.Kind() == "marker_annotation" || child.Kind() == "annotation":
+				if an := child.ChildByFieldName("name"); an != nil {
+					mods = append(mods, "@"+an.Utf8Text(content))
+				}
+			case !child.IsNamed():
+				mods = append(mods, child.Kind())
+			}
+		}
+	}
+	return mods
+}
+
+// decoratorName returns the dotted name of a decorator, dropping any call
+// arguments so "@app.route('/x')" becomes "app.route".
+func decoratorName(decorator *sitter.Node, content []byte) string {
+	expr := decorator.NamedChild(0)
+	if expr == nil {
+		return ""
+	}
+	switch expr.Kind() {
+	case "call", "call_expression":
+		if fn := expr.ChildByFieldName("function"); fn != nil {
+			return fn.Utf8Text(content)
+		}
+	}
+	return expr.Utf8Text(content)
+}
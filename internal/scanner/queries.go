@@ -19,12 +19,46 @@ var Queries = map[string]string{
 	"typescript": `
 		(function_declaration name: (identifier) @name) @def
 		(class_declaration name: (type_identifier) @name) @def
+		(abstract_class_declaration name: (type_identifier) @name) @def
 		(method_definition name: (property_identifier) @name) @def
 		(interface_declaration name: (type_identifier) @name) @def
 		(type_alias_declaration name: (type_identifier) @name) @def
 	`,
 	"zig": `
 		(function_declaration name: (identifier) @name) @def
+		(source_file
+			(variable_declaration
+				(identifier) @name
+				[
+					(struct_declaration)
+					(enum_declaration)
+					(union_declaration)
+					(opaque_declaration)
+				]) @def)
+	`,
+	"rust": `
+		(function_item name: (identifier) @name) @def
+		(struct_item name: (type_identifier) @name) @def
+		(enum_item name: (type_identifier) @name) @def
+		(trait_item name: (type_identifier) @name) @def
+		(impl_item type: (_) @name) @def
+	`,
+	"java": `
+		(class_declaration name: (identifier) @name) @def
+		(interface_declaration name: (identifier) @name) @def
+		(enum_declaration name: (identifier) @name) @def
+		(record_declaration name: (identifier) @name) @def
+		(method_declaration name: (identifier) @name) @def
+	`,
+	"cpp": `
+		(function_definition declarator: [
+			(function_declarator declarator: (_) @name)
+			(pointer_declarator declarator: (function_declarator declarator: (_) @name))
+			(reference_declarator (function_declarator declarator: (_) @name))
+		]) @def
+		(struct_specifier name: (type_identifier) @name body: (field_declaration_list)) @def
+		(class_specifier name: (type_identifier) @name body: (field_declaration_list)) @def
+		(enum_specifier name: (type_identifier) @name body: (enumerator_list)) @def
 	`,
 	"lua": `
 		(function_declaration name: [
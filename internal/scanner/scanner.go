@@ -2,36 +2,87 @@ package scanner
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	tslua "github.com/tree-sitter-grammars/tree-sitter-lua/bindings/go"
 	tszig "github.com/tree-sitter-grammars/tree-sitter-zig/bindings/go"
 	sitter "github.com/tree-sitter/go-tree-sitter"
+	tscpp "github.com/tree-sitter/tree-sitter-cpp/bindings/go"
 	tsgo "github.com/tree-sitter/tree-sitter-go/bindings/go"
+	tsjava "github.com/tree-sitter/tree-sitter-java/bindings/go"
 	tsjs "github.com/tree-sitter/tree-sitter-javascript/bindings/go"
 	tspy "github.com/tree-sitter/tree-sitter-python/bindings/go"
+	tsrust "github.com/tree-sitter/tree-sitter-rust/bindings/go"
 	tsts "github.com/tree-sitter/tree-sitter-typescript/bindings/go"
 
-	ignore "github.com/sabhiram/go-gitignore"
-
 	"codemap/internal/graph"
+	"codemap/internal/overlay"
 	"codemap/util"
 )
 
+// ErrSyntax is returned by parseFile when the grammar reported syntax errors.
+// The nodes returned alongside it were extracted from the partial parse tree.
+var ErrSyntax = errors.New("file contains syntax errors")
+
+// ErrLanguageDisabled is returned by ScanFile for files whose language is
+// excluded by CODEMAP_LANGUAGES.
+var ErrLanguageDisabled = errors.New("language disabled by CODEMAP_LANGUAGES")
+
+// FileError records a problem with a single file during a workspace scan.
+type FileError struct {
+	Path string // path relative to the scan root
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
 type Scanner struct {
 	languages map[string]*sitter.Language
 	queries   map[string]*sitter.Query
 	root      string
+	overlay   *overlay.Overlay // unsaved buffers read instead of disk
+
+	// extensions maps file extensions, without the dot, to language names:
+	// the defaults merged with CODEMAP_EXTENSIONS.
+	extensions map[string]string
+
+	// ignoreRules name the dependency and build directories never descended
+	// into.
+	ignoreRules []ignoreRule
+
+	// gitignore applies .gitignore rules; CODEMAP_NO_GITIGNORE disables
+	// them.
+	gitignore bool
+
+	// scope limits scans to the files it includes. It can change while the
+	// watcher is using the scanner.
+	scope atomic.Pointer[Scope]
 }
 
 func New() (*Scanner, error) {
 	s := &Scanner{
-		languages: make(map[string]*sitter.Language),
-		queries:   make(map[string]*sitter.Query),
+		languages:   make(map[string]*sitter.Language),
+		queries:     make(map[string]*sitter.Query),
+		ignoreRules: ignoreRulesFromEnv(),
 	}
+	noGitignore, _ := strconv.ParseBool(os.Getenv("CODEMAP_NO_GITIGNORE"))
+	s.gitignore = !noGitignore
 
 	// Register languages
 	s.languages["go"] = sitter.NewLanguage(tsgo.Language())
@@ -42,24 +93,132 @@ func New() (*Scanner, error) {
 	s.languages["tsx"] = sitter.NewLanguage(tsts.LanguageTSX())
 	s.languages["lua"] = sitter.NewLanguage(tslua.Language())
 	s.languages["zig"] = sitter.NewLanguage(tszig.Language())
+	s.languages["rs"] = sitter.NewLanguage(tsrust.Language())
+	s.languages["java"] = sitter.NewLanguage(tsjava.Language())
+	cpp := sitter.NewLanguage(tscpp.Language())
+	// C parses with the C++ grammar, which accepts nearly all of it
+	for _, ext := range []string{"cpp", "cc", "cxx", "hpp", "hh", "hxx", "h", "c"} {
+		s.languages[ext] = cpp
+	}
 
-	// Compile queries
+	// Extensions mapped by CODEMAP_EXTENSIONS parse with their language's
+	// grammar
+	extensions, err := util.ParseExtensions(os.Getenv("CODEMAP_EXTENSIONS"))
+	if err != nil {
+		log.Printf("Warning: CODEMAP_EXTENSIONS: %v", err)
+	}
+	builtin := make(map[string]*sitter.Language, len(s.languages))
 	for ext, lang := range s.languages {
-		qStr, ok := Queries[getLangKey(ext)]
+		builtin[ext] = lang
+	}
+	s.extensions = make(map[string]string, len(extensions))
+	for dotExt, langKey := range extensions {
+		ext := strings.TrimPrefix(dotExt, ".")
+		s.extensions[ext] = langKey
+		if _, ok := builtin[ext]; ok && builtinLangKey(ext) == langKey {
+			continue
+		}
+		if primary, ok := grammarExtensions[langKey]; ok {
+			s.languages[ext] = builtin[primary]
+		} else {
+			delete(s.languages, ext)
+		}
+	}
+
+	// Compile queries, leaving languages outside CODEMAP_LANGUAGES without
+	// one so their files are never indexed
+	enabled := util.EnabledLanguages()
+	for name := range enabled {
+		if _, ok := Queries[name]; !ok {
+			log.Printf("Warning: CODEMAP_LANGUAGES lists unknown language %q", name)
+		}
+	}
+	// Extensions sharing a grammar and language share the compiled query
+	type grammarQuery struct {
+		lang    *sitter.Language
+		langKey string
+	}
+	compiled := make(map[grammarQuery]*sitter.Query)
+	for ext, lang := range s.languages {
+		langKey := s.langKey(ext)
+		if enabled != nil && !enabled[langKey] {
+			continue
+		}
+		qStr, ok := Queries[langKey]
 		if !ok {
 			continue
 		}
+		if q, ok := compiled[grammarQuery{lang, langKey}]; ok {
+			s.queries[ext] = q
+			continue
+		}
 		q, err := sitter.NewQuery(lang, qStr)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile query for %s: %w", ext, err)
 		}
+		compiled[grammarQuery{lang, langKey}] = q
 		s.queries[ext] = q
 	}
 
 	return s, nil
 }
 
-func getLangKey(ext string) string {
+// SetOverlay makes the scanner read files from o's buffers where it has them.
+func (s *Scanner) SetOverlay(o *overlay.Overlay) {
+	s.overlay = o
+}
+
+// SetGitignore turns .gitignore rules on or off, overriding
+// CODEMAP_NO_GITIGNORE.
+func (s *Scanner) SetGitignore(enabled bool) {
+	s.gitignore = enabled
+}
+
+// SetScope limits later scans, and the files the watcher reindexes, to
+// scope. The patterns should have been validated; a malformed one matches
+// nothing.
+func (s *Scanner) SetScope(scope Scope) {
+	s.scope.Store(&scope)
+}
+
+// InScope reports whether relPath, relative to the scan root and a
+// directory when isDir is set, is within the scanner's scope.
+func (s *Scanner) InScope(relPath string, isDir bool) bool {
+	scope := s.scope.Load()
+	return scope == nil || scope.Includes(relPath, isDir)
+}
+
+// Gitignore returns the .gitignore matcher for root, or nil when .gitignore
+// rules are disabled.
+func (s *Scanner) Gitignore(root string) *Gitignore {
+	if !s.gitignore {
+		return nil
+	}
+	return NewGitignore(root)
+}
+
+// grammarExtensions names the built-in extension whose grammar parses files
+// that CODEMAP_EXTENSIONS assigns to each language.
+var grammarExtensions = map[string]string{
+	"go":         "go",
+	"python":     "py",
+	"javascript": "js",
+	"typescript": "ts",
+	"lua":        "lua",
+	"zig":        "zig",
+	"rust":       "rs",
+	"java":       "java",
+	"cpp":        "cpp",
+}
+
+// langKey returns the language of files with extension ext (without the
+// dot), or "" if it is not supported.
+func (s *Scanner) langKey(ext string) string {
+	return s.extensions[ext]
+}
+
+// builtinLangKey returns the language of a built-in grammar's extension.
+func builtinLangKey(ext string) string {
 	switch ext {
 	case "go":
 		return "go"
@@ -77,6 +236,12 @@ func getLangKey(ext string) string {
 		return "lua"
 	case "zig":
 		return "zig"
+	case "rs":
+		return "rust"
+	case "java":
+		return "java"
+	case "cpp", "cc", "cxx", "hpp", "hh", "hxx", "h", "c":
+		return "cpp"
 	default:
 		return ""
 	}
@@ -84,6 +249,23 @@ func getLangKey(ext string) string {
 
 // ScanFile scans a single file and returns its nodes.
 func (s *Scanner) ScanFile(ctx context.Context, path string) ([]*graph.Node, error) {
+	if _, err := s.scannableExt(path); err != nil {
+		return nil, err
+	}
+	content, err := s.overlay.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return s.ScanContent(path, content)
+}
+
+// ScanContent returns the nodes of content as if it were the file at path,
+// for sources that are not on disk, such as an older revision of the file.
+func (s *Scanner) ScanContent(path string, content []byte) ([]*graph.Node, error) {
+	ext, err := s.scannableExt(path)
+	if err != nil {
+		return nil, err
+	}
 	relPath := path
 	if s.root != "" {
 		if rel, err := filepath.Rel(s.root, path); err == nil {
@@ -91,24 +273,46 @@ func (s *Scanner) ScanFile(ctx context.Context, path string) ([]*graph.Node, err
 		}
 	}
 
-	ext := strings.TrimPrefix(filepath.Ext(path), ".")
-	lang, ok := s.languages[ext]
-	if !ok {
-		return nil, fmt.Errorf("unsupported file extension: %s", ext)
+	nodes, err := s.parseFile(ext, path, relPath, content)
+	if err != nil && !errors.Is(err, ErrSyntax) {
+		return nil, err
 	}
+	return nodes, nil
+}
 
-	query, ok := s.queries[ext]
-	if !ok {
-		return nil, fmt.Errorf("no query for extension: %s", ext)
+// NodeID returns the ID a scan of root gives a symbol named name in the file
+// at path, which tells scanned nodes apart from those enrichment adds.
+func NodeID(root, path, name string) string {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		relPath = path
 	}
+	return util.GenerateNodeID(relPath, name)
+}
 
-	content, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+// scannableExt returns the extension of path, or an error if files with it
+// are not parsed.
+func (s *Scanner) scannableExt(path string) (string, error) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if _, ok := s.languages[ext]; !ok {
+		return "", fmt.Errorf("unsupported file extension: %s", ext)
 	}
+	if _, ok := s.queries[ext]; !ok {
+		if !util.LanguageEnabled(s.langKey(ext)) {
+			return "", fmt.Errorf("%w: %s", ErrLanguageDisabled, s.langKey(ext))
+		}
+		return "", fmt.Errorf("no query for extension: %s", ext)
+	}
+	return ext, nil
+}
 
+// parseFile parses content with the grammar registered for ext and extracts
+// the definition nodes matched by the language query. If the file has syntax
+// errors it still returns whatever could be extracted, along with ErrSyntax.
+func (s *Scanner) parseFile(ext, path, relPath string, content []byte) ([]*graph.Node, error) {
 	parser := sitter.NewParser()
-	parser.SetLanguage(lang)
+	defer parser.Close()
+	parser.SetLanguage(s.languages[ext])
 
 	tree := parser.Parse(content, nil)
 	if tree == nil {
@@ -116,9 +320,11 @@ func (s *Scanner) ScanFile(ctx context.Context, path string) ([]*graph.Node, err
 	}
 	defer tree.Close()
 
+	query := s.queries[ext]
 	qc := sitter.NewQueryCursor()
 	defer qc.Close()
 
+	langKey := s.langKey(ext)
 	var nodes []*graph.Node
 	matches := qc.Matches(query, tree.RootNode(), content)
 	captureNames := query.CaptureNames()
@@ -133,7 +339,7 @@ func (s *Scanner) ScanFile(ctx context.Context, path string) ([]*graph.Node, err
 		var defNode sitter.Node
 		var foundName bool
 		var foundDef bool
-		kind := "symbol"
+		kind := graph.KindSymbol
 
 		for _, capture := range match.Captures {
 			switch captureNames[capture.Index] {
@@ -146,46 +352,193 @@ func (s *Scanner) ScanFile(ctx context.Context, path string) ([]*graph.Node, err
 			}
 		}
 
-		if foundName {
-			name := nameNode.Utf8Text(content)
-			rangeNode := nameNode
-			if foundDef {
-				kind = defNode.Kind()
-				rangeNode = defNode
-			} else if parentNode := nameNode.Parent(); parentNode != nil {
-				kind = parentNode.Kind()
-				rangeNode = *parentNode
-			}
+		if !foundName {
+			continue
+		}
 
-			startPos := nameNode.StartPosition()
-			endPos := rangeNode.EndPosition()
-			nodes = append(nodes, &graph.Node{
-				ID:        util.GenerateNodeID(relPath, name),
-				Name:      name,
-				Kind:      kind,
-				FilePath:  path,
-				LineStart: int(startPos.Row) + 1,
-				LineEnd:   int(endPos.Row) + 1,
-				ColStart:  int(startPos.Column) + 1,
-				ColEnd:    int(endPos.Column) + 1,
-				SymbolURI: util.PathToURI(path),
-			})
+		name := nameNode.Utf8Text(content)
+		if foundDef && defNode.Kind() == "impl_item" {
+			name = implName(&defNode, content)
 		}
+		rangeNode := nameNode
+		if foundDef {
+			kind = canonicalKind(langKey, &defNode, &nameNode)
+			rangeNode = defNode
+		} else if parentNode := nameNode.Parent(); parentNode != nil {
+			kind = canonicalKind(langKey, parentNode, &nameNode)
+			rangeNode = *parentNode
+		}
+
+		startPos := nameNode.StartPosition()
+		endPos := rangeNode.EndPosition()
+		nodes = append(nodes, &graph.Node{
+			ID:        util.GenerateNodeID(relPath, name),
+			Name:      name,
+			Kind:      kind,
+			FilePath:  path, // Store absolute path for LSP compatibility
+			LineStart: int(startPos.Row) + 1,
+			LineEnd:   int(endPos.Row) + 1,
+			ColStart:  int(startPos.Column) + 1,
+			ColEnd:    int(endPos.Column) + 1,
+			SymbolURI: util.PathToURI(path),
+			Modifiers: extractModifiers(langKey, &rangeNode, name, content),
+		})
 	}
 
+	if tree.RootNode().HasError() {
+		return nodes, ErrSyntax
+	}
 	return nodes, nil
 }
 
+// implName names a Rust impl block after what it implements ("impl Foo",
+// "impl Display for Foo"), so it does not share an ID with the type itself.
+func implName(def *sitter.Node, content []byte) string {
+	name := "impl "
+	if trait := def.ChildByFieldName("trait"); trait != nil {
+		name += trait.Utf8Text(content) + " for "
+	}
+	if typ := def.ChildByFieldName("type"); typ != nil {
+		name += typ.Utf8Text(content)
+	}
+	return name
+}
+
+// ScanResult holds the outcome of a workspace scan.
+type ScanResult struct {
+	Nodes        []*graph.Node
+	FilesScanned int          // number of files with a supported extension that were parsed
+	Errors       []*FileError // per-file problems; files with syntax errors still contribute nodes
+}
+
+// SupportedExtensions returns the file extensions the scanner can parse, sorted.
+func (s *Scanner) SupportedExtensions() []string {
+	exts := make([]string, 0, len(s.queries))
+	for ext := range s.queries {
+		exts = append(exts, "."+ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// SupportedLanguages returns the languages the scanner can parse, sorted.
+func (s *Scanner) SupportedLanguages() []string {
+	seen := make(map[string]bool)
+	var langs []string
+	for ext := range s.queries {
+		if lang := s.langKey(ext); lang != "" && !seen[lang] {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
 func (s *Scanner) Scan(ctx context.Context, root string) ([]*graph.Node, error) {
-	s.root = root
+	res, err := s.ScanWorkspace(ctx, root)
+	if res == nil {
+		return nil, err
+	}
+	return res.Nodes, err
+}
+
+// ScanWorkspace walks root and parses every supported file, reporting how many
+// files were parsed alongside the extracted nodes.
+func (s *Scanner) ScanWorkspace(ctx context.Context, root string) (*ScanResult, error) {
 	var nodes []*graph.Node
+	res, err := s.scanFiles(ctx, root, func(fileNodes []*graph.Node) error {
+		nodes = append(nodes, fileNodes...)
+		return nil
+	})
+	res.Nodes = nodes
+	return res, err
+}
 
-	// Load gitignore
-	ign, _ := ignore.CompileIgnoreFile(filepath.Join(root, ".gitignore"))
+// ScanStream is ScanWorkspace for large repositories: instead of collecting
+// every node, it sends each file's nodes on out as soon as the file is parsed,
+// so the caller can store them in batches while the walk continues. It closes
+// out when the walk ends and returns a ScanResult without Nodes. If ctx is
+// cancelled, or the caller stops receiving and cancels, the walk stops and
+// ctx.Err() is returned.
+func (s *Scanner) ScanStream(ctx context.Context, root string, out chan<- []*graph.Node) (*ScanResult, error) {
+	defer close(out)
+	return s.scanFiles(ctx, root, func(fileNodes []*graph.Node) error {
+		if len(fileNodes) == 0 {
+			return nil
+		}
+		select {
+		case out <- fileNodes:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// scanFiles parses every supported file under root, passing each file's nodes
+// to emit. The returned result carries no nodes.
+func (s *Scanner) scanFiles(ctx context.Context, root string, emit func([]*graph.Node) error) (*ScanResult, error) {
+	s.root = root
+	filesScanned := 0
+
+	fileErrors, err := s.walkSourceFiles(ctx, root, func(path, relPath, ext string, content []byte) error {
+		fileNodes, err := s.parseFile(ext, path, relPath, content)
+		if err != nil && !errors.Is(err, ErrSyntax) {
+			return err
+		}
+		// Files with syntax errors still contribute their partial nodes
+		filesScanned++
+		if emitErr := emit(fileNodes); emitErr != nil {
+			return emitErr
+		}
+		return err
+	})
+
+	return &ScanResult{FilesScanned: filesScanned, Errors: fileErrors}, err
+}
+
+// Fingerprint hashes the path and content of every file ScanWorkspace would
+// parse under root, without parsing them. Two equal fingerprints mean a scan
+// would see exactly the same sources.
+func (s *Scanner) Fingerprint(ctx context.Context, root string) (string, error) {
+	h := sha256.New()
+	_, err := s.walkSourceFiles(ctx, root, func(path, relPath, ext string, content []byte) error {
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(h, "%s\x00%x\n", filepath.ToSlash(relPath), sum)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkSourceFiles calls visit with the content of every supported file under
+// root, in lexical order, applying the same hidden-file, ignore-dir,
+// .gitignore and scope rules for every caller. Unreadable entries and errors returned
+// by visit are collected as FileErrors rather than stopping the walk; only
+// cancellation of ctx stops it early.
+func (s *Scanner) walkSourceFiles(ctx context.Context, root string, visit func(path, relPath, ext string, content []byte) error) ([]*FileError, error) {
+	var fileErrors []*FileError
+
+	ign := s.Gitignore(root)
 
 	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			return err
+			if path == root {
+				return err
+			}
+			// Skip unreadable entries rather than aborting the whole scan
+			relPath, _ := filepath.Rel(root, path)
+			fileErrors = append(fileErrors, &FileError{Path: relPath, Err: err})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		// Skip hidden files and common ignore dirs
@@ -195,13 +548,20 @@ func (s *Scanner) Scan(ctx context.Context, root string) ([]*graph.Node, error)
 			}
 			return nil
 		}
-		if d.IsDir() && (d.Name() == "node_modules" || d.Name() == "vendor" || d.Name() == "zig-out") {
+		if d.IsDir() && path != root && s.IgnoresDir(path) {
 			return filepath.SkipDir
 		}
 
-		// Check gitignore
+		// Check gitignore; root itself is scanned even if a .gitignore
+		// above it excludes it
 		relPath, _ := filepath.Rel(root, path)
-		if ign != nil && ign.MatchesPath(relPath) {
+		if ign != nil && path != root && ign.Matches(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root && !s.InScope(relPath, d.IsDir()) {
 			if d.IsDir() {
 				return filepath.SkipDir
 			}
@@ -214,92 +574,24 @@ func (s *Scanner) Scan(ctx context.Context, root string) ([]*graph.Node, error)
 
 		// Check extension
 		ext := strings.TrimPrefix(filepath.Ext(path), ".")
-		lang, ok := s.languages[ext]
-		if !ok {
-			return nil
-		}
-		query, ok := s.queries[ext]
-		if !ok {
+		if _, ok := s.queries[ext]; !ok {
 			return nil
 		}
 
-		// Parse
-		content, err := os.ReadFile(path)
+		content, err := s.overlay.ReadFile(path)
 		if err != nil {
+			fileErrors = append(fileErrors, &FileError{Path: relPath, Err: fmt.Errorf("failed to read file: %w", err)})
 			return nil // Skip unreadable files
 		}
 
-		parser := sitter.NewParser()
-		parser.SetLanguage(lang)
-		tree := parser.Parse(content, nil)
-		if tree == nil {
-			return nil
-		}
-		defer tree.Close()
-
-		rootNode := tree.RootNode()
-		qc := sitter.NewQueryCursor()
-		defer qc.Close()
-
-		matches := qc.Matches(query, rootNode, content)
-		captureNames := query.CaptureNames()
-
-		for {
-			match := matches.Next()
-			if match == nil {
-				break
-			}
-
-			var nameNode sitter.Node
-			var defNode sitter.Node
-			var foundName bool
-			var foundDef bool
-			var kind string = "symbol"
-
-			for _, capture := range match.Captures {
-				cName := captureNames[capture.Index]
-
-				if cName == "name" {
-					nameNode = capture.Node
-					foundName = true
-				} else if cName == "def" {
-					defNode = capture.Node
-					foundDef = true
-				}
-			}
-
-			if foundName {
-				// Extract content
-				name := nameNode.Utf8Text(content)
-
-				// simple kind inference
-				rangeNode := nameNode
-				if foundDef {
-					kind = defNode.Kind()
-					rangeNode = defNode
-				} else if parentNode := nameNode.Parent(); parentNode != nil {
-					kind = parentNode.Kind()
-					rangeNode = *parentNode
-				}
-
-				startPos := nameNode.StartPosition()
-				endPos := rangeNode.EndPosition()
-				node := &graph.Node{
-					ID:        util.GenerateNodeID(relPath, name),
-					Name:      name,
-					Kind:      kind,
-					FilePath:  path, // Store absolute path for LSP compatibility
-					LineStart: int(startPos.Row) + 1,
-					LineEnd:   int(endPos.Row) + 1,
-					ColStart:  int(startPos.Column) + 1,
-					ColEnd:    int(endPos.Column) + 1,
-				}
-				nodes = append(nodes, node)
+		if err := visit(path, relPath, ext, content); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
 			}
+			fileErrors = append(fileErrors, &FileError{Path: relPath, Err: err})
 		}
-
 		return nil
 	})
 
-	return nodes, err
+	return fileErrors, err
 }
@@ -0,0 +1,83 @@
+package scanner
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Scope narrows a scan to part of the workspace. Patterns are matched
+// against paths relative to the scan root, with forward slashes, using
+// path.Match syntax plus ** for any number of directories. A pattern that
+// matches a directory covers everything beneath it, so "src" and "src/**"
+// are the same.
+type Scope struct {
+	// IncludeGlobs, if any, limit the scan to files matching one of them.
+	IncludeGlobs []string
+	// ExcludeGlobs skip the files and directories matching any of them,
+	// even those an include pattern matches.
+	ExcludeGlobs []string
+}
+
+// Validate reports the first malformed pattern.
+func (sc Scope) Validate() error {
+	for _, globs := range [][]string{sc.IncludeGlobs, sc.ExcludeGlobs} {
+		for _, glob := range globs {
+			for _, seg := range strings.Split(glob, "/") {
+				if _, err := path.Match(seg, ""); err != nil {
+					return fmt.Errorf("invalid glob %q: %w", glob, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Includes reports whether relPath, a directory when isDir is set, is in
+// scope. Directories are only tested against the exclusions, since files
+// beneath one may still match an include pattern.
+func (sc Scope) Includes(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(relPath)
+	if matchesAnyGlob(sc.ExcludeGlobs, relPath) {
+		return false
+	}
+	return isDir || len(sc.IncludeGlobs) == 0 || matchesAnyGlob(sc.IncludeGlobs, relPath)
+}
+
+// matchesAnyGlob reports whether one of globs matches p or a directory
+// above it.
+func matchesAnyGlob(globs []string, p string) bool {
+	for _, glob := range globs {
+		pattern := strings.Split(strings.Trim(glob, "/"), "/")
+		for prefix := p; prefix != "." && prefix != "/" && prefix != ""; prefix = path.Dir(prefix) {
+			if matchSegments(pattern, strings.Split(prefix, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, where a **
+// segment matches any number of path segments, including none.
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
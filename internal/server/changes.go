@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"codemap/internal/graph"
+	"codemap/internal/scanner"
+	"codemap/util"
+)
+
+// How a symbol differs between a git revision and the working tree.
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+)
+
+// ChangedSymbol is a symbol that was added, removed or modified since a git
+// revision. A removed symbol carries its location at that revision.
+type ChangedSymbol struct {
+	graph.Node
+	Change string `json:"change"`
+}
+
+// ChangedSymbols lists the symbols that differ between a git revision and the
+// working tree.
+type ChangedSymbols struct {
+	BaseRef string          `json:"base_ref"`
+	Files   []string        `json:"files"` // changed source files, relative to the workspace
+	Symbols []ChangedSymbol `json:"symbols"`
+}
+
+// changedSymbols compares the indexed symbols of the source files under root
+// that differ from revision baseRef with the symbols of the same files at
+// baseRef, scanned from git. Symbols match by name and kind; a matched symbol
+// is modified if its source text changed, so moving code does not count.
+func (s *Server) changedSymbols(ctx context.Context, root, baseRef string) (*ChangedSymbols, error) {
+	files, err := util.GitChangedFiles(ctx, root, baseRef)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ChangedSymbols{BaseRef: baseRef, Files: []string{}, Symbols: []ChangedSymbol{}}
+	for _, rel := range files {
+		path := filepath.Join(root, rel)
+		if util.LanguageForPath(path) == "" {
+			continue
+		}
+		result.Files = append(result.Files, rel)
+
+		stored, err := s.store.GetSymbolsInFile(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		// The base revision is only scanned, so nested symbols that
+		// enrichment added, such as fields, are left out of both sides
+		var current []*graph.Node
+		for _, n := range stored {
+			if n.ID == scanner.NodeID(root, path, n.Name) {
+				current = append(current, n)
+			}
+		}
+		content, existed, err := util.GitShowFile(ctx, root, baseRef, rel)
+		if err != nil {
+			return nil, err
+		}
+		var base []*graph.Node
+		if existed {
+			if base, err = s.scanner.ScanContent(path, content); err != nil {
+				return nil, fmt.Errorf("failed to scan %s at %s: %w", rel, baseRef, err)
+			}
+		}
+
+		result.Symbols = append(result.Symbols, s.diffSymbols(path, current, base, content)...)
+	}
+	return result, nil
+}
+
+// diffSymbols classifies the symbols of one file: current are those indexed
+// now, base those found in baseContent, the file at the base revision.
+func (s *Server) diffSymbols(path string, current, base []*graph.Node, baseContent []byte) []ChangedSymbol {
+	key := func(n *graph.Node) string { return n.Name + "\x00" + n.Kind }
+
+	// Symbols sharing a name and kind, such as methods of different types,
+	// match any of their namesakes at the base revision
+	baseSources := make(map[string]map[string]bool)
+	for _, n := range base {
+		source, _ := readLines(bytes.NewReader(baseContent), n.LineStart, n.LineEnd)
+		if baseSources[key(n)] == nil {
+			baseSources[key(n)] = make(map[string]bool)
+		}
+		baseSources[key(n)][source] = true
+	}
+
+	var changes []ChangedSymbol
+	stillPresent := make(map[string]bool)
+	for _, n := range current {
+		stillPresent[key(n)] = true
+		sources, existed := baseSources[key(n)]
+		if !existed {
+			changes = append(changes, ChangedSymbol{Node: *n, Change: changeAdded})
+			continue
+		}
+		if source, err := s.readSource(path, n.LineStart, n.LineEnd); err != nil || !sources[source] {
+			changes = append(changes, ChangedSymbol{Node: *n, Change: changeModified})
+		}
+	}
+	for _, n := range base {
+		if !stillPresent[key(n)] {
+			changes = append(changes, ChangedSymbol{Node: *n, Change: changeRemoved})
+		}
+	}
+	return changes
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 
+	"codemap/internal/graph"
+
 	"github.com/google/jsonschema-go/jsonschema"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -28,6 +32,32 @@ func (s *Server) registerResources() {
 		}, nil
 	})
 
+	s.mcpServer.AddResource(&mcp.Resource{
+		URI:         "codemap://graph",
+		Name:        "Code Graph",
+		Description: "The whole code graph as JSON, sorted deterministically with paths relative to the workspace",
+		MIMEType:    "application/json",
+	}, func(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+		g, err := s.store.Export(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cwd, _ := os.Getwd()
+		var buf bytes.Buffer
+		if err := graph.WriteExport(&buf, g, graph.FormatJSON, cwd); err != nil {
+			return nil, err
+		}
+		return &mcp.ReadResourceResult{
+			Contents: []*mcp.ResourceContents{
+				{
+					URI:      "codemap://graph",
+					MIMEType: "application/json",
+					Text:     buf.String(),
+				},
+			},
+		}, nil
+	})
+
 	// Build a map of tool name -> schema JSON for dynamic dispatch.
 	schemaMap := buildSchemaMap()
 
@@ -64,7 +94,24 @@ func buildSchemaMap() map[string]string {
 	addSchema[IndexStatusArgs](m, "index_status")
 	addSchema[GetSymbolsInFileArgs](m, "get_symbols_in_file")
 	addSchema[FindImpactArgs](m, "find_impact")
+	addSchema[FindFileLocalArgs](m, "find_file_local")
+	addSchema[ChangedSymbolsArgs](m, "changed_symbols")
 	addSchema[GetSymbolArgs](m, "get_symbol")
+	addSchema[GetImplementationsArgs](m, "get_implementations")
+	addSchema[FindReferencesArgs](m, "find_references")
+	addSchema[GoToDefinitionArgs](m, "go_to_definition")
+	addSchema[GetSymbolAtArgs](m, "get_symbol_at")
+	addSchema[StatsArgs](m, "stats")
+	addSchema[SearchSymbolsArgs](m, "search_symbols")
+	addSchema[GetNeighborhoodArgs](m, "get_neighborhood")
+	addSchema[GetFileEdgesArgs](m, "get_file_edges")
+	addSchema[CallTreeArgs](m, "call_tree")
+	addSchema[GetCallersArgs](m, "get_callers")
+	addSchema[GetCalleesArgs](m, "get_callees")
+	addSchema[ReadFileRangeArgs](m, "read_file_range")
+	addSchema[DiagnosticsArgs](m, "diagnostics")
+	addSchema[UpdateBufferArgs](m, "update_buffer")
+	addSchema[CloseBufferArgs](m, "close_buffer")
 	return m
 }
 
@@ -2,14 +2,21 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"codemap/internal/graph"
+	"codemap/internal/indexer"
 	"codemap/internal/lsp"
+	"codemap/internal/overlay"
 	"codemap/internal/scanner"
+	"codemap/util"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -21,8 +28,19 @@ const (
 	IndexStatusInProgress IndexStatus = "in_progress"
 	IndexStatusReady      IndexStatus = "ready"
 	IndexStatusFailed     IndexStatus = "failed"
+	// IndexStatusEmpty means indexing completed but found no supported files.
+	IndexStatusEmpty IndexStatus = "empty"
+	// IndexStatusSymbolsReady means the run has stored every symbol and is
+	// still adding edges with LSP enrichment.
+	IndexStatusSymbolsReady IndexStatus = "symbols_ready"
 )
 
+// running reports whether status belongs to an index run that has not
+// finished.
+func (status IndexStatus) running() bool {
+	return status == IndexStatusInProgress || status == IndexStatusSymbolsReady
+}
+
 type Server struct {
 	scanner      *scanner.Scanner
 	store        *graph.Store
@@ -30,14 +48,80 @@ type Server struct {
 	mcpServer    *mcp.Server
 	systemPrompt string
 
-	indexStatus    IndexStatus
-	indexError     error
-	indexStartTime time.Time
-	indexEndTime   time.Time
-	indexMu        sync.RWMutex
-	indexReady     chan struct{}
+	// buffers holds unsaved editor contents and reindex re-scans one file
+	// from them; both are nil until SetBuffers is called.
+	buffers *overlay.Overlay
+	reindex func(ctx context.Context, path string) error
+
+	// index holds the current indexSnapshot. Readers load it without locking,
+	// so status queries never wait on a running index.
+	index atomic.Pointer[indexSnapshot]
+
+	// indexMu serializes status transitions and guards indexReady and
+	// symbolsReady; it is only ever held briefly, never across indexing work.
+	// symbolsReady closes once a run has stored its symbols, indexReady once
+	// it has finished, edges included.
+	indexMu      sync.Mutex
+	indexReady   chan struct{}
+	symbolsReady chan struct{}
+
+	// background tracks the enrichment of async index runs, which runs on
+	// closing rather than the request's context; Close cancels it and waits.
+	// closed, guarded by indexMu, stops new runs from starting it.
+	background     sync.WaitGroup
+	closing        context.Context
+	stopBackground context.CancelFunc
+	closed         bool
+}
+
+// indexSnapshot is an immutable view of the index status. Transitions replace
+// the whole snapshot rather than mutating it.
+type indexSnapshot struct {
+	status    IndexStatus
+	err       error
+	startTime time.Time
+	endTime   time.Time
+	phases    indexPhases // phases of the current or last run finished so far
 }
 
+// indexPhases are the phase timings of an index run, formatted for the
+// index tool and status.
+type indexPhases indexer.Phases
+
+// PhaseSeconds is the per-phase breakdown of an index run, in seconds.
+type PhaseSeconds struct {
+	Scan   float64 `json:"scan"`
+	Store  float64 `json:"store"`
+	Enrich float64 `json:"enrich"`
+	Prune  float64 `json:"prune"`
+}
+
+// seconds converts p for output, returning nil if no phase has run.
+func (p indexPhases) seconds() *PhaseSeconds {
+	if p == (indexPhases{}) {
+		return nil
+	}
+	return &PhaseSeconds{
+		Scan:   p.Scan.Seconds(),
+		Store:  p.Store.Seconds(),
+		Enrich: p.Enrich.Seconds(),
+		Prune:  p.Prune.Seconds(),
+	}
+}
+
+// String formats p as "scan 0.42s, store 0.05s, enrich 3.10s, prune 0.01s".
+func (p indexPhases) String() string {
+	return fmt.Sprintf("scan %.2fs, store %.2fs, enrich %.2fs, prune %.2fs",
+		p.Scan.Seconds(), p.Store.Seconds(), p.Enrich.Seconds(), p.Prune.Seconds())
+}
+
+// errIndexInProgress is returned by indexWorkspace when another index run has
+// not finished yet.
+var errIndexInProgress = errors.New("indexing already in progress")
+
+// errServerClosed fails an async index run started after Close.
+var errServerClosed = errors.New("server is shutting down")
+
 func New(scn *scanner.Scanner, store *graph.Store, lspSvc *lsp.Service, systemPrompt string) *Server {
 	s := mcp.NewServer(&mcp.Implementation{
 		Name:    "codemap",
@@ -50,53 +134,140 @@ func New(scn *scanner.Scanner, store *graph.Store, lspSvc *lsp.Service, systemPr
 		lsp:          lspSvc,
 		mcpServer:    s,
 		systemPrompt: systemPrompt,
-		indexStatus:  IndexStatusNotStarted,
 		indexReady:   make(chan struct{}),
+		symbolsReady: make(chan struct{}),
 	}
+	srv.closing, srv.stopBackground = context.WithCancel(context.Background())
+	srv.index.Store(&indexSnapshot{status: IndexStatusNotStarted})
 	srv.registerTools()
 	srv.registerResources()
 	srv.registerPrompts()
 	return srv
 }
 
+// SetBuffers enables update_buffer and close_buffer. buffers must be the
+// overlay the scanner and language servers read from, and reindex re-scans
+// a single file through it.
+func (s *Server) SetBuffers(buffers *overlay.Overlay, reindex func(ctx context.Context, path string) error) {
+	s.buffers = buffers
+	s.reindex = reindex
+}
+
+// GetIndexStatus returns the current status, the error of a failed run and how
+// long the current or last run took. It never blocks.
 func (s *Server) GetIndexStatus() (IndexStatus, error, time.Duration) {
-	s.indexMu.RLock()
-	defer s.indexMu.RUnlock()
-	
+	snap := s.index.Load()
+
 	var duration time.Duration
-	if !s.indexStartTime.IsZero() {
-		if s.indexEndTime.IsZero() {
-			duration = time.Since(s.indexStartTime)
+	if !snap.startTime.IsZero() {
+		if snap.endTime.IsZero() {
+			duration = time.Since(snap.startTime)
 		} else {
-			duration = s.indexEndTime.Sub(s.indexStartTime)
+			duration = snap.endTime.Sub(snap.startTime)
 		}
 	}
-	
-	return s.indexStatus, s.indexError, duration
+
+	return snap.status, snap.err, duration
+}
+
+// beginIndex moves the status to in_progress, re-arming indexReady and
+// symbolsReady after a finished run. It reports false if a run is already in
+// progress.
+func (s *Server) beginIndex() bool {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	switch s.index.Load().status {
+	case IndexStatusInProgress, IndexStatusSymbolsReady:
+		return false
+	case IndexStatusReady, IndexStatusFailed, IndexStatusEmpty:
+		s.indexReady = make(chan struct{})
+		s.symbolsReady = make(chan struct{})
+	}
+	s.index.Store(&indexSnapshot{status: IndexStatusInProgress, startTime: time.Now()})
+	return true
 }
 
+// setIndexStatus records the outcome of the running index and wakes anyone
+// in WaitForIndex or WaitForSymbols.
 func (s *Server) setIndexStatus(status IndexStatus, err error) {
 	s.indexMu.Lock()
 	defer s.indexMu.Unlock()
-	
-	s.indexStatus = status
-	s.indexError = err
-	
-	if status == IndexStatusInProgress {
-		s.indexStartTime = time.Now()
-	} else if status == IndexStatusReady || status == IndexStatusFailed {
-		s.indexEndTime = time.Now()
-		close(s.indexReady)
+
+	prev := s.index.Load()
+	if !prev.status.running() {
+		// Nothing is running; there is no run to finish
+		return
+	}
+	if prev.status == IndexStatusInProgress {
+		close(s.symbolsReady)
+	}
+	s.index.Store(&indexSnapshot{
+		status:    status,
+		err:       err,
+		startTime: prev.startTime,
+		endTime:   time.Now(),
+		phases:    prev.phases,
+	})
+	close(s.indexReady)
+}
+
+// setIndexPhases publishes the phase timings of the running index.
+func (s *Server) setIndexPhases(phases indexPhases) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	prev := s.index.Load()
+	if !prev.status.running() {
+		return
 	}
+	next := *prev
+	next.phases = phases
+	s.index.Store(&next)
 }
 
+// setSymbolsReady moves the running index to symbols_ready and wakes anyone
+// in WaitForSymbols, while enrichment goes on.
+func (s *Server) setSymbolsReady() {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	prev := s.index.Load()
+	if prev.status != IndexStatusInProgress {
+		return
+	}
+	next := *prev
+	next.status = IndexStatusSymbolsReady
+	s.index.Store(&next)
+	close(s.symbolsReady)
+}
+
+// WaitForSymbols waits until the current index run has stored its symbols,
+// which is enough for queries that do not follow edges. It returns the error
+// of a run that failed before that.
+func (s *Server) WaitForSymbols(ctx context.Context) error {
+	s.indexMu.Lock()
+	ready := s.symbolsReady
+	s.indexMu.Unlock()
+
+	select {
+	case <-ready:
+		return s.index.Load().err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForIndex waits until the current index run has finished, edges
+// included, and returns its error.
 func (s *Server) WaitForIndex(ctx context.Context) error {
+	s.indexMu.Lock()
+	ready := s.indexReady
+	s.indexMu.Unlock()
+
 	select {
-	case <-s.indexReady:
-		s.indexMu.RLock()
-		err := s.indexError
-		s.indexMu.RUnlock()
-		return err
+	case <-ready:
+		return s.index.Load().err
 	case <-ctx.Done():
 		return ctx.Err()
 	}
@@ -106,50 +277,212 @@ func (s *Server) Run(ctx context.Context) error {
 	return s.mcpServer.Run(ctx, &mcp.StdioTransport{})
 }
 
+// Close cancels the background enrichment of an async index run and waits
+// for it to stop, so nothing writes to the store once the caller closes it.
+func (s *Server) Close() {
+	s.indexMu.Lock()
+	s.closed = true
+	s.indexMu.Unlock()
+	s.stopBackground()
+	s.background.Wait()
+}
+
 func (s *Server) RunInitialIndex(ctx context.Context, projectRoot string) {
-	s.setIndexStatus(IndexStatusInProgress, nil)
-	
-	nodes, err := s.scanner.Scan(ctx, projectRoot)
-	if err != nil {
-		s.setIndexStatus(IndexStatusFailed, fmt.Errorf("scan failed: %w", err))
-		return
+	s.indexWorkspace(ctx, projectRoot, scanner.Scope{}, false, false)
+}
+
+// indexResult summarizes a completed index run.
+type indexResult struct {
+	Files     int
+	Nodes     int
+	Edges     int
+	Duration  time.Duration
+	Phases    indexPhases
+	Warnings  []string // non-fatal problems that left the index incomplete
+	Unchanged bool     // nothing changed since the last index, which was kept
+	Enriching bool     // edges are still being added in the background
+}
+
+// Meta keys recording the last successful index run.
+const (
+	metaIndexFingerprint = "index_fingerprint" // sources fingerprint plus git HEAD
+	metaIndexStats       = "index_stats"       // JSON-encoded indexStats
+)
+
+// indexStats are the counts of the last successful index run, replayed when
+// an unchanged workspace short-circuits.
+type indexStats struct {
+	Files int `json:"files"`
+	Nodes int `json:"nodes"`
+	Edges int `json:"edges"`
+}
+
+// indexWorkspace runs the full scan → store → prune → enrich pipeline for the
+// files of root within scope, and records the outcome in the index status.
+// The scope stays with the scanner, so the watcher keeps to it too. Unless
+// force is set, it returns early with the previous counts when neither the
+// source files nor git HEAD have changed since the last successful run. With
+// async set it returns once the symbols are stored, and enrichment finishes
+// the run in the background, no longer bound to ctx but stopped by Close.
+func (s *Server) indexWorkspace(ctx context.Context, root string, scope scanner.Scope, force, async bool) (*indexResult, error) {
+	if !s.beginIndex() {
+		return nil, errIndexInProgress
 	}
+	startTime := time.Now()
+	s.scanner.SetScope(scope)
 
-	// COLLECT VALID FILES
-	validFiles := make(map[string]bool)
-	var validFileList []string
-	for _, n := range nodes {
-		if !validFiles[n.FilePath] {
-			validFiles[n.FilePath] = true
-			validFileList = append(validFileList, n.FilePath)
+	fingerprint, err := s.workspaceFingerprint(ctx, root)
+	if err != nil {
+		// Not fatal; the full index below does not depend on it
+		fmt.Fprintf(os.Stderr, "Warning: Failed to fingerprint workspace: %v\n", err)
+	}
+	if !force && fingerprint != "" {
+		if stats, ok := s.unchangedSince(ctx, fingerprint); ok {
+			s.setIndexStatus(IndexStatusReady, nil)
+			return &indexResult{
+				Files:     stats.Files,
+				Nodes:     stats.Nodes,
+				Edges:     stats.Edges,
+				Duration:  time.Since(startTime),
+				Unchanged: true,
+			}, nil
 		}
 	}
 
-	if err := s.store.BulkUpsertNodes(ctx, nodes); err != nil {
-		s.setIndexStatus(IndexStatusFailed, fmt.Errorf("failed to store nodes: %w", err))
-		return
+	// Forget the previous fingerprint first, so a run that dies halfway is
+	// never mistaken for a complete one.
+	if err := s.store.DeleteMeta(ctx, metaIndexFingerprint); err != nil {
+		return nil, s.failIndex(err)
 	}
 
-	// PRUNE STALE DATA
-	if err := s.store.PruneStaleFiles(ctx, validFileList); err != nil {
-		// Log warning but don't fail
-		fmt.Fprintf(os.Stderr, "Warning: Failed to prune stale files: %v\n", err)
+	ix := &indexer.Indexer{
+		Scanner:  s.scanner,
+		Store:    s.store,
+		LSP:      s.lsp,
+		Progress: func(p indexer.Phases) { s.setIndexPhases(indexPhases(p)) },
+	}
+	var phases indexer.Phases
+	sym, err := ix.StoreSymbols(ctx, root, &phases)
+	if err != nil {
+		return nil, s.failIndex(err)
 	}
 
-	edges, err := s.lsp.Enrich(ctx, nodes, s.store)
+	// Nothing to index: leave the existing graph untouched, since an empty scan
+	// usually means the root is wrong or everything was ignored.
+	if sym.FilesScanned == 0 {
+		s.setIndexStatus(IndexStatusEmpty, nil)
+		return &indexResult{Duration: time.Since(startTime), Phases: indexPhases(phases)}, nil
+	}
+	warnings := sym.Warnings
+
+	// Symbol queries can be answered from here on
+	s.setSymbolsReady()
+
+	enrich := func(ctx context.Context) (*indexResult, error) {
+		links, err := ix.Enrich(ctx, sym, &phases)
+		if err != nil {
+			return nil, s.failIndex(err)
+		}
+		warnings = append(warnings, links.Warnings...)
+		// Nested symbols the language servers found are stored nodes too
+		nodes := sym.Nodes + links.Nodes
+
+		// A run with warnings, such as a missing language server, is only
+		// partly indexed, so the next one must not be skipped
+		if fingerprint != "" && len(warnings) == 0 {
+			s.recordIndex(ctx, fingerprint, indexStats{Files: sym.FilesScanned, Nodes: nodes, Edges: links.Edges})
+		}
+
+		s.setIndexStatus(IndexStatusReady, nil)
+		return &indexResult{
+			Files:    sym.FilesScanned,
+			Nodes:    nodes,
+			Edges:    links.Edges,
+			Duration: time.Since(startTime),
+			Phases:   indexPhases(phases),
+			Warnings: warnings,
+		}, nil
+	}
+	if !async {
+		return enrich(ctx)
+	}
+
+	res := &indexResult{
+		Files:     sym.FilesScanned,
+		Nodes:     sym.Nodes,
+		Duration:  time.Since(startTime),
+		Phases:    indexPhases(phases),
+		Warnings:  append([]string(nil), warnings...),
+		Enriching: true,
+	}
+	s.indexMu.Lock()
+	if s.closed {
+		s.indexMu.Unlock()
+		return nil, s.failIndex(errServerClosed)
+	}
+	s.background.Add(1)
+	s.indexMu.Unlock()
+	go func() {
+		defer s.background.Done()
+		if _, err := enrich(s.closing); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Background enrichment failed: %v\n", err)
+		}
+	}()
+	return res, nil
+}
+
+// workspaceFingerprint identifies the sources under root together with the
+// commit checked out there.
+func (s *Server) workspaceFingerprint(ctx context.Context, root string) (string, error) {
+	sources, err := s.scanner.Fingerprint(ctx, root)
 	if err != nil {
-		s.setIndexStatus(IndexStatusFailed, fmt.Errorf("LSP enrichment failed: %w", err))
-		return
+		return "", err
+	}
+	return sources + ":" + util.GitHead(root), nil
+}
+
+// unchangedSince reports whether the last successful index was of exactly
+// fingerprint, returning its counts.
+func (s *Server) unchangedSince(ctx context.Context, fingerprint string) (indexStats, bool) {
+	var stats indexStats
+	last, err := s.store.GetMeta(ctx, metaIndexFingerprint)
+	if err != nil || last != fingerprint {
+		return stats, false
+	}
+	raw, err := s.store.GetMeta(ctx, metaIndexStats)
+	if err != nil || json.Unmarshal([]byte(raw), &stats) != nil {
+		return stats, false
 	}
+	return stats, true
+}
 
-	if err := s.store.BulkUpsertEdges(ctx, edges); err != nil {
-		s.setIndexStatus(IndexStatusFailed, fmt.Errorf("failed to store edges: %w", err))
+// recordIndex remembers a successful run so an unchanged workspace can skip
+// the next one. Failures only cost that shortcut, so they are just logged.
+func (s *Server) recordIndex(ctx context.Context, fingerprint string, stats indexStats) {
+	data, _ := json.Marshal(stats)
+	if err := s.store.SetMeta(ctx, metaIndexStats, string(data)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to record index stats: %v\n", err)
 		return
 	}
+	if err := s.store.SetMeta(ctx, metaIndexFingerprint, fingerprint); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to record index fingerprint: %v\n", err)
+	}
+}
 
-	s.setIndexStatus(IndexStatusReady, nil)
+// failIndex marks the index as failed and returns err for convenience.
+func (s *Server) failIndex(err error) error {
+	s.setIndexStatus(IndexStatusFailed, err)
+	return err
 }
 
+// emptyIndexMessage explains why an index run found nothing to index.
+func (s *Server) emptyIndexMessage(root string) string {
+	return fmt.Sprintf("No indexable files found in %s. Supported extensions: %s (%s). "+
+		"Check that the project directory is correct and that source files are not excluded by .gitignore, hidden directories or the include and exclude globs.",
+		root,
+		strings.Join(s.scanner.SupportedExtensions(), ", "),
+		strings.Join(s.scanner.SupportedLanguages(), ", "))
+}
 
 func textResult(text string) *mcp.CallToolResult {
 	return &mcp.CallToolResult{
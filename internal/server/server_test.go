@@ -0,0 +1,859 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codemap/internal/db"
+	"codemap/internal/graph"
+	"codemap/internal/lsp"
+	"codemap/internal/scanner"
+	"codemap/util"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestIndexStatusReadsDoNotBlockDuringIndex(t *testing.T) {
+	s := New(nil, nil, nil, "")
+
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed on a fresh server")
+	}
+	if s.beginIndex() {
+		t.Fatal("beginIndex succeeded while an index was already in progress")
+	}
+
+	// Hold the transition lock as a long-running index step would if it
+	// contended with readers; status reads must still complete.
+	s.indexMu.Lock()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if status, _, _ := s.GetIndexStatus(); status != IndexStatusInProgress {
+					t.Errorf("status = %s mid-index, want %s", status, IndexStatusInProgress)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetIndexStatus blocked while the index was running")
+	}
+	s.indexMu.Unlock()
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.WaitForIndex(context.Background()) }()
+
+	indexErr := errors.New("boom")
+	s.setIndexStatus(IndexStatusFailed, indexErr)
+
+	select {
+	case err := <-waitErr:
+		if !errors.Is(err, indexErr) {
+			t.Errorf("WaitForIndex() = %v, want %v", err, indexErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForIndex did not return after the index finished")
+	}
+
+	status, err, duration := s.GetIndexStatus()
+	if status != IndexStatusFailed || !errors.Is(err, indexErr) || duration <= 0 {
+		t.Errorf("GetIndexStatus() = %s, %v, %v after failure", status, err, duration)
+	}
+
+	// A finished run can be followed by another one
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed after the previous run finished")
+	}
+	if status, err, _ := s.GetIndexStatus(); status != IndexStatusInProgress || err != nil {
+		t.Errorf("GetIndexStatus() = %s, %v after re-index started", status, err)
+	}
+}
+
+func TestConcurrentStatusReadsAndTransitions(t *testing.T) {
+	s := New(nil, nil, nil, "")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.GetIndexStatus()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if !s.beginIndex() {
+			t.Fatalf("run %d: beginIndex failed", i)
+		}
+		s.setIndexStatus(IndexStatusReady, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := s.WaitForIndex(ctx); err != nil {
+			t.Fatalf("run %d: WaitForIndex failed: %v", i, err)
+		}
+		cancel()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestFindIdentifier(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.go", "package a\n\n// ParseConfigFile is unrelated\nfunc run() { cfg := yaml.ParseConfig(data) }\n")
+	b := write("b.go", "package b\n\nvar x = ParseConfig()\nvar y = ParseConfig()\n")
+	c := write("c.go", "package c\n")
+
+	got := findIdentifier([]string{a, b, c, filepath.Join(dir, "missing.go")}, "yaml.ParseConfig", 5)
+	want := []identifierSite{
+		{path: a, line: 3, char: 25},
+		{path: b, line: 2, char: 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findIdentifier() = %+v, want %+v", got, want)
+	}
+
+	if got := findIdentifier([]string{a, b}, "ParseConfig", 1); len(got) != 1 {
+		t.Errorf("limit 1 returned %d sites", len(got))
+	}
+	if got := findIdentifier([]string{a, b}, "Missing", 5); len(got) != 0 {
+		t.Errorf("absent name returned %+v", got)
+	}
+}
+
+func TestLiveDefinitionWithoutLanguageServers(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "a.go")
+	if err := os.WriteFile(path, []byte("package a\n\nvar x = Missing()\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpsertNode(ctx, &graph.Node{ID: "x", Name: "x", Kind: graph.KindVariable, FilePath: path, LineStart: 3, LineEnd: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(nil, store, nil, "")
+	if _, err := s.liveDefinition(ctx, "Missing"); err == nil {
+		t.Error("liveDefinition without language servers succeeded, want an error")
+	}
+}
+
+func TestReadSource(t *testing.T) {
+	long := strings.Repeat("x", 200_000) // past bufio.Scanner's default token size
+	path := filepath.Join(t.TempDir(), "min.js")
+	if err := os.WriteFile(path, []byte("one\r\n"+long+"\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(nil, nil, nil, "")
+	tests := []struct {
+		start, end int
+		want       string
+	}{
+		{1, 1, "one"},
+		{2, 2, long},
+		{1, 3, "one\n" + long + "\nthree"},
+		{3, 10, "three"},
+		{4, 10, ""},
+	}
+	for _, tt := range tests {
+		got, err := s.readSource(path, tt.start, tt.end)
+		if err != nil || got != tt.want {
+			t.Errorf("readSource(%d, %d) = %.20q, %v; want %.20q", tt.start, tt.end, got, err, tt.want)
+		}
+	}
+}
+
+func TestSymbolInfoFlagsMissingFile(t *testing.T) {
+	gone := filepath.Join(t.TempDir(), "gone.go")
+	s := New(nil, nil, nil, "")
+
+	si := s.symbolInfo(&graph.Node{Name: "Gone", FilePath: gone, LineStart: 1, LineEnd: 3}, true)
+	if si.Source != "" || si.SourceUnavailable != sourceFileMissing {
+		t.Fatalf("symbolInfo = %+v, want the missing file flagged", si)
+	}
+
+	// With a re-indexer, each missing file is re-indexed once
+	var reindexed []string
+	s.reindex = func(ctx context.Context, path string) error {
+		reindexed = append(reindexed, path)
+		return nil
+	}
+	info := []SymbolInfo{si, si}
+	s.dropMissingFiles(context.Background(), info)
+	if !reflect.DeepEqual(reindexed, []string{gone}) {
+		t.Errorf("re-indexed %v, want only %s", reindexed, gone)
+	}
+	for _, si := range info {
+		if si.SourceUnavailable != sourceFileRemoved {
+			t.Errorf("SourceUnavailable = %q, want %q", si.SourceUnavailable, sourceFileRemoved)
+		}
+	}
+}
+
+func TestChangedSymbols(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	write("shapes.go", "package shapes\n\nfunc Kept() int { return 1 }\n\nfunc Edited() int { return 1 }\n\nfunc Dropped() {}\n")
+	write("gone.go", "package shapes\n\nfunc Deleted() {}\n")
+	write("notes.txt", "not source\n")
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+
+	// Kept moves down a line unchanged; Edited changes; Dropped goes and
+	// Added arrives; gone.go is deleted and fresh.go is new and untracked
+	write("shapes.go", "package shapes\n\n// comment\nfunc Kept() int { return 1 }\n\nfunc Edited() int { return 2 }\n\nfunc Added() {}\n")
+	os.Remove(filepath.Join(dir, "gone.go"))
+	write("fresh.go", "package shapes\n\nfunc Fresh() {}\n")
+	write("notes.txt", "changed\n")
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	ctx := context.Background()
+	nodes, err := scn.Scan(ctx, dir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	store := graph.NewStore(database)
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatal(err)
+	}
+	// Enrichment stores nested symbols the scanner never extracts, which
+	// the base revision's scan cannot have
+	for _, n := range nodes {
+		if n.Name == "Kept" {
+			field := &graph.Node{ID: util.GenerateNodeID(n.ID, "total"), Name: "total", Kind: "variable",
+				FilePath: n.FilePath, LineStart: n.LineStart, LineEnd: n.LineEnd, SymbolURI: n.SymbolURI}
+			if err := store.BulkUpsertNodes(ctx, []*graph.Node{field}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s := New(scn, store, nil, "")
+
+	got, err := s.changedSymbols(ctx, dir, "HEAD")
+	if err != nil {
+		t.Fatalf("changedSymbols failed: %v", err)
+	}
+	if want := []string{"fresh.go", "gone.go", "shapes.go"}; !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("Files = %v, want %v", got.Files, want)
+	}
+	changes := make(map[string]string)
+	for _, c := range got.Symbols {
+		changes[c.Name] = c.Change
+	}
+	want := map[string]string{
+		"Fresh":   changeAdded,
+		"Deleted": changeRemoved,
+		"Edited":  changeModified,
+		"Dropped": changeRemoved,
+		"Added":   changeAdded,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+
+	for _, ref := range []string{"no-such-branch", "--output=x"} {
+		if _, err := s.changedSymbols(ctx, dir, ref); err == nil {
+			t.Errorf("changedSymbols(%q) succeeded, want an error", ref)
+		}
+	}
+}
+
+func TestInWorkspace(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.go"), []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"secret.go":   secret,
+		"dangling.go": filepath.Join(outside, "missing"),
+		"alias.go":    filepath.Join(root, "a.go"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The workspace itself may be reached through a symlink, as $PWD can be
+	linkedRoot := filepath.Join(t.TempDir(), "ws")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root, path string
+		want       bool
+	}{
+		{root, filepath.Join(root, "a.go"), true},
+		{root, filepath.Join(root, "unsaved.go"), true},
+		{root, filepath.Join(root, "sub", "..", "a.go"), true},
+		{root, filepath.Join(root, "..", "a.go"), false},
+		{root, filepath.Join(outside, "a.go"), false},
+		{root, filepath.Join(root, "escape", "a.go"), false},
+		{root, filepath.Join(root, "secret.go"), false},
+		{root, filepath.Join(root, "dangling.go"), false},
+		{root, filepath.Join(root, "alias.go"), true},
+		{root, "a.go", false},
+		{linkedRoot, filepath.Join(linkedRoot, "a.go"), true},
+		{linkedRoot, filepath.Join(root, "a.go"), true},
+		{linkedRoot, filepath.Join(linkedRoot, "unsaved.go"), true},
+		{linkedRoot, filepath.Join(linkedRoot, "secret.go"), false},
+	}
+	for _, tt := range tests {
+		if got := inWorkspace(tt.root, tt.path); got != tt.want {
+			t.Errorf("inWorkspace(%s, %s) = %v, want %v", tt.root, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestUnchangedSinceLastIndex(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	s := New(nil, graph.NewStore(database), nil, "")
+	ctx := context.Background()
+
+	if _, ok := s.unchangedSince(ctx, "abc:head"); ok {
+		t.Fatal("unchangedSince reported a match before any index")
+	}
+
+	want := indexStats{Files: 3, Nodes: 40, Edges: 12}
+	s.recordIndex(ctx, "abc:head", want)
+
+	got, ok := s.unchangedSince(ctx, "abc:head")
+	if !ok || got != want {
+		t.Errorf("unchangedSince() = %+v, %v, want %+v, true", got, ok, want)
+	}
+	if _, ok := s.unchangedSince(ctx, "abc:other-head"); ok {
+		t.Error("a different HEAD matched the recorded fingerprint")
+	}
+
+	// Clearing the graph forgets the fingerprint too
+	if err := s.store.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.unchangedSince(ctx, "abc:head"); ok {
+		t.Error("fingerprint survived Clear")
+	}
+}
+
+func TestIndexPhasesSurviveCompletion(t *testing.T) {
+	s := New(nil, nil, nil, "")
+
+	// Phases are only recorded for a running index
+	s.setIndexPhases(indexPhases{Scan: time.Second})
+	if got := s.index.Load().phases.seconds(); got != nil {
+		t.Fatalf("phases recorded with no index running: %+v", got)
+	}
+
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed on a fresh server")
+	}
+	s.setIndexPhases(indexPhases{Scan: time.Second})
+	if got := s.index.Load().phases.Scan; got != time.Second {
+		t.Errorf("scan phase mid-index = %v, want 1s", got)
+	}
+
+	s.setIndexPhases(indexPhases{Scan: time.Second, Enrich: 9 * time.Second})
+	s.setIndexStatus(IndexStatusReady, nil)
+
+	want := &PhaseSeconds{Scan: 1, Enrich: 9}
+	if got := s.index.Load().phases.seconds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("phases after completion = %+v, want %+v", got, want)
+	}
+}
+
+func TestSymbolsReadyBeforeEdges(t *testing.T) {
+	s := New(nil, nil, nil, "")
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed on a fresh server")
+	}
+
+	short := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 20*time.Millisecond)
+	}
+	ctx, cancel := short()
+	if err := s.WaitForSymbols(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForSymbols() mid-scan = %v, want a timeout", err)
+	}
+	cancel()
+
+	s.setSymbolsReady()
+	if status, _, _ := s.GetIndexStatus(); status != IndexStatusSymbolsReady {
+		t.Errorf("status = %s after storing symbols, want %s", status, IndexStatusSymbolsReady)
+	}
+	ctx, cancel = short()
+	if err := s.WaitForSymbols(ctx); err != nil {
+		t.Errorf("WaitForSymbols() = %v once symbols are stored", err)
+	}
+	cancel()
+	ctx, cancel = short()
+	if err := s.WaitForIndex(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForIndex() = %v while enriching, want a timeout", err)
+	}
+	cancel()
+	if s.beginIndex() {
+		t.Error("beginIndex succeeded while enrichment was running")
+	}
+
+	s.setIndexStatus(IndexStatusReady, nil)
+	ctx, cancel = short()
+	if err := s.WaitForIndex(ctx); err != nil {
+		t.Errorf("WaitForIndex() = %v after enrichment", err)
+	}
+	cancel()
+
+	// A run that fails before storing its symbols releases both waits
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed after the previous run finished")
+	}
+	indexErr := errors.New("boom")
+	s.setIndexStatus(IndexStatusFailed, indexErr)
+	ctx, cancel = short()
+	defer cancel()
+	if err := s.WaitForSymbols(ctx); !errors.Is(err, indexErr) {
+		t.Errorf("WaitForSymbols() = %v after a failed scan, want %v", err, indexErr)
+	}
+}
+
+func TestAwaitIndex(t *testing.T) {
+	s := New(nil, nil, nil, "")
+	text := func(res *mcp.CallToolResult) string {
+		if res == nil {
+			return ""
+		}
+		return res.Content[0].(*mcp.TextContent).Text
+	}
+	short := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 20*time.Millisecond)
+	}
+
+	if !s.beginIndex() {
+		t.Fatal("beginIndex failed on a fresh server")
+	}
+	ctx, cancel := short()
+	if got := text(s.awaitIndex(ctx, true)); got != "ERROR: Indexing in progress, please try again" {
+		t.Errorf("awaitIndex mid-scan = %q, want an in-progress error", got)
+	}
+	cancel()
+
+	s.setSymbolsReady()
+	ctx, cancel = short()
+	if res := s.awaitIndex(ctx, true); res != nil {
+		t.Errorf("awaitIndex for symbols = %q once they are stored, want nil", text(res))
+	}
+	if got := text(s.awaitIndex(ctx, false)); got != "ERROR: Indexing in progress, please try again" {
+		t.Errorf("awaitIndex while enriching = %q, want an in-progress error", got)
+	}
+	cancel()
+
+	s.setIndexStatus(IndexStatusFailed, errors.New("boom"))
+	ctx, cancel = short()
+	defer cancel()
+	if got := text(s.awaitIndex(ctx, false)); got != "ERROR: Indexing failed: boom" {
+		t.Errorf("awaitIndex after a failed run = %q, want the failure", got)
+	}
+}
+
+func TestIndexCountsNestedSymbols(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "shapes.go")
+	if err := os.WriteFile(file, []byte("package shapes\n\ntype Shape struct {\n\tsize int\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The language server reports a member the scanner does not extract
+	at := func(line, char int) lsp.Range {
+		return lsp.Range{Start: lsp.Position{Line: line, Character: char}, End: lsp.Position{Line: line, Character: char + 1}}
+	}
+	svc := attachFakeLSP(t, func(method string) interface{} {
+		if method != "textDocument/documentSymbol" {
+			return nil
+		}
+		return []lsp.DocumentSymbol{{
+			Name: "Shape", Kind: 23, Range: at(2, 0), SelectionRange: at(2, 5),
+			Children: []lsp.DocumentSymbol{{Name: "hidden", Kind: 8, Range: at(3, 1), SelectionRange: at(3, 1)}},
+		}}
+	})
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	store := graph.NewStore(database)
+	s := New(scn, store, svc, "")
+
+	res, err := s.indexWorkspace(context.Background(), dir, scanner.Scope{}, true, false)
+	if err != nil {
+		t.Fatalf("indexWorkspace failed: %v", err)
+	}
+	stored, err := store.GetSymbolsInFile(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nested bool
+	for _, n := range stored {
+		nested = nested || n.Name == "hidden"
+	}
+	if !nested {
+		t.Fatalf("nested symbol was not stored: %v", stored)
+	}
+	// Counted as codemap.Graph.Index counts them
+	if res.Nodes != len(stored) {
+		t.Errorf("Nodes = %d, want %d, nested symbols included", res.Nodes, len(stored))
+	}
+}
+
+func TestCloseStopsBackgroundEnrichment(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc Main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake language server never answers until the test ends
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	svc := attachFakeLSP(t, func(method string) interface{} {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+	t.Cleanup(func() { close(release) })
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	s := New(scn, graph.NewStore(database), svc, "")
+
+	res, err := s.indexWorkspace(context.Background(), dir, scanner.Scope{}, true, true)
+	if err != nil || !res.Enriching {
+		t.Fatalf("indexWorkspace = %+v, %v; want enrichment left running", res, err)
+	}
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background enrichment sent no request")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not stop the background enrichment")
+	}
+	if status, _, _ := s.GetIndexStatus(); status != IndexStatusFailed {
+		t.Errorf("status = %s after Close, want %s", status, IndexStatusFailed)
+	}
+
+	// Runs after Close cannot leave enrichment behind
+	if _, err := s.indexWorkspace(context.Background(), dir, scanner.Scope{}, true, true); !errors.Is(err, errServerClosed) {
+		t.Errorf("indexWorkspace after Close = %v, want %v", err, errServerClosed)
+	}
+}
+
+func TestCompileNamePattern(t *testing.T) {
+	names := []string{"TestParse", "TestLex", "parseHandler", "HandlerFunc", "run"}
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"", names},
+		{"Test*", []string{"TestParse", "TestLex"}},
+		{"?un", []string{"run"}},
+		{"Handler$", []string{"parseHandler"}},
+		{"^(Test|run)", []string{"TestParse", "TestLex", "run"}},
+		{"Test.*", []string{"TestParse", "TestLex"}},
+		{"Lex.*", []string{"TestLex"}}, // regexes are unanchored
+		{"Handler", nil},               // a glob without wildcards matches whole names only
+	}
+	for _, tt := range tests {
+		match, err := compileNamePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileNamePattern(%q) failed: %v", tt.pattern, err)
+		}
+		var got []string
+		for _, name := range names {
+			if match(name) {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pattern %q matched %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"Test[", "(unclosed"} {
+		if _, err := compileNamePattern(bad); err == nil {
+			t.Errorf("compileNamePattern(%q) should fail", bad)
+		}
+	}
+}
+
+// attachFakeLSP returns a Service with a go client attached over a unix
+// socket to a fake server that answers each request with handle(method).
+// Enrichment reuses the client rather than launching gopls.
+func attachFakeLSP(t *testing.T, handle func(method string) interface{}) *lsp.Service {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "lsp.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := lsp.ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     *int   `json:"id"`
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &req)
+			if req.ID != nil {
+				var result interface{}
+				if req.Method == "initialize" {
+					result = map[string]interface{}{"capabilities": map[string]bool{
+						"definitionProvider":     true,
+						"referencesProvider":     true,
+						"documentSymbolProvider": true,
+					}}
+				} else {
+					result = handle(req.Method)
+				}
+				lsp.WriteMessage(conn, lsp.Response{JSONRPC: "2.0", ID: *req.ID, Result: result})
+			}
+		}
+	}()
+
+	t.Setenv("CODEMAP_HOME", t.TempDir())
+	t.Setenv("PATH", os.Getenv("PATH"))
+	t.Setenv("CODEMAP_LSP_GO_SOCKET", "unix://"+sock)
+	svc := lsp.NewService()
+	t.Cleanup(svc.Shutdown)
+	if err := svc.AttachClient(context.Background(), "go", "unix://"+sock); err != nil {
+		t.Fatalf("AttachClient failed: %v", err)
+	}
+	return svc
+}
+
+func TestFindReferencesDeduplicates(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "parse.go")
+	if err := os.WriteFile(file, []byte("package parse\n\nfunc Parse() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "main.go")
+
+	at := func(path string, line, char int) lsp.Location {
+		return lsp.Location{URI: util.PathToURI(path), Range: lsp.Range{Start: lsp.Position{Line: line, Character: char}}}
+	}
+	svc := attachFakeLSP(t, func(method string) interface{} {
+		if method == "textDocument/references" {
+			return []lsp.Location{at(other, 9, 2), at(file, 2, 5), at(other, 4, 8), at(other, 9, 2)}
+		}
+		return nil
+	})
+	s := New(nil, nil, svc, "")
+
+	// Two declarations of one name get the same answer; each site is listed once
+	decls := []*graph.Node{
+		{ID: "a", Name: "Parse", FilePath: file, LineStart: 3, ColStart: 6},
+		{ID: "b", Name: "Parse", FilePath: file, LineStart: 3, ColStart: 6},
+	}
+	sites, err := s.findReferences(context.Background(), decls, true)
+	if err != nil {
+		t.Fatalf("findReferences failed: %v", err)
+	}
+	want := []ReferenceSite{
+		{FilePath: other, Line: 5, Col: 9},
+		{FilePath: other, Line: 10, Col: 3},
+		{FilePath: file, Line: 3, Col: 6},
+	}
+	if !reflect.DeepEqual(sites, want) {
+		t.Errorf("findReferences() = %+v, want %+v", sites, want)
+	}
+
+	missing := []*graph.Node{{ID: "c", Name: "Parse", FilePath: filepath.Join(dir, "gone.go"), LineStart: 1, ColStart: 1}}
+	if _, err := s.findReferences(context.Background(), missing, false); err == nil {
+		t.Error("expected an error when no declaration can be queried")
+	}
+}
+
+func TestGoToDefinition(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(file, []byte("package main\n\nfunc main() { helper() }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	def := lsp.Location{
+		URI:   util.PathToURI("/deps/helper.go"),
+		Range: lsp.Range{Start: lsp.Position{Line: 4, Character: 5}, End: lsp.Position{Line: 4, Character: 11}},
+	}
+	svc := attachFakeLSP(t, func(method string) interface{} {
+		if method == "textDocument/definition" {
+			// A single Location rather than an array, as the spec allows
+			return def
+		}
+		return nil
+	})
+	s := New(nil, nil, svc, "")
+
+	defs, err := s.goToDefinition(context.Background(), file, 3, 15)
+	if err != nil {
+		t.Fatalf("goToDefinition failed: %v", err)
+	}
+	want := []Definition{{FilePath: "/deps/helper.go", Line: 5, Col: 6, EndLine: 5, EndCol: 12}}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("goToDefinition() = %+v, want %+v", defs, want)
+	}
+
+	if _, err := s.goToDefinition(context.Background(), "/src/app.py", 1, 1); err == nil {
+		t.Error("expected an error without a python language server")
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	items := []string{"a.go:1", "a.go:7", "b.go:2", "b.go:9", "c.go:4"}
+
+	// Walking the pages yields every item once, in order
+	var walked []string
+	for offset := 0; ; offset += 2 {
+		page, hasMore := paginate(items, offset, 2)
+		walked = append(walked, page...)
+		if !hasMore {
+			break
+		}
+	}
+	if !reflect.DeepEqual(walked, items) {
+		t.Errorf("pages = %v, want %v", walked, items)
+	}
+
+	tests := []struct {
+		offset, limit int
+		want          []string
+		more          bool
+	}{
+		{0, 0, items, false},
+		{3, 0, items[3:], false},
+		{1, 2, items[1:3], true},
+		{3, 2, items[3:], false},
+		{5, 2, []string{}, false},
+		{9, 0, []string{}, false},
+	}
+	for _, tt := range tests {
+		page, more := paginate(items, tt.offset, tt.limit)
+		if !reflect.DeepEqual(page, tt.want) || more != tt.more {
+			t.Errorf("paginate(offset %d, limit %d) = %v, %v; want %v, %v", tt.offset, tt.limit, page, more, tt.want, tt.more)
+		}
+	}
+}
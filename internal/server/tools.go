@@ -2,14 +2,26 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"codemap/internal/graph"
+	"codemap/internal/lsp"
+	"codemap/internal/pkgmgr"
+	"codemap/internal/scanner"
+	"codemap/util"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -17,24 +29,205 @@ import (
 // Arguments structs
 
 type IndexArgs struct {
-	Force bool `json:"force" jsonschema:"description:Force a full re-index even if no changes are detected"`
+	Force   bool     `json:"force" jsonschema:"description:Force a full re-index even if no changes are detected"`
+	Async   bool     `json:"async,omitempty" jsonschema:"description:Return as soon as symbols are stored and add edges with LSP enrichment in the background; index_status reports ready once edges are done"`
+	Include []string `json:"include,omitempty" jsonschema:"description:Only index files matching one of these globs, relative to the workspace root, such as src or **/*.go; ** matches any number of directories. Symbols outside them are removed from the graph"`
+	Exclude []string `json:"exclude,omitempty" jsonschema:"description:Skip files and directories matching any of these globs, such as **/*_gen.go; takes precedence over include"`
 }
 
 type IndexStatusArgs struct{}
 
+// IndexResult is the structured output of the index tool.
+type IndexResult struct {
+	Files           int           `json:"files"`
+	Nodes           int           `json:"nodes"`
+	Edges           int           `json:"edges"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Phases          *PhaseSeconds `json:"phases,omitempty"` // where the time went; absent when nothing was re-indexed
+	Warnings        []string      `json:"warnings,omitempty"`
+	Unchanged       bool          `json:"unchanged,omitempty"` // nothing changed, so the previous index was kept
+	Enriching       bool          `json:"enriching,omitempty"` // edges are still being added in the background
+}
+
 type GetSymbolsInFileArgs struct {
-	FilePath string `json:"file_path" jsonschema:"required,description:The absolute path to the file to analyze"`
+	FilePath    string `json:"file_path" jsonschema:"required,description:The absolute path to the file to analyze"`
+	NamePattern string `json:"name_pattern,omitempty" jsonschema:"description:Only return symbols whose name matches this glob (e.g. Test*) or regular expression (e.g. Handler$)"`
+	Nested      bool   `json:"nested,omitempty" jsonschema:"description:List symbols under the symbol containing them, such as methods and fields under their class, instead of as a flat list"`
+	Limit       int    `json:"limit,omitempty" jsonschema:"description:Maximum number of symbols to return; nested symbols come with their container (default all)"`
+	Offset      int    `json:"offset,omitempty" jsonschema:"description:Number of symbols to skip, for the next page"`
+}
+
+type FindFileLocalArgs struct {
+	FilePath string `json:"file_path" jsonschema:"required,description:The absolute path to the file"`
 }
 
 type FindImpactArgs struct {
 	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the symbol to analyze for impact"`
+	Limit      int    `json:"limit,omitempty" jsonschema:"description:Maximum number of impacted symbols to return (default all)"`
+	Offset     int    `json:"offset,omitempty" jsonschema:"description:Number of impacted symbols to skip, for the next page"`
+}
+
+type ChangedSymbolsArgs struct {
+	BaseRef string `json:"base_ref" jsonschema:"required,description:The git revision to compare the working tree with, e.g. main or HEAD~3"`
+}
+
+type GetNeighborhoodArgs struct {
+	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the symbol at the center of the neighborhood"`
+	Radius     int    `json:"radius,omitempty" jsonschema:"description:How many hops to expand along incoming and outgoing edges (default 1, at most 3)"`
+}
+
+type GetFileEdgesArgs struct {
+	FilePath string `json:"file_path" jsonschema:"required,description:The absolute path to the file"`
+}
+
+type CallTreeArgs struct {
+	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the entrypoint to expand (e.g. main)"`
+	Depth      int    `json:"depth,omitempty" jsonschema:"description:How many levels of calls to expand (default 3, at most 10)"`
+}
+
+type GetCallersArgs struct {
+	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the symbol whose callers to list"`
+	Depth      int    `json:"depth,omitempty" jsonschema:"description:How many levels of callers to expand (default 1, at most 10)"`
+}
+
+type GetCalleesArgs struct {
+	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the symbol whose callees to list"`
+	Depth      int    `json:"depth,omitempty" jsonschema:"description:How many levels of callees to expand (default 1, at most 10)"`
+}
+
+type StatsArgs struct {
+	Top int `json:"top,omitempty" jsonschema:"description:How many most-referenced symbols and largest files to list (default 10)"`
 }
 
 type GetSymbolArgs struct {
-	SymbolName string `json:"symbol_name" jsonschema:"required,description:The name of the symbol to locate"`
-	WithSource bool   `json:"with_source" jsonschema:"description:If true, includes the source code of the symbol in the response"`
+	SymbolName   string `json:"symbol_name" jsonschema:"required,description:The name of the symbol to locate"`
+	WithSource   bool   `json:"with_source" jsonschema:"description:If true, includes the source code of the symbol in the response"`
+	LiveFallback bool   `json:"live_fallback,omitempty" jsonschema:"description:If true and the symbol is not in the index, ask the language server where it is defined (e.g. for symbols in dependencies)"`
+}
+
+type GetImplementationsArgs struct {
+	SymbolName   string `json:"symbol_name" jsonschema:"required,description:The name of the interface, base type or method whose implementations to find"`
+	LiveFallback bool   `json:"live_fallback,omitempty" jsonschema:"description:If true and the index records no implementations, ask the language server (e.g. for interface methods)"`
+}
+
+type FindReferencesArgs struct {
+	SymbolName         string `json:"symbol_name" jsonschema:"required,description:The name of the symbol whose uses to find"`
+	IncludeDeclaration bool   `json:"include_declaration,omitempty" jsonschema:"description:If true, also lists the symbol's own declaration"`
+}
+
+type GoToDefinitionArgs struct {
+	FilePath  string `json:"file_path" jsonschema:"required,description:The absolute path of the workspace file containing the usage"`
+	Line      int    `json:"line" jsonschema:"required,description:1-based line number of the usage"`
+	Character int    `json:"character" jsonschema:"required,description:1-based column of the usage, on the identifier"`
+}
+
+type SearchSymbolsArgs struct {
+	Query string `json:"query" jsonschema:"required,description:Case-insensitive fragment of the symbol names to find; its characters may also be spread out (e.g. gsl for GetSymbolLocation)"`
+	Limit int    `json:"limit,omitempty" jsonschema:"description:Maximum number of symbols to return (default 20)"`
+}
+
+type GetSymbolAtArgs struct {
+	FilePath   string `json:"file_path" jsonschema:"required,description:The absolute path to the file"`
+	Line       int    `json:"line" jsonschema:"required,description:1-based line number of the position"`
+	Character  int    `json:"character,omitempty" jsonschema:"description:Optional 1-based column of the position; narrows the match on a symbol's last line"`
+	WithSource bool   `json:"with_source,omitempty" jsonschema:"description:If true, includes the source code of the symbol in the response"`
+}
+
+type ReadFileRangeArgs struct {
+	FilePath  string `json:"file_path" jsonschema:"required,description:The absolute path of a file in the workspace"`
+	LineStart int    `json:"line_start" jsonschema:"required,description:1-based first line to return"`
+	LineEnd   int    `json:"line_end" jsonschema:"required,description:1-based last line to return, inclusive"`
 }
 
+type UpdateBufferArgs struct {
+	FilePath string `json:"file_path" jsonschema:"required,description:The absolute path of the file being edited"`
+	Content  string `json:"content" jsonschema:"required,description:The full unsaved text of the file"`
+}
+
+type CloseBufferArgs struct {
+	FilePath string `json:"file_path" jsonschema:"required,description:The absolute path of the file whose buffer to discard"`
+}
+
+type DiagnosticsArgs struct{}
+
+// Diagnostics is the resolved configuration reported by the diagnostics tool.
+type Diagnostics struct {
+	*pkgmgr.Environment
+	Workspace string   `json:"workspace"`
+	Languages []string `json:"languages"`
+}
+
+// SymbolInfo is a symbol location as returned by get_symbol, get_symbol_at
+// and search_symbols.
+type SymbolInfo struct {
+	graph.Node
+	References        int    `json:"references"` // distinct symbols with an edge to this one
+	Source            string `json:"source,omitempty"`
+	SourceUnavailable string `json:"source_unavailable,omitempty"` // why Source is empty although it was requested
+	Origin            string `json:"origin,omitempty"`             // "lsp" when located by a live language server query
+
+	fileMissing bool // the symbol's file no longer exists, so the index is stale
+}
+
+// Implementations pairs a declaration with the symbols implementing it.
+type Implementations struct {
+	Declaration     SymbolInfo   `json:"declaration"`
+	Implementations []SymbolInfo `json:"implementations"`
+}
+
+// ReferenceSite is a 1-based position where find_references found a symbol
+// used.
+type ReferenceSite struct {
+	FilePath string `json:"file_path"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+}
+
+// Definition is a definition location found by go_to_definition, with 1-based
+// start and end positions.
+type Definition struct {
+	FilePath string `json:"file_path"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	EndLine  int    `json:"end_line"`
+	EndCol   int    `json:"end_col"`
+}
+
+// Explanations for SymbolInfo.SourceUnavailable when the file is gone
+const (
+	sourceFileMissing = "source unavailable; the file no longer exists and may have been deleted or moved, consider re-indexing"
+	sourceFileRemoved = "source unavailable; the file no longer exists and may have been deleted or moved, so its symbols were removed from the index"
+)
+
+// defaultSearchLimit is how many symbols search_symbols returns when the
+// caller does not say.
+const defaultSearchLimit = 20
+
+// defaultStatsTop is how many entries the stats tool lists per ranking when
+// the caller does not say.
+const defaultStatsTop = 10
+
+// maxNeighborhoodRadius bounds get_neighborhood, since the subgraph grows
+// quickly with each hop through widely referenced symbols.
+const maxNeighborhoodRadius = 3
+
+// defaultCallTreeDepth and maxCallTreeDepth bound how far call_tree expands.
+const (
+	defaultCallTreeDepth = 3
+	maxCallTreeDepth     = 10
+)
+
+// defaultCallLevelsDepth is how far get_callers and get_callees expand by
+// default; maxCallTreeDepth bounds them too.
+const defaultCallLevelsDepth = 1
+
+// maxFileRangeLines bounds how many lines read_file_range returns at once.
+const maxFileRangeLines = 2000
+
+// maxListedWarnings caps how many index warnings are spelled out in the text
+// result; the structured output always carries the full list.
+const maxListedWarnings = 10
+
 func (s *Server) registerTools() {
 	mcp.AddTool(s.mcpServer, &mcp.Tool{
 		Name:        "index",
@@ -42,68 +235,48 @@ func (s *Server) registerTools() {
 	}, func(ctx context.Context, req *mcp.CallToolRequest, args IndexArgs) (*mcp.CallToolResult, any, error) {
 		cwd, _ := os.Getwd()
 
-		// Check if already indexing
-		s.indexMu.RLock()
-		currentStatus := s.indexStatus
-		s.indexMu.RUnlock()
-		
-		if currentStatus == IndexStatusInProgress {
-			return errorResult("Indexing already in progress"), nil, nil
+		scope := scanner.Scope{IncludeGlobs: args.Include, ExcludeGlobs: args.Exclude}
+		if err := scope.Validate(); err != nil {
+			return errorResult(err.Error()), nil, nil
 		}
 
-		// Reset indexReady channel if this is a re-index
-		if currentStatus == IndexStatusReady || currentStatus == IndexStatusFailed {
-			s.indexMu.Lock()
-			s.indexReady = make(chan struct{})
-			s.indexMu.Unlock()
+		res, err := s.indexWorkspace(ctx, cwd, scope, args.Force, args.Async)
+		if errors.Is(err, errIndexInProgress) {
+			return errorResult("Indexing already in progress"), nil, nil
 		}
-
-		// Run indexing and track status
-		s.setIndexStatus(IndexStatusInProgress, nil)
-		startTime := time.Now()
-
-		nodes, err := s.scanner.Scan(ctx, cwd)
 		if err != nil {
-			s.setIndexStatus(IndexStatusFailed, fmt.Errorf("scan failed: %w", err))
-			return errorResult(fmt.Sprintf("Scan failed: %v", err)), nil, nil
-		}
-
-		// COLLECT VALID FILES
-		validFiles := make(map[string]bool)
-		var validFileList []string
-		for _, n := range nodes {
-			if !validFiles[n.FilePath] {
-				validFiles[n.FilePath] = true
-				validFileList = append(validFileList, n.FilePath)
-			}
+			return errorResult(fmt.Sprintf("Indexing failed: %v", err)), nil, nil
 		}
-
-		if err := s.store.BulkUpsertNodes(ctx, nodes); err != nil {
-			s.setIndexStatus(IndexStatusFailed, fmt.Errorf("failed to store nodes: %w", err))
-			return errorResult(fmt.Sprintf("Failed to store nodes: %v", err)), nil, nil
+		if res.Files == 0 {
+			return textResult(s.emptyIndexMessage(cwd)), nil, nil
 		}
 
-		// PRUNE STALE DATA
-		if err := s.store.PruneStaleFiles(ctx, validFileList); err != nil {
-			// Log warning but don't fail
-			fmt.Fprintf(os.Stderr, "Warning: Failed to prune stale files: %v\n", err)
+		msg := fmt.Sprintf("Indexed %d nodes and %d edges in %.2fs (%s)", res.Nodes, res.Edges, res.Duration.Seconds(), res.Phases)
+		if res.Unchanged {
+			msg = fmt.Sprintf("No changes since the last index; index is current (%d nodes and %d edges). Use force to rebuild.", res.Nodes, res.Edges)
+		} else if res.Enriching {
+			msg = fmt.Sprintf("Indexed %d nodes in %.2fs (%s); edges are being added in the background, index_status reports ready when done", res.Nodes, res.Duration.Seconds(), res.Phases)
 		}
-
-		edges, err := s.lsp.Enrich(ctx, nodes, s.store)
-		if err != nil {
-			s.setIndexStatus(IndexStatusFailed, fmt.Errorf("LSP enrichment failed: %w", err))
-			return errorResult(fmt.Sprintf("Enrich failed: %v", err)), nil, nil
-		}
-
-		if err := s.store.BulkUpsertEdges(ctx, edges); err != nil {
-			s.setIndexStatus(IndexStatusFailed, fmt.Errorf("failed to store edges: %w", err))
-			return errorResult(fmt.Sprintf("Failed to store edges: %v", err)), nil, nil
+		if len(res.Warnings) > 0 {
+			msg += fmt.Sprintf(" with %d warnings:", len(res.Warnings))
+			for i, w := range res.Warnings {
+				if i == maxListedWarnings {
+					msg += fmt.Sprintf("\n- ... and %d more", len(res.Warnings)-i)
+					break
+				}
+				msg += "\n- " + w
+			}
 		}
-
-		s.setIndexStatus(IndexStatusReady, nil)
-		duration := time.Since(startTime)
-		msg := fmt.Sprintf("Indexed %d nodes and %d edges in %.2fs", len(nodes), len(edges), duration.Seconds())
-		return textResult(msg), nil, nil
+		return textResult(msg), &IndexResult{
+			Files:           res.Files,
+			Nodes:           res.Nodes,
+			Edges:           res.Edges,
+			DurationSeconds: res.Duration.Seconds(),
+			Phases:          res.Phases.seconds(),
+			Warnings:        res.Warnings,
+			Unchanged:       res.Unchanged,
+			Enriching:       res.Enriching,
+		}, nil
 	})
 
 	mcp.AddTool(s.mcpServer, &mcp.Tool{
@@ -120,10 +293,27 @@ func (s *Server) registerTools() {
 			result["duration_seconds"] = duration.Seconds()
 		}
 
+		if phases := s.index.Load().phases.seconds(); phases != nil {
+			result["phases"] = phases
+		}
+
+		// Which binary serves each language, so missing edges can be traced
+		// to an old or unexpected server
+		if s.lsp != nil {
+			if servers := s.lsp.Servers(); len(servers) > 0 {
+				result["language_servers"] = servers
+			}
+		}
+
 		if err != nil {
 			result["error"] = err.Error()
 		}
 
+		if status == IndexStatusEmpty {
+			cwd, _ := os.Getwd()
+			result["message"] = s.emptyIndexMessage(cwd)
+		}
+
 		jsonBytes, _ := json.MarshalIndent(result, "", "  ")
 		return textResult(string(jsonBytes)), nil, nil
 	})
@@ -132,18 +322,16 @@ func (s *Server) registerTools() {
 		Name:        "get_symbols_in_file",
 		Description: "Returns the structure of a file",
 	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetSymbolsInFileArgs) (*mcp.CallToolResult, any, error) {
-		// Wait for initial indexing with timeout
-		waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-		if err := s.WaitForIndex(waitCtx); err != nil {
-			status, indexErr, _ := s.GetIndexStatus()
-			if indexErr != nil {
-				return errorResult(fmt.Sprintf("Indexing failed: %v", indexErr)), nil, nil
-			}
-			if status == IndexStatusInProgress {
-				return errorResult("Indexing in progress, please try again"), nil, nil
-			}
-			return errorResult(fmt.Sprintf("Indexing wait failed: %v", err)), nil, nil
+		match, err := compileNamePattern(args.NamePattern)
+		if err != nil {
+			return errorResult(err.Error()), nil, nil
+		}
+		if args.Limit < 0 || args.Offset < 0 {
+			return errorResult("limit and offset must not be negative"), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, true); res != nil {
+			return res, nil, nil
 		}
 
 		nodes, err := s.store.GetSymbolsInFile(ctx, args.FilePath)
@@ -151,40 +339,119 @@ func (s *Server) registerTools() {
 			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
 		}
 
+		// Containing symbol of each nested one, when nesting is asked for
+		parentOf := make(map[string]string)
+		if args.Nested {
+			fileEdges, err := s.store.GetFileEdges(ctx, args.FilePath)
+			if err != nil {
+				return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+			}
+			for _, e := range fileEdges.Internal[graph.RelationContains] {
+				parentOf[e.Target.ID] = e.Source.ID
+			}
+		}
+
 		type SimpleNode struct {
-			Name  string `json:"name"`
-			Kind  string `json:"kind"`
-			Range string `json:"range"`
+			Name      string        `json:"name"`
+			Kind      string        `json:"kind"`
+			Range     string        `json:"range"`
+			Modifiers []string      `json:"modifiers,omitempty"`
+			Children  []*SimpleNode `json:"children,omitempty"`
 		}
-		var simple []SimpleNode
+		var matched []*graph.Node
+		byID := make(map[string]*SimpleNode)
 		for _, n := range nodes {
-			simple = append(simple, SimpleNode{
-				Name:  n.Name,
-				Kind:  n.Kind,
-				Range: fmt.Sprintf("%d:%d-%d:%d", n.LineStart, n.ColStart, n.LineEnd, n.ColEnd),
-			})
+			if !match(n.Name) {
+				continue
+			}
+			matched = append(matched, n)
+			byID[n.ID] = &SimpleNode{
+				Name:      n.Name,
+				Kind:      n.Kind,
+				Range:     fmt.Sprintf("%d:%d-%d:%d", n.LineStart, n.ColStart, n.LineEnd, n.ColEnd),
+				Modifiers: n.Modifiers,
+			}
+		}
+		var simple []*SimpleNode
+		for _, n := range matched {
+			// A symbol whose container was filtered out is listed at the top
+			if parent, ok := byID[parentOf[n.ID]]; ok {
+				parent.Children = append(parent.Children, byID[n.ID])
+			} else {
+				simple = append(simple, byID[n.ID])
+			}
 		}
 
-		jsonBytes, _ := json.MarshalIndent(simple, "", "  ")
+		symbols, hasMore := paginate(simple, args.Offset, args.Limit)
+		result := struct {
+			Total   int           `json:"total"`
+			HasMore bool          `json:"has_more,omitempty"`
+			Symbols []*SimpleNode `json:"symbols"`
+		}{len(simple), hasMore, symbols}
+
+		jsonBytes, _ := json.MarshalIndent(result, "", "  ")
 		return textResult(string(jsonBytes)), nil, nil
 	})
 
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "find_file_local",
+		Description: "Finds symbols in a file that are used, but only from within that file: candidates to make private",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args FindFileLocalArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		nodes, err := s.store.FileLocalSymbols(ctx, args.FilePath)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+		if len(nodes) == 0 {
+			return textResult(fmt.Sprintf("No symbols in %s are used only from within the file.", args.FilePath)), nil, nil
+		}
+
+		info := make([]SymbolInfo, 0, len(nodes))
+		for _, n := range nodes {
+			info = append(info, s.symbolInfo(n, false))
+		}
+		if err := s.addReferenceCounts(ctx, info); err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(info, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "stats",
+		Description: "Summarizes the code graph: nodes by kind and language, edges by relation, most-referenced symbols, largest files and average out-degree",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args StatsArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		top := args.Top
+		if top <= 0 {
+			top = defaultStatsTop
+		}
+		stats, err := s.store.Stats(ctx, top)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(stats, "", "  ")
+		return textResult(string(jsonBytes)), stats, nil
+	})
+
 	mcp.AddTool(s.mcpServer, &mcp.Tool{
 		Name:        "find_impact",
 		Description: "Finds downstream dependents of a symbol",
 	}, func(ctx context.Context, req *mcp.CallToolRequest, args FindImpactArgs) (*mcp.CallToolResult, any, error) {
-		// Wait for initial indexing with timeout
-		waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-		if err := s.WaitForIndex(waitCtx); err != nil {
-			status, indexErr, _ := s.GetIndexStatus()
-			if indexErr != nil {
-				return errorResult(fmt.Sprintf("Indexing failed: %v", indexErr)), nil, nil
-			}
-			if status == IndexStatusInProgress {
-				return errorResult("Indexing in progress, please try again"), nil, nil
-			}
-			return errorResult(fmt.Sprintf("Indexing wait failed: %v", err)), nil, nil
+		if args.Limit < 0 || args.Offset < 0 {
+			return errorResult("limit and offset must not be negative"), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
 		}
 
 		nodes, err := s.store.FindImpact(ctx, args.SymbolName)
@@ -197,39 +464,245 @@ func (s *Server) registerTools() {
 		}
 
 		type ImpactNode struct {
-			Name     string `json:"name"`
-			FilePath string `json:"file_path"`
-			Kind     string `json:"kind"`
+			Name      string   `json:"name"`
+			FilePath  string   `json:"file_path"`
+			Kind      string   `json:"kind"`
+			Modifiers []string `json:"modifiers,omitempty"`
 		}
-		var impacted []ImpactNode
-		for _, n := range nodes {
+		page, hasMore := paginate(nodes, args.Offset, args.Limit)
+		impacted := []ImpactNode{}
+		for _, n := range page {
 			impacted = append(impacted, ImpactNode{
-				Name:     n.Name,
-				FilePath: n.FilePath,
-				Kind:     n.Kind,
+				Name:      n.Name,
+				FilePath:  n.FilePath,
+				Kind:      n.Kind,
+				Modifiers: n.Modifiers,
 			})
 		}
+		result := struct {
+			Total    int          `json:"total"`
+			HasMore  bool         `json:"has_more,omitempty"`
+			Impacted []ImpactNode `json:"impacted"`
+		}{len(nodes), hasMore, impacted}
+
+		jsonBytes, _ := json.MarshalIndent(result, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "changed_symbols",
+		Description: "Lists the symbols added, removed or modified between a git revision and the working tree, e.g. everything a branch touches since main",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args ChangedSymbolsArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, true); res != nil {
+			return res, nil, nil
+		}
+
+		cwd, _ := os.Getwd()
+		changes, err := s.changedSymbols(ctx, cwd, args.BaseRef)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Comparison failed: %v", err)), nil, nil
+		}
+		if len(changes.Symbols) == 0 {
+			return textResult(fmt.Sprintf("No symbols changed since %s (%d source files differ).", args.BaseRef, len(changes.Files))), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(changes, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_neighborhood",
+		Description: "Returns the nodes and edges within a radius of a symbol, following incoming and outgoing edges, for drawing a local dependency diagram",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetNeighborhoodArgs) (*mcp.CallToolResult, any, error) {
+		radius := args.Radius
+		if radius <= 0 {
+			radius = 1
+		}
+		if radius > maxNeighborhoodRadius {
+			return errorResult(fmt.Sprintf("radius must be at most %d", maxNeighborhoodRadius)), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		hood, err := s.store.Neighborhood(ctx, args.SymbolName, radius)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		if len(hood.Nodes) == 0 {
+			return textResult("Symbol not found."), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(hood, "", "  ")
+		return textResult(string(jsonBytes)), hood, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_file_edges",
+		Description: "Returns every edge touching a file's symbols: outgoing to other files, incoming from them and internal, each grouped by relation",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetFileEdgesArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		edges, err := s.store.GetFileEdges(ctx, args.FilePath)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		if len(edges.Outgoing) == 0 && len(edges.Incoming) == 0 && len(edges.Internal) == 0 {
+			return textResult(fmt.Sprintf("No edges touch the symbols of %s.", args.FilePath)), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(edges, "", "  ")
+		return textResult(string(jsonBytes)), edges, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "call_tree",
+		Description: "Expands the calls made from an entrypoint into a nested tree, depth first up to a depth; symbols already expanded elsewhere are marked seen",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args CallTreeArgs) (*mcp.CallToolResult, any, error) {
+		depth := args.Depth
+		if depth <= 0 {
+			depth = defaultCallTreeDepth
+		}
+		if depth > maxCallTreeDepth {
+			return errorResult(fmt.Sprintf("depth must be at most %d", maxCallTreeDepth)), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		trees, err := s.store.CallTree(ctx, args.SymbolName, depth)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		if len(trees) == 0 {
+			return textResult("Symbol not found."), nil, nil
+		}
 
-		jsonBytes, _ := json.MarshalIndent(impacted, "", "  ")
+		jsonBytes, _ := json.MarshalIndent(trees, "", "  ")
 		return textResult(string(jsonBytes)), nil, nil
 	})
 
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_callers",
+		Description: "Lists the symbols that call or reference a symbol, grouped by depth: direct callers, their callers and so on",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetCallersArgs) (*mcp.CallToolResult, any, error) {
+		return s.callLevelsResult(ctx, args.SymbolName, args.Depth, s.store.CallerLevels), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_callees",
+		Description: "Lists the symbols a symbol calls or references, grouped by depth: direct callees, their callees and so on",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetCalleesArgs) (*mcp.CallToolResult, any, error) {
+		return s.callLevelsResult(ctx, args.SymbolName, args.Depth, s.store.CalleeLevels), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "read_file_range",
+		Description: "Returns a range of lines of a workspace file, such as a location from a stack trace",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args ReadFileRangeArgs) (*mcp.CallToolResult, any, error) {
+		if args.LineStart < 1 || args.LineEnd < args.LineStart {
+			return errorResult("line_start must be at least 1 and line_end at least line_start"), nil, nil
+		}
+		if args.LineEnd-args.LineStart >= maxFileRangeLines {
+			return errorResult(fmt.Sprintf("at most %d lines can be read at once", maxFileRangeLines)), nil, nil
+		}
+		cwd, _ := os.Getwd()
+		if !inWorkspace(cwd, args.FilePath) {
+			return errorResult(fmt.Sprintf("%s is not an absolute path inside the workspace %s", args.FilePath, cwd)), nil, nil
+		}
+
+		source, err := s.readSource(args.FilePath, args.LineStart, args.LineEnd)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Read failed: %v", err)), nil, nil
+		}
+		if source == "" {
+			return textResult(fmt.Sprintf("%s has no lines in %d-%d.", args.FilePath, args.LineStart, args.LineEnd)), nil, nil
+		}
+		return textResult(source), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "diagnostics",
+		Description: "Reports where codemap keeps language servers, the platform key, the languages indexed so far and the environment variables influencing them",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args DiagnosticsArgs) (*mcp.CallToolResult, any, error) {
+		env, err := pkgmgr.ResolveEnvironment()
+		if err != nil {
+			return errorResult(fmt.Sprintf("Resolving environment failed: %v", err)), nil, nil
+		}
+		cwd, _ := os.Getwd()
+
+		if res := s.awaitIndex(ctx, true); res != nil {
+			return res, nil, nil
+		}
+
+		files, err := s.store.ListFiles(ctx)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		diag := Diagnostics{
+			Environment: env,
+			Workspace:   cwd,
+			Languages:   util.LanguagesForPaths(files),
+		}
+		jsonBytes, _ := json.MarshalIndent(diag, "", "  ")
+		return textResult(string(jsonBytes)), diag, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "update_buffer",
+		Description: "Indexes the unsaved contents of a file in place of the file on disk, until it is saved or close_buffer is called",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args UpdateBufferArgs) (*mcp.CallToolResult, any, error) {
+		if s.buffers == nil {
+			return errorResult("Unsaved buffers are not supported by this server"), nil, nil
+		}
+		cwd, _ := os.Getwd()
+		if !inWorkspace(cwd, args.FilePath) {
+			return errorResult(fmt.Sprintf("%s is not an absolute path inside the workspace %s", args.FilePath, cwd)), nil, nil
+		}
+
+		s.buffers.Set(args.FilePath, []byte(args.Content))
+		if err := s.reindex(ctx, args.FilePath); err != nil {
+			return errorResult(fmt.Sprintf("Re-indexing failed: %v", err)), nil, nil
+		}
+
+		nodes, err := s.store.GetSymbolsInFile(ctx, args.FilePath)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+		return textResult(fmt.Sprintf("Indexed unsaved buffer of %s: %d symbols", args.FilePath, len(nodes))), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "close_buffer",
+		Description: "Discards the unsaved buffer of a file and re-indexes it from disk",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args CloseBufferArgs) (*mcp.CallToolResult, any, error) {
+		if s.buffers == nil {
+			return errorResult("Unsaved buffers are not supported by this server"), nil, nil
+		}
+
+		if !s.buffers.Clear(args.FilePath) {
+			return textResult(fmt.Sprintf("No unsaved buffer for %s.", args.FilePath)), nil, nil
+		}
+		if err := s.reindex(ctx, args.FilePath); err != nil {
+			return errorResult(fmt.Sprintf("Re-indexing failed: %v", err)), nil, nil
+		}
+		return textResult(fmt.Sprintf("Closed buffer of %s; re-indexed from disk", args.FilePath)), nil, nil
+	})
+
 	mcp.AddTool(s.mcpServer, &mcp.Tool{
 		Name:        "get_symbol",
 		Description: "Finds the location and optionally the source code of a symbol",
 	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetSymbolArgs) (*mcp.CallToolResult, any, error) {
-		// Wait for initial indexing with timeout
-		waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
-		if err := s.WaitForIndex(waitCtx); err != nil {
-			status, indexErr, _ := s.GetIndexStatus()
-			if indexErr != nil {
-				return errorResult(fmt.Sprintf("Indexing failed: %v", indexErr)), nil, nil
-			}
-			if status == IndexStatusInProgress {
-				return errorResult("Indexing in progress, please try again"), nil, nil
-			}
-			return errorResult(fmt.Sprintf("Indexing wait failed: %v", err)), nil, nil
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
 		}
 
 		nodes, err := s.store.GetSymbolLocation(ctx, args.SymbolName)
@@ -237,62 +710,641 @@ func (s *Server) registerTools() {
 			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
 		}
 
-		if len(nodes) == 0 {
-			return textResult("Symbol not found."), nil, nil
+		origin := ""
+		if len(nodes) == 0 && args.LiveFallback {
+			nodes, err = s.liveDefinition(ctx, args.SymbolName)
+			if err != nil {
+				return textResult(fmt.Sprintf("Symbol not found; live lookup failed: %v", err)), nil, nil
+			}
+			origin = "lsp"
 		}
 
-		type SymbolInfo struct {
-			graph.Node
-			Source string `json:"source,omitempty"`
+		if len(nodes) == 0 {
+			return textResult("Symbol not found."), nil, nil
 		}
 
 		var info []SymbolInfo
 		for _, n := range nodes {
-			si := SymbolInfo{Node: *n}
-			if args.WithSource {
-				source, err := s.readSource(n.FilePath, n.LineStart, n.LineEnd)
-				if err != nil {
-					// Log warning but return what we have
-					fmt.Fprintf(os.Stderr, "Warning: Failed to read source for %s in %s: %v\n", n.Name, n.FilePath, err)
-				} else {
-					si.Source = source
+			si := s.symbolInfo(n, args.WithSource)
+			si.Origin = origin
+			info = append(info, si)
+		}
+		if origin == "" {
+			s.dropMissingFiles(ctx, info)
+		}
+		if err := s.addReferenceCounts(ctx, info); err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+		// Most-referenced definition first when a name is defined more than once
+		sort.SliceStable(info, func(i, j int) bool { return info[i].References > info[j].References })
+
+		jsonBytes, _ := json.MarshalIndent(info, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_implementations",
+		Description: "Finds an interface, base type or method together with every implementation of it",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetImplementationsArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		decls, err := s.store.GetSymbolLocation(ctx, args.SymbolName)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+		if len(decls) == 0 {
+			return textResult("Symbol not found."), nil, nil
+		}
+
+		var result []Implementations
+		for _, decl := range decls {
+			impls, err := s.store.Implementations(ctx, decl.ID)
+			if err != nil {
+				return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+			}
+			origin := ""
+			if len(impls) == 0 && args.LiveFallback {
+				if impls, err = s.liveImplementations(ctx, decl); err != nil {
+					return errorResult(fmt.Sprintf("Live lookup failed: %v", err)), nil, nil
 				}
+				origin = "lsp"
 			}
-			info = append(info, si)
+
+			entry := Implementations{Declaration: s.symbolInfo(decl, false), Implementations: []SymbolInfo{}}
+			for _, n := range impls {
+				si := s.symbolInfo(n, false)
+				si.Origin = origin
+				entry.Implementations = append(entry.Implementations, si)
+			}
+			result = append(result, entry)
+		}
+
+		jsonBytes, _ := json.MarshalIndent(result, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "find_references",
+		Description: "Lists every place a symbol is used, asking the language server directly",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args FindReferencesArgs) (*mcp.CallToolResult, any, error) {
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		decls, err := s.store.GetSymbolLocation(ctx, args.SymbolName)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+		if len(decls) == 0 {
+			return textResult("Symbol not found."), nil, nil
+		}
+
+		sites, err := s.findReferences(ctx, decls, args.IncludeDeclaration)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Reference lookup failed: %v", err)), nil, nil
+		}
+		if len(sites) == 0 {
+			return textResult("No references found."), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(sites, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "go_to_definition",
+		Description: "Finds where the identifier at a file position is defined, asking the language server directly",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GoToDefinitionArgs) (*mcp.CallToolResult, any, error) {
+		if args.Line < 1 || args.Character < 1 {
+			return errorResult("line and character must be 1 or greater"), nil, nil
+		}
+		cwd, _ := os.Getwd()
+		if !inWorkspace(cwd, args.FilePath) {
+			return errorResult(fmt.Sprintf("%s is not an absolute path inside the workspace %s", args.FilePath, cwd)), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, false); res != nil {
+			return res, nil, nil
+		}
+
+		defs, err := s.goToDefinition(ctx, args.FilePath, args.Line, args.Character)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Definition lookup failed: %v", err)), nil, nil
+		}
+		if len(defs) == 0 {
+			return textResult(fmt.Sprintf("No definition found at %s:%d:%d.", args.FilePath, args.Line, args.Character)), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(defs, "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "search_symbols",
+		Description: "Searches symbols by name fragment, ranking exact names, then prefixes, substrings and fuzzy matches, most-referenced first within each",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args SearchSymbolsArgs) (*mcp.CallToolResult, any, error) {
+		if strings.TrimSpace(args.Query) == "" {
+			return errorResult("query must not be empty"), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, true); res != nil {
+			return res, nil, nil
+		}
+
+		limit := args.Limit
+		if limit <= 0 {
+			limit = defaultSearchLimit
+		}
+		nodes, err := s.store.SearchSymbols(ctx, args.Query, limit)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		if len(nodes) == 0 {
+			return textResult("No matching symbols found."), nil, nil
+		}
+
+		info := make([]SymbolInfo, 0, len(nodes))
+		for _, n := range nodes {
+			info = append(info, s.symbolInfo(n, false))
+		}
+		if err := s.addReferenceCounts(ctx, info); err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
 		}
 
 		jsonBytes, _ := json.MarshalIndent(info, "", "  ")
 		return textResult(string(jsonBytes)), nil, nil
 	})
+
+	mcp.AddTool(s.mcpServer, &mcp.Tool{
+		Name:        "get_symbol_at",
+		Description: "Finds the innermost symbol whose definition contains a file position (e.g. the function under the cursor)",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, args GetSymbolAtArgs) (*mcp.CallToolResult, any, error) {
+		if args.Line < 1 {
+			return errorResult("line must be 1 or greater"), nil, nil
+		}
+
+		if res := s.awaitIndex(ctx, true); res != nil {
+			return res, nil, nil
+		}
+
+		n, err := s.store.FindNode(ctx, args.FilePath, args.Line, args.Character)
+		if err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		if n == nil {
+			return textResult(fmt.Sprintf("No symbol contains %s:%d.", args.FilePath, args.Line)), nil, nil
+		}
+
+		info := []SymbolInfo{s.symbolInfo(n, args.WithSource)}
+		if err := s.addReferenceCounts(ctx, info); err != nil {
+			return errorResult(fmt.Sprintf("Query failed: %v", err)), nil, nil
+		}
+
+		jsonBytes, _ := json.MarshalIndent(info[0], "", "  ")
+		return textResult(string(jsonBytes)), nil, nil
+	})
 }
 
-func (s *Server) readSource(filePath string, lineStart, lineEnd int) (string, error) {
-	f, err := os.Open(filePath)
+// indexWaitTimeout bounds how long a tool waits for the initial index.
+const indexWaitTimeout = 30 * time.Second
+
+// awaitIndex waits for the current index run to finish, or with symbolsOnly
+// only for its symbols to be stored. It returns nil once they are ready, and
+// otherwise the result explaining why they are not.
+func (s *Server) awaitIndex(ctx context.Context, symbolsOnly bool) *mcp.CallToolResult {
+	waitCtx, cancel := context.WithTimeout(ctx, indexWaitTimeout)
+	defer cancel()
+	wait := s.WaitForIndex
+	if symbolsOnly {
+		wait = s.WaitForSymbols
+	}
+	if err := wait(waitCtx); err != nil {
+		status, indexErr, _ := s.GetIndexStatus()
+		if indexErr != nil {
+			return errorResult(fmt.Sprintf("Indexing failed: %v", indexErr))
+		}
+		if status.running() {
+			return errorResult("Indexing in progress, please try again")
+		}
+		return errorResult(fmt.Sprintf("Indexing wait failed: %v", err))
+	}
+	return nil
+}
+
+// callLevelsResult runs a get_callers or get_callees query once the index is
+// ready, walking depth levels (default defaultCallLevelsDepth) with walk.
+func (s *Server) callLevelsResult(ctx context.Context, symbolName string, depth int, walk func(context.Context, string, int) (*graph.CallLevels, error)) *mcp.CallToolResult {
+	if depth <= 0 {
+		depth = defaultCallLevelsDepth
+	}
+	if depth > maxCallTreeDepth {
+		return errorResult(fmt.Sprintf("depth must be at most %d", maxCallTreeDepth))
+	}
+
+	if res := s.awaitIndex(ctx, false); res != nil {
+		return res
+	}
+
+	levels, err := walk(ctx, symbolName, depth)
 	if err != nil {
-		return "", err
+		return errorResult(fmt.Sprintf("Query failed: %v", err))
+	}
+	if levels == nil {
+		return textResult("Symbol not found.")
 	}
-	defer f.Close()
 
-	var builder strings.Builder
-	scanner := bufio.NewScanner(f)
-	currentLine := 1
-	first := true
-	for scanner.Scan() {
-		if currentLine >= lineStart && currentLine <= lineEnd {
-			if !first {
-				builder.WriteByte('\n')
+	jsonBytes, _ := json.MarshalIndent(levels, "", "  ")
+	return textResult(string(jsonBytes))
+}
+
+// paginate returns the items of a page of at most limit items starting at
+// offset, and whether more follow it. A limit of 0 means no limit.
+func paginate[T any](items []T, offset, limit int) ([]T, bool) {
+	if offset >= len(items) {
+		return []T{}, false
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		return items[:limit], true
+	}
+	return items, false
+}
+
+// compileNamePattern returns a matcher for a get_symbols_in_file name pattern.
+// Patterns containing regular expression syntax that globs lack, including
+// the .* wildcard, are compiled as unanchored regular expressions; anything
+// else is a glob matched against the whole name. An empty pattern matches
+// every name.
+func compileNamePattern(pattern string) (func(string) bool, error) {
+	if pattern == "" {
+		return func(string) bool { return true }, nil
+	}
+
+	if strings.ContainsAny(pattern, `^$()+|\{}`) || strings.Contains(pattern, ".*") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name_pattern regular expression: %w", err)
+		}
+		return re.MatchString, nil
+	}
+
+	// Reject malformed globs up front rather than silently matching nothing
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid name_pattern glob %q: %w", pattern, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// symbolInfo wraps n for output, reading its source when withSource is set.
+func (s *Server) symbolInfo(n *graph.Node, withSource bool) SymbolInfo {
+	si := SymbolInfo{Node: *n}
+	if withSource {
+		source, err := s.readSource(n.FilePath, n.LineStart, n.LineEnd)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			si.SourceUnavailable = sourceFileMissing
+			si.fileMissing = true
+		case err != nil:
+			// Log warning but return what we have
+			fmt.Fprintf(os.Stderr, "Warning: Failed to read source for %s in %s: %v\n", n.Name, n.FilePath, err)
+			si.SourceUnavailable = fmt.Sprintf("source unavailable; %v", err)
+		default:
+			si.Source = source
+		}
+	}
+	return si
+}
+
+// dropMissingFiles re-indexes each file in info found to be missing, which
+// removes its stale symbols so later queries no longer return them.
+func (s *Server) dropMissingFiles(ctx context.Context, info []SymbolInfo) {
+	if s.reindex == nil {
+		return
+	}
+	done := make(map[string]error)
+	for i := range info {
+		if !info[i].fileMissing {
+			continue
+		}
+		path := info[i].FilePath
+		err, ok := done[path]
+		if !ok {
+			err = s.reindex(ctx, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to drop stale symbols of %s: %v\n", path, err)
+			}
+			done[path] = err
+		}
+		if err == nil {
+			info[i].SourceUnavailable = sourceFileRemoved
+		}
+	}
+}
+
+// addReferenceCounts fills in the incoming-reference count of each entry.
+func (s *Server) addReferenceCounts(ctx context.Context, info []SymbolInfo) error {
+	ids := make([]string, len(info))
+	for i := range info {
+		ids[i] = info[i].ID
+	}
+	counts, err := s.store.ReferenceCounts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range info {
+		info[i].References = counts[info[i].ID]
+	}
+	return nil
+}
+
+// maxLiveProbes bounds how many occurrences of a name live_fallback asks the
+// language server about before giving up.
+const maxLiveProbes = 5
+
+// liveDefinitionTimeout bounds live_fallback's probes together, since each
+// may wait on the language server.
+const liveDefinitionTimeout = 30 * time.Second
+
+// liveDefinition locates name through the language server when the index has
+// no node for it. It queries textDocument/definition at occurrences of the
+// name in indexed files, since a use site is the only place the server can
+// resolve a symbol from, and returns the first definitions found.
+func (s *Server) liveDefinition(ctx context.Context, name string) ([]*graph.Node, error) {
+	if s.lsp == nil {
+		return nil, errors.New("no language servers are available")
+	}
+	ctx, cancel := context.WithTimeout(ctx, liveDefinitionTimeout)
+	defer cancel()
+
+	files, err := s.store.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	probes := findIdentifier(files, name, maxLiveProbes)
+	if len(probes) == 0 {
+		return nil, nil
+	}
+
+	var lastErr error
+	for _, p := range probes {
+		locs, err := s.lsp.FindDefinition(ctx, p.path, p.line, p.char)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var nodes []*graph.Node
+		for _, loc := range locs {
+			nodes = append(nodes, s.locationNode(ctx, name, loc))
+		}
+		if len(nodes) > 0 {
+			return nodes, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// liveImplementations asks the language server for the implementations of
+// decl, for declarations enrichment records no implements edges for, such as
+// interface methods.
+func (s *Server) liveImplementations(ctx context.Context, decl *graph.Node) ([]*graph.Node, error) {
+	if s.lsp == nil {
+		return nil, errors.New("no language servers are available")
+	}
+	locs, err := s.lsp.FindImplementations(ctx, decl.FilePath, decl.LineStart-1, decl.ColStart-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*graph.Node
+	for _, loc := range locs {
+		// An implementation's name need not match, as for a type implementing
+		// an interface, so any stored symbol at the location is taken
+		path := util.URIToPath(loc.URI)
+		n, err := s.store.FindNode(ctx, path, loc.Range.Start.Line+1, loc.Range.Start.Character+1)
+		if err != nil || n == nil {
+			n = s.locationNode(ctx, decl.Name, loc)
+		}
+		if n.ID != "" && n.ID == decl.ID {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// goToDefinitionTimeout bounds a go_to_definition query, opening the
+// document included.
+const goToDefinitionTimeout = 15 * time.Second
+
+// goToDefinition asks the language server where the identifier at the
+// 1-based line:char of path is defined.
+func (s *Server) goToDefinition(ctx context.Context, path string, line, char int) ([]Definition, error) {
+	if s.lsp == nil {
+		return nil, errors.New("no language servers are available")
+	}
+	ctx, cancel := context.WithTimeout(ctx, goToDefinitionTimeout)
+	defer cancel()
+
+	locs, err := s.lsp.FindDefinition(ctx, path, line-1, char-1)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]Definition, 0, len(locs))
+	for _, loc := range locs {
+		defs = append(defs, Definition{
+			FilePath: util.URIToPath(loc.URI),
+			Line:     loc.Range.Start.Line + 1,
+			Col:      loc.Range.Start.Character + 1,
+			EndLine:  loc.Range.End.Line + 1,
+			EndCol:   loc.Range.End.Character + 1,
+		})
+	}
+	return defs, nil
+}
+
+// findReferences asks the language server for the uses of each of decls and
+// returns them once each, ordered by file and position. It fails only if no
+// declaration could be queried.
+func (s *Server) findReferences(ctx context.Context, decls []*graph.Node, includeDeclaration bool) ([]ReferenceSite, error) {
+	if s.lsp == nil {
+		return nil, errors.New("no language servers are available")
+	}
+
+	seen := make(map[ReferenceSite]bool)
+	sites := []ReferenceSite{}
+	var lastErr error
+	queried := 0
+	for _, decl := range decls {
+		locs, err := s.lsp.FindReferences(ctx, decl.FilePath, decl.LineStart-1, decl.ColStart-1, includeDeclaration)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		queried++
+		for _, loc := range locs {
+			site := ReferenceSite{
+				FilePath: util.URIToPath(loc.URI),
+				Line:     loc.Range.Start.Line + 1,
+				Col:      loc.Range.Start.Character + 1,
+			}
+			if !seen[site] {
+				seen[site] = true
+				sites = append(sites, site)
 			}
-			builder.Write(scanner.Bytes())
-			first = false
 		}
-		if currentLine > lineEnd {
+	}
+	if queried == 0 {
+		return nil, lastErr
+	}
+
+	sort.Slice(sites, func(i, j int) bool {
+		a, b := sites[i], sites[j]
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return sites, nil
+}
+
+// locationNode turns a definition location into a node, preferring the stored
+// node when the location falls on one with the same name.
+func (s *Server) locationNode(ctx context.Context, name string, loc lsp.Location) *graph.Node {
+	path := util.URIToPath(loc.URI)
+	line, col := loc.Range.Start.Line+1, loc.Range.Start.Character+1
+	if n, err := s.store.FindNode(ctx, path, line, col); err == nil && n != nil && n.Name == name {
+		return n
+	}
+	return &graph.Node{
+		Name:      name,
+		FilePath:  path,
+		LineStart: line,
+		ColStart:  col,
+		LineEnd:   loc.Range.End.Line + 1,
+		ColEnd:    loc.Range.End.Character + 1,
+	}
+}
+
+// identifierSite is a 0-based position of an identifier in a file.
+type identifierSite struct {
+	path       string
+	line, char int
+}
+
+// findIdentifier returns up to limit positions where name appears as a whole
+// word in files, at most one per file. For a qualified name like "pkg.Func"
+// only the last component is searched for. Columns are byte offsets, which
+// match the LSP's UTF-16 offsets for ASCII source.
+func findIdentifier(files []string, name string, limit int) []identifierSite {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		return nil
+	}
+	word := regexp.MustCompile(`(^|[^\w$])(` + regexp.QuoteMeta(name) + `)($|[^\w$])`)
+
+	var sites []identifierSite
+	for _, path := range files {
+		if len(sites) >= limit {
 			break
 		}
-		currentLine++
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if m := word.FindStringSubmatchIndex(line); m != nil {
+				sites = append(sites, identifierSite{path: path, line: i, char: m[4]})
+				break
+			}
+		}
+	}
+	return sites
+}
+
+// inWorkspace reports whether path lies inside root once symlinks are
+// resolved, so file tools cannot be pointed at arbitrary files on the host.
+func inWorkspace(root, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
 	}
+	resolved, ok := resolvePath(path)
+	if !ok {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath resolves every symlink in path. A file that only exists as an
+// unsaved buffer has its directory resolved instead; a symlink that cannot be
+// resolved fails, since where it points is unknown.
+func resolvePath(path string) (string, bool) {
+	path = filepath.Clean(path)
+	if r, err := filepath.EvalSymlinks(path); err == nil {
+		return r, true
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return "", false
+	}
+	dir, base := filepath.Split(path)
+	if r, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = r
+	}
+	return filepath.Join(dir, base), true
+}
 
-	if err := scanner.Err(); err != nil {
-		return "", err
+// readSource returns lines lineStart through lineEnd (1-based, inclusive) of
+// a file, preferring its unsaved buffer. Lines are read whole however long
+// they are, so minified or generated sources do not fail.
+func (s *Server) readSource(filePath string, lineStart, lineEnd int) (string, error) {
+	var r io.Reader
+	if content, ok := s.buffers.Get(filePath); ok {
+		r = bytes.NewReader(content)
+	} else {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	return readLines(r, lineStart, lineEnd)
+}
+
+// readLines returns lines lineStart through lineEnd (1-based, inclusive) of r.
+func readLines(r io.Reader, lineStart, lineEnd int) (string, error) {
+	var builder strings.Builder
+	br := bufio.NewReader(r)
+	for line := 1; line <= lineEnd; line++ {
+		text, err := br.ReadString('\n')
+		if line >= lineStart && (text != "" || err == nil) {
+			if line > lineStart {
+				builder.WriteByte('\n')
+			}
+			builder.WriteString(strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
 	}
 
 	return builder.String(), nil
@@ -2,6 +2,7 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,11 +12,12 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	ignore "github.com/sabhiram/go-gitignore"
 
 	"codemap/internal/graph"
 	"codemap/internal/lsp"
+	"codemap/internal/overlay"
 	"codemap/internal/scanner"
+	"codemap/util"
 )
 
 // Watcher monitors file system changes and triggers re-indexing.
@@ -25,7 +27,8 @@ type Watcher struct {
 	lsp       *lsp.Service
 	watcher   *fsnotify.Watcher
 	root      string
-	gitignore *ignore.GitIgnore
+	gitignore *scanner.Gitignore // nil when .gitignore rules are disabled
+	overlay   *overlay.Overlay   // unsaved buffers, dropped once saved
 
 	// Debouncing
 	debounceTime time.Duration
@@ -40,8 +43,7 @@ func New(scn *scanner.Scanner, store *graph.Store, lspSvc *lsp.Service, root str
 		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
 	}
 
-	// Load gitignore
-	ign, _ := ignore.CompileIgnoreFile(filepath.Join(root, ".gitignore"))
+	ign := scn.Gitignore(root)
 
 	w := &Watcher{
 		scanner:      scn,
@@ -57,6 +59,12 @@ func New(scn *scanner.Scanner, store *graph.Store, lspSvc *lsp.Service, root str
 	return w, nil
 }
 
+// SetOverlay gives the watcher the unsaved buffers, so that saving a file
+// drops its buffer and files with a buffer are not treated as deleted.
+func (w *Watcher) SetOverlay(o *overlay.Overlay) {
+	w.overlay = o
+}
+
 // Watch starts watching the directory tree for changes.
 func (w *Watcher) Watch(ctx context.Context) error {
 	// Add all directories to watch recursively
@@ -96,16 +104,18 @@ func (w *Watcher) handleEvent(ctx context.Context, event fsnotify.Event) {
 		return
 	}
 
-	if w.gitignore != nil && w.gitignore.MatchesPath(relPath) {
+	info, statErr := os.Stat(event.Name)
+	isDir := statErr == nil && info.IsDir()
+	if w.gitignore != nil && w.gitignore.Matches(event.Name, isDir) {
+		return
+	}
+	if !w.scanner.InScope(relPath, isDir) {
 		return
 	}
 
 	if !w.isSourceFile(event.Name) {
-		if event.Op&fsnotify.Create != 0 {
-			info, err := os.Stat(event.Name)
-			if err == nil && info.IsDir() {
-				w.addDirectoriesRecursively(event.Name)
-			}
+		if event.Op&fsnotify.Create != 0 && isDir {
+			w.addDirectoriesRecursively(event.Name)
 		}
 		return
 	}
@@ -113,9 +123,11 @@ func (w *Watcher) handleEvent(ctx context.Context, event fsnotify.Event) {
 	switch {
 	case event.Op&fsnotify.Write != 0:
 		log.Printf("File modified: %s", relPath)
+		w.overlay.Clear(event.Name) // saved: disk is current again
 		w.debounceFile(event.Name)
 	case event.Op&fsnotify.Create != 0:
 		log.Printf("File created: %s", relPath)
+		w.overlay.Clear(event.Name)
 		w.debounceFile(event.Name)
 	case event.Op&fsnotify.Remove != 0:
 		log.Printf("File deleted: %s", relPath)
@@ -166,18 +178,47 @@ func (w *Watcher) processPendingFiles(ctx context.Context) {
 	}
 }
 
+// Reindex re-scans a single file, reading its unsaved buffer if it has one,
+// and replaces its nodes and the edges touching them.
+func (w *Watcher) Reindex(ctx context.Context, path string) error {
+	return w.reindexFile(ctx, path)
+}
+
 func (w *Watcher) reindexFile(ctx context.Context, path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return w.handleFileDeleted(ctx, path)
+	if _, buffered := w.overlay.Get(path); !buffered {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return w.handleFileDeleted(ctx, path)
+		}
 	}
 
 	log.Printf("Re-indexing: %s", path)
 
 	nodes, err := w.scanner.ScanFile(ctx, path)
+	if errors.Is(err, scanner.ErrLanguageDisabled) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("scan failed: %w", err)
 	}
 
+	// Edges of the file's symbols are recomputed below; those of symbols that
+	// no longer exist are dropped
+	old, err := w.store.GetSymbolsInFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("load old nodes failed: %w", err)
+	}
+	current := make(map[string]bool, len(nodes))
+	var changedIDs, removedIDs []string
+	for _, n := range nodes {
+		current[n.ID] = true
+		changedIDs = append(changedIDs, n.ID)
+	}
+	for _, n := range old {
+		if !current[n.ID] {
+			removedIDs = append(removedIDs, n.ID)
+		}
+	}
+
 	if err := w.store.DeleteNodesByFile(ctx, path); err != nil {
 		return fmt.Errorf("delete old nodes failed: %w", err)
 	}
@@ -186,20 +227,29 @@ func (w *Watcher) reindexFile(ctx context.Context, path string) error {
 		return fmt.Errorf("bulk store nodes failed: %w", err)
 	}
 
-	edges, err := w.lsp.Enrich(ctx, nodes, w.store)
+	nested, edges, err := w.lsp.EnrichChanged(ctx, nodes, w.store)
 	if err != nil {
+		// Keep the remaining symbols' edges rather than dropping them unrecomputed
 		log.Printf("LSP enrichment failed for %s: %v", path, err)
+		changedIDs, edges = nil, nil
+	}
+	if err := w.store.BulkUpsertNodes(ctx, nested); err != nil {
+		return fmt.Errorf("store nested nodes failed: %w", err)
 	}
 
-	if err := w.store.BulkUpsertEdges(ctx, edges); err != nil {
-		return fmt.Errorf("bulk store edges failed: %w", err)
+	if err := w.store.ReplaceEdges(ctx, append(changedIDs, removedIDs...), edges); err != nil {
+		return fmt.Errorf("store edges failed: %w", err)
 	}
 
-	log.Printf("✓ Re-indexed %s: %d nodes, %d edges", filepath.Base(path), len(nodes), len(edges))
+	log.Printf("✓ Re-indexed %s: %d nodes, %d edges", filepath.Base(path), len(nodes)+len(nested), len(edges))
 	return nil
 }
 
 func (w *Watcher) handleFileDeleted(ctx context.Context, path string) error {
+	if _, buffered := w.overlay.Get(path); buffered {
+		// Still open in the editor; its symbols come from the buffer
+		return nil
+	}
 	log.Printf("Removing nodes for deleted file: %s", path)
 	return w.store.DeleteNodesByFile(ctx, path)
 }
@@ -219,12 +269,14 @@ func (w *Watcher) addDirectoriesRecursively(root string) error {
 			return filepath.SkipDir
 		}
 
-		if name == "node_modules" || name == "vendor" || name == "__pycache__" {
+		if path != w.root && w.scanner.IgnoresDir(path) {
 			return filepath.SkipDir
 		}
 
-		relPath, err := filepath.Rel(w.root, path)
-		if err == nil && w.gitignore != nil && w.gitignore.MatchesPath(relPath) {
+		if path != w.root && w.gitignore != nil && w.gitignore.Matches(path, true) {
+			return filepath.SkipDir
+		}
+		if relPath, err := filepath.Rel(w.root, path); err == nil && path != w.root && !w.scanner.InScope(relPath, true) {
 			return filepath.SkipDir
 		}
 
@@ -237,18 +289,15 @@ func (w *Watcher) addDirectoriesRecursively(root string) error {
 }
 
 func (w *Watcher) isSourceFile(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".go", ".py", ".js", ".ts", ".tsx", ".jsx", ".lua", ".templ":
-		// skip generated Go files
-		base := filepath.Base(path)
-		if strings.HasSuffix(base, "_templ.go") || strings.HasSuffix(base, ".sql.go") || strings.HasSuffix(base, "_string.go") {
-			return false
-		}
-		return true
-	default:
+	if util.Extensions()[strings.ToLower(filepath.Ext(path))] == "" {
+		return false
+	}
+	// skip generated Go files
+	base := filepath.Base(path)
+	if strings.HasSuffix(base, "_templ.go") || strings.HasSuffix(base, ".sql.go") || strings.HasSuffix(base, "_string.go") {
 		return false
 	}
+	return true
 }
 
 func (w *Watcher) Close() error {
@@ -3,17 +3,23 @@ package main
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
+	"codemap/codemap"
 	"codemap/internal/db"
 	"codemap/internal/graph"
 	"codemap/internal/lsp"
+	"codemap/internal/overlay"
+	"codemap/internal/pkgmgr"
 	"codemap/internal/scanner"
 	"codemap/internal/server"
 	"codemap/internal/watcher"
@@ -24,6 +30,22 @@ import (
 var systemPrompt string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "versions" {
+		os.Exit(runVersions(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		os.Exit(runPurge(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "env" {
+		os.Exit(runEnv(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "warm" {
+		os.Exit(runWarm(os.Args[2:]))
+	}
+
 	projectDir := flag.String("project-dir", "", "Project directory to index (default: current working directory)")
 	flag.Parse()
 
@@ -45,20 +67,9 @@ func main() {
 	}
 
 	// 1. Setup DB
-	// Try to find git root for project-specific DB
-	projectRoot, err := util.FindGitRoot()
-	dbDir := ".ctxhub"
-	dbName := "codemap.sqlite"
-	var dbPath string
-	if err == nil && projectRoot != "" {
-		dbPath = filepath.Join(projectRoot, dbDir, dbName)
-	} else {
-		// Fallback to CWD
-		cwd, err := os.Getwd()
-		if err != nil {
-			log.Fatalf("Failed to get working directory: %v", err)
-		}
-		dbPath = filepath.Join(cwd, dbDir, dbName)
+	dbPath, err := projectDBPath()
+	if err != nil {
+		log.Fatalf("Failed to get working directory: %v", err)
 	}
 
 	database, err := db.New(dbPath)
@@ -79,6 +90,12 @@ func main() {
 	lspSvc := lsp.NewService()
 	defer lspSvc.Shutdown()
 
+	// Unsaved editor buffers, read by the scanner and language servers in
+	// place of the files on disk
+	buffers := overlay.New()
+	scn.SetOverlay(buffers)
+	lspSvc.SetOverlay(buffers)
+
 	// 4. Setup signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -100,6 +117,7 @@ func main() {
 
 	// 6. Start MCP Server
 	srv := server.New(scn, store, lspSvc, systemPrompt)
+	defer srv.Close()
 
 	log.Println("Starting MCP server on stdio...")
 
@@ -110,8 +128,10 @@ func main() {
 		status, indexErr, duration := srv.GetIndexStatus()
 		if indexErr != nil {
 			log.Printf("Background indexing failed after %.2fs: %v", duration.Seconds(), indexErr)
-		} else if status == "ready" {
+		} else if status == server.IndexStatusReady {
 			log.Printf("Background indexing completed successfully in %.2fs", duration.Seconds())
+		} else if status == server.IndexStatusEmpty {
+			log.Printf("Background indexing found no supported source files in %s", cwd)
 		}
 	}()
 
@@ -121,6 +141,8 @@ func main() {
 		log.Fatalf("Failed to create watcher: %v", err)
 	}
 	defer w.Close()
+	w.SetOverlay(buffers)
+	srv.SetBuffers(buffers, w.Reindex)
 
 	log.Printf("Watching %s for file changes...", cwd)
 
@@ -153,3 +175,371 @@ func main() {
 		log.Println("Shutting down gracefully...")
 	}
 }
+
+// projectDBPath returns where the graph database for the current directory
+// lives: under the git root if there is one, otherwise under the directory.
+func projectDBPath() (string, error) {
+	const dbDir, dbName = ".ctxhub", "codemap.sqlite"
+	if projectRoot, err := util.FindGitRoot(); err == nil && projectRoot != "" {
+		return filepath.Join(projectRoot, dbDir, dbName), nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cwd, dbDir, dbName), nil
+}
+
+// runExport implements "codemap export [-index [-no-enrich]] [-format json|dot] [-o file]",
+// writing the indexed graph of the current project in a deterministic order.
+// With -index it indexes the project first, so CI can produce the graph in
+// one step without a running server.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", graph.FormatJSON, "Export format: json or dot")
+	output := fs.String("o", "", "Write to this file instead of stdout")
+	index := fs.Bool("index", false, "Index the project before exporting, failing if indexing fails")
+	noEnrich := fs.Bool("no-enrich", false, "With -index, skip language servers: symbols only, no edges")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: codemap export [-index [-no-enrich]] [-format json|dot] [-o file]")
+		return 2
+	}
+
+	dbPath, err := projectDBPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get working directory: %v\n", err)
+		return 1
+	}
+	// Paths are written relative to the project root, where the index lives
+	root := filepath.Dir(filepath.Dir(dbPath))
+	if *index {
+		if err := indexProject(dbPath, root, *noEnrich); err != nil {
+			fmt.Fprintf(os.Stderr, "indexing failed: %v\n", err)
+			return 1
+		}
+	} else if _, err := os.Stat(dbPath); err != nil {
+		fmt.Fprintf(os.Stderr, "no index found at %s; run codemap in this project first, or export with -index\n", dbPath)
+		return 1
+	}
+	database, err := db.NewReadOnly(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", dbPath, err)
+		return 1
+	}
+	defer database.Close()
+
+	g, err := graph.NewStore(database).Export(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := graph.WriteExport(w, g, *format, root); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// indexProject runs the full index of root into the database at dbPath, as
+// the server's initial index does, leaving out language servers if noEnrich.
+// Progress and warnings go to the log, so they stay out of an export written
+// to stdout.
+func indexProject(dbPath, root string, noEnrich bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	g, err := codemap.Open(codemap.Options{DBPath: dbPath, NoEnrich: noEnrich})
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	log.Printf("Indexing workspace: %s", root)
+	start := time.Now()
+	res, err := g.Index(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, w := range res.Warnings {
+		log.Printf("Warning: %s", w)
+	}
+	if res.Files == 0 {
+		log.Printf("No supported source files found in %s", root)
+		return nil
+	}
+	log.Printf("Indexed %d files in %.2fs: %d nodes, %d edges", res.Files, time.Since(start).Seconds(), res.Nodes, res.Edges)
+	return nil
+}
+
+// runEnv implements "codemap env [-json]", printing the directories codemap
+// resolved, the languages in the current project's index and the environment
+// variables that influence them.
+func runEnv(args []string) int {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: codemap env [-json]")
+		return 2
+	}
+
+	env, err := pkgmgr.ResolveEnvironment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	dbPath, err := projectDBPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get working directory: %v\n", err)
+		return 1
+	}
+
+	// Languages come from the index; a project that was never indexed has none
+	languages := []string{}
+	if _, err := os.Stat(dbPath); err == nil {
+		database, err := db.NewReadOnly(dbPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", dbPath, err)
+			return 1
+		}
+		defer database.Close()
+		files, err := graph.NewStore(database).ListFiles(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		languages = util.LanguagesForPaths(files)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(struct {
+			*pkgmgr.Environment
+			Database  string   `json:"database"`
+			Languages []string `json:"languages"`
+		}{env, dbPath, languages}, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	fmt.Printf("home:         %s (%s)\n", env.Home, env.HomeSource)
+	fmt.Printf("bin:          %s\n", env.BinDir)
+	fmt.Printf("packages:     %s\n", env.PackagesDir)
+	fmt.Printf("registry:     %s\n", env.RegistryDir)
+	fmt.Printf("tmp:          %s\n", env.TmpDir)
+	fmt.Printf("platform:     %s\n", env.Platform)
+	fmt.Printf("database:     %s\n", dbPath)
+	fmt.Printf("languages:    %s\n", strings.Join(languages, ", "))
+	fmt.Println("installed:")
+	for _, pkg := range env.Installed {
+		if pkg.ReportedVersion != "" {
+			fmt.Printf("  %s %s (binary reports %s)\n", pkg.Name, pkg.Version, pkg.ReportedVersion)
+		} else {
+			fmt.Printf("  %s %s\n", pkg.Name, pkg.Version)
+		}
+	}
+	fmt.Println("environment:")
+	for _, name := range env.SortedVariables() {
+		fmt.Printf("  %s=%s\n", name, env.Variables[name])
+	}
+	return 0
+}
+
+// runVersions implements "codemap versions <language>", listing the language
+// server versions that can be installed, newest first.
+func runVersions(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: codemap versions <language>\nlanguages: %s\n",
+			strings.Join(pkgmgr.SupportedLanguages(), ", "))
+		return 2
+	}
+	lang := args[0]
+
+	metadata, ok := pkgmgr.LookupLSPMetadata(lang)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown language %q (supported: %s)\n",
+			lang, strings.Join(pkgmgr.SupportedLanguages(), ", "))
+		return 1
+	}
+
+	mgr, err := pkgmgr.NewManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize package manager: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	versions, err := mgr.AvailableVersions(ctx, lang, metadata.VersionResolver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	_, installedVersion, _ := mgr.IsInstalled(lang)
+
+	// Show what the binary itself reports, which may differ from its package
+	installedLabel := "installed"
+	if packages, err := mgr.ListInstalled(); err == nil {
+		for _, pkg := range packages {
+			if pkg.Name == lang && pkg.ReportedVersion != "" {
+				installedLabel = fmt.Sprintf("installed, binary reports %s", pkg.ReportedVersion)
+			}
+		}
+	}
+
+	fmt.Printf("%s versions (newest first):\n", metadata.Name)
+	for _, v := range versions {
+		if installedVersion != "" && strings.TrimPrefix(v, "v") == strings.TrimPrefix(installedVersion, "v") {
+			fmt.Printf("  %s (%s)\n", v, installedLabel)
+		} else {
+			fmt.Printf("  %s\n", v)
+		}
+	}
+	return 0
+}
+
+// runWarm implements "codemap warm [language...]", installing the language
+// servers of the given languages, or of all of them, ahead of time so that
+// indexing later works offline. Every language is attempted; the exit status
+// is 1 if any failed.
+func runWarm(args []string) int {
+	fs := flag.NewFlagSet("warm", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	langs := fs.Args()
+	for _, lang := range langs {
+		if _, ok := pkgmgr.LookupLSPMetadata(lang); !ok {
+			fmt.Fprintf(os.Stderr, "unknown language %q (supported: %s)\n",
+				lang, strings.Join(pkgmgr.SupportedLanguages(), ", "))
+			return 2
+		}
+	}
+	mgr, err := pkgmgr.NewManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize package manager: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	installer := pkgmgr.NewInstaller(mgr)
+	var results []pkgmgr.PrefetchResult
+	if len(langs) == 0 {
+		results = installer.PrefetchAll(ctx)
+	} else {
+		results = installer.Prefetch(ctx, langs)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("%-12s %s %s: FAILED: %v\n", r.Language, r.Name, r.Version, r.Err)
+		} else {
+			fmt.Printf("%-12s %s %s: ok\n", r.Language, r.Name, r.Version)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d language servers could not be installed\n", failed, len(results))
+		return 1
+	}
+	return 0
+}
+
+// runPurge implements "codemap purge <language>|--all|--orphans", removing
+// cached language servers so the next launch installs them from scratch, or
+// only the leftovers of failed installs.
+func runPurge(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: codemap purge <language>|--all|--orphans|--old-versions\nlanguages: %s\n",
+			strings.Join(pkgmgr.SupportedLanguages(), ", "))
+		return 2
+	}
+
+	mgr, err := pkgmgr.NewManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize package manager: %v\n", err)
+		return 1
+	}
+
+	if args[0] == "--all" {
+		if err := mgr.PurgeAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Println("Removed all cached language servers")
+		return 0
+	}
+
+	if args[0] == "--orphans" {
+		removed, err := mgr.CleanOrphans()
+		for _, o := range removed {
+			fmt.Printf("Removed %s (%s)\n", o.Path, o.Reason)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if len(removed) == 0 {
+			fmt.Println("No orphaned package files found")
+		}
+		return 0
+	}
+
+	if args[0] == "--old-versions" {
+		packages, err := mgr.ListInstalled()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		total := 0
+		for _, pkg := range packages {
+			removed, err := mgr.PruneVersions(pkg.Name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", pkg.Name, err)
+				return 1
+			}
+			if removed > 0 {
+				fmt.Printf("Removed %d old version(s) of %s\n", removed, pkg.Name)
+			}
+			total += removed
+		}
+		if total == 0 {
+			fmt.Println("No old versions found")
+		}
+		return 0
+	}
+
+	lang := args[0]
+	if _, ok := pkgmgr.LookupLSPMetadata(lang); !ok {
+		fmt.Fprintf(os.Stderr, "unknown language %q (supported: %s)\n",
+			lang, strings.Join(pkgmgr.SupportedLanguages(), ", "))
+		return 1
+	}
+	if err := mgr.Purge(lang); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("Removed cached %s language server\n", lang)
+	return 0
+}
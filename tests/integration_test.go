@@ -2,13 +2,22 @@ package tests
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"codemap/codemap"
 	"codemap/internal/db"
 	"codemap/internal/graph"
+	"codemap/internal/overlay"
 	"codemap/internal/scanner"
+	"codemap/util"
 )
 
 func TestIntegration_ReindexAndQuery(t *testing.T) {
@@ -92,8 +101,8 @@ MyTable.Method = function() end
 	if len(locs) != 1 {
 		t.Errorf("Expected 1 location for MainFunc, got %d", len(locs))
 	} else {
-		if locs[0].Kind != "function_declaration" {
-			t.Errorf("Expected kind function_declaration, got %s", locs[0].Kind)
+		if locs[0].Kind != "function" {
+			t.Errorf("Expected kind function, got %s", locs[0].Kind)
 		}
 	}
 
@@ -105,8 +114,8 @@ MyTable.Method = function() end
 	if len(locs) != 1 {
 		t.Errorf("Expected 1 location for MyClass, got %d", len(locs))
 	} else {
-		if locs[0].Kind != "class_definition" {
-			t.Errorf("Expected kind class_definition, got %s", locs[0].Kind)
+		if locs[0].Kind != "class" {
+			t.Errorf("Expected kind class, got %s", locs[0].Kind)
 		}
 	}
 
@@ -118,8 +127,8 @@ MyTable.Method = function() end
 	if len(locs) != 1 {
 		t.Errorf("Expected 1 location for User, got %d", len(locs))
 	} else {
-		if locs[0].Kind != "interface_declaration" {
-			t.Errorf("Expected kind interface_declaration, got %s", locs[0].Kind)
+		if locs[0].Kind != "interface" {
+			t.Errorf("Expected kind interface, got %s", locs[0].Kind)
 		}
 	}
 
@@ -131,8 +140,8 @@ MyTable.Method = function() end
 	if len(locs) != 1 {
 		t.Errorf("Expected 1 location for log, got %d", len(locs))
 	} else {
-		if locs[0].Kind != "method_definition" {
-			t.Errorf("Expected kind method_definition, got %s", locs[0].Kind)
+		if locs[0].Kind != "method" {
+			t.Errorf("Expected kind method, got %s", locs[0].Kind)
 		}
 	}
 
@@ -164,6 +173,1984 @@ MyTable.Method = function() end
 	}
 }
 
+func TestIntegration_PythonModifiers(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "app.py", `
+@app.route("/orders")
+@login_required
+async def list_orders(request):
+    pass
+
+@pytest.fixture
+def client():
+    pass
+
+def plain():
+    pass
+`)
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	nodes, err := scn.Scan(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if err := store.BulkUpsertNodes(context.Background(), nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"list_orders", []string{"@app.route", "@login_required", "async"}},
+		{"client", []string{"@pytest.fixture"}},
+		{"plain", nil},
+	}
+	for _, tt := range tests {
+		locs, err := store.GetSymbolLocation(context.Background(), tt.name)
+		if err != nil || len(locs) != 1 {
+			t.Fatalf("GetSymbolLocation(%s) = %v, %v", tt.name, locs, err)
+		}
+		if got := strings.Join(locs[0].Modifiers, ","); got != strings.Join(tt.want, ",") {
+			t.Errorf("%s modifiers = %v, want %v", tt.name, locs[0].Modifiers, tt.want)
+		}
+	}
+}
+
+func TestIntegration_LanguageModifiers(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "svc.go", `package svc
+
+func Exported() {}
+
+func internal() {}
+`)
+	createFile(t, wsDir, "svc.ts", `
+export default class Service {
+  @Get()
+  private static async fetchAll() {}
+
+  get total() { return 0; }
+}
+
+export abstract class Base {}
+`)
+	createFile(t, wsDir, "handlers.js", `
+export const handler = async () => {};
+`)
+	createFile(t, wsDir, "util.lua", `
+local function helper() end
+
+function M.run() end
+`)
+	createFile(t, wsDir, "lib.zig", `
+pub fn add(a: i32, b: i32) i32 { return a + b; }
+
+export fn ffi() void {}
+
+fn private() void {}
+
+pub const Config = struct {};
+`)
+	createFile(t, wsDir, "lib.rs", `
+pub struct Point { x: i32 }
+
+pub(crate) enum Mode { Fast }
+
+impl Point {
+    pub async fn load() -> Self { Point { x: 0 } }
+}
+
+pub const unsafe fn raw() {}
+
+extern "C" fn callback() {}
+`)
+	createFile(t, wsDir, "Repo.java", `
+@Service
+public abstract class Repo {
+    @Override
+    public static final void save() {}
+}
+`)
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	nodes, err := scn.Scan(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	byName := make(map[string]*graph.Node)
+	for _, n := range nodes {
+		byName[n.Name] = n
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Exported", []string{"exported"}},
+		{"internal", nil},
+		{"Service", []string{"export", "default"}},
+		{"fetchAll", []string{"@Get", "private", "static", "async"}},
+		{"total", []string{"get"}},
+		{"Base", []string{"export", "abstract"}},
+		{"handler", []string{"export", "async"}},
+		{"helper", []string{"local"}},
+		{"M.run", nil},
+		{"add", []string{"pub"}},
+		{"ffi", []string{"export"}},
+		{"private", nil},
+		{"Config", []string{"pub"}},
+		{"Point", []string{"pub"}},
+		{"Mode", []string{"pub(crate)"}},
+		{"load", []string{"pub", "async"}},
+		{"raw", []string{"pub", "const", "unsafe"}},
+		{"callback", []string{"extern"}},
+		{"impl Point", nil},
+		{"Repo", []string{"@Service", "public", "abstract"}},
+		{"save", []string{"@Override", "public", "static", "final"}},
+	}
+	for _, tt := range tests {
+		n, ok := byName[tt.name]
+		if !ok {
+			t.Errorf("symbol %s not found", tt.name)
+			continue
+		}
+		if got := strings.Join(n.Modifiers, ","); got != strings.Join(tt.want, ",") {
+			t.Errorf("%s modifiers = %v, want %v", tt.name, n.Modifiers, tt.want)
+		}
+	}
+}
+
+func TestIntegration_CanonicalKinds(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "shapes.go", `package shapes
+
+type Shape interface{ Area() float64 }
+
+type Circle struct{ R float64 }
+
+type Radius float64
+
+func (c Circle) Area() float64 { return 0 }
+
+func NewCircle() Circle { return Circle{} }
+`)
+	createFile(t, wsDir, "model.py", `
+class Model:
+    @property
+    def size(self):
+        return 0
+
+def load():
+    pass
+`)
+	createFile(t, wsDir, "app.js", `
+const limit = 10;
+let counter = 0;
+const render = () => {};
+`)
+	createFile(t, wsDir, "mod.lua", `
+function Obj:draw() end
+`)
+	createFile(t, wsDir, "vec.zig", `
+pub const Vec = struct {
+    x: f32,
+
+    pub fn length(self: Vec) f32 { return self.x; }
+};
+
+const Color = enum { red, green };
+
+const Value = union(enum) { int: i64 };
+
+const Handle = opaque {};
+
+const max_size = 10;
+
+fn clamp() void {
+    const Local = struct {};
+    _ = Local;
+}
+`)
+	createFile(t, wsDir, "shape.rs", `
+pub trait Drawable {
+    fn draw(&self) {}
+}
+
+pub struct Square { side: f64 }
+
+enum Fill { Solid }
+
+impl Square {
+    fn side(&self) -> f64 { self.side }
+}
+
+impl<T> Drawable for Wrapper<T> {}
+
+fn paint() {}
+`)
+	createFile(t, wsDir, "Store.java", `
+public class Store {
+    Store() {}
+    void put() {}
+}
+interface Cache {}
+enum Level { LOW }
+record Pair(int a) {}
+`)
+	createFile(t, wsDir, "geo.hpp", `
+namespace geo {
+struct Point { int x; };
+class Polygon {
+public:
+  double area() const { return 0; }
+};
+enum class Winding { Clockwise };
+struct Forward;
+}
+double geo::Polygon::perimeter() { return 0; }
+int* allocate() { return 0; }
+`)
+	createFile(t, wsDir, "ring.c", `
+struct ring { int head; };
+enum ring_state { RING_EMPTY };
+static int ring_push(struct ring *r, int v) { return v; }
+`)
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	nodes, err := scn.Scan(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	byName := make(map[string]*graph.Node)
+	for _, n := range nodes {
+		byName[n.Name] = n
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Shape", graph.KindInterface},
+		{"Circle", graph.KindStruct},
+		{"Radius", graph.KindType},
+		{"Area", graph.KindMethod},
+		{"NewCircle", graph.KindFunction},
+		{"Model", graph.KindClass},
+		{"size", graph.KindMethod},
+		{"load", graph.KindFunction},
+		{"limit", graph.KindConstant},
+		{"counter", graph.KindVariable},
+		{"render", graph.KindFunction},
+		{"Obj:draw", graph.KindMethod},
+		{"Vec", graph.KindStruct},
+		{"length", graph.KindMethod},
+		{"Color", graph.KindEnum},
+		{"Value", graph.KindType},
+		{"Handle", graph.KindType},
+		{"clamp", graph.KindFunction},
+		{"Drawable", graph.KindInterface},
+		{"draw", graph.KindMethod},
+		{"Square", graph.KindStruct},
+		{"Fill", graph.KindEnum},
+		{"side", graph.KindMethod},
+		{"impl Square", graph.KindSymbol},
+		{"impl Drawable for Wrapper<T>", graph.KindSymbol},
+		{"paint", graph.KindFunction},
+		{"Store", graph.KindClass},
+		{"put", graph.KindMethod},
+		{"Cache", graph.KindInterface},
+		{"Level", graph.KindEnum},
+		{"Pair", graph.KindClass},
+		{"Point", graph.KindStruct},
+		{"Polygon", graph.KindClass},
+		{"area", graph.KindMethod},
+		{"Winding", graph.KindEnum},
+		{"geo::Polygon::perimeter", graph.KindMethod},
+		{"allocate", graph.KindFunction},
+		{"ring", graph.KindStruct},
+		{"ring_state", graph.KindEnum},
+		{"ring_push", graph.KindFunction},
+	}
+	for _, tt := range tests {
+		n, ok := byName[tt.name]
+		if !ok {
+			t.Errorf("symbol %s not found", tt.name)
+			continue
+		}
+		if n.Kind != tt.want {
+			t.Errorf("%s kind = %s, want %s", tt.name, n.Kind, tt.want)
+		}
+	}
+
+	// Only top-level Zig bindings of container types, and C++ types with a
+	// body, are symbols
+	for _, name := range []string{"max_size", "Local", "Forward"} {
+		if _, ok := byName[name]; ok {
+			t.Errorf("%s should not be a symbol", name)
+		}
+	}
+}
+
+func TestIntegration_ScanSyntaxErrors(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "good.py", `
+def ok():
+    pass
+`)
+	createFile(t, wsDir, "broken.py", `
+def before():
+    pass
+
+def broken(:
+    pass
+`)
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	res, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("ScanWorkspace failed: %v", err)
+	}
+
+	if res.FilesScanned != 2 {
+		t.Errorf("FilesScanned = %d, want 2", res.FilesScanned)
+	}
+	if len(res.Errors) != 1 || res.Errors[0].Path != "broken.py" || !errors.Is(res.Errors[0], scanner.ErrSyntax) {
+		t.Fatalf("Errors = %v, want a single syntax error for broken.py", res.Errors)
+	}
+
+	names := make(map[string]bool)
+	for _, n := range res.Nodes {
+		names[n.Name] = true
+	}
+	if !names["ok"] || !names["before"] {
+		t.Errorf("expected symbols from both files, got %v", names)
+	}
+}
+
+func TestIntegration_FindNodeAtPosition(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "shapes.py", `class Shape:
+    sides = 0
+
+    def area(self):
+        return 0
+
+def helper(): return 1
+
+x = 1
+`)
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	nodes, err := scn.Scan(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if err := store.BulkUpsertNodes(context.Background(), nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+
+	path := filepath.Join(wsDir, "shapes.py")
+	tests := []struct {
+		line, col int
+		want      string
+	}{
+		{1, 0, "Shape"},
+		{2, 0, "Shape"},
+		{5, 0, "area"}, // innermost wins over the enclosing class
+		{5, 9, "area"},
+		{7, 5, "helper"},
+		{7, 50, ""}, // past the end of helper's last line
+		{9, 0, ""},  // module-level code
+	}
+	for _, tt := range tests {
+		n, err := store.FindNode(context.Background(), path, tt.line, tt.col)
+		if err != nil {
+			t.Fatalf("FindNode(%d:%d) failed: %v", tt.line, tt.col, err)
+		}
+		got := ""
+		if n != nil {
+			got = n.Name
+		}
+		if got != tt.want {
+			t.Errorf("FindNode(%d:%d) = %q, want %q", tt.line, tt.col, got, tt.want)
+		}
+	}
+}
+
+func TestIntegration_FindImpactIgnoresRecursiveEdges(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "fact", Name: "fact", Kind: graph.KindFunction, FilePath: "/src/fact.go", LineStart: 3, LineEnd: 8},
+		{ID: "caller", Name: "caller", Kind: graph.KindFunction, FilePath: "/src/fact.go", LineStart: 10, LineEnd: 12},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "fact", TargetID: "fact", Relation: graph.RelationRecursive},
+		{SourceID: "caller", TargetID: "fact", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	impacted, err := store.FindImpact(ctx, "fact")
+	if err != nil {
+		t.Fatalf("FindImpact failed: %v", err)
+	}
+	if len(impacted) != 1 || impacted[0].Name != "caller" {
+		t.Errorf("FindImpact(fact) = %v, want only caller", impacted)
+	}
+
+	impacted, err = store.FindImpact(ctx, "caller")
+	if err != nil {
+		t.Fatalf("FindImpact failed: %v", err)
+	}
+	if len(impacted) != 0 {
+		t.Errorf("FindImpact(caller) = %v, want none", impacted)
+	}
+}
+
+func TestIntegration_FindImpactOrder(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	// Inserted out of order; dependents come back by file, then line
+	nodes := []*graph.Node{
+		{ID: "core", Name: "core", Kind: graph.KindFunction, FilePath: "/src/core.go", LineStart: 1, LineEnd: 3},
+		{ID: "z2", Name: "z2", Kind: graph.KindFunction, FilePath: "/src/z.go", LineStart: 20, LineEnd: 22},
+		{ID: "a9", Name: "a9", Kind: graph.KindFunction, FilePath: "/src/a.go", LineStart: 90, LineEnd: 92},
+		{ID: "z1", Name: "z1", Kind: graph.KindFunction, FilePath: "/src/z.go", LineStart: 5, LineEnd: 7},
+		{ID: "a1", Name: "a1", Kind: graph.KindFunction, FilePath: "/src/a.go", LineStart: 10, LineEnd: 12},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "z2", TargetID: "core", Relation: graph.RelationReferences},
+		{SourceID: "a9", TargetID: "core", Relation: graph.RelationReferences},
+		{SourceID: "z1", TargetID: "z2", Relation: graph.RelationReferences},
+		{SourceID: "a1", TargetID: "a9", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		impacted, err := store.FindImpact(ctx, "core")
+		if err != nil {
+			t.Fatalf("FindImpact failed: %v", err)
+		}
+		var names []string
+		for _, n := range impacted {
+			names = append(names, n.Name)
+		}
+		if got := strings.Join(names, ","); got != "a1,a9,z1,z2" {
+			t.Fatalf("FindImpact(core) = %s, want a1,a9,z1,z2", got)
+		}
+	}
+}
+
+func TestIntegration_ContainsEdgesAreStructural(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "Shape", Name: "Shape", Kind: graph.KindClass, FilePath: "/src/Shape.java", LineStart: 1, LineEnd: 20},
+		{ID: "area", Name: "area", Kind: graph.KindMethod, FilePath: "/src/Shape.java", LineStart: 3, LineEnd: 5},
+		{ID: "Shape.size", Name: "size", Kind: graph.KindField, FilePath: "/src/Shape.java", LineStart: 7, LineEnd: 7},
+		{ID: "main", Name: "main", Kind: graph.KindFunction, FilePath: "/src/Main.java", LineStart: 3, LineEnd: 6},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "Shape", TargetID: "area", Relation: graph.RelationContains},
+		{SourceID: "Shape", TargetID: "Shape.size", Relation: graph.RelationContains},
+		{SourceID: "main", TargetID: "area", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	impacted, err := store.FindImpact(ctx, "area")
+	if err != nil {
+		t.Fatalf("FindImpact failed: %v", err)
+	}
+	if len(impacted) != 1 || impacted[0].Name != "main" {
+		t.Errorf("FindImpact(area) = %v, want only main", impacted)
+	}
+
+	counts, err := store.ReferenceCounts(ctx, []string{"area", "Shape.size"})
+	if err != nil {
+		t.Fatalf("ReferenceCounts failed: %v", err)
+	}
+	if counts["area"] != 1 || counts["Shape.size"] != 0 {
+		t.Errorf("ReferenceCounts = %v, want area 1 and size 0", counts)
+	}
+
+	fileEdges, err := store.GetFileEdges(ctx, "/src/Shape.java")
+	if err != nil {
+		t.Fatalf("GetFileEdges failed: %v", err)
+	}
+	if got := len(fileEdges.Internal[graph.RelationContains]); got != 2 {
+		t.Errorf("got %d internal contains edges, want 2", got)
+	}
+}
+
+func TestIntegration_FileLocalSymbols(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "Parse", Name: "Parse", Kind: graph.KindFunction, FilePath: "/src/parse.go", LineStart: 3, LineEnd: 8},
+		{ID: "helper", Name: "helper", Kind: graph.KindFunction, FilePath: "/src/parse.go", LineStart: 10, LineEnd: 12},
+		{ID: "shared", Name: "shared", Kind: graph.KindFunction, FilePath: "/src/parse.go", LineStart: 14, LineEnd: 16},
+		{ID: "unused", Name: "unused", Kind: graph.KindFunction, FilePath: "/src/parse.go", LineStart: 18, LineEnd: 20},
+		{ID: "loop", Name: "loop", Kind: graph.KindFunction, FilePath: "/src/parse.go", LineStart: 22, LineEnd: 26},
+		{ID: "main", Name: "main", Kind: graph.KindFunction, FilePath: "/src/main.go", LineStart: 3, LineEnd: 6},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "Parse", Relation: graph.RelationReferences},
+		{SourceID: "Parse", TargetID: "helper", Relation: graph.RelationReferences},
+		{SourceID: "Parse", TargetID: "shared", Relation: graph.RelationReferences},
+		{SourceID: "main", TargetID: "shared", Relation: graph.RelationReferences},
+		{SourceID: "loop", TargetID: "loop", Relation: graph.RelationRecursive},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	local, err := store.FileLocalSymbols(ctx, "/src/parse.go")
+	if err != nil {
+		t.Fatalf("FileLocalSymbols failed: %v", err)
+	}
+	if len(local) != 1 || local[0].Name != "helper" {
+		t.Errorf("FileLocalSymbols = %v, want only helper", local)
+	}
+}
+
+func TestIntegration_Implementations(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "Shape", Name: "Shape", Kind: graph.KindInterface, FilePath: "/src/shape.go", LineStart: 3, LineEnd: 5},
+		{ID: "Square", Name: "Square", Kind: graph.KindStruct, FilePath: "/src/square.go", LineStart: 3, LineEnd: 5},
+		{ID: "Circle", Name: "Circle", Kind: graph.KindStruct, FilePath: "/src/circle.go", LineStart: 3, LineEnd: 5},
+		{ID: "draw", Name: "draw", Kind: graph.KindFunction, FilePath: "/src/draw.go", LineStart: 3, LineEnd: 5},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "Square", TargetID: "Shape", Relation: graph.RelationImplements},
+		{SourceID: "Circle", TargetID: "Shape", Relation: graph.RelationImplements},
+		{SourceID: "draw", TargetID: "Shape", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	impls, err := store.Implementations(ctx, "Shape")
+	if err != nil {
+		t.Fatalf("Implementations failed: %v", err)
+	}
+	var names []string
+	for _, n := range impls {
+		names = append(names, n.Name)
+	}
+	if strings.Join(names, ",") != "Circle,Square" {
+		t.Errorf("Implementations(Shape) = %v, want Circle and Square only", names)
+	}
+}
+
+func TestIntegration_EnabledLanguages(t *testing.T) {
+	t.Setenv("CODEMAP_LANGUAGES", "go, Python")
+
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "main.go", "package main\n\nfunc Run() {}\n")
+	createFile(t, wsDir, "util.py", "def helper():\n    pass\n")
+	createFile(t, wsDir, "init.lua", "local function setup() end\n")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	if got := strings.Join(scn.SupportedLanguages(), ","); got != "go,python" {
+		t.Errorf("SupportedLanguages() = %s, want go,python", got)
+	}
+
+	res, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if res.FilesScanned != 2 {
+		t.Errorf("FilesScanned = %d, want 2", res.FilesScanned)
+	}
+	for _, n := range res.Nodes {
+		if strings.HasSuffix(n.FilePath, ".lua") {
+			t.Errorf("node %s from disabled language was indexed", n.Name)
+		}
+	}
+
+	_, err = scn.ScanFile(context.Background(), filepath.Join(wsDir, "init.lua"))
+	if !errors.Is(err, scanner.ErrLanguageDisabled) {
+		t.Errorf("ScanFile(init.lua) error = %v, want ErrLanguageDisabled", err)
+	}
+}
+
+func TestIntegration_CustomExtensions(t *testing.T) {
+	t.Setenv("CODEMAP_EXTENSIONS", ".gs=javascript, pyi=python")
+
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "Code.gs", "function onOpen() {}\n")
+	createFile(t, wsDir, "api.pyi", "def fetch(url: str) -> bytes: ...\n")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	res, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var names []string
+	for _, n := range res.Nodes {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "fetch,onOpen" {
+		t.Errorf("indexed %v, want fetch and onOpen", names)
+	}
+	if got := util.LanguageForPath("/src/api.pyi"); got != "python" {
+		t.Errorf("LanguageForPath(api.pyi) = %q, want python", got)
+	}
+
+	// Conflicting and unknown assignments are reported and left out
+	exts, err := util.ParseExtensions(".x=go,.x=python,.gs=cobol")
+	if err == nil || !strings.Contains(err.Error(), ".x is assigned to both go and python") || !strings.Contains(err.Error(), "cobol") {
+		t.Errorf("ParseExtensions error = %v, want the conflict and unknown language reported", err)
+	}
+	if _, ok := exts[".x"]; ok {
+		t.Errorf("conflicting extension .x was mapped to %s", exts[".x"])
+	}
+	if exts[".go"] != "go" {
+		t.Errorf("defaults were not kept: .go = %q", exts[".go"])
+	}
+}
+
+func TestIntegration_WorkspaceFingerprint(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "main.go", "package main\n\nfunc Run() {}\n")
+	createFile(t, wsDir, "notes.txt", "not a source file\n")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	ctx := context.Background()
+
+	first, err := scn.Fingerprint(ctx, wsDir)
+	if err != nil {
+		t.Fatalf("Fingerprint failed: %v", err)
+	}
+	if again, _ := scn.Fingerprint(ctx, wsDir); again != first {
+		t.Error("fingerprint changed without any edits")
+	}
+
+	// Files the scanner ignores do not count
+	createFile(t, wsDir, "notes.txt", "edited\n")
+	if got, _ := scn.Fingerprint(ctx, wsDir); got != first {
+		t.Error("editing a non-source file changed the fingerprint")
+	}
+
+	createFile(t, wsDir, "main.go", "package main\n\nfunc Run() { println() }\n")
+	edited, _ := scn.Fingerprint(ctx, wsDir)
+	if edited == first {
+		t.Error("editing a source file did not change the fingerprint")
+	}
+
+	createFile(t, wsDir, "util.go", "package main\n")
+	if added, _ := scn.Fingerprint(ctx, wsDir); added == edited {
+		t.Error("adding a source file did not change the fingerprint")
+	}
+}
+
+func TestIntegration_GitHead(t *testing.T) {
+	repo := t.TempDir()
+	if got := util.GitHead(repo); got != "" {
+		t.Errorf("GitHead outside a repo = %q, want empty", got)
+	}
+
+	gitDir := filepath.Join(repo, ".git")
+	if err := os.MkdirAll(filepath.Join(gitDir, "refs", "heads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	createFile(t, gitDir, "HEAD", "ref: refs/heads/main\n")
+	createFile(t, gitDir, "packed-refs", "# pack-refs with: peeled\naaaa111 refs/heads/main\n")
+	if got := util.GitHead(repo); got != "aaaa111" {
+		t.Errorf("GitHead from packed-refs = %q, want aaaa111", got)
+	}
+
+	createFile(t, filepath.Join(gitDir, "refs", "heads"), "main", "bbbb222\n")
+	if got := util.GitHead(repo); got != "bbbb222" {
+		t.Errorf("GitHead from loose ref = %q, want bbbb222", got)
+	}
+
+	createFile(t, gitDir, "HEAD", "cccc333\n")
+	if got := util.GitHead(repo); got != "cccc333" {
+		t.Errorf("detached GitHead = %q, want cccc333", got)
+	}
+
+	// A linked worktree resolves its branch through the main repository
+	worktree := t.TempDir()
+	wtGitDir := filepath.Join(gitDir, "worktrees", "feature")
+	if err := os.MkdirAll(wtGitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	createFile(t, worktree, ".git", "gitdir: "+wtGitDir+"\n")
+	createFile(t, wtGitDir, "HEAD", "ref: refs/heads/feature\n")
+	createFile(t, wtGitDir, "commondir", "../..\n")
+	createFile(t, filepath.Join(gitDir, "refs", "heads"), "feature", "dddd444\n")
+	if got := util.GitHead(worktree); got != "dddd444" {
+		t.Errorf("worktree GitHead = %q, want dddd444", got)
+	}
+}
+
+func TestIntegration_GraphStats(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "iface", Name: "Shape", Kind: graph.KindInterface, FilePath: "/src/shape.go"},
+		{ID: "area", Name: "Area", Kind: graph.KindFunction, FilePath: "/src/shape.go"},
+		{ID: "circle", Name: "Circle", Kind: graph.KindClass, FilePath: "/src/circle.py"},
+		{ID: "main", Name: "main", Kind: graph.KindFunction, FilePath: "/src/main.go"},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "circle", TargetID: "iface", Relation: graph.RelationImplements},
+		{SourceID: "main", TargetID: "iface", Relation: graph.RelationReferences},
+		{SourceID: "main", TargetID: "area", Relation: graph.RelationReferences},
+		{SourceID: "area", TargetID: "area", Relation: graph.RelationRecursive},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	st, err := store.Stats(ctx, 1)
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if st.Nodes != 4 || st.Edges != 4 {
+		t.Errorf("Nodes, Edges = %d, %d, want 4, 4", st.Nodes, st.Edges)
+	}
+	if st.NodesByKind[graph.KindFunction] != 2 || st.NodesByLanguage["go"] != 3 || st.NodesByLanguage["python"] != 1 {
+		t.Errorf("unexpected node breakdown: %v, %v", st.NodesByKind, st.NodesByLanguage)
+	}
+	if st.EdgesByRelation[graph.RelationReferences] != 2 || st.EdgesByRelation[graph.RelationImplements] != 1 {
+		t.Errorf("unexpected edge breakdown: %v", st.EdgesByRelation)
+	}
+	if st.AvgOutDegree != 0.75 {
+		t.Errorf("AvgOutDegree = %v, want 0.75 (recursive edges excluded)", st.AvgOutDegree)
+	}
+	if len(st.MostReferenced) != 1 || st.MostReferenced[0].Name != "Shape" || st.MostReferenced[0].Count != 2 {
+		t.Errorf("MostReferenced = %+v, want Shape with 2", st.MostReferenced)
+	}
+	if len(st.LargestFiles) != 1 || st.LargestFiles[0].FilePath != "/src/shape.go" {
+		t.Errorf("LargestFiles = %+v, want /src/shape.go", st.LargestFiles)
+	}
+}
+
+func TestIntegration_SearchSymbolsByReferences(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "parse_helper", Name: "parseHelper", Kind: graph.KindFunction, FilePath: "/src/a.go"},
+		{ID: "parse", Name: "Parse", Kind: graph.KindFunction, FilePath: "/src/b.go"},
+		{ID: "parse_pct", Name: "parse_100%", Kind: graph.KindFunction, FilePath: "/src/c.py"},
+		{ID: "main", Name: "main", Kind: graph.KindFunction, FilePath: "/src/main.go"},
+		{ID: "run", Name: "run", Kind: graph.KindFunction, FilePath: "/src/main.go"},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "run", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "run", TargetID: "parse", Relation: graph.RelationCalls},
+		{SourceID: "main", TargetID: "parse_helper", Relation: graph.RelationReferences},
+		{SourceID: "parse_helper", TargetID: "parse_helper", Relation: graph.RelationRecursive},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	found, err := store.SearchSymbols(ctx, "parse", 10)
+	if err != nil {
+		t.Fatalf("SearchSymbols failed: %v", err)
+	}
+	var names []string
+	for _, n := range found {
+		names = append(names, n.Name)
+	}
+	if strings.Join(names, ",") != "Parse,parseHelper,parse_100%" {
+		t.Errorf("SearchSymbols(parse) = %v, want Parse, parseHelper, parse_100%% by references", names)
+	}
+
+	// LIKE wildcards in the query match literally
+	found, err = store.SearchSymbols(ctx, "_100%", 10)
+	if err != nil {
+		t.Fatalf("SearchSymbols failed: %v", err)
+	}
+	if len(found) != 1 || found[0].ID != "parse_pct" {
+		t.Errorf("SearchSymbols(_100%%) = %v, want only parse_100%%", found)
+	}
+
+	counts, err := store.ReferenceCounts(ctx, []string{"parse", "parse_helper", "main"})
+	if err != nil {
+		t.Fatalf("ReferenceCounts failed: %v", err)
+	}
+	if counts["parse"] != 2 || counts["parse_helper"] != 1 || counts["main"] != 0 {
+		t.Errorf("ReferenceCounts = %v, want parse 2, parse_helper 1, main 0", counts)
+	}
+
+	// More ids than SQLite binds in one statement, as a large search limit asks for
+	ids := []string{"parse"}
+	for i := 0; i < 40000; i++ {
+		ids = append(ids, fmt.Sprintf("absent%d", i))
+	}
+	ids = append(ids, "parse_helper")
+	counts, err = store.ReferenceCounts(ctx, ids)
+	if err != nil {
+		t.Fatalf("ReferenceCounts over %d ids failed: %v", len(ids), err)
+	}
+	if len(counts) != len(ids) || counts["parse"] != 2 || counts["parse_helper"] != 1 {
+		t.Errorf("ReferenceCounts over %d ids = %d counts, parse %d, parse_helper %d; want every id, parse 2, parse_helper 1",
+			len(ids), len(counts), counts["parse"], counts["parse_helper"])
+	}
+}
+
+func TestIntegration_SearchSymbolsRanksMatchQuality(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	nodes := []*graph.Node{
+		{ID: "gsl", Name: "GetSymbolLocation", Kind: graph.KindMethod, FilePath: "/src/store.go"},
+		{ID: "sym", Name: "symbolInfo", Kind: graph.KindFunction, FilePath: "/src/tools.go"},
+		{ID: "Sym", Name: "SYMBOL", Kind: graph.KindConstant, FilePath: "/src/kinds.go"},
+		{ID: "lsym", Name: "liveSymbols", Kind: graph.KindFunction, FilePath: "/src/live.go"},
+		{ID: "sample", Name: "SimpleModel", Kind: graph.KindStruct, FilePath: "/src/model.go"},
+		{ID: "flag", Name: "SymmetricBool", Kind: graph.KindType, FilePath: "/src/flag.go"},
+		{ID: "main", Name: "main", Kind: graph.KindFunction, FilePath: "/src/main.go"},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	// References must not lift a weaker match above a stronger one
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "flag", Relation: graph.RelationReferences},
+		{SourceID: "main", TargetID: "gsl", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// exact, prefix, substring (most referenced first), subsequence
+		{"symbol", "SYMBOL,symbolInfo,GetSymbolLocation,liveSymbols,SymmetricBool"},
+		{"gsl", "GetSymbolLocation"},
+		{"SmMdl", "SimpleModel"},
+		{"xyz", ""},
+	}
+	for _, tt := range tests {
+		found, err := store.SearchSymbols(ctx, tt.query, 10)
+		if err != nil {
+			t.Fatalf("SearchSymbols failed: %v", err)
+		}
+		var names []string
+		for _, n := range found {
+			names = append(names, n.Name)
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("SearchSymbols(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestIntegration_Neighborhood(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	// main -> handle -> parse -> lex, and util -> parse
+	var nodes []*graph.Node
+	for _, name := range []string{"main", "handle", "parse", "lex", "util", "unrelated"} {
+		nodes = append(nodes, &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: "/src/" + name + ".go"})
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "handle", Relation: graph.RelationReferences},
+		{SourceID: "handle", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "parse", TargetID: "lex", Relation: graph.RelationReferences},
+		{SourceID: "util", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "parse", TargetID: "parse", Relation: graph.RelationRecursive},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	names := func(hood *graph.Subgraph) string {
+		var out []string
+		for _, n := range hood.Nodes {
+			out = append(out, n.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	hood, err := store.Neighborhood(ctx, "parse", 1)
+	if err != nil {
+		t.Fatalf("Neighborhood failed: %v", err)
+	}
+	if got := names(hood); got != "handle,lex,parse,util" {
+		t.Errorf("radius 1 nodes = %s, want handle,lex,parse,util", got)
+	}
+	// Every edge among those nodes, including the self-edge, and nothing to main
+	if len(hood.Edges) != 4 {
+		t.Errorf("radius 1 edges = %d, want 4", len(hood.Edges))
+	}
+
+	hood, err = store.Neighborhood(ctx, "parse", 2)
+	if err != nil {
+		t.Fatalf("Neighborhood failed: %v", err)
+	}
+	if got := names(hood); got != "handle,lex,main,parse,util" || len(hood.Edges) != 5 {
+		t.Errorf("radius 2 = %s with %d edges, want main added and 5 edges", got, len(hood.Edges))
+	}
+
+	hood, err = store.Neighborhood(ctx, "missing", 2)
+	if err != nil {
+		t.Fatalf("Neighborhood failed: %v", err)
+	}
+	if len(hood.Nodes) != 0 || len(hood.Edges) != 0 {
+		t.Errorf("unknown symbol returned %+v", hood)
+	}
+}
+
+func TestIntegration_FileEdges(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	// orders.go holds process and validate; handlers.go calls into it and it
+	// calls out to billing.go
+	nodes := []*graph.Node{
+		{ID: "handle", Name: "handle", Kind: graph.KindFunction, FilePath: "/src/handlers.go", LineStart: 1},
+		{ID: "process", Name: "process", Kind: graph.KindFunction, FilePath: "/src/orders.go", LineStart: 1},
+		{ID: "validate", Name: "validate", Kind: graph.KindFunction, FilePath: "/src/orders.go", LineStart: 10},
+		{ID: "charge", Name: "charge", Kind: graph.KindFunction, FilePath: "/src/billing.go", LineStart: 1},
+		{ID: "unrelated", Name: "unrelated", Kind: graph.KindFunction, FilePath: "/src/other.go", LineStart: 1},
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "handle", TargetID: "process", Relation: graph.RelationReferences},
+		{SourceID: "process", TargetID: "validate", Relation: graph.RelationReferences},
+		{SourceID: "process", TargetID: "charge", Relation: graph.RelationCalls},
+		{SourceID: "validate", TargetID: "validate", Relation: graph.RelationRecursive},
+		{SourceID: "unrelated", TargetID: "charge", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	fileEdges, err := store.GetFileEdges(ctx, "/src/orders.go")
+	if err != nil {
+		t.Fatalf("GetFileEdges failed: %v", err)
+	}
+	describe := func(byRelation map[string][]*graph.FileEdge) string {
+		var out []string
+		for relation, list := range byRelation {
+			for _, e := range list {
+				out = append(out, e.Source.Name+" "+relation+" "+e.Target.Name)
+			}
+		}
+		sort.Strings(out)
+		return strings.Join(out, ", ")
+	}
+	if got := describe(fileEdges.Outgoing); got != "process calls charge" {
+		t.Errorf("outgoing = %q, want process calls charge", got)
+	}
+	if got := describe(fileEdges.Incoming); got != "handle references process" {
+		t.Errorf("incoming = %q, want handle references process", got)
+	}
+	// The recursive self-edge is left out
+	if got := describe(fileEdges.Internal); got != "process references validate" {
+		t.Errorf("internal = %q, want process references validate", got)
+	}
+	if e := fileEdges.Incoming[graph.RelationReferences][0]; e.Source.FilePath != "/src/handlers.go" || e.Target.LineStart != 1 {
+		t.Errorf("incoming edge endpoints = %+v, %+v", e.Source, e.Target)
+	}
+
+	fileEdges, err = store.GetFileEdges(ctx, "/src/missing.go")
+	if err != nil {
+		t.Fatalf("GetFileEdges failed: %v", err)
+	}
+	if len(fileEdges.Outgoing)+len(fileEdges.Incoming)+len(fileEdges.Internal) != 0 {
+		t.Errorf("unknown file returned %+v", fileEdges)
+	}
+}
+
+func TestIntegration_CallTree(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	// main -> handle -> parse -> lex, main -> parse, parse -> parse
+	var nodes []*graph.Node
+	for _, name := range []string{"main", "handle", "parse", "lex"} {
+		nodes = append(nodes, &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: "/src/" + name + ".go"})
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "handle", Relation: graph.RelationCalls},
+		{SourceID: "main", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "handle", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "parse", TargetID: "lex", Relation: graph.RelationReferences},
+		{SourceID: "parse", TargetID: "parse", Relation: graph.RelationRecursive},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	// Renders a tree as name(children), with * for seen and ... for truncated
+	var render func(n *graph.CallTree) string
+	render = func(n *graph.CallTree) string {
+		s := n.Name
+		if n.Seen {
+			s += "*"
+		}
+		if n.Truncated {
+			s += "..."
+		}
+		if len(n.Calls) > 0 {
+			var children []string
+			for _, c := range n.Calls {
+				children = append(children, render(c))
+			}
+			s += "(" + strings.Join(children, ",") + ")"
+		}
+		return s
+	}
+
+	trees, err := store.CallTree(ctx, "main", 3)
+	if err != nil {
+		t.Fatalf("CallTree failed: %v", err)
+	}
+	if len(trees) != 1 {
+		t.Fatalf("got %d trees, want 1", len(trees))
+	}
+	if got, want := render(trees[0]), "main(handle(parse(lex)),parse*)"; got != want {
+		t.Errorf("depth 3 tree = %s, want %s", got, want)
+	}
+
+	trees, err = store.CallTree(ctx, "main", 1)
+	if err != nil {
+		t.Fatalf("CallTree failed: %v", err)
+	}
+	if got, want := render(trees[0]), "main(handle...,parse...)"; got != want {
+		t.Errorf("depth 1 tree = %s, want %s", got, want)
+	}
+
+	trees, err = store.CallTree(ctx, "missing", 3)
+	if err != nil {
+		t.Fatalf("CallTree failed: %v", err)
+	}
+	if len(trees) != 0 {
+		t.Errorf("unknown symbol returned %d trees", len(trees))
+	}
+}
+
+func TestIntegration_CallLevels(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	// main -> serve -> handle -> dispatch -> handle is a cycle; dispatch also
+	// recurses into itself
+	var nodes []*graph.Node
+	for i, name := range []string{"main", "serve", "handle", "dispatch", "log"} {
+		nodes = append(nodes, &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: "/src/app.go", LineStart: i*10 + 1, LineEnd: i*10 + 5})
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "serve", Relation: graph.RelationCalls},
+		{SourceID: "serve", TargetID: "handle", Relation: graph.RelationReferences},
+		{SourceID: "handle", TargetID: "dispatch", Relation: graph.RelationCalls},
+		{SourceID: "dispatch", TargetID: "handle", Relation: graph.RelationCalls},
+		{SourceID: "dispatch", TargetID: "dispatch", Relation: graph.RelationRecursive},
+		{SourceID: "handle", TargetID: "log", Relation: graph.RelationReferences},
+		{SourceID: "serve", TargetID: "log", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	render := func(cl *graph.CallLevels) string {
+		var levels []string
+		for _, l := range cl.Levels {
+			var names []string
+			for _, n := range l.Symbols {
+				names = append(names, n.Name)
+			}
+			levels = append(levels, fmt.Sprintf("%d:%s", l.Depth, strings.Join(names, ",")))
+		}
+		return strings.Join(levels, " ")
+	}
+
+	tests := []struct {
+		name  string
+		walk  func(context.Context, string, int) (*graph.CallLevels, error)
+		from  string
+		depth int
+		want  string
+	}{
+		{"direct callees", store.CalleeLevels, "main", 1, "1:serve"},
+		// The cycle back to handle ends the walk instead of repeating it
+		{"callees through a cycle", store.CalleeLevels, "main", 10, "1:serve 2:handle,log 3:dispatch"},
+		{"direct callers", store.CallerLevels, "handle", 1, "1:dispatch,serve"},
+		{"callers through a cycle", store.CallerLevels, "handle", 10, "1:dispatch,serve 2:main"},
+		{"no callers", store.CallerLevels, "main", 3, ""},
+	}
+	for _, tt := range tests {
+		levels, err := tt.walk(ctx, tt.from, tt.depth)
+		if err != nil {
+			t.Fatalf("%s: walk failed: %v", tt.name, err)
+		}
+		if got := render(levels); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if levels.Truncated {
+			t.Errorf("%s: walk reported truncation", tt.name)
+		}
+	}
+
+	if levels, err := store.CalleeLevels(ctx, "missing", 1); err != nil || levels != nil {
+		t.Errorf("CalleeLevels(missing) = %v, %v; want nil", levels, err)
+	}
+
+	// A hub with more callees than the cap stops the walk
+	hub := []*graph.Node{{ID: "hub", Name: "hub", Kind: graph.KindFunction, FilePath: "/src/hub.go"}}
+	var fanout []*graph.Edge
+	for i := 0; i <= graph.MaxCallLevelSymbols; i++ {
+		id := fmt.Sprintf("leaf%d", i)
+		hub = append(hub, &graph.Node{ID: id, Name: id, Kind: graph.KindFunction, FilePath: "/src/hub.go"})
+		fanout = append(fanout, &graph.Edge{SourceID: "hub", TargetID: id, Relation: graph.RelationCalls})
+	}
+	if err := store.BulkUpsertNodes(ctx, hub); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	if err := store.BulkUpsertEdges(ctx, fanout); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+	levels, err := store.CalleeLevels(ctx, "hub", 2)
+	if err != nil {
+		t.Fatalf("CalleeLevels failed: %v", err)
+	}
+	if !levels.Truncated || len(levels.Levels) != 1 || len(levels.Levels[0].Symbols) != graph.MaxCallLevelSymbols {
+		t.Errorf("hub walk listed %d levels, truncated %v; want %d symbols and truncation", len(levels.Levels), levels.Truncated, graph.MaxCallLevelSymbols)
+	}
+}
+
+func TestIntegration_ReplaceEdges(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	var nodes []*graph.Node
+	for _, name := range []string{"main", "handle", "parse", "lex"} {
+		nodes = append(nodes, &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: "/src/" + name + ".go"})
+	}
+	if err := store.BulkUpsertNodes(ctx, nodes); err != nil {
+		t.Fatalf("BulkUpsertNodes failed: %v", err)
+	}
+	edges := []*graph.Edge{
+		{SourceID: "main", TargetID: "handle", Relation: graph.RelationReferences},
+		{SourceID: "handle", TargetID: "parse", Relation: graph.RelationReferences},
+		{SourceID: "parse", TargetID: "lex", Relation: graph.RelationReferences},
+	}
+	if err := store.BulkUpsertEdges(ctx, edges); err != nil {
+		t.Fatalf("BulkUpsertEdges failed: %v", err)
+	}
+
+	// handle changed: it now calls lex instead of parse
+	recomputed := []*graph.Edge{
+		{SourceID: "main", TargetID: "handle", Relation: graph.RelationReferences},
+		{SourceID: "handle", TargetID: "lex", Relation: graph.RelationReferences},
+	}
+	if err := store.ReplaceEdges(ctx, []string{"handle"}, recomputed); err != nil {
+		t.Fatalf("ReplaceEdges failed: %v", err)
+	}
+
+	g, err := store.Export(ctx)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	var got []string
+	for _, e := range g.Edges {
+		got = append(got, e.SourceID+"->"+e.TargetID)
+	}
+	if want := "handle->lex,main->handle,parse->lex"; strings.Join(got, ",") != want {
+		t.Errorf("edges = %v, want %s", got, want)
+	}
+
+	found, err := store.GetSymbolsByNames(ctx, []string{"lex", "main", "missing"})
+	if err != nil {
+		t.Fatalf("GetSymbolsByNames failed: %v", err)
+	}
+	if len(found) != 2 || found[0].Name != "lex" || found[1].Name != "main" {
+		t.Errorf("GetSymbolsByNames = %v, want lex and main", found)
+	}
+}
+
+func TestIntegration_ExportIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	root := filepath.Join(string(filepath.Separator), "work", "repo")
+
+	nodes := []*graph.Node{
+		{ID: util.GenerateNodeID("b.go", "Run"), Name: "Run", Kind: graph.KindFunction, FilePath: filepath.Join(root, "b.go"), LineStart: 3},
+		{ID: util.GenerateNodeID("a.go", "Parse"), Name: "Parse", Kind: graph.KindFunction, FilePath: filepath.Join(root, "a.go"), LineStart: 7},
+		{ID: util.GenerateNodeID("c.py", "Lex"), Name: "Lex", Kind: graph.KindFunction, FilePath: filepath.Join(root, "c.py"), LineStart: 1},
+	}
+	edges := []*graph.Edge{
+		{SourceID: nodes[0].ID, TargetID: nodes[1].ID, Relation: graph.RelationReferences},
+		{SourceID: nodes[1].ID, TargetID: nodes[2].ID, Relation: graph.RelationReferences},
+		{SourceID: nodes[0].ID, TargetID: nodes[1].ID, Relation: graph.RelationCalls},
+	}
+
+	// Build the same graph twice, inserting in opposite orders
+	export := func(reverse bool, format string) string {
+		database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("Failed to init DB: %v", err)
+		}
+		defer database.Close()
+		store := graph.NewStore(database)
+
+		ns := append([]*graph.Node(nil), nodes...)
+		es := append([]*graph.Edge(nil), edges...)
+		if reverse {
+			for i, j := 0, len(ns)-1; i < j; i, j = i+1, j-1 {
+				ns[i], ns[j] = ns[j], ns[i]
+			}
+			for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+				es[i], es[j] = es[j], es[i]
+			}
+		}
+		for _, n := range ns {
+			if err := store.UpsertNode(ctx, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, e := range es {
+			if err := store.UpsertEdge(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		g, err := store.Export(ctx)
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		var buf strings.Builder
+		if err := graph.WriteExport(&buf, g, format, root); err != nil {
+			t.Fatalf("WriteExport(%s) failed: %v", format, err)
+		}
+		return buf.String()
+	}
+
+	for _, format := range []string{graph.FormatJSON, graph.FormatDOT} {
+		a, b := export(false, format), export(true, format)
+		if a != b {
+			t.Errorf("%s export depends on insertion order:\n%s\n---\n%s", format, a, b)
+		}
+		if strings.Contains(a, root) {
+			t.Errorf("%s export contains absolute paths:\n%s", format, a)
+		}
+	}
+
+	dot := export(false, graph.FormatDOT)
+	edgeID := util.GenerateEdgeID(nodes[1].ID, nodes[2].ID, graph.RelationReferences)
+	if !strings.Contains(dot, `id="`+edgeID+`"`) || !strings.Contains(dot, `Parse\nfunction\na.go:7`) {
+		t.Errorf("unexpected DOT export:\n%s", dot)
+	}
+
+	if err := graph.WriteExport(&strings.Builder{}, &graph.Subgraph{}, "svg", root); err == nil {
+		t.Error("WriteExport accepted an unknown format")
+	}
+}
+
+func TestIntegration_DatabaseRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A file that is not a database is moved aside and replaced
+	dbPath := filepath.Join(dir, "corrupt.db")
+	garbage := []byte(strings.Repeat("definitely not sqlite ", 512))
+	if err := os.WriteFile(dbPath, garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("New on a corrupt file failed: %v", err)
+	}
+	if _, err := graph.NewStore(database).Stats(ctx, 1); err != nil {
+		t.Errorf("rebuilt database is unusable: %v", err)
+	}
+	database.Close()
+	if kept, err := os.ReadFile(dbPath + ".corrupt"); err != nil || string(kept) != string(garbage) {
+		t.Errorf("corrupt file was not kept aside: %v", err)
+	}
+
+	// A database whose contents no longer match its checksum is rebuilt
+	dbPath = filepath.Join(dir, "tampered.db")
+	database, err = db.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	if err := graph.NewStore(database).UpsertNode(ctx, &graph.Node{ID: "n", Name: "n", Kind: graph.KindFunction, FilePath: "/src/n.go"}); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec("UPDATE nodes SET name = 'm'"); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	database, err = db.New(dbPath)
+	if err != nil {
+		t.Fatalf("New on a tampered database failed: %v", err)
+	}
+	if files, _ := graph.NewStore(database).ListFiles(ctx); len(files) != 0 {
+		t.Errorf("tampered database kept its nodes: %v", files)
+	}
+	database.Close()
+	if _, err := os.Stat(dbPath + ".corrupt"); err != nil {
+		t.Errorf("tampered database was not kept aside: %v", err)
+	}
+
+	// A database from a newer schema version is refused and left alone
+	dbPath = filepath.Join(dir, "new.db")
+	database, err = db.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	if _, err := database.Exec(fmt.Sprintf("PRAGMA user_version = %d", db.SchemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	if _, err := db.New(dbPath); !errors.Is(err, db.ErrNewerSchema) {
+		t.Errorf("New on a newer schema = %v, want ErrNewerSchema", err)
+	}
+
+	// A database from an older schema version is emptied
+	dbPath = filepath.Join(dir, "old.db")
+	database, err = db.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	store := graph.NewStore(database)
+	if err := store.UpsertNode(ctx, &graph.Node{ID: "n", Name: "n", Kind: graph.KindFunction, FilePath: "/src/n.go"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Exec(fmt.Sprintf("PRAGMA user_version = %d", db.SchemaVersion-1)); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	database, err = db.New(dbPath)
+	if err != nil {
+		t.Fatalf("reopening an incompatible database failed: %v", err)
+	}
+	defer database.Close()
+	files, err := graph.NewStore(database).ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("incompatible database kept its nodes: %v", files)
+	}
+	var version int
+	if err := database.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != db.SchemaVersion {
+		t.Errorf("user_version = %d, %v, want %d", version, err, db.SchemaVersion)
+	}
+}
+
+func TestIntegration_ReadOnlyDatabase(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "shared.db")
+
+	// A server has the database open while a command such as export reads it
+	server, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	node := func(name string) *graph.Node {
+		return &graph.Node{ID: name, Name: name, Kind: graph.KindFunction, FilePath: "/src/" + name + ".go"}
+	}
+	if err := graph.NewStore(server).UpsertNode(ctx, node("a")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := db.NewReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("NewReadOnly failed: %v", err)
+	}
+	if files, err := graph.NewStore(reader).ListFiles(ctx); err != nil || len(files) != 1 {
+		t.Errorf("read-only ListFiles = %v, %v; want the server's file", files, err)
+	}
+	if err := graph.NewStore(reader).UpsertNode(ctx, node("x")); err == nil {
+		t.Error("read-only database accepted a write")
+	}
+	reader.Close()
+
+	// The server keeps writing, then dies without closing the database
+	if err := graph.NewStore(server).UpsertNode(ctx, node("b")); err != nil {
+		t.Fatal(err)
+	}
+	server.DB.Close()
+
+	reopened, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	defer reopened.Close()
+	if files, _ := graph.NewStore(reopened).ListFiles(ctx); len(files) != 2 {
+		t.Errorf("files after restart = %v, want both; the reader's close must not leave a checksum behind", files)
+	}
+	if _, err := os.Stat(dbPath + ".corrupt"); err == nil {
+		t.Error("database was quarantined after a read-only open")
+	}
+
+	if _, err := db.NewReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("NewReadOnly created a missing database")
+	}
+}
+
+func TestIntegration_NodeWriter(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to init DB: %v", err)
+	}
+	defer database.Close()
+	store := graph.NewStore(database)
+	ctx := context.Background()
+
+	old := []*graph.Node{
+		{ID: "a.Old", Name: "Old", Kind: graph.KindFunction, FilePath: "/src/a.go", LineStart: 1, LineEnd: 1},
+		{ID: "a.Old.field", Name: "field", Kind: graph.KindField, FilePath: "/src/a.go", LineStart: 1, LineEnd: 1},
+	}
+	if err := store.BulkUpsertNodes(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	names := func() []string {
+		t.Helper()
+		nodes, err := store.GetSymbolsInFile(ctx, "/src/a.go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, n := range nodes {
+			got = append(got, n.Name)
+		}
+		return got
+	}
+	replacement := []*graph.Node{{ID: "a.New", Name: "New", Kind: graph.KindFunction, FilePath: "/src/a.go", LineStart: 3, LineEnd: 3}}
+
+	// A rolled back scan leaves the previous nodes in place
+	w, err := store.BeginNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplaceFile(ctx, "/src/a.go", replacement); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"Old", "field"}) {
+		t.Errorf("after rollback = %v, want the old nodes", got)
+	}
+
+	// A committed one replaces every node of the file
+	if w, err = store.BeginNodes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplaceFile(ctx, "/src/a.go", replacement); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"New"}) {
+		t.Errorf("after commit = %v, want [New]", got)
+	}
+}
+
+func TestIntegration_ScanStream(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "a.go", "package a\n\nfunc A() {}\nfunc B() {}\n")
+	createFile(t, wsDir, "b.py", "def c():\n    pass\n")
+	createFile(t, wsDir, "empty.go", "package a\n")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	want, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("ScanWorkspace failed: %v", err)
+	}
+
+	out := make(chan []*graph.Node)
+	var res *scanner.ScanResult
+	scanDone := make(chan error, 1)
+	go func() {
+		var err error
+		res, err = scn.ScanStream(context.Background(), wsDir, out)
+		scanDone <- err
+	}()
+	var got []*graph.Node
+	batches := 0
+	for fileNodes := range out {
+		batches++
+		got = append(got, fileNodes...)
+	}
+	if err := <-scanDone; err != nil {
+		t.Fatalf("ScanStream failed: %v", err)
+	}
+
+	if batches != 2 {
+		t.Errorf("received %d batches, want one per file with symbols (2)", batches)
+	}
+	if len(got) != len(want.Nodes) || res.FilesScanned != want.FilesScanned || res.Nodes != nil {
+		t.Errorf("ScanStream sent %d nodes over %d files, want %d over %d",
+			len(got), res.FilesScanned, len(want.Nodes), want.FilesScanned)
+	}
+
+	// A cancelled stream stops without waiting for a receiver
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := scn.ScanStream(ctx, wsDir, make(chan []*graph.Node)); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled ScanStream error = %v, want context.Canceled", err)
+	}
+}
+
+func TestIntegration_DefaultIgnoreDirs(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "main.go", "package main\n\nfunc Main() {}\n")
+	for _, dir := range []string{"node_modules/lib", "vendor/dep", "__pycache__", "zig-out", "web/dist", "build", "web/build"} {
+		if err := os.MkdirAll(filepath.Join(wsDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createFile(t, wsDir, "node_modules/lib/index.js", "function Dep() {}\n")
+	createFile(t, wsDir, "vendor/dep/dep.go", "package dep\n\nfunc Vendored() {}\n")
+	createFile(t, wsDir, "web/package.json", "{}")
+	createFile(t, wsDir, "web/dist/app.js", "function Bundled() {}\n")
+	createFile(t, wsDir, "web/build/app.js", "function Built() {}\n")
+	// Without a package.json beside it, build is an ordinary directory
+	createFile(t, wsDir, "build/build.go", "package build\n\nfunc Build() {}\n")
+
+	scan := func() string {
+		t.Helper()
+		scn, err := scanner.New()
+		if err != nil {
+			t.Fatalf("Failed to init scanner: %v", err)
+		}
+		res, err := scn.ScanWorkspace(context.Background(), wsDir)
+		if err != nil {
+			t.Fatalf("ScanWorkspace failed: %v", err)
+		}
+		var names []string
+		for _, n := range res.Nodes {
+			names = append(names, n.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	if got := scan(); got != "Build,Main" {
+		t.Errorf("default ignores: indexed %s, want Build,Main", got)
+	}
+
+	// Only the indexed languages' directories are skipped: a JavaScript
+	// project's vendor directory is its own code
+	createFile(t, wsDir, "vendor/dep/dep.js", "function VendoredJS() {}\n")
+	t.Setenv("CODEMAP_LANGUAGES", "javascript")
+	if got := scan(); got != "VendoredJS" {
+		t.Errorf("CODEMAP_LANGUAGES=javascript: indexed %s, want VendoredJS", got)
+	}
+	t.Setenv("CODEMAP_LANGUAGES", "go")
+	if got := scan(); got != "Build,Main" {
+		t.Errorf("CODEMAP_LANGUAGES=go: indexed %s, want Build,Main", got)
+	}
+	t.Setenv("CODEMAP_LANGUAGES", "")
+
+	t.Setenv("CODEMAP_IGNORE_DIRS", "node_modules, build")
+	if got := scan(); got != "Bundled,Main,Vendored,VendoredJS" {
+		t.Errorf("CODEMAP_IGNORE_DIRS=node_modules,build: indexed %s, want Bundled,Main,Vendored,VendoredJS", got)
+	}
+
+	t.Setenv("CODEMAP_IGNORE_DIRS", "none")
+	if got := scan(); got != "Build,Built,Bundled,Dep,Main,Vendored,VendoredJS" {
+		t.Errorf("CODEMAP_IGNORE_DIRS=none: indexed %s, want everything", got)
+	}
+}
+
+func TestIntegration_NestedGitignore(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"generated", "pkg/scratch", "pkg/sub"} {
+		if err := os.MkdirAll(filepath.Join(repo, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createFile(t, repo, ".git/hook.go", "package hook\n\nfunc Hook() {}\n")
+	createFile(t, repo, ".gitignore", "generated/\n*.gen.go\n")
+	createFile(t, repo, "main.go", "package main\n\nfunc Main() {}\n")
+	createFile(t, repo, "main.gen.go", "package main\n\nfunc MainGen() {}\n")
+	createFile(t, repo, "generated/api.go", "package generated\n\nfunc API() {}\n")
+	// The nested file applies beneath pkg only, and overrides the root one
+	createFile(t, repo, "pkg/.gitignore", "scratch/\n/local.go\n!keep.gen.go\n")
+	createFile(t, repo, "pkg/pkg.go", "package pkg\n\nfunc Pkg() {}\n")
+	createFile(t, repo, "pkg/local.go", "package pkg\n\nfunc Local() {}\n")
+	createFile(t, repo, "pkg/keep.gen.go", "package pkg\n\nfunc Kept() {}\n")
+	createFile(t, repo, "pkg/scratch/tmp.go", "package scratch\n\nfunc Scratch() {}\n")
+	createFile(t, repo, "pkg/sub/local.go", "package sub\n\nfunc SubLocal() {}\n")
+	createFile(t, repo, "pkg/sub/sub.gen.go", "package sub\n\nfunc SubGen() {}\n")
+
+	scan := func(root string, gitignore bool) string {
+		t.Helper()
+		scn, err := scanner.New()
+		if err != nil {
+			t.Fatalf("Failed to init scanner: %v", err)
+		}
+		scn.SetGitignore(gitignore)
+		res, err := scn.ScanWorkspace(context.Background(), root)
+		if err != nil {
+			t.Fatalf("ScanWorkspace failed: %v", err)
+		}
+		var names []string
+		for _, n := range res.Nodes {
+			names = append(names, n.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	if got := scan(repo, true); got != "Kept,Main,Pkg,SubLocal" {
+		t.Errorf("scan of repo: indexed %s, want Kept,Main,Pkg,SubLocal", got)
+	}
+	// Rules are anchored at the git root even when scanning below it
+	if got := scan(filepath.Join(repo, "pkg"), true); got != "Kept,Pkg,SubLocal" {
+		t.Errorf("scan of pkg: indexed %s, want Kept,Pkg,SubLocal", got)
+	}
+	// .git stays out either way
+	if got := scan(repo, false); got != "API,Kept,Local,Main,MainGen,Pkg,Scratch,SubGen,SubLocal" {
+		t.Errorf("scan without gitignore: indexed %s, want everything outside .git", got)
+	}
+}
+
+func TestIntegration_ScanScope(t *testing.T) {
+	scope := scanner.Scope{
+		IncludeGlobs: []string{"src", "tools/**/*.go"},
+		ExcludeGlobs: []string{"**/gen/**", "**/*_gen.go", "src/legacy"},
+	}
+	if err := scope.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	for _, tt := range []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"src/main.go", false, true},
+		{"src/a/b/c.go", false, true},           // a matched directory covers its subtree
+		{"tools/x.go", false, true},             // ** matches no directories
+		{"tools/a/b/x.go", false, true},         // or several
+		{"tools/a/x.py", false, false},          // but the rest must still match
+		{"lib/util.go", false, false},           // not included
+		{"lib", true, true},                     // directories are only tested against exclusions
+		{"src/api_gen.go", false, false},        // exclusions win over inclusions
+		{"src/deep/gen/types.go", false, false}, // ** matches nested directories
+		{"gen", true, false},                    // and a top-level one
+		{"src/legacy/old.go", false, false},     // an excluded directory covers its subtree
+		{"src/legacy_new/new.go", false, true},  // but not its name as a prefix
+	} {
+		if got := scope.Includes(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Includes(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+	if err := (scanner.Scope{ExcludeGlobs: []string{"src/[a-"}}).Validate(); err == nil {
+		t.Error("Validate accepted a malformed glob")
+	}
+
+	wsDir := t.TempDir()
+	for _, dir := range []string{"src/gen", "src/legacy", "lib"} {
+		if err := os.MkdirAll(filepath.Join(wsDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createFile(t, wsDir, "src/main.go", "package main\n\nfunc Main() {}\n")
+	createFile(t, wsDir, "src/api_gen.go", "package main\n\nfunc Generated() {}\n")
+	createFile(t, wsDir, "src/gen/types.go", "package gen\n\nfunc Types() {}\n")
+	createFile(t, wsDir, "src/legacy/old.go", "package legacy\n\nfunc Old() {}\n")
+	createFile(t, wsDir, "lib/util.go", "package lib\n\nfunc Util() {}\n")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	scn.SetScope(scope)
+	res, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("ScanWorkspace failed: %v", err)
+	}
+	var names []string
+	for _, n := range res.Nodes {
+		names = append(names, n.Name)
+	}
+	if got := strings.Join(names, ","); got != "Main" {
+		t.Errorf("scoped scan indexed %s, want Main", got)
+	}
+}
+
+func TestIntegration_ScanOverlay(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "a.go", "package a\n\nfunc Saved() {}\n")
+	path := filepath.Join(wsDir, "a.go")
+	unsaved := filepath.Join(wsDir, "new.go")
+
+	scn, err := scanner.New()
+	if err != nil {
+		t.Fatalf("Failed to init scanner: %v", err)
+	}
+	buffers := overlay.New()
+	scn.SetOverlay(buffers)
+	buffers.Set(path, []byte("package a\n\nfunc Edited() {}\n"))
+	buffers.Set(unsaved, []byte("package a\n\nfunc Draft() {}\n"))
+
+	names := func(nodes []*graph.Node) string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	// The buffer wins over disk, and a file that only exists as a buffer scans
+	nodes, err := scn.ScanFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ScanFile failed: %v", err)
+	}
+	if got := names(nodes); got != "Edited" {
+		t.Errorf("symbols with buffer = %q, want Edited", got)
+	}
+	nodes, err = scn.ScanFile(context.Background(), unsaved)
+	if err != nil {
+		t.Fatalf("ScanFile of unsaved file failed: %v", err)
+	}
+	if got := names(nodes); got != "Draft" {
+		t.Errorf("symbols of unsaved file = %q, want Draft", got)
+	}
+
+	// Workspace scans read buffers of files that exist on disk
+	res, err := scn.ScanWorkspace(context.Background(), wsDir)
+	if err != nil {
+		t.Fatalf("ScanWorkspace failed: %v", err)
+	}
+	if got := names(res.Nodes); got != "Edited" {
+		t.Errorf("workspace symbols = %q, want Edited", got)
+	}
+
+	// Clearing the buffer falls back to disk
+	if !buffers.Clear(path) {
+		t.Error("Clear reported no buffer")
+	}
+	nodes, err = scn.ScanFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ScanFile failed: %v", err)
+	}
+	if got := names(nodes); got != "Saved" {
+		t.Errorf("symbols after Clear = %q, want Saved", got)
+	}
+	if got := buffers.Paths(); len(got) != 1 || got[0] != unsaved {
+		t.Errorf("Paths() = %v, want [%s]", got, unsaved)
+	}
+}
+
+func TestIntegration_LibraryAPI(t *testing.T) {
+	wsDir := t.TempDir()
+	createFile(t, wsDir, "a.go", "package a\n\nfunc Parse() {}\n\nfunc Print() {}\n")
+	createFile(t, wsDir, "b.go", "package a\n\ntype Config struct{}\n")
+
+	g, err := codemap.Open(codemap.Options{DBPath: filepath.Join(t.TempDir(), "graph.sqlite"), NoEnrich: true})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer g.Close()
+
+	ctx := context.Background()
+	res, err := g.Index(ctx, wsDir)
+	if err != nil {
+		t.Fatalf("Index failed: %v", err)
+	}
+	if res.Files != 2 || res.Nodes != 3 || res.Edges != 0 {
+		t.Errorf("Index() = %+v, want 2 files, 3 nodes and no edges", res)
+	}
+
+	nodes, err := g.GetSymbol(ctx, "Config")
+	if err != nil || len(nodes) != 1 || nodes[0].Kind != graph.KindStruct {
+		t.Errorf("GetSymbol(Config) = %v, %v; want one struct", nodes, err)
+	}
+
+	nodes, err = g.SymbolsInFile(ctx, filepath.Join(wsDir, "a.go"))
+	if err != nil || len(nodes) != 2 || nodes[0].Name != "Parse" || nodes[1].Name != "Print" {
+		t.Errorf("SymbolsInFile(a.go) = %v, %v; want Parse, Print", nodes, err)
+	}
+
+	// Parse only matches as a subsequence, so it ranks below Print
+	nodes, err = g.SearchSymbols(ctx, "pr", 10)
+	if err != nil || len(nodes) != 2 || nodes[0].Name != "Print" || nodes[1].Name != "Parse" {
+		t.Errorf("SearchSymbols(pr) = %v, %v; want Print, Parse", nodes, err)
+	}
+
+	// Removed files drop out on the next run
+	if err := os.Remove(filepath.Join(wsDir, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Index(ctx, wsDir); err != nil {
+		t.Fatalf("re-Index failed: %v", err)
+	}
+	if nodes, _ := g.GetSymbol(ctx, "Config"); len(nodes) != 0 {
+		t.Errorf("GetSymbol(Config) after removing b.go = %v, want none", nodes)
+	}
+}
+
 func createFile(t *testing.T, dir, name, content string) {
 	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
 	if err != nil {
@@ -3,27 +3,135 @@ package util
 import (
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// defaultGitRootDepth is how many parent directories FindGitRoot checks.
+const defaultGitRootDepth = 32
+
+// GitRootOptions bounds how far FindGitRootFrom walks up the directory tree,
+// so a project outside any repository is not indexed as part of an unrelated
+// repository further up.
+type GitRootOptions struct {
+	// StopAt is the highest directory checked, such as the user's home. It
+	// only applies when it is an ancestor of the start; "" means no limit.
+	StopAt string
+	// SameDevice ends the walk at a filesystem (mount) boundary.
+	SameDevice bool
+	// MaxDepth caps how many parent directories are checked; 0 means no cap.
+	MaxDepth int
+}
+
+// DefaultGitRootOptions stops at the user's home directory and at mount
+// points, and checks at most 32 parent directories.
+func DefaultGitRootOptions() GitRootOptions {
+	home, _ := os.UserHomeDir()
+	return GitRootOptions{StopAt: home, SameDevice: true, MaxDepth: defaultGitRootDepth}
+}
+
 // FindGitRoot finds the root of the git repository starting from the current directory.
-// Returns the current directory if .git is not found.
+// Returns the current directory if .git is not found within DefaultGitRootOptions.
 func FindGitRoot() (string, error) {
-	dir, err := os.Getwd()
+	cwd, err := os.Getwd()
 	if err != nil {
 		return "", err
 	}
+	if root, ok := FindGitRootFrom(cwd, DefaultGitRootOptions()); ok {
+		return root, nil
+	}
+	return filepath.Clean(cwd), nil
+}
+
+// FindGitRootFrom returns the nearest directory at or above dir that has a
+// .git directory, or a .git file as worktrees and submodules do, within the
+// bounds of opts. It reports false if there is none.
+func FindGitRootFrom(dir string, opts GitRootOptions) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	stopAt := ""
+	if opts.StopAt != "" {
+		if stopAt, err = filepath.Abs(opts.StopAt); err != nil {
+			stopAt = ""
+		}
+	}
+	device, hasDevice := deviceOf(dir)
 
-	for {
+	for depth := 0; ; depth++ {
 		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
-			return dir, nil
+			return dir, true
 		}
 
 		parent := filepath.Dir(dir)
-		if parent == dir {
-			// Reached root
-			cwd, _ := os.Getwd()
-			return cwd, nil
+		switch {
+		case parent == dir, dir == stopAt:
+			return "", false
+		case opts.MaxDepth > 0 && depth >= opts.MaxDepth:
+			return "", false
+		}
+		if opts.SameDevice && hasDevice {
+			if d, ok := deviceOf(parent); ok && d != device {
+				return "", false
+			}
 		}
 		dir = parent
 	}
 }
+
+// GitHead returns the commit hash HEAD points at in the repository rooted at
+// dir, or "" if dir is not a git repository or HEAD cannot be resolved. It
+// reads .git directly rather than shelling out to git.
+func GitHead(dir string) string {
+	gitDir := filepath.Join(dir, ".git")
+	if info, err := os.Stat(gitDir); err != nil {
+		return ""
+	} else if !info.IsDir() {
+		// Worktrees and submodules use a "gitdir: <path>" file
+		data, err := os.ReadFile(gitDir)
+		if err != nil {
+			return ""
+		}
+		target := strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		gitDir = target
+	}
+
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	head := strings.TrimSpace(string(data))
+	ref, ok := strings.CutPrefix(head, "ref: ")
+	if !ok {
+		return head // detached HEAD
+	}
+
+	// A linked worktree keeps only HEAD in its own git dir; branches live in
+	// the common dir of the main repository, named by its commondir file
+	refDir := gitDir
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		refDir = strings.TrimSpace(string(data))
+		if !filepath.IsAbs(refDir) {
+			refDir = filepath.Join(gitDir, refDir)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(refDir, filepath.FromSlash(ref))); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+
+	// Loose ref missing; look in packed-refs ("<hash> <ref>" per line)
+	packed, err := os.ReadFile(filepath.Join(refDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		if hash, name, ok := strings.Cut(strings.TrimSpace(line), " "); ok && name == ref {
+			return hash
+		}
+	}
+	return ""
+}
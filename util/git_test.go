@@ -0,0 +1,57 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindGitRootFrom(t *testing.T) {
+	base := t.TempDir()
+	mkdir := func(parts ...string) string {
+		t.Helper()
+		dir := filepath.Join(append([]string{base}, parts...)...)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	repo := mkdir("repo")
+	mkdir("repo", ".git")
+	nested := mkdir("repo", "a", "b", "c")
+
+	// A worktree has a .git file pointing at the main repository
+	worktree := mkdir("worktree")
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: "+repo+"/.git/worktrees/wt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	worktreeSub := mkdir("worktree", "pkg")
+
+	noRepo := mkdir("plain", "x", "y")
+	bounded := GitRootOptions{StopAt: base}
+
+	tests := []struct {
+		name   string
+		dir    string
+		opts   GitRootOptions
+		want   string
+		wantOK bool
+	}{
+		{"repo root", repo, bounded, repo, true},
+		{"nested dir", nested, bounded, repo, true},
+		{"unnormalized path", filepath.Join(nested, "..", "."), bounded, repo, true},
+		{"worktree .git file", worktreeSub, bounded, worktree, true},
+		{"no repo anywhere", noRepo, bounded, "", false},
+		{"stops at StopAt below the repo", nested, GitRootOptions{StopAt: filepath.Join(repo, "a")}, "", false},
+		{"depth cap", nested, GitRootOptions{StopAt: base, MaxDepth: 2}, "", false},
+		{"depth cap reaching the repo", nested, GitRootOptions{StopAt: base, MaxDepth: 3}, repo, true},
+		{"same device", nested, GitRootOptions{StopAt: base, SameDevice: true}, repo, true},
+	}
+	for _, tt := range tests {
+		got, ok := FindGitRootFrom(tt.dir, tt.opts)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: FindGitRootFrom(%s) = %q, %v; want %q, %v", tt.name, tt.dir, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GitChangedFiles returns the files under dir that differ between revision
+// base and the working tree, including untracked files that are not ignored,
+// as sorted paths relative to dir. Unlike GitHead it needs the git binary.
+func GitChangedFiles(ctx context.Context, dir, base string) ([]string, error) {
+	if err := verifyRevision(ctx, dir, base); err != nil {
+		return nil, err
+	}
+	changed, err := git(ctx, dir, "diff", "--name-only", "--no-renames", "--relative", "-z", base, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(ctx, dir, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, name := range strings.Split(string(changed)+string(untracked), "\x00") {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			files = append(files, filepath.FromSlash(name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// GitShowFile returns the content at revision rev of the file relPath,
+// relative to dir. It reports false if the file did not exist at rev.
+func GitShowFile(ctx context.Context, dir, rev, relPath string) ([]byte, bool, error) {
+	if err := verifyRevision(ctx, dir, rev); err != nil {
+		return nil, false, err
+	}
+	object := rev + ":./" + filepath.ToSlash(relPath)
+	if _, err := git(ctx, dir, "cat-file", "-e", object); err != nil {
+		// The revision exists, so the path does not
+		return nil, false, nil
+	}
+	content, err := git(ctx, dir, "cat-file", "blob", object)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+// verifyRevision checks that rev names a commit in the repository at dir.
+func verifyRevision(ctx context.Context, dir, rev string) error {
+	// A leading dash would be taken as an option
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return fmt.Errorf("invalid git revision %q", rev)
+	}
+	if _, err := git(ctx, dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}"); err != nil {
+		return fmt.Errorf("unknown git revision %q", rev)
+	}
+	return nil
+}
+
+// git runs git with args in dir and returns its standard output.
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
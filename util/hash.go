@@ -12,3 +12,11 @@ func GenerateNodeID(filePath, symbolName string) string {
 	hash := sha256.Sum256([]byte(input))
 	return hex.EncodeToString(hash[:])
 }
+
+// GenerateEdgeID creates a deterministic hash for an edge from its endpoints
+// and relation, so the same relationship has the same ID in every export.
+func GenerateEdgeID(sourceID, targetID, relation string) string {
+	input := fmt.Sprintf("%s->%s:%s", sourceID, targetID, relation)
+	hash := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EnabledLanguages returns the languages allowed by CODEMAP_LANGUAGES, a
+// comma-separated list such as "go,typescript". It returns nil when the
+// variable is unset or empty, meaning every supported language is enabled.
+func EnabledLanguages() map[string]bool {
+	raw := strings.TrimSpace(os.Getenv("CODEMAP_LANGUAGES"))
+	if raw == "" {
+		return nil
+	}
+
+	enabled := make(map[string]bool)
+	for _, lang := range strings.Split(raw, ",") {
+		if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+			enabled[lang] = true
+		}
+	}
+	return enabled
+}
+
+// LanguageEnabled reports whether lang passes the CODEMAP_LANGUAGES allowlist.
+func LanguageEnabled(lang string) bool {
+	enabled := EnabledLanguages()
+	return enabled == nil || enabled[lang]
+}
+
+// defaultExtensions maps the file extensions recognized out of the box to
+// their language names.
+var defaultExtensions = map[string]string{
+	".go":    "go",
+	".py":    "python",
+	".js":    "javascript",
+	".jsx":   "javascript",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".lua":   "lua",
+	".zig":   "zig",
+	".rs":    "rust",
+	".java":  "java",
+	".cpp":   "cpp",
+	".cc":    "cpp",
+	".cxx":   "cpp",
+	".hpp":   "cpp",
+	".hh":    "cpp",
+	".hxx":   "cpp",
+	".h":     "cpp",
+	".c":     "cpp",
+	".templ": "templ",
+}
+
+// ParseExtensions merges raw, the value of CODEMAP_EXTENSIONS, over the
+// default extension map. raw is a comma-separated list of ext=language pairs
+// such as ".gs=javascript,.pyi=python"; the leading dot is optional. Entries
+// naming an unknown language, and extensions assigned to two different
+// languages, are left out and reported in the returned error; the map is
+// usable either way.
+func ParseExtensions(raw string) (map[string]string, error) {
+	known := make(map[string]bool)
+	for _, lang := range defaultExtensions {
+		known[lang] = true
+	}
+
+	user := make(map[string]string)
+	conflicts := make(map[string]bool)
+	var errs []error
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ext, lang, ok := strings.Cut(entry, "=")
+		ext = strings.TrimSpace(ext)
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if !ok || ext == "" || ext == "." || lang == "" {
+			errs = append(errs, fmt.Errorf("entry %q is not of the form .ext=language", entry))
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !known[lang] {
+			errs = append(errs, fmt.Errorf("%s: unknown language %q", ext, lang))
+			continue
+		}
+		if prev, ok := user[ext]; ok && prev != lang {
+			errs = append(errs, fmt.Errorf("%s is assigned to both %s and %s", ext, prev, lang))
+			conflicts[ext] = true
+			continue
+		}
+		user[ext] = lang
+	}
+
+	merged := make(map[string]string, len(defaultExtensions)+len(user))
+	for ext, lang := range defaultExtensions {
+		merged[ext] = lang
+	}
+	for ext, lang := range user {
+		if !conflicts[ext] {
+			merged[ext] = lang
+		}
+	}
+	return merged, errors.Join(errs...)
+}
+
+// extensionCache holds the parsed CODEMAP_EXTENSIONS, so LanguageForPath does
+// not re-parse it for every file.
+var extensionCache struct {
+	sync.Mutex
+	raw        string
+	extensions map[string]string
+}
+
+// Extensions returns the extension to language map in effect: the defaults
+// merged with CODEMAP_EXTENSIONS. Problems with the variable are reported by
+// ParseExtensions, which the scanner calls at startup. The map is shared and
+// must not be modified.
+func Extensions() map[string]string {
+	raw := os.Getenv("CODEMAP_EXTENSIONS")
+
+	extensionCache.Lock()
+	defer extensionCache.Unlock()
+	if extensionCache.extensions == nil || extensionCache.raw != raw {
+		extensionCache.extensions, _ = ParseExtensions(raw)
+		extensionCache.raw = raw
+	}
+	return extensionCache.extensions
+}
+
+// LanguageForPath maps a file's extension to its language name ("go",
+// "python", "typescript", ...), or "" for unsupported files.
+func LanguageForPath(path string) string {
+	return Extensions()[filepath.Ext(path)]
+}
+
+// LanguagesForPaths returns the sorted, distinct languages of paths,
+// ignoring unsupported files.
+func LanguagesForPaths(paths []string) []string {
+	seen := make(map[string]bool)
+	langs := []string{}
+	for _, p := range paths {
+		if lang := LanguageForPath(p); lang != "" && !seen[lang] {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}